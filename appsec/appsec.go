@@ -19,6 +19,8 @@ import (
 	"fmt"
 	"net/http"
 	"net/netip"
+	"strconv"
+	"time"
 
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
@@ -39,8 +41,35 @@ func init() {
 // Handler checks the CrowdSec AppSec component decided whether
 // an HTTP request is blocked or not.
 type Handler struct {
+	// ExemptRaw is a list of matcher sets. Requests matching any of
+	// the sets bypass the AppSec check.
+	ExemptRaw caddyhttp.RawMatcherSets `json:"exempt,omitempty" caddy:"namespace=http.matchers"`
+	// ReturnErrors makes the handler return a Caddy HTTP error for
+	// blocked requests, instead of writing the response directly. The
+	// response can then be customized using the error routes of the
+	// server (i.e. `handle_errors`). Details about the AppSec action
+	// are available through the {http.vars.crowdsec_decision_*} placeholders.
+	ReturnErrors bool `json:"return_errors,omitempty"`
+	// MaxBodySize is the maximum number of request body bytes that will
+	// be sent to the AppSec component for requests handled by this
+	// handler. Defaults to the appsec_max_body_bytes of the crowdsec app.
+	MaxBodySize int `json:"max_body_bytes,omitempty"`
+	// StreamingBody determines how streaming request bodies, like
+	// those of gRPC calls and bodies of unknown length, are sent to the
+	// AppSec component. With "headers" only the headers are sent, with
+	// "skip" the request isn't checked at all, and with "prefix" the
+	// start of the body is sent, up to max_body_bytes, or 64 KiB if
+	// there's no maximum. Reading a prefix waits for the client to send
+	// it, so it's only suited for unary gRPC calls. Defaults to "headers".
+	StreamingBody string `json:"streaming_body,omitempty"`
+	// ServerTiming adds a `Server-Timing: appsec;dur=<ms>` entry to
+	// responses, with the time it took the AppSec component to check
+	// the request.
+	ServerTiming bool `json:"server_timing,omitempty"`
+
 	logger   *zap.Logger
 	crowdsec *crowdsec.CrowdSec
+	exempt   caddyhttp.MatcherSets
 }
 
 // CaddyModule returns the Caddy module information.
@@ -59,7 +88,19 @@ func (h *Handler) Provision(ctx caddy.Context) error {
 	}
 	h.crowdsec = crowdsecAppIface.(*crowdsec.CrowdSec)
 
-	h.logger = ctx.Logger(h)
+	h.logger = h.crowdsec.Logger(ctx.Logger(h))
+
+	h.StreamingBody = caddy.NewReplacer().ReplaceKnown(h.StreamingBody, "")
+
+	if h.ExemptRaw != nil {
+		matcherSets, err := ctx.LoadModule(h, "ExemptRaw")
+		if err != nil {
+			return fmt.Errorf("loading exempt matchers: %w", err)
+		}
+		if err := h.exempt.FromInterface(matcherSets); err != nil {
+			return fmt.Errorf("loading exempt matchers: %w", err)
+		}
+	}
 
 	return nil
 }
@@ -69,6 +110,14 @@ func (h *Handler) Validate() error {
 	if h.crowdsec == nil {
 		return errors.New("crowdsec app not available")
 	}
+	if h.MaxBodySize < 0 {
+		return errors.New("max body bytes must not be negative")
+	}
+	switch h.StreamingBody {
+	case "", bouncer.StreamingBodyHeaders, bouncer.StreamingBodySkip, bouncer.StreamingBodyPrefix:
+	default:
+		return fmt.Errorf("invalid streaming body mode %q; must be one of headers, skip or prefix", h.StreamingBody)
+	}
 
 	return nil
 }
@@ -82,13 +131,23 @@ func (h *Handler) Cleanup() error {
 
 // ServeHTTP is the Caddy handler for serving HTTP requests.
 func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+	if len(h.exempt) > 0 && h.exempt.AnyMatch(r) {
+		return next.ServeHTTP(w, r)
+	}
+
 	var (
 		ctx = r.Context()
 		ip  netip.Addr
 	)
 
 	ctx, ip = httputils.EnsureIP(ctx)
-	if err := h.crowdsec.CheckRequest(ctx, r); err != nil {
+	checkCtx := bouncer.WithAppSecStreamingBody(bouncer.WithAppSecMaxBodySize(ctx, h.MaxBodySize), h.StreamingBody)
+	start := time.Now()
+	err := h.crowdsec.CheckRequest(checkCtx, r)
+	if h.ServerTiming {
+		httputils.AddServerTiming(w, "appsec", time.Since(start))
+	}
+	if err != nil {
 		a := &bouncer.AppSecError{}
 		if !errors.As(err, &a) {
 			return err
@@ -100,6 +159,20 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyht
 		case "log":
 			h.logger.Info("appsec rule triggered", zap.String("ip", ip.String()), zap.String("action", a.Action))
 		default:
+			h.crowdsec.RecordRemediation(a.Action, "appsec", ip)
+			h.crowdsec.LogBlocked(crowdsec.BlockedRequest{
+				IP:     ip,
+				Host:   r.Host,
+				Method: r.Method,
+				Path:   r.URL.Path,
+				Type:   a.Action,
+				Origin: "appsec",
+				Module: string(h.CaddyModule().ID),
+			})
+			if h.ReturnErrors {
+				httputils.SetDecisionVars(ctx, a.Action, ip.String(), "appsec", "")
+				return httputils.ErrorResponse(w, a.Action, a.Duration, a.StatusCode)
+			}
 			return httputils.WriteResponse(w, h.logger, a.Action, ip.String(), a.Duration, a.StatusCode)
 		}
 	}
@@ -112,15 +185,78 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyht
 	return nil
 }
 
-// UnmarshalCaddyfile implements caddyfile.Unmarshaler.
+// UnmarshalCaddyfile implements caddyfile.Unmarshaler. Syntax:
+//
+//	appsec {
+//		exempt <matcher>
+//		return_errors
+//		max_body_bytes <bytes>
+//		streaming_body headers|skip|prefix
+//		server_timing
+//	}
 func (h *Handler) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	return h.unmarshalCaddyfile(httpcaddyfile.Helper{Dispenser: d})
+}
+
+func (h *Handler) unmarshalCaddyfile(helper httpcaddyfile.Helper) error {
+	d := helper.Dispenser
+	for d.Next() {
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+		for d.NextBlock(0) {
+			switch d.Val() {
+			case "exempt":
+				matcherSet, err := httputils.ParseMatcherSet(helper)
+				if err != nil {
+					return err
+				}
+				h.ExemptRaw = append(h.ExemptRaw, matcherSet)
+			case "return_errors":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				h.ReturnErrors = true
+			case "max_body_bytes", "max_body_size":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				// numbers can't be replaced when provisioning, so
+				// placeholders like {env.*} are replaced when parsing
+				v, err := strconv.Atoi(caddy.NewReplacer().ReplaceKnown(d.Val(), ""))
+				if err != nil {
+					return d.Errf("invalid maximum number of bytes %q: %v", d.Val(), err)
+				}
+				h.MaxBodySize = v
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+			case "server_timing":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				h.ServerTiming = true
+			case "streaming_body":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				h.StreamingBody = d.Val()
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+			default:
+				return d.Errf("invalid configuration token %q provided", d.Val())
+			}
+		}
+	}
+
 	return nil
 }
 
 // parseCaddyfileHandlerDirective parses the `crowdsec` Caddyfile directive
 func parseCaddyfileHandlerDirective(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error) {
 	var handler Handler
-	err := handler.UnmarshalCaddyfile(h.Dispenser)
+	err := handler.unmarshalCaddyfile(h)
 	return &handler, err
 }
 
@@ -0,0 +1,159 @@
+package appsec
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+
+	"github.com/hslatman/caddy-crowdsec-bouncer/crowdsec"
+	"github.com/hslatman/caddy-crowdsec-bouncer/crowdsectest"
+	"github.com/hslatman/caddy-crowdsec-bouncer/internal/testutils"
+)
+
+// newCrowdSec returns a started CrowdSec app, which checks requests
+// with the AppSec component of lapi.
+func newCrowdSec(t *testing.T, lapi *crowdsectest.Server) *crowdsec.CrowdSec {
+	t.Helper()
+
+	config := fmt.Sprintf(`{
+		"api_url": %q,
+		"api_key": %q,
+		"enable_streaming": false,
+		"appsec_url": %q
+	}`, lapi.URL(), lapi.APIKey(), lapi.AppSecURL())
+
+	cs := testutils.NewCrowdSecModule(t, context.Background(), config)
+	require.NoError(t, cs.Start())
+	t.Cleanup(func() {
+		require.NoError(t, cs.Stop())
+		require.NoError(t, cs.Cleanup())
+	})
+
+	return cs
+}
+
+// nextHandler is the next handler in tests, which records whether it
+// was called.
+type nextHandler struct {
+	called bool
+}
+
+func (n *nextHandler) ServeHTTP(w http.ResponseWriter, _ *http.Request) error {
+	n.called = true
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+func TestHandler_exempt(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		checked []string
+	)
+	lapi := crowdsectest.NewServer(t)
+	lapi.BlockAppSecRequests(func(r *http.Request) bool {
+		// the AppSec health check is sent for 127.0.0.1
+		if r.Header.Get("X-Crowdsec-Appsec-Ip") != "192.0.2.1" {
+			return false
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		checked = append(checked, r.Header.Get("X-Crowdsec-Appsec-Uri"))
+		return true
+	})
+
+	h := &Handler{
+		exempt: caddyhttp.MatcherSets{
+			{caddyhttp.MatchPath{"/healthz"}},
+		},
+		logger:   zaptest.NewLogger(t),
+		crowdsec: newCrowdSec(t, lapi),
+	}
+
+	tests := []struct {
+		name    string
+		target  string
+		allowed bool
+	}{
+		{name: "exempt", target: "/healthz", allowed: true},
+		{name: "not-exempt", target: "/", allowed: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, tt.target, http.NoBody)
+			ctx := context.WithValue(r.Context(), caddyhttp.VarsCtxKey, map[string]any{
+				caddyhttp.ClientIPVarKey: "192.0.2.1",
+			})
+			ctx = context.WithValue(ctx, caddy.ReplacerCtxKey, caddy.NewReplacer())
+			r = r.WithContext(ctx)
+
+			w := httptest.NewRecorder()
+			next := &nextHandler{}
+			require.NoError(t, h.ServeHTTP(w, r, next))
+
+			assert.Equal(t, tt.allowed, next.called)
+			if !tt.allowed {
+				assert.Equal(t, http.StatusForbidden, w.Code)
+			}
+		})
+	}
+
+	// only the request that isn't exempt was sent to the AppSec component
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, []string{"/"}, checked)
+}
+
+func TestHandler_UnmarshalCaddyfile(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    Handler
+		wantErr bool
+	}{
+		{name: "ok", input: `appsec`, want: Handler{}},
+		{name: "ok/exempt", input: `appsec {
+			exempt /healthz
+			exempt {
+				path /metrics
+				remote_ip 10.0.0.0/8
+			}
+		}`, want: Handler{
+			ExemptRaw: caddyhttp.RawMatcherSets{
+				{"path": json.RawMessage(`["/healthz"]`)},
+				{
+					"path":      json.RawMessage(`["/metrics"]`),
+					"remote_ip": json.RawMessage(`{"ranges":["10.0.0.0/8"]}`),
+				},
+			},
+		}},
+		{name: "fail/exempt-without-matcher", input: `appsec {
+			exempt
+		}`, wantErr: true},
+		{name: "fail/argument", input: `appsec 127.0.0.1`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var h Handler
+			err := h.UnmarshalCaddyfile(caddyfile.NewTestDispenser(tt.input))
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, h)
+		})
+	}
+}
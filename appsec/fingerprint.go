@@ -0,0 +1,162 @@
+// Copyright 2024 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package appsec
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"sync"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"go.uber.org/zap"
+
+	"github.com/hslatman/caddy-crowdsec-bouncer/internal/fingerprint"
+)
+
+func init() {
+	caddy.RegisterModule(FingerprintListenerWrapper{})
+}
+
+// maxClientHelloSize is the maximum number of bytes read to find
+// the ClientHello; a TLS record can't be larger than this.
+const maxClientHelloSize = 5 + 16384
+
+// FingerprintListenerWrapper computes the JA3 and JA4 fingerprints of
+// TLS clients, so that they can be forwarded to the AppSec component.
+// It must be configured before the `tls` listener wrapper, so that it
+// can read the raw ClientHello. Caddy puts the `tls` listener wrapper
+// first when it's not configured explicitly, so it has to be listed
+// after this one. When the wrapper receives connections on which TLS
+// was already terminated, an error is logged, and the connections are
+// passed on without being fingerprinted.
+//
+// Fingerprints are kept for as long as the connection is open, keyed
+// by the address of the client, which is unique among open TCP
+// connections.
+type FingerprintListenerWrapper struct {
+	logger *zap.Logger
+}
+
+// CaddyModule returns the Caddy module information.
+func (FingerprintListenerWrapper) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "caddy.listeners.crowdsec_fingerprint",
+		New: func() caddy.Module { return new(FingerprintListenerWrapper) },
+	}
+}
+
+// Provision sets up the listener wrapper.
+func (w *FingerprintListenerWrapper) Provision(ctx caddy.Context) error {
+	w.logger = ctx.Logger(w)
+
+	return nil
+}
+
+// WrapListener wraps ln, fingerprinting the connections it accepts.
+func (w *FingerprintListenerWrapper) WrapListener(ln net.Listener) net.Listener {
+	logger := w.logger
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+
+	return &fingerprintListener{Listener: ln, logger: logger}
+}
+
+// UnmarshalCaddyfile implements caddyfile.Unmarshaler. Syntax:
+//
+//	crowdsec_fingerprint
+func (FingerprintListenerWrapper) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+	}
+
+	return nil
+}
+
+type fingerprintListener struct {
+	net.Listener
+	logger     *zap.Logger
+	misordered sync.Once
+}
+
+func (l *fingerprintListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	// the ClientHello was already consumed by the tls listener wrapper
+	if _, ok := conn.(*tls.Conn); ok {
+		l.misordered.Do(func() {
+			l.logger.Error("crowdsec_fingerprint listener wrapper must be configured before the tls listener wrapper; TLS clients are not fingerprinted",
+				zap.String("address", l.Addr().String()),
+			)
+		})
+		return conn, nil
+	}
+
+	return &fingerprintConn{Conn: conn}, nil
+}
+
+// fingerprintConn records the data read from the connection until the
+// ClientHello has been read, without consuming it, and stores the
+// fingerprint of the client for as long as the connection is open.
+type fingerprintConn struct {
+	net.Conn
+	buf       []byte
+	done      bool
+	closeOnce sync.Once
+}
+
+func (c *fingerprintConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if c.done || n == 0 {
+		return n, err
+	}
+
+	c.buf = append(c.buf, p[:n]...)
+	hello, perr := fingerprint.Parse(c.buf)
+	switch {
+	case errors.Is(perr, fingerprint.ErrIncomplete) && len(c.buf) < maxClientHelloSize:
+		return n, err // wait for more data
+	case perr == nil:
+		fingerprint.Store(c.RemoteAddr().String(), hello.Fingerprint())
+	}
+
+	c.done = true
+	c.buf = nil
+
+	return n, err
+}
+
+func (c *fingerprintConn) Close() error {
+	c.closeOnce.Do(func() {
+		fingerprint.Delete(c.RemoteAddr().String())
+	})
+
+	return c.Conn.Close()
+}
+
+// Interface guards
+var (
+	_ caddy.Module          = (*FingerprintListenerWrapper)(nil)
+	_ caddy.Provisioner     = (*FingerprintListenerWrapper)(nil)
+	_ caddy.ListenerWrapper = (*FingerprintListenerWrapper)(nil)
+	_ caddyfile.Unmarshaler = (*FingerprintListenerWrapper)(nil)
+)
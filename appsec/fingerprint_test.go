@@ -0,0 +1,92 @@
+package appsec
+
+import (
+	"crypto/tls"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+
+	"github.com/hslatman/caddy-crowdsec-bouncer/internal/fingerprint"
+)
+
+func listen(t *testing.T) net.Listener {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = ln.Close() })
+
+	return ln
+}
+
+func TestFingerprintListenerWrapper(t *testing.T) {
+	ln := (&FingerprintListenerWrapper{}).WrapListener(listen(t))
+
+	client, err := net.Dial("tcp", ln.Addr().String())
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = client.Close() })
+
+	// the handshake doesn't complete, as the server never responds
+	go func() {
+		_ = client.SetDeadline(time.Now().Add(5 * time.Second))
+		_ = tls.Client(client, &tls.Config{ServerName: "example.com"}).Handshake()
+	}()
+
+	conn, err := ln.Accept()
+	require.NoError(t, err)
+	require.IsType(t, &fingerprintConn{}, conn)
+
+	addr := client.LocalAddr().String()
+	buf := make([]byte, 1024)
+	for {
+		_, err := conn.Read(buf)
+		require.NoError(t, err)
+		if _, ok := fingerprint.Lookup(addr); ok {
+			break
+		}
+	}
+
+	fp, _ := fingerprint.Lookup(addr)
+	assert.NotEmpty(t, fp.JA3)
+	assert.NotEmpty(t, fp.JA4)
+
+	require.NoError(t, conn.Close())
+	_, ok := fingerprint.Lookup(addr)
+	assert.False(t, ok)
+}
+
+func TestFingerprintListenerWrapper_afterTLS(t *testing.T) {
+	core, logs := observer.New(zapcore.ErrorLevel)
+	w := &FingerprintListenerWrapper{logger: zap.New(core)}
+	ln := w.WrapListener(tls.NewListener(listen(t), &tls.Config{}))
+
+	for range 2 {
+		client, err := net.Dial("tcp", ln.Addr().String())
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = client.Close() })
+
+		conn, err := ln.Accept()
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = conn.Close() })
+
+		// connections on which TLS is terminated are passed on as is
+		assert.IsType(t, &tls.Conn{}, conn)
+	}
+
+	// the misconfiguration is logged once
+	require.Equal(t, 1, logs.Len())
+	assert.Contains(t, logs.All()[0].Message, "must be configured before the tls listener wrapper")
+}
+
+func TestFingerprintListenerWrapper_UnmarshalCaddyfile(t *testing.T) {
+	var w FingerprintListenerWrapper
+	assert.NoError(t, w.UnmarshalCaddyfile(caddyfile.NewTestDispenser(`crowdsec_fingerprint`)))
+	assert.Error(t, w.UnmarshalCaddyfile(caddyfile.NewTestDispenser(`crowdsec_fingerprint tls`)))
+}
@@ -0,0 +1,1143 @@
+package crowdsec
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"net/netip"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/crowdsecurity/crowdsec/pkg/models"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+
+	"github.com/hslatman/caddy-crowdsec-bouncer/internal/bouncer"
+	"github.com/hslatman/caddy-crowdsec-bouncer/internal/cti"
+	"github.com/hslatman/caddy-crowdsec-bouncer/internal/duration"
+	"github.com/hslatman/caddy-crowdsec-bouncer/internal/version"
+)
+
+func init() {
+	caddy.RegisterModule(adminAPI{})
+}
+
+// adminAPI is a module that serves endpoints to retrieve
+// information about the CrowdSec app.
+type adminAPI struct {
+	ctx         caddy.Context
+	logger      *zap.Logger
+	auditLogger *zap.Logger
+}
+
+// CaddyModule returns the Caddy module information.
+func (adminAPI) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "admin.api.crowdsec",
+		New: func() caddy.Module { return new(adminAPI) },
+	}
+}
+
+// Provision sets up the adminAPI module.
+func (a *adminAPI) Provision(ctx caddy.Context) error {
+	a.ctx = ctx
+	a.logger = ctx.Logger(a)
+	a.auditLogger = a.logger.Named("audit")
+
+	return nil
+}
+
+const adminEndpointBase = "/crowdsec/"
+
+// Routes returns the admin routes for the CrowdSec app.
+func (a *adminAPI) Routes() []caddy.AdminRoute {
+	return []caddy.AdminRoute{
+		{
+			Pattern: adminEndpointBase + "ban",
+			Handler: a.rateLimited(a.handleBan),
+		},
+		{
+			Pattern: adminEndpointBase + "check",
+			Handler: a.rateLimited(a.handleCheck),
+		},
+		{
+			Pattern: adminEndpointBase + "config",
+			Handler: a.rateLimited(a.handleConfig),
+		},
+		{
+			Pattern: adminEndpointBase + "covered",
+			Handler: a.rateLimited(a.handleCovered),
+		},
+		{
+			Pattern: adminEndpointBase + "decisions",
+			Handler: a.rateLimited(a.handleDecisions),
+		},
+		{
+			Pattern: adminEndpointBase + "enforcement",
+			Handler: a.rateLimited(a.handleEnforcement),
+		},
+		{
+			Pattern: adminEndpointBase + "events",
+			Handler: a.rateLimited(a.handleEvents),
+		},
+		{
+			Pattern: adminEndpointBase + "export",
+			Handler: a.rateLimited(a.handleExport),
+		},
+		{
+			Pattern: adminEndpointBase + "health",
+			Handler: a.rateLimited(a.handleHealth),
+		},
+		{
+			Pattern: adminEndpointBase + "info",
+			Handler: a.rateLimited(a.handleInfo),
+		},
+		{
+			Pattern: adminEndpointBase + "log_level",
+			Handler: a.rateLimited(a.handleLogLevel),
+		},
+		{
+			Pattern: adminEndpointBase + "metrics",
+			Handler: a.rateLimited(a.handleMetrics),
+		},
+		{
+			Pattern: adminEndpointBase + "mode",
+			Handler: a.rateLimited(a.handleMode),
+		},
+		{
+			Pattern: adminEndpointBase + "ping",
+			Handler: a.rateLimited(a.handlePing),
+		},
+		{
+			Pattern: adminEndpointBase + "refresh",
+			Handler: a.rateLimited(a.handleRefresh),
+		},
+		{
+			Pattern: adminEndpointBase + "simulate",
+			Handler: a.rateLimited(a.handleSimulate),
+		},
+		{
+			Pattern: adminEndpointBase + "stats",
+			Handler: a.rateLimited(a.handleStats),
+		},
+		{
+			Pattern: adminEndpointBase + "unban",
+			Handler: a.rateLimited(a.handleUnban),
+		},
+		{
+			Pattern: adminEndpointBase + "verdicts",
+			Handler: a.rateLimited(a.handleVerdicts),
+		},
+		{
+			Pattern: adminEndpointBase + "verify",
+			Handler: a.rateLimited(a.handleVerify),
+		},
+		{
+			Pattern: adminEndpointBase + "version",
+			Handler: a.rateLimited(a.handleVersion),
+		},
+	}
+}
+
+// defaultBanDuration is the duration of local decisions if none is
+// provided, which is the same as the default duration used by cscli.
+const defaultBanDuration = "4h"
+
+type banRequest struct {
+	Value    string `json:"value"`
+	Duration string `json:"duration,omitempty"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+type banResponse struct {
+	Decision bouncer.DecisionDetails `json:"decision"`
+}
+
+// handleBan adds a local ban decision for an IP or CIDR.
+func (a *adminAPI) handleBan(w http.ResponseWriter, r *http.Request) error {
+	c, err := a.crowdsec(r, http.MethodPost)
+	if err != nil {
+		return err
+	}
+
+	var req banRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return caddy.APIError{
+			HTTPStatus: http.StatusBadRequest,
+			Err:        fmt.Errorf("failed decoding request: %w", err),
+		}
+	}
+
+	prf, err := parsePrefix(req.Value)
+	if err != nil {
+		return caddy.APIError{
+			HTTPStatus: http.StatusBadRequest,
+			Err:        err,
+		}
+	}
+
+	if req.Duration == "" {
+		req.Duration = defaultBanDuration
+	}
+	banDuration, err := duration.Parse("duration", req.Duration)
+	if err != nil {
+		return caddy.APIError{
+			HTTPStatus: http.StatusBadRequest,
+			Err:        err,
+		}
+	}
+
+	decision, err := c.Ban(prf, banDuration, req.Reason)
+	if err != nil {
+		return caddy.APIError{
+			HTTPStatus: http.StatusBadRequest,
+			Err:        fmt.Errorf("failed banning %s: %w", prf, err),
+		}
+	}
+
+	a.audit(w, r, "banned", zap.String("value", decision.Value), zap.String("duration", decision.Duration), zap.String("reason", decision.Scenario))
+
+	return writeJSON(w, banResponse{Decision: decision})
+}
+
+type verdictsResponse struct {
+	Decisions []bouncer.DecisionDetails `json:"decisions"`
+}
+
+// handleVerdicts adds local decisions for alerts sent by a CrowdSec
+// notification plugin, i.e. for out-of-band AppSec rules. The request
+// body is a JSON array of alerts, which is the default format of the
+// http notification plugin.
+func (a *adminAPI) handleVerdicts(w http.ResponseWriter, r *http.Request) error {
+	c, err := a.crowdsec(r, http.MethodPost)
+	if err != nil {
+		return err
+	}
+
+	var alerts []*models.Alert
+	if err := json.NewDecoder(r.Body).Decode(&alerts); err != nil {
+		return caddy.APIError{
+			HTTPStatus: http.StatusBadRequest,
+			Err:        fmt.Errorf("failed decoding request: %w", err),
+		}
+	}
+
+	banDuration, _ := duration.Parse("duration", defaultBanDuration)
+	decisions, err := c.AddVerdicts(alerts, banDuration)
+	if err != nil {
+		return caddy.APIError{
+			HTTPStatus: http.StatusInternalServerError,
+			Err:        fmt.Errorf("failed adding decisions: %w", err),
+		}
+	}
+
+	a.audit(w, r, "added verdicts", zap.Int("alerts", len(alerts)), zap.Int("decisions", len(decisions)))
+
+	return writeJSON(w, verdictsResponse{Decisions: decisions})
+}
+
+type unbanRequest struct {
+	Value string `json:"value"`
+}
+
+type unbanResponse struct {
+	Value string `json:"value"`
+}
+
+// handleUnban removes the local decision for an IP or CIDR.
+func (a *adminAPI) handleUnban(w http.ResponseWriter, r *http.Request) error {
+	c, err := a.crowdsec(r, http.MethodPost)
+	if err != nil {
+		return err
+	}
+
+	var req unbanRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return caddy.APIError{
+			HTTPStatus: http.StatusBadRequest,
+			Err:        fmt.Errorf("failed decoding request: %w", err),
+		}
+	}
+
+	prf, err := parsePrefix(req.Value)
+	if err != nil {
+		return caddy.APIError{
+			HTTPStatus: http.StatusBadRequest,
+			Err:        err,
+		}
+	}
+
+	removed, err := c.Unban(prf)
+	if err != nil {
+		return caddy.APIError{
+			HTTPStatus: http.StatusBadRequest,
+			Err:        fmt.Errorf("failed unbanning %s: %w", prf, err),
+		}
+	}
+	if !removed {
+		return caddy.APIError{
+			HTTPStatus: http.StatusNotFound,
+			Err:        fmt.Errorf("no local decision for %s", prf),
+		}
+	}
+
+	a.audit(w, r, "unbanned", zap.String("value", prf.String()))
+
+	return writeJSON(w, unbanResponse{Value: prf.String()})
+}
+
+// maxCheckIPs is the maximum number of IPs that can be checked
+// in a single request.
+const maxCheckIPs = 1000
+
+type checkRequest struct {
+	IP  string   `json:"ip,omitempty"`
+	IPs []string `json:"ips,omitempty"`
+}
+
+type checkResponse struct {
+	IP          string                    `json:"ip"`
+	Blocked     bool                      `json:"blocked"`
+	Reason      string                    `json:"reason,omitempty"`
+	Enforcement string                    `json:"enforcement"`
+	Decisions   []bouncer.DecisionDetails `json:"decisions"`
+	CTI         *cti.Info                 `json:"cti,omitempty"`
+	Error       string                    `json:"error,omitempty"`
+}
+
+type checkBatchResponse struct {
+	Results []checkResponse `json:"results"`
+}
+
+// handleCheck checks if an IP is allowed, returning the details
+// of all decisions that apply to it. Multiple IPs can be checked
+// at once using "ips", in which case errors are reported per IP.
+func (a *adminAPI) handleCheck(w http.ResponseWriter, r *http.Request) error {
+	c, err := a.crowdsec(r, http.MethodPost)
+	if err != nil {
+		return err
+	}
+
+	var req checkRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return caddy.APIError{
+			HTTPStatus: http.StatusBadRequest,
+			Err:        fmt.Errorf("failed decoding request: %w", err),
+		}
+	}
+
+	if req.IPs != nil {
+		if req.IP != "" {
+			return caddy.APIError{
+				HTTPStatus: http.StatusBadRequest,
+				Err:        errors.New(`only one of "ip" and "ips" can be provided`),
+			}
+		}
+		if len(req.IPs) > maxCheckIPs {
+			return caddy.APIError{
+				HTTPStatus: http.StatusBadRequest,
+				Err:        fmt.Errorf("too many IPs; at most %d can be checked at once", maxCheckIPs),
+			}
+		}
+
+		response := checkBatchResponse{Results: make([]checkResponse, 0, len(req.IPs))}
+		for _, v := range req.IPs {
+			result, err := check(c, v)
+			if err != nil {
+				result = checkResponse{IP: v, Enforcement: c.Enforcement(), Decisions: []bouncer.DecisionDetails{}, Error: err.Error()}
+			}
+			response.Results = append(response.Results, result)
+		}
+
+		return writeJSON(w, response)
+	}
+
+	response, err := check(c, req.IP)
+	if err != nil {
+		return err
+	}
+
+	return writeJSON(w, response)
+}
+
+// check checks if the IP in v is allowed. Errors are returned as
+// caddy.APIError.
+func check(c *CrowdSec, v string) (checkResponse, error) {
+	ip, err := netip.ParseAddr(v)
+	if err != nil {
+		return checkResponse{}, caddy.APIError{
+			HTTPStatus: http.StatusBadRequest,
+			Err:        fmt.Errorf("invalid IP %q: %w", v, err),
+		}
+	}
+	ip = ip.Unmap() // decisions are stored and looked up unmapped
+
+	isAllowed, decision, err := c.IsAllowed(ip)
+	if err != nil {
+		return checkResponse{}, caddy.APIError{
+			HTTPStatus: http.StatusInternalServerError,
+			Err:        fmt.Errorf("failed checking IP: %w", err),
+		}
+	}
+
+	decisions, err := c.Lookup(ip)
+	if err != nil {
+		return checkResponse{}, caddy.APIError{
+			HTTPStatus: http.StatusBadGateway,
+			Err:        fmt.Errorf("failed looking up decisions: %w", err),
+		}
+	}
+
+	response := checkResponse{
+		IP:          ip.String(),
+		Blocked:     !isAllowed,
+		Enforcement: c.Enforcement(),
+		Decisions:   decisions,
+	}
+	if response.Decisions == nil {
+		response.Decisions = []bouncer.DecisionDetails{}
+	}
+	if !isAllowed && decision != nil {
+		response.Reason = reason(decision)
+	}
+	if c.cti != nil {
+		// CTI information is best effort; lookups may be rate limited
+		if info, err := c.cti.Lookup(ip); err == nil {
+			response.CTI = info
+		}
+	}
+
+	return response, nil
+}
+
+// reason describes why a decision applies, i.e. "ban by
+// crowdsecurity/ssh-bf (crowdsec)".
+func reason(d *models.Decision) string {
+	var sb strings.Builder
+	sb.WriteString(stringValue(d.Type))
+	if scenario := stringValue(d.Scenario); scenario != "" {
+		sb.WriteString(" by " + scenario)
+	}
+	if origin := stringValue(d.Origin); origin != "" {
+		sb.WriteString(" (" + origin + ")")
+	}
+
+	return sb.String()
+}
+
+func stringValue(s *string) string {
+	if s == nil {
+		return ""
+	}
+
+	return *s
+}
+
+type configResponse struct {
+	Config      CrowdSec             `json:"config"`
+	Streaming   bool                 `json:"streaming"`
+	Enforcement string               `json:"enforcement"`
+	LogLevel    string               `json:"log_level"`
+	AppSec      bouncer.AppSecConfig `json:"appsec"`
+}
+
+// handleConfig returns the configuration of the CrowdSec app, after
+// placeholders have been replaced and defaults have been applied, and
+// the settings that can be changed at runtime. Secrets are redacted.
+func (a *adminAPI) handleConfig(w http.ResponseWriter, r *http.Request) error {
+	c, err := a.crowdsec(r, http.MethodGet, http.MethodPost)
+	if err != nil {
+		return err
+	}
+
+	response := configResponse{
+		Config:      c.Config(),
+		Streaming:   c.IsStreaming(),
+		Enforcement: c.Enforcement(),
+		LogLevel:    "default",
+		AppSec:      c.AppSecConfig(),
+	}
+	if level, _, ok := c.LogLevel(); ok {
+		response.LogLevel = level.String()
+	}
+
+	return writeJSON(w, response)
+}
+
+type coveredRequest struct {
+	CIDR string `json:"cidr"`
+}
+
+type coveredResponse struct {
+	CIDR      string                    `json:"cidr"`
+	Decisions []bouncer.DecisionDetails `json:"decisions"`
+}
+
+// handleCovered returns all decisions that overlap a CIDR, both the
+// ones for prefixes containing it and the ones for prefixes within it.
+func (a *adminAPI) handleCovered(w http.ResponseWriter, r *http.Request) error {
+	c, err := a.crowdsec(r, http.MethodPost)
+	if err != nil {
+		return err
+	}
+
+	var req coveredRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return caddy.APIError{
+			HTTPStatus: http.StatusBadRequest,
+			Err:        fmt.Errorf("failed decoding request: %w", err),
+		}
+	}
+
+	prf, err := parsePrefix(req.CIDR)
+	if err != nil {
+		return caddy.APIError{
+			HTTPStatus: http.StatusBadRequest,
+			Err:        err,
+		}
+	}
+
+	decisions, err := c.Covered(prf)
+	if err != nil {
+		if errors.Is(err, bouncer.ErrNotStreaming) {
+			return caddy.APIError{
+				HTTPStatus: http.StatusBadRequest,
+				Err:        errors.New("querying covering decisions requires streaming mode"),
+			}
+		}
+		return caddy.APIError{
+			HTTPStatus: http.StatusInternalServerError,
+			Err:        fmt.Errorf("failed querying covering decisions: %w", err),
+		}
+	}
+
+	return writeJSON(w, coveredResponse{CIDR: prf.String(), Decisions: decisions})
+}
+
+type decisionsResponse struct {
+	Decisions []bouncer.DecisionDetails `json:"decisions"`
+}
+
+// handleDecisions returns the decisions known to the CrowdSec app. The
+// decisions can be filtered using the "type", "origin", "scope" and
+// "contains" query parameters.
+func (a *adminAPI) handleDecisions(w http.ResponseWriter, r *http.Request) error {
+	c, err := a.crowdsec(r, http.MethodGet, http.MethodPost)
+	if err != nil {
+		return err
+	}
+
+	query := r.URL.Query()
+	filter := bouncer.DecisionFilter{
+		Type:   query.Get("type"),
+		Origin: query.Get("origin"),
+		Scope:  query.Get("scope"),
+	}
+	if v := query.Get("contains"); v != "" {
+		ip, err := netip.ParseAddr(v)
+		if err != nil {
+			return caddy.APIError{
+				HTTPStatus: http.StatusBadRequest,
+				Err:        fmt.Errorf("invalid IP %q: %w", v, err),
+			}
+		}
+		filter.Contains = ip
+	}
+
+	decisions, err := c.Decisions(filter)
+	if err != nil {
+		if errors.Is(err, bouncer.ErrNotStreaming) {
+			return caddy.APIError{
+				HTTPStatus: http.StatusBadRequest,
+				Err:        errors.New("listing decisions requires streaming mode"),
+			}
+		}
+		return caddy.APIError{
+			HTTPStatus: http.StatusInternalServerError,
+			Err:        fmt.Errorf("failed listing decisions: %w", err),
+		}
+	}
+
+	return writeJSON(w, decisionsResponse{Decisions: decisions})
+}
+
+// handleExport serves the decisions streamed from the CrowdSec Local
+// API as a blocklist mirror, so that other instances can pull them.
+func (a *adminAPI) handleExport(w http.ResponseWriter, r *http.Request) error {
+	c, err := a.crowdsec(r, http.MethodGet, http.MethodPost)
+	if err != nil {
+		return err
+	}
+
+	decisions, err := c.Export()
+	if err != nil {
+		if errors.Is(err, bouncer.ErrNotStreaming) {
+			return caddy.APIError{
+				HTTPStatus: http.StatusBadRequest,
+				Err:        errors.New("exporting decisions requires streaming mode"),
+			}
+		}
+		return caddy.APIError{
+			HTTPStatus: http.StatusInternalServerError,
+			Err:        fmt.Errorf("failed exporting decisions: %w", err),
+		}
+	}
+
+	return writeJSON(w, decisions)
+}
+
+type enforcementRequest struct {
+	Mode string `json:"mode"`
+}
+
+type enforcementResponse struct {
+	Mode string `json:"mode"`
+}
+
+// handleEnforcement returns the enforcement mode on GET requests.
+// On POST requests, the enforcement mode is changed.
+func (a *adminAPI) handleEnforcement(w http.ResponseWriter, r *http.Request) error {
+	c, err := a.crowdsec(r, http.MethodGet, http.MethodPost)
+	if err != nil {
+		return err
+	}
+
+	if r.Method == http.MethodPost {
+		var req enforcementRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			return caddy.APIError{
+				HTTPStatus: http.StatusBadRequest,
+				Err:        fmt.Errorf("failed decoding request: %w", err),
+			}
+		}
+
+		if err := c.SetEnforcement(req.Mode); err != nil {
+			return caddy.APIError{
+				HTTPStatus: http.StatusBadRequest,
+				Err:        err,
+			}
+		}
+
+		a.audit(w, r, "changed enforcement mode", zap.String("mode", req.Mode))
+	}
+
+	return writeJSON(w, enforcementResponse{Mode: c.Enforcement()})
+}
+
+// handleEvents streams decision and remediation events until the client
+// disconnects. Events are sent as server-sent events if the client accepts
+// those, and as newline delimited JSON otherwise.
+func (a *adminAPI) handleEvents(w http.ResponseWriter, r *http.Request) error {
+	c, err := a.crowdsec(r, http.MethodGet, http.MethodPost)
+	if err != nil {
+		return err
+	}
+
+	events, cancel := c.Subscribe()
+	defer cancel()
+
+	sse := strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+	if sse {
+		w.Header().Set("Content-Type", "text/event-stream")
+	} else {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	}
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	rc := http.NewResponseController(w)
+	if err := rc.Flush(); err != nil {
+		return nil // headers can't be flushed; nothing else to do
+	}
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return nil
+		case e, ok := <-events:
+			if !ok {
+				return nil // app stopped
+			}
+
+			encoded, err := json.Marshal(e)
+			if err != nil {
+				a.logger.Error("failed encoding event", zap.Error(err))
+				continue
+			}
+
+			if sse {
+				_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, encoded)
+			} else {
+				_, err = fmt.Fprintf(w, "%s\n", encoded)
+			}
+			if err != nil {
+				return nil // client disconnected
+			}
+			if err := rc.Flush(); err != nil {
+				return nil
+			}
+		}
+	}
+}
+
+type healthResponse struct {
+	Status    string                  `json:"status"`
+	Healthy   bool                    `json:"healthy"`
+	Decisions bouncer.DecisionsHealth `json:"decisions"`
+	AppSec    bouncer.AppSecHealth    `json:"appsec"`
+}
+
+// handleHealth reports the health of the CrowdSec app, which is one of
+// "healthy", "degraded" or "unhealthy", including the health of retrieving
+// decisions and the result of the most recent AppSec component health
+// check. When the app is unhealthy, the response has status 503.
+func (a *adminAPI) handleHealth(w http.ResponseWriter, r *http.Request) error {
+	c, err := a.crowdsec(r, http.MethodGet, http.MethodPost)
+	if err != nil {
+		return err
+	}
+
+	h := c.Health()
+	response := healthResponse{
+		Status:    h.Status,
+		Healthy:   h.Status == bouncer.HealthStatusHealthy,
+		Decisions: h.Decisions,
+		AppSec:    h.AppSec,
+	}
+
+	status := http.StatusOK
+	if h.Status == bouncer.HealthStatusUnhealthy {
+		status = http.StatusServiceUnavailable
+	}
+
+	return writeJSONStatus(w, status, response)
+}
+
+type infoResponse struct {
+	Version    string               `json:"version"`
+	InstanceID string               `json:"instance_id"`
+	APIUrl     string               `json:"api_url"`
+	Streaming  bool                 `json:"streaming"`
+	Features   []string             `json:"features"`
+	AppSecUrl  string               `json:"appsec_url,omitempty"`
+	AppSec     bouncer.AppSecHealth `json:"appsec"`
+	Memory     bouncer.Memory       `json:"memory"`
+	// Stream is only set in streaming mode.
+	Stream *bouncer.StreamStats `json:"stream,omitempty"`
+}
+
+// lapiVersionTimeout is the maximum time spent checking if the
+// CrowdSec Local API is reachable when reporting versions.
+const lapiVersionTimeout = 5 * time.Second
+
+type versionResponse struct {
+	Version     string      `json:"version"`
+	GoCSBouncer string      `json:"go_cs_bouncer"`
+	Caddy       string      `json:"caddy"`
+	Go          string      `json:"go"`
+	LAPI        lapiVersion `json:"lapi"`
+}
+
+// lapiVersion describes the CrowdSec Local API. The Local API doesn't
+// expose its version to bouncers, so only its reachability is reported.
+type lapiVersion struct {
+	URL       string `json:"url"`
+	Reachable bool   `json:"reachable"`
+	Error     string `json:"error,omitempty"`
+}
+
+// handleVersion returns the versions of the module, its main
+// dependencies, and whether the CrowdSec Local API is reachable.
+func (a *adminAPI) handleVersion(w http.ResponseWriter, r *http.Request) error {
+	c, err := a.crowdsec(r, http.MethodGet, http.MethodPost)
+	if err != nil {
+		return err
+	}
+
+	_, caddyVersion := caddy.Version()
+	response := versionResponse{
+		Version:     version.Current(),
+		GoCSBouncer: version.Dependency("github.com/crowdsecurity/go-cs-bouncer"),
+		Caddy:       caddyVersion,
+		Go:          runtime.Version(),
+		LAPI: lapiVersion{
+			URL: c.APIUrl,
+		},
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), lapiVersionTimeout)
+	defer cancel()
+
+	if err := c.CheckLAPI(ctx); err != nil {
+		response.LAPI.Error = err.Error()
+	} else {
+		response.LAPI.Reachable = true
+	}
+
+	return writeJSON(w, response)
+}
+
+// handleInfo returns information about the CrowdSec app.
+func (a *adminAPI) handleInfo(w http.ResponseWriter, r *http.Request) error {
+	c, err := a.crowdsec(r, http.MethodGet, http.MethodPost)
+	if err != nil {
+		return err
+	}
+
+	response := infoResponse{
+		Version:    version.Current(),
+		InstanceID: c.bouncer.InstanceID(),
+		APIUrl:     c.APIUrl,
+		Streaming:  c.bouncer.IsStreaming(),
+		Features:   c.bouncer.FeatureFlags(),
+		AppSecUrl:  c.AppSecUrl,
+		AppSec:     c.AppSecHealth(),
+		Memory:     c.Memory(),
+	}
+
+	if response.Streaming {
+		stats := c.StreamStats()
+		response.Stream = &stats
+	}
+
+	return writeJSON(w, response)
+}
+
+type logLevelRequest struct {
+	Level       string         `json:"level"`
+	RevertAfter caddy.Duration `json:"revert_after,omitempty"`
+}
+
+type logLevelResponse struct {
+	Level    string     `json:"level"`
+	RevertAt *time.Time `json:"revert_at,omitempty"`
+}
+
+// handleLogLevel returns the log level of the CrowdSec app and modules
+// on GET requests. On POST requests, the log level is changed, optionally
+// reverting after some time. The level "default" removes the override.
+func (a *adminAPI) handleLogLevel(w http.ResponseWriter, r *http.Request) error {
+	c, err := a.crowdsec(r, http.MethodGet, http.MethodPost)
+	if err != nil {
+		return err
+	}
+
+	if r.Method == http.MethodPost {
+		var req logLevelRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			return caddy.APIError{
+				HTTPStatus: http.StatusBadRequest,
+				Err:        fmt.Errorf("failed decoding request: %w", err),
+			}
+		}
+
+		if req.Level == "" || req.Level == "default" {
+			c.ResetLogLevel()
+			a.audit(w, r, "reset log level")
+		} else {
+			level, err := zapcore.ParseLevel(req.Level)
+			if err != nil {
+				return caddy.APIError{
+					HTTPStatus: http.StatusBadRequest,
+					Err:        err,
+				}
+			}
+			c.SetLogLevel(level, time.Duration(req.RevertAfter))
+			a.audit(w, r, "changed log level", zap.Stringer("level", level), zap.Duration("revert_after", time.Duration(req.RevertAfter)))
+		}
+	}
+
+	response := logLevelResponse{Level: "default"}
+	if level, revertAt, ok := c.LogLevel(); ok {
+		response.Level = level.String()
+		if !revertAt.IsZero() {
+			response.RevertAt = &revertAt
+		}
+	}
+
+	return writeJSON(w, response)
+}
+
+// handleMetrics returns the current values of the counters kept
+// by the CrowdSec app.
+func (a *adminAPI) handleMetrics(w http.ResponseWriter, r *http.Request) error {
+	c, err := a.crowdsec(r, http.MethodGet, http.MethodPost)
+	if err != nil {
+		return err
+	}
+
+	return writeJSON(w, c.Metrics())
+}
+
+type pingResponse struct {
+	Pong       bool   `json:"pong"`
+	InstanceID string `json:"instance_id"`
+}
+
+// handlePing responds if the CrowdSec app is running.
+func (a *adminAPI) handlePing(w http.ResponseWriter, r *http.Request) error {
+	c, err := a.crowdsec(r, http.MethodGet, http.MethodPost)
+	if err != nil {
+		return err
+	}
+
+	return writeJSON(w, pingResponse{Pong: true, InstanceID: c.bouncer.InstanceID()})
+}
+
+type refreshResponse struct {
+	Decisions int `json:"decisions"`
+}
+
+const (
+	modeStreaming = "streaming"
+	modeLive      = "live"
+)
+
+type modeRequest struct {
+	Mode string `json:"mode"`
+}
+
+type modeResponse struct {
+	Mode string `json:"mode"`
+}
+
+// handleMode returns whether decisions are streamed or looked up live
+// on GET requests. On POST requests, the mode is changed.
+func (a *adminAPI) handleMode(w http.ResponseWriter, r *http.Request) error {
+	c, err := a.crowdsec(r, http.MethodGet, http.MethodPost)
+	if err != nil {
+		return err
+	}
+
+	if r.Method == http.MethodPost {
+		var req modeRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			return caddy.APIError{
+				HTTPStatus: http.StatusBadRequest,
+				Err:        fmt.Errorf("failed decoding request: %w", err),
+			}
+		}
+
+		if req.Mode != modeStreaming && req.Mode != modeLive {
+			return caddy.APIError{
+				HTTPStatus: http.StatusBadRequest,
+				Err:        fmt.Errorf("invalid mode %q; must be one of %q or %q", req.Mode, modeStreaming, modeLive),
+			}
+		}
+
+		if err := c.SetStreaming(r.Context(), req.Mode == modeStreaming); err != nil {
+			return caddy.APIError{
+				HTTPStatus: http.StatusBadGateway,
+				Err:        fmt.Errorf("failed switching to %s mode: %w", req.Mode, err),
+			}
+		}
+
+		a.audit(w, r, "changed mode", zap.String("mode", req.Mode))
+	}
+
+	mode := modeLive
+	if c.IsStreaming() {
+		mode = modeStreaming
+	}
+
+	return writeJSON(w, modeResponse{Mode: mode})
+}
+
+// handleRefresh retrieves all active decisions from the CrowdSec
+// Local API, and replaces the decisions in the store with them.
+func (a *adminAPI) handleRefresh(w http.ResponseWriter, r *http.Request) error {
+	c, err := a.crowdsec(r, http.MethodPost)
+	if err != nil {
+		return err
+	}
+
+	n, err := c.Refresh(r.Context())
+	if err != nil {
+		return refreshError("refreshing", err)
+	}
+
+	a.audit(w, r, "refreshed decisions", zap.Int("decisions", n))
+
+	return writeJSON(w, refreshResponse{Decisions: n})
+}
+
+// handleVerify compares the decisions known to the CrowdSec app with the
+// active decisions in the CrowdSec Local API, and reports the differences.
+func (a *adminAPI) handleVerify(w http.ResponseWriter, r *http.Request) error {
+	c, err := a.crowdsec(r, http.MethodPost)
+	if err != nil {
+		return err
+	}
+
+	v, err := c.Verify(r.Context())
+	if err != nil {
+		return refreshError("verifying", err)
+	}
+
+	a.audit(w, r, "verified decisions", zap.Int("missing", len(v.Missing)), zap.Int("extra", len(v.Extra)))
+
+	return writeJSON(w, v)
+}
+
+func refreshError(action string, err error) error {
+	if errors.Is(err, bouncer.ErrNotStreaming) {
+		return caddy.APIError{
+			HTTPStatus: http.StatusBadRequest,
+			Err:        fmt.Errorf("%s decisions requires streaming mode", action),
+		}
+	}
+
+	return caddy.APIError{
+		HTTPStatus: http.StatusBadGateway,
+		Err:        fmt.Errorf("failed %s decisions: %w", action, err),
+	}
+}
+
+type simulateRequest struct {
+	IP     string `json:"ip"`
+	Method string `json:"method,omitempty"`
+	Host   string `json:"host,omitempty"`
+	Path   string `json:"path,omitempty"`
+}
+
+type simulateResponse struct {
+	IP       string       `json:"ip"`
+	Method   string       `json:"method"`
+	Host     string       `json:"host"`
+	Path     string       `json:"path"`
+	Handlers []Simulation `json:"handlers"`
+}
+
+// handleSimulate reports what each of the crowdsec HTTP handlers would
+// do for a request from an IP, without serving the request.
+func (a *adminAPI) handleSimulate(w http.ResponseWriter, r *http.Request) error {
+	c, err := a.crowdsec(r, http.MethodPost)
+	if err != nil {
+		return err
+	}
+
+	req := simulateRequest{Method: http.MethodGet, Host: "localhost", Path: "/"}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return caddy.APIError{
+			HTTPStatus: http.StatusBadRequest,
+			Err:        fmt.Errorf("failed decoding request: %w", err),
+		}
+	}
+
+	ip, err := netip.ParseAddr(req.IP)
+	if err != nil {
+		return caddy.APIError{
+			HTTPStatus: http.StatusBadRequest,
+			Err:        fmt.Errorf("invalid IP %q: %w", req.IP, err),
+		}
+	}
+
+	simulations, err := c.Simulate(ip, req.Method, req.Host, req.Path)
+	if err != nil {
+		return caddy.APIError{
+			HTTPStatus: http.StatusBadRequest,
+			Err:        err,
+		}
+	}
+
+	return writeJSON(w, simulateResponse{
+		IP:       ip.String(),
+		Method:   req.Method,
+		Host:     req.Host,
+		Path:     req.Path,
+		Handlers: simulations,
+	})
+}
+
+// handleStats returns statistics about the decisions known
+// to the CrowdSec app.
+func (a *adminAPI) handleStats(w http.ResponseWriter, r *http.Request) error {
+	c, err := a.crowdsec(r, http.MethodGet, http.MethodPost)
+	if err != nil {
+		return err
+	}
+
+	return writeJSON(w, c.Stats())
+}
+
+// crowdsec checks the request method is one of methods and returns
+// the CrowdSec app that is currently running, if it's configured.
+func (a *adminAPI) crowdsec(r *http.Request, methods ...string) (*CrowdSec, error) {
+	if !slices.Contains(methods, r.Method) {
+		return nil, caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed: %v", r.Method),
+		}
+	}
+
+	c, ok := a.ctx.AppIfConfigured("crowdsec").(*CrowdSec)
+	if !ok || c == nil || c.bouncer == nil {
+		return nil, caddy.APIError{
+			HTTPStatus: http.StatusNotFound,
+			Err:        errors.New("crowdsec app not configured"),
+		}
+	}
+
+	return c, nil
+}
+
+// rateLimited limits the rate of requests per client to the endpoint
+// served by next, if rate limiting is enabled in the CrowdSec app.
+func (a *adminAPI) rateLimited(next caddy.AdminHandlerFunc) caddy.AdminHandler {
+	return caddy.AdminHandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		c, ok := a.ctx.AppIfConfigured("crowdsec").(*CrowdSec)
+		if !ok || c == nil || c.adminLimiter == nil {
+			return next(w, r)
+		}
+
+		client, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			client = r.RemoteAddr
+		}
+
+		if ok, retryAfter := c.adminLimiter.allow(client, time.Now()); !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+			return caddy.APIError{
+				HTTPStatus: http.StatusTooManyRequests,
+				Err:        errors.New("too many requests"),
+			}
+		}
+
+		return next(w, r)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, v any) error {
+	return writeJSONStatus(w, http.StatusOK, v)
+}
+
+func writeJSONStatus(w http.ResponseWriter, status int, v any) error {
+	encoded, err := json.Marshal(v)
+	if err != nil {
+		return caddy.APIError{
+			HTTPStatus: http.StatusInternalServerError,
+			Err:        err,
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, _ = w.Write(encoded)
+
+	return nil
+}
+
+// Interface guards
+var (
+	_ caddy.Module      = (*adminAPI)(nil)
+	_ caddy.AdminRouter = (*adminAPI)(nil)
+	_ caddy.Provisioner = (*adminAPI)(nil)
+)
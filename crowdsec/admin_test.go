@@ -0,0 +1,278 @@
+package crowdsec
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/crowdsecurity/crowdsec/pkg/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/hslatman/caddy-crowdsec-bouncer/crowdsectest"
+)
+
+// newAdminAPI loads a Caddy config with the CrowdSec app in live mode,
+// which looks up decisions in lapi, and returns the admin API for it.
+func newAdminAPI(t *testing.T, lapi *crowdsectest.Server) *adminAPI {
+	t.Helper()
+
+	config := fmt.Sprintf(`{
+		"admin": {"disabled": true, "config": {"persist": false}},
+		"apps": {
+			"crowdsec": {
+				"api_url": %q,
+				"api_key": %q,
+				"enable_streaming": false
+			}
+		}
+	}`, lapi.URL(), lapi.APIKey())
+
+	require.NoError(t, caddy.Load([]byte(config), true))
+	t.Cleanup(func() { require.NoError(t, caddy.Stop()) })
+
+	a := &adminAPI{}
+	require.NoError(t, a.Provision(caddy.ActiveContext()))
+
+	return a
+}
+
+// serveAdmin serves a request to the admin API route with pattern.
+func serveAdmin(t *testing.T, a *adminAPI, method, pattern, body string) (*httptest.ResponseRecorder, error) {
+	t.Helper()
+
+	for _, route := range a.Routes() {
+		if route.Pattern != pattern {
+			continue
+		}
+
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(method, pattern, strings.NewReader(body))
+		return w, route.Handler.ServeHTTP(w, r)
+	}
+
+	t.Fatalf("no admin API route for %q", pattern)
+	return nil, nil
+}
+
+func TestAdminAPI(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	t.Cleanup(cancel)
+
+	a := &adminAPI{}
+	require.NoError(t, a.Provision(ctx))
+
+	routes := a.Routes()
+
+	patterns := make([]string, 0, len(routes))
+	for _, route := range routes {
+		patterns = append(patterns, route.Pattern)
+	}
+	assert.ElementsMatch(t, []string{
+		"/crowdsec/ban",
+		"/crowdsec/check",
+		"/crowdsec/config",
+		"/crowdsec/covered",
+		"/crowdsec/decisions",
+		"/crowdsec/enforcement",
+		"/crowdsec/events",
+		"/crowdsec/export",
+		"/crowdsec/health",
+		"/crowdsec/info",
+		"/crowdsec/log_level",
+		"/crowdsec/metrics",
+		"/crowdsec/mode",
+		"/crowdsec/ping",
+		"/crowdsec/refresh",
+		"/crowdsec/simulate",
+		"/crowdsec/stats",
+		"/crowdsec/unban",
+		"/crowdsec/verdicts",
+		"/crowdsec/verify",
+		"/crowdsec/version",
+	}, patterns)
+
+	readOnly := map[string]bool{
+		"/crowdsec/config":      true,
+		"/crowdsec/decisions":   true,
+		"/crowdsec/enforcement": true,
+		"/crowdsec/events":      true,
+		"/crowdsec/export":      true,
+		"/crowdsec/health":      true,
+		"/crowdsec/log_level":   true,
+		"/crowdsec/info":        true,
+		"/crowdsec/metrics":     true,
+		"/crowdsec/mode":        true,
+		"/crowdsec/ping":        true,
+		"/crowdsec/stats":       true,
+		"/crowdsec/version":     true,
+	}
+
+	tests := []struct {
+		name       string
+		method     string
+		wantStatus func(pattern string) int
+	}{
+		{"method-not-allowed", http.MethodDelete, func(string) int { return http.StatusMethodNotAllowed }},
+		{"get", http.MethodGet, func(pattern string) int {
+			if readOnly[pattern] {
+				return http.StatusNotFound
+			}
+			return http.StatusMethodNotAllowed
+		}},
+		{"not-configured", http.MethodPost, func(string) int { return http.StatusNotFound }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, route := range routes {
+				r := httptest.NewRequest(tt.method, route.Pattern, http.NoBody)
+				err := route.Handler.ServeHTTP(httptest.NewRecorder(), r)
+
+				var apiErr caddy.APIError
+				require.True(t, errors.As(err, &apiErr))
+				assert.Equal(t, tt.wantStatus(route.Pattern), apiErr.HTTPStatus, route.Pattern)
+			}
+		})
+	}
+}
+
+func Test_reason(t *testing.T) {
+	typ, scenario, origin := "ban", "crowdsecurity/ssh-bf", "crowdsec"
+	assert.Equal(t, "ban by crowdsecurity/ssh-bf (crowdsec)", reason(&models.Decision{Type: &typ, Scenario: &scenario, Origin: &origin}))
+	assert.Equal(t, "ban", reason(&models.Decision{Type: &typ}))
+}
+
+func TestAdminAPI_handleCheck(t *testing.T) {
+	lapi := crowdsectest.NewServer(t)
+	lapi.AddDecisions(crowdsectest.NewDecision("Ip", "192.0.2.1", "ban"))
+	a := newAdminAPI(t, lapi)
+
+	tooMany := make([]string, maxCheckIPs+1)
+	for i := range tooMany {
+		tooMany[i] = "10.0.0.1"
+	}
+	tooManyBody, err := json.Marshal(checkRequest{IPs: tooMany})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name       string
+		body       string
+		want       checkResponse
+		wantBatch  []checkResponse
+		wantStatus int
+	}{
+		{name: "blocked", body: `{"ip": "192.0.2.1"}`, want: checkResponse{
+			IP:          "192.0.2.1",
+			Blocked:     true,
+			Reason:      "ban by crowdsectest (cscli)",
+			Enforcement: "enforce",
+		}},
+		{name: "blocked/ipv4-mapped", body: `{"ip": "::ffff:192.0.2.1"}`, want: checkResponse{
+			IP:          "192.0.2.1",
+			Blocked:     true,
+			Reason:      "ban by crowdsectest (cscli)",
+			Enforcement: "enforce",
+		}},
+		{name: "allowed", body: `{"ip": "10.0.0.1"}`, want: checkResponse{
+			IP:          "10.0.0.1",
+			Enforcement: "enforce",
+		}},
+		{name: "batch", body: `{"ips": ["192.0.2.1", "10.0.0.1", "invalid"]}`, wantBatch: []checkResponse{
+			{IP: "192.0.2.1", Blocked: true, Reason: "ban by crowdsectest (cscli)", Enforcement: "enforce"},
+			{IP: "10.0.0.1", Enforcement: "enforce"},
+			{IP: "invalid", Enforcement: "enforce", Error: `invalid IP "invalid": ParseAddr("invalid"): unable to parse IP`},
+		}},
+		{name: "batch-empty", body: `{"ips": []}`, wantBatch: []checkResponse{}},
+		{name: "fail/invalid-ip", body: `{"ip": "invalid"}`, wantStatus: http.StatusBadRequest},
+		{name: "fail/invalid-json", body: `{`, wantStatus: http.StatusBadRequest},
+		{name: "fail/ip-and-ips", body: `{"ip": "10.0.0.1", "ips": ["10.0.0.2"]}`, wantStatus: http.StatusBadRequest},
+		{name: "fail/too-many-ips", body: string(tooManyBody), wantStatus: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w, err := serveAdmin(t, a, http.MethodPost, "/crowdsec/check", tt.body)
+			if tt.wantStatus != 0 {
+				var apiErr caddy.APIError
+				require.True(t, errors.As(err, &apiErr))
+				assert.Equal(t, tt.wantStatus, apiErr.HTTPStatus)
+				return
+			}
+
+			require.NoError(t, err)
+			require.Equal(t, http.StatusOK, w.Code)
+
+			if tt.wantBatch != nil {
+				var got checkBatchResponse
+				require.NoError(t, json.NewDecoder(w.Body).Decode(&got))
+				require.Len(t, got.Results, len(tt.wantBatch))
+				for i, want := range tt.wantBatch {
+					assertCheckResponse(t, want, got.Results[i])
+				}
+				return
+			}
+
+			var got checkResponse
+			require.NoError(t, json.NewDecoder(w.Body).Decode(&got))
+			assertCheckResponse(t, tt.want, got)
+		})
+	}
+}
+
+// assertCheckResponse asserts got equals want, ignoring the details of
+// the decisions, of which there's one for blocked IPs.
+func assertCheckResponse(t *testing.T, want, got checkResponse) {
+	t.Helper()
+
+	if want.Blocked {
+		assert.Len(t, got.Decisions, 1)
+	} else {
+		assert.Empty(t, got.Decisions)
+	}
+	assert.NotNil(t, got.Decisions)
+
+	got.Decisions, want.Decisions = nil, nil
+	assert.Equal(t, want, got)
+}
+
+func TestAdminAPI_handleBan(t *testing.T) {
+	a := newAdminAPI(t, crowdsectest.NewServer(t))
+
+	tests := []struct {
+		name       string
+		body       string
+		want       time.Duration
+		wantStatus int
+	}{
+		{name: "default-duration", body: `{"value": "192.0.2.1"}`, want: 4 * time.Hour},
+		{name: "duration", body: `{"value": "192.0.2.2", "duration": "1h30m"}`, want: 90 * time.Minute},
+		{name: "duration-seconds", body: `{"value": "192.0.2.3", "duration": "90"}`, want: 90 * time.Second},
+		{name: "fail/invalid-duration", body: `{"value": "192.0.2.4", "duration": "1x"}`, wantStatus: http.StatusBadRequest},
+		{name: "fail/negative-duration", body: `{"value": "192.0.2.5", "duration": "-1m"}`, wantStatus: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w, err := serveAdmin(t, a, http.MethodPost, "/crowdsec/ban", tt.body)
+			if tt.wantStatus != 0 {
+				var apiErr caddy.APIError
+				require.True(t, errors.As(err, &apiErr))
+				assert.Equal(t, tt.wantStatus, apiErr.HTTPStatus)
+				return
+			}
+
+			require.NoError(t, err)
+
+			var got banResponse
+			require.NoError(t, json.NewDecoder(w.Body).Decode(&got))
+			remaining, err := time.ParseDuration(got.Decision.Duration)
+			require.NoError(t, err)
+			assert.InDelta(t, tt.want, remaining, float64(time.Second))
+		})
+	}
+}
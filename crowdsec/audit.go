@@ -0,0 +1,56 @@
+// Copyright 2024 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package crowdsec
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+
+	"go.uber.org/zap"
+)
+
+// requestIDHeader is the header carrying the ID of a request to the
+// admin API. If a client doesn't provide one, an ID is generated.
+const requestIDHeader = "X-Request-Id"
+
+// audit logs a state-changing request to the admin API, so that changes
+// made through the admin API can be traced. The request ID is returned
+// to the client in the response headers. It must be called before the
+// response is written.
+func (a *adminAPI) audit(w http.ResponseWriter, r *http.Request, action string, fields ...zap.Field) {
+	id := r.Header.Get(requestIDHeader)
+	if id == "" {
+		id = newRequestID()
+	}
+	w.Header().Set(requestIDHeader, id)
+
+	fields = append([]zap.Field{
+		zap.String("request_id", id),
+		zap.String("method", r.Method),
+		zap.String("uri", r.RequestURI),
+		zap.String("remote_addr", r.RemoteAddr),
+		zap.String("user_agent", r.UserAgent()),
+	}, fields...)
+
+	a.auditLogger.Info(action, fields...)
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,42 @@
+package crowdsec
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func Test_adminAPI_audit(t *testing.T) {
+	core, logs := observer.New(zapcore.InfoLevel)
+	a := &adminAPI{auditLogger: zap.New(core)}
+
+	r := httptest.NewRequest(http.MethodPost, "/crowdsec/enforcement", http.NoBody)
+	r.Header.Set("User-Agent", "caddy-crowdsec/v0.8.0")
+	w := httptest.NewRecorder()
+	a.audit(w, r, "changed enforcement mode", zap.String("mode", "off"))
+
+	require.Equal(t, 1, logs.Len())
+	entry := logs.All()[0]
+	assert.Equal(t, "changed enforcement mode", entry.Message)
+
+	fields := entry.ContextMap()
+	assert.Equal(t, w.Header().Get(requestIDHeader), fields["request_id"])
+	assert.Len(t, fields["request_id"], 16)
+	assert.Equal(t, "POST", fields["method"])
+	assert.Equal(t, "/crowdsec/enforcement", fields["uri"])
+	assert.Equal(t, "192.0.2.1:1234", fields["remote_addr"])
+	assert.Equal(t, "caddy-crowdsec/v0.8.0", fields["user_agent"])
+	assert.Equal(t, "off", fields["mode"])
+
+	r.Header.Set(requestIDHeader, "abc")
+	w = httptest.NewRecorder()
+	a.audit(w, r, "reset log level")
+	assert.Equal(t, "abc", w.Header().Get(requestIDHeader))
+	assert.Equal(t, "abc", logs.All()[1].ContextMap()["request_id"])
+}
@@ -0,0 +1,99 @@
+// Copyright 2024 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package crowdsec
+
+import (
+	"net/netip"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+
+	"github.com/hslatman/caddy-crowdsec-bouncer/internal/cti"
+)
+
+// blockedLoggerName is the name of the logger writing the blocked
+// request log, relative to the logger of the app.
+const blockedLoggerName = "blocked"
+
+// BlockedRequest describes a request or connection that was blocked
+// by one of the CrowdSec modules.
+type BlockedRequest struct {
+	// IP is the client IP.
+	IP netip.Addr
+	// Host is the requested host. It's empty for connections.
+	Host string
+	// Method is the request method. It's empty for connections.
+	Method string
+	// Path is the request path. It's empty for connections.
+	Path string
+	// Type is the remediation served, i.e. "ban" or "captcha".
+	Type string
+	// Origin of the decision, or "appsec" for AppSec verdicts.
+	Origin string
+	// Scenario that resulted in the decision, if known.
+	Scenario string
+	// Module is the ID of the module that blocked the request.
+	Module string
+}
+
+// LogBlocked writes a line describing br to the blocked request log,
+// if it's enabled. The log has a stable set of fields, so that it can
+// be acquired by the CrowdSec agent. When CTI lookups are enabled, the
+// line is written when the client IP was looked up, and it has a "cti"
+// field with the information about the IP, if it's known.
+func (c *CrowdSec) LogBlocked(br BlockedRequest) {
+	if c.blockedLogger == nil || !c.blockedLogger.Core().Enabled(zapcore.InfoLevel) {
+		return
+	}
+
+	if c.cti == nil {
+		c.logBlocked(br, nil)
+		return
+	}
+
+	c.lookupAndLogBlocked(br)
+}
+
+// lookupAndLogBlocked logs br when the CTI lookup for its IP is done. It's
+// separate from LogBlocked, so that br only escapes to the heap when it's
+// captured for the lookup.
+func (c *CrowdSec) lookupAndLogBlocked(br BlockedRequest) {
+	c.cti.LookupAsync(br.IP, func(info *cti.Info) {
+		c.logBlocked(br, info)
+	})
+}
+
+func (c *CrowdSec) logBlocked(br BlockedRequest, info *cti.Info) {
+	ce := c.blockedLogger.Check(zapcore.InfoLevel, "request blocked")
+	if ce == nil {
+		return
+	}
+
+	fields := []zap.Field{
+		zap.String("ip", br.IP.String()),
+		zap.String("host", br.Host),
+		zap.String("method", br.Method),
+		zap.String("path", br.Path),
+		zap.String("type", br.Type),
+		zap.String("origin", br.Origin),
+		zap.String("scenario", br.Scenario),
+		zap.String("module", br.Module),
+	}
+	if info != nil && info.Known {
+		fields = append(fields, zap.Any("cti", info))
+	}
+
+	ce.Write(fields...)
+}
@@ -0,0 +1,62 @@
+package crowdsec
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestCrowdSec_LogBlocked(t *testing.T) {
+	br := BlockedRequest{
+		IP:       netip.MustParseAddr("192.0.2.1"),
+		Host:     "example.com",
+		Method:   "GET",
+		Path:     "/wp-login.php",
+		Type:     "ban",
+		Origin:   "crowdsec",
+		Scenario: "crowdsecurity/http-bf",
+		Module:   "http.handlers.crowdsec",
+	}
+
+	// disabled by default
+	c := &CrowdSec{}
+	c.LogBlocked(br)
+
+	core, logs := observer.New(zapcore.InfoLevel)
+	c.blockedLogger = zap.New(core).Named(blockedLoggerName)
+	c.LogBlocked(br)
+
+	require.Equal(t, 1, logs.Len())
+	entry := logs.All()[0]
+	assert.Equal(t, "blocked", entry.LoggerName)
+	assert.Equal(t, "request blocked", entry.Message)
+	assert.Equal(t, map[string]any{
+		"ip":       "192.0.2.1",
+		"host":     "example.com",
+		"method":   "GET",
+		"path":     "/wp-login.php",
+		"type":     "ban",
+		"origin":   "crowdsec",
+		"scenario": "crowdsecurity/http-bf",
+		"module":   "http.handlers.crowdsec",
+	}, entry.ContextMap())
+}
+
+func TestCrowdSec_LogBlockedLevelDisabled(t *testing.T) {
+	br := BlockedRequest{IP: netip.MustParseAddr("192.0.2.1"), Type: "ban"}
+
+	core, logs := observer.New(zapcore.WarnLevel)
+	c := &CrowdSec{blockedLogger: zap.New(core).Named(blockedLoggerName)}
+
+	allocs := testing.AllocsPerRun(100, func() {
+		c.LogBlocked(br)
+	})
+
+	assert.Zero(t, allocs)
+	assert.Zero(t, logs.Len())
+}
@@ -7,19 +7,18 @@ import (
 	"strings"
 	"time"
 
+	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/caddyconfig"
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
 	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+
+	"github.com/hslatman/caddy-crowdsec-bouncer/internal/duration"
 )
 
 func parseCrowdSec(d *caddyfile.Dispenser, existingVal any) (any, error) {
 	tv := true
 	fv := false
-	cs := &CrowdSec{
-		TickerInterval:  "60s",
-		EnableStreaming: &tv,
-		EnableHardFails: &fv,
-	}
+	cs := &CrowdSec{}
 
 	if !d.Next() {
 		return nil, d.Err("expected tokens")
@@ -52,15 +51,115 @@ func parseCrowdSec(d *caddyfile.Dispenser, existingVal any) (any, error) {
 				return nil, d.ArgErr()
 			}
 			cs.APIKey = d.Val()
+		case "capi":
+			capi, err := parseCAPI(d)
+			if err != nil {
+				return nil, err
+			}
+			cs.CAPI = capi
+		case "feed":
+			// feed <name> <api_url> <api_key>
+			args := d.RemainingArgs()
+			if len(args) != 3 {
+				return nil, d.ArgErr()
+			}
+			cs.Feeds = append(cs.Feeds, &Feed{Name: args[0], APIUrl: args[1], APIKey: args[2]})
+		case "blocklist_mirror":
+			m, err := parseBlocklistMirror(d)
+			if err != nil {
+				return nil, err
+			}
+			cs.BlocklistMirror = m
+		case "snapshot":
+			m, err := parseBlocklistMirror(d)
+			if err != nil {
+				return nil, err
+			}
+			cs.Snapshot = m
+		case "instance_name":
+			if !d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			cs.InstanceName = d.Val()
+			if d.NextArg() {
+				return nil, d.ArgErr()
+			}
+		case "api_header":
+			if !d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			name := d.Val()
+			if !d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			if cs.APIHeaders == nil {
+				cs.APIHeaders = map[string]string{}
+			}
+			cs.APIHeaders[name] = d.Val()
+			if d.NextArg() {
+				return nil, d.ArgErr()
+			}
+		case "module_warnings":
+			if !d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			cs.ModuleWarnings = d.Val()
+			if d.NextArg() {
+				return nil, d.ArgErr()
+			}
 		case "ticker_interval":
 			if !d.NextArg() {
 				return nil, d.ArgErr()
 			}
-			interval, err := time.ParseDuration(d.Val())
+			interval, err := duration.ParseCaddyfile(d, "ticker_interval")
 			if err != nil {
-				return nil, d.Errf("invalid duration %s: %v", d.Val(), err)
+				return nil, err
+			}
+			cs.TickerInterval = time.Duration(interval).String()
+		case "metrics_interval":
+			if !d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			var interval caddy.Duration
+			if d.Val() != "off" {
+				var err error
+				if interval, err = duration.ParseCaddyfile(d, "metrics_interval"); err != nil {
+					return nil, err
+				}
+			}
+			cs.MetricsInterval = &interval
+			if d.NextArg() {
+				return nil, d.ArgErr()
+			}
+		case "decision_log_threshold":
+			if !d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			threshold, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return nil, d.Errf("invalid decision log threshold %q: %v", d.Val(), err)
+			}
+			cs.DecisionLogThreshold = &threshold
+			if d.NextArg() {
+				return nil, d.ArgErr()
+			}
+		case "log_manual_decisions":
+			if d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			cs.LogManualDecisions = true
+		case "summary_interval":
+			if !d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			interval, err := duration.ParseCaddyfile(d, "summary_interval")
+			if err != nil {
+				return nil, err
+			}
+			cs.SummaryInterval = interval
+			if d.NextArg() {
+				return nil, d.ArgErr()
 			}
-			cs.TickerInterval = interval.String()
 		case "disable_streaming":
 			if d.NextArg() {
 				return nil, d.ArgErr()
@@ -71,20 +170,117 @@ func parseCrowdSec(d *caddyfile.Dispenser, existingVal any) (any, error) {
 				return nil, d.ArgErr()
 			}
 			cs.EnableHardFails = &tv
-		case "appsec_url":
+		case "appsec":
+			if d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			for nesting := d.Nesting(); d.NextBlock(nesting); {
+				if err := parseAppSecOption(d, cs, d.Val()); err != nil {
+					return nil, err
+				}
+			}
+		case "appsec_url", "appsec_api_key", "appsec_max_body_bytes", "appsec_max_body_size",
+			"appsec_timeout", "appsec_failure_policy", "appsec_max_retries", "appsec_retry_backoff",
+			"appsec_health_check_interval", "appsec_header_allowlist", "appsec_header_denylist",
+			"appsec_exclude", "appsec_mode", "appsec_queue_size",
+			"appsec_cache_ttl", "appsec_cache_size", "appsec_max_concurrency",
+			"appsec_max_queued", "appsec_overflow_policy", "appsec_block_suspicious_upgrades":
+			if err := parseAppSecOption(d, cs, strings.TrimPrefix(d.Val(), "appsec_")); err != nil {
+				return nil, err
+			}
+		case "denylist":
+			values := d.RemainingArgs()
+			if len(values) == 0 {
+				return nil, d.ArgErr()
+			}
+			cs.Denylist = append(cs.Denylist, values...)
+		case "denylist_type":
 			if !d.NextArg() {
 				return nil, d.ArgErr()
 			}
-			cs.AppSecUrl = d.Val()
-		case "appsec_max_body_bytes":
+			cs.DenylistType = d.Val()
+		case "blocklists":
+			values := d.RemainingArgs()
+			if len(values) == 0 {
+				return nil, d.ArgErr()
+			}
+			cs.Blocklists = append(cs.Blocklists, values...)
+		case "blocklist_type":
 			if !d.NextArg() {
 				return nil, d.ArgErr()
 			}
-			v, err := strconv.Atoi(d.Val())
+			cs.BlocklistType = d.Val()
+		case "blocklist_interval":
+			if !d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			interval, err := duration.ParseCaddyfile(d, "blocklist_interval")
 			if err != nil {
-				return nil, d.Errf("invalid maximum number of bytes %q: %v", d.Val(), err)
+				return nil, err
 			}
-			cs.AppSecMaxBodySize = v
+			cs.BlocklistInterval = interval
+			if d.NextArg() {
+				return nil, d.ArgErr()
+			}
+		case "blocklist_rollup":
+			if d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			cs.BlocklistRollup = true
+		case "admin_rate_limit":
+			if !d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			limit, err := strconv.ParseFloat(d.Val(), 64)
+			if err != nil {
+				return nil, d.Errf("invalid admin rate limit %q: %v", d.Val(), err)
+			}
+			cs.AdminRateLimit = limit
+			if d.NextArg() {
+				burst, err := strconv.Atoi(d.Val())
+				if err != nil {
+					return nil, d.Errf("invalid admin rate burst %q: %v", d.Val(), err)
+				}
+				cs.AdminRateBurst = burst
+			}
+			if d.NextArg() {
+				return nil, d.ArgErr()
+			}
+		case "blocked_log":
+			if d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			cs.BlockedLog = true
+		case "alerts":
+			alerts, err := parseAlerts(d)
+			if err != nil {
+				return nil, err
+			}
+			cs.Alerts = alerts
+		case "auto_ban":
+			a, err := parseAutoBan(d)
+			if err != nil {
+				return nil, err
+			}
+			cs.AutoBan = a
+		case "client":
+			c, err := parseClient(d)
+			if err != nil {
+				return nil, err
+			}
+			cs.Client = c
+		case "cti":
+			cti, err := parseCTI(d)
+			if err != nil {
+				return nil, err
+			}
+			cs.CTI = cti
+		case "webhook":
+			w, err := parseWebhook(d)
+			if err != nil {
+				return nil, err
+			}
+			cs.Webhook = w
 		default:
 			return nil, d.Errf("invalid configuration token %q provided", d.Val())
 		}
@@ -95,3 +291,638 @@ func parseCrowdSec(d *caddyfile.Dispenser, existingVal any) (any, error) {
 		Value: caddyconfig.JSON(cs, nil),
 	}, nil
 }
+
+// parseAppSecOption parses a single AppSec option. Options can be
+// configured in the crowdsec block with an "appsec_" prefix, or in
+// a nested appsec block without the prefix.
+func parseAppSecOption(d *caddyfile.Dispenser, cs *CrowdSec, option string) error {
+	switch option {
+	case "header_allowlist", "header_denylist":
+		headers := d.RemainingArgs()
+		if len(headers) == 0 {
+			return d.ArgErr()
+		}
+		if option == "header_allowlist" {
+			cs.AppSecHeaderAllowlist = append(cs.AppSecHeaderAllowlist, headers...)
+		} else {
+			cs.AppSecHeaderDenylist = append(cs.AppSecHeaderDenylist, headers...)
+		}
+		return nil
+	case "block_suspicious_upgrades":
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+		cs.AppSecBlockSuspiciousUpgrades = true
+		return nil
+	case "exclude":
+		e, err := parseAppSecExclusion(d)
+		if err != nil {
+			return err
+		}
+		cs.AppSecExclude = append(cs.AppSecExclude, e)
+		return nil
+	case "jail":
+		j, err := parseAppSecJail(d)
+		if err != nil {
+			return err
+		}
+		cs.AppSecJail = j
+		return nil
+	}
+
+	if !d.NextArg() {
+		return d.ArgErr()
+	}
+
+	switch option {
+	case "url":
+		cs.AppSecUrl = d.Val()
+	case "api_key":
+		cs.AppSecAPIKey = d.Val()
+	case "max_body_bytes", "max_body_size":
+		v, err := strconv.Atoi(d.Val())
+		if err != nil {
+			return d.Errf("invalid maximum number of bytes %q: %v", d.Val(), err)
+		}
+		cs.AppSecMaxBodySize = v
+	case "timeout":
+		timeout, err := duration.ParseCaddyfile(d, "appsec_timeout")
+		if err != nil {
+			return err
+		}
+		cs.AppSecTimeout = timeout
+	case "failure_policy":
+		cs.AppSecFailurePolicy = d.Val()
+	case "max_retries":
+		v, err := strconv.Atoi(d.Val())
+		if err != nil {
+			return d.Errf("invalid number of retries %q: %v", d.Val(), err)
+		}
+		cs.AppSecMaxRetries = v
+	case "retry_backoff":
+		backoff, err := duration.ParseCaddyfile(d, "appsec_retry_backoff")
+		if err != nil {
+			return err
+		}
+		cs.AppSecRetryBackoff = backoff
+	case "mode":
+		cs.AppSecMode = d.Val()
+	case "queue_size":
+		v, err := strconv.Atoi(d.Val())
+		if err != nil {
+			return d.Errf("invalid queue size %q: %v", d.Val(), err)
+		}
+		cs.AppSecQueueSize = v
+	case "cache_ttl":
+		ttl, err := duration.ParseCaddyfile(d, "appsec_cache_ttl")
+		if err != nil {
+			return err
+		}
+		cs.AppSecCacheTTL = ttl
+	case "cache_size":
+		v, err := strconv.Atoi(d.Val())
+		if err != nil {
+			return d.Errf("invalid cache size %q: %v", d.Val(), err)
+		}
+		cs.AppSecCacheSize = v
+	case "max_concurrency":
+		v, err := strconv.Atoi(d.Val())
+		if err != nil {
+			return d.Errf("invalid maximum concurrency %q: %v", d.Val(), err)
+		}
+		cs.AppSecMaxConcurrency = v
+	case "max_queued":
+		v, err := strconv.Atoi(d.Val())
+		if err != nil {
+			return d.Errf("invalid maximum number of queued requests %q: %v", d.Val(), err)
+		}
+		cs.AppSecMaxQueued = v
+	case "overflow_policy":
+		cs.AppSecOverflowPolicy = d.Val()
+	case "health_check_interval":
+		interval, err := duration.ParseCaddyfile(d, "appsec_health_check_interval")
+		if err != nil {
+			return err
+		}
+		cs.AppSecHealthCheckInterval = interval
+	default:
+		return d.Errf("invalid appsec configuration token %q provided", option)
+	}
+
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+
+	return nil
+}
+
+// parseAppSecExclusion parses an AppSec exclusion block:
+//
+//	exclude {
+//		path <patterns...>
+//		method <methods...>
+//		content_type <types...>
+//		max_content_length <bytes>
+//	}
+func parseAppSecExclusion(d *caddyfile.Dispenser) (*AppSecExclusion, error) {
+	if d.NextArg() {
+		return nil, d.ArgErr()
+	}
+
+	e := &AppSecExclusion{}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "path":
+			values := d.RemainingArgs()
+			if len(values) == 0 {
+				return nil, d.ArgErr()
+			}
+			e.Paths = append(e.Paths, values...)
+		case "method":
+			values := d.RemainingArgs()
+			if len(values) == 0 {
+				return nil, d.ArgErr()
+			}
+			e.Methods = append(e.Methods, values...)
+		case "content_type":
+			values := d.RemainingArgs()
+			if len(values) == 0 {
+				return nil, d.ArgErr()
+			}
+			e.ContentTypes = append(e.ContentTypes, values...)
+		case "max_content_length":
+			if !d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			v, err := strconv.ParseInt(d.Val(), 10, 64)
+			if err != nil {
+				return nil, d.Errf("invalid maximum content length %q: %v", d.Val(), err)
+			}
+			e.MaxContentLength = v
+			if d.NextArg() {
+				return nil, d.ArgErr()
+			}
+		default:
+			return nil, d.Errf("invalid appsec exclusion token %q provided", d.Val())
+		}
+	}
+
+	return e, nil
+}
+
+// parseAppSecJail parses the configuration for banning IPs that had too
+// many requests blocked by the AppSec component:
+//
+//	jail {
+//		threshold <count>
+//		window <duration>
+//		duration <duration>
+//	}
+func parseAppSecJail(d *caddyfile.Dispenser) (*AppSecJail, error) {
+	if d.NextArg() {
+		return nil, d.ArgErr()
+	}
+
+	j := &AppSecJail{}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		option := d.Val()
+		if !d.NextArg() {
+			return nil, d.ArgErr()
+		}
+
+		switch option {
+		case "threshold":
+			v, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return nil, d.Errf("invalid appsec jail threshold %q: %v", d.Val(), err)
+			}
+			j.Threshold = v
+		case "window":
+			window, err := duration.ParseCaddyfile(d, "appsec_jail window")
+			if err != nil {
+				return nil, err
+			}
+			j.Window = window
+		case "duration":
+			dur, err := duration.ParseCaddyfile(d, "appsec_jail duration")
+			if err != nil {
+				return nil, err
+			}
+			j.Duration = dur
+		default:
+			return nil, d.Errf("invalid appsec jail configuration token %q provided", option)
+		}
+
+		if d.NextArg() {
+			return nil, d.ArgErr()
+		}
+	}
+
+	return j, nil
+}
+
+// parseWebhook parses a webhook block:
+//
+//	webhook <url> {
+//		events <types...>
+//		template <template>
+//		content_type <type>
+//		batch_size <n>
+//		batch_interval <duration>
+//		rate_limit <n>
+//		timeout <duration>
+//	}
+func parseWebhook(d *caddyfile.Dispenser) (*Webhook, error) {
+	if !d.NextArg() {
+		return nil, d.ArgErr()
+	}
+
+	w := &Webhook{URL: d.Val()}
+	if d.NextArg() {
+		return nil, d.ArgErr()
+	}
+
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		option := d.Val()
+		if option == "events" {
+			values := d.RemainingArgs()
+			if len(values) == 0 {
+				return nil, d.ArgErr()
+			}
+			w.Events = append(w.Events, values...)
+			continue
+		}
+
+		if !d.NextArg() {
+			return nil, d.ArgErr()
+		}
+
+		switch option {
+		case "template":
+			w.Template = d.Val()
+		case "content_type":
+			w.ContentType = d.Val()
+		case "batch_size":
+			v, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return nil, d.Errf("invalid batch size %q: %v", d.Val(), err)
+			}
+			w.BatchSize = v
+		case "batch_interval":
+			interval, err := duration.ParseCaddyfile(d, "webhook batch_interval")
+			if err != nil {
+				return nil, err
+			}
+			w.BatchInterval = interval
+		case "rate_limit":
+			v, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return nil, d.Errf("invalid webhook rate limit %q: %v", d.Val(), err)
+			}
+			w.RateLimit = v
+		case "timeout":
+			timeout, err := duration.ParseCaddyfile(d, "webhook timeout")
+			if err != nil {
+				return nil, err
+			}
+			w.Timeout = timeout
+		default:
+			return nil, d.Errf("invalid webhook configuration token %q provided", option)
+		}
+
+		if d.NextArg() {
+			return nil, d.ArgErr()
+		}
+	}
+
+	return w, nil
+}
+
+// parseCAPI parses a Central API block:
+//
+//	capi {
+//		url <url>
+//		machine_id <id>
+//		password <password>
+//		scenarios <scenarios...>
+//	}
+func parseCAPI(d *caddyfile.Dispenser) (*CAPI, error) {
+	if d.NextArg() {
+		return nil, d.ArgErr()
+	}
+
+	c := &CAPI{}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		option := d.Val()
+		if option == "scenarios" {
+			values := d.RemainingArgs()
+			if len(values) == 0 {
+				return nil, d.ArgErr()
+			}
+			c.Scenarios = append(c.Scenarios, values...)
+			continue
+		}
+
+		if !d.NextArg() {
+			return nil, d.ArgErr()
+		}
+
+		switch option {
+		case "url":
+			c.URL = d.Val()
+		case "machine_id":
+			c.MachineID = d.Val()
+		case "password":
+			c.Password = d.Val()
+		default:
+			return nil, d.Errf("invalid capi configuration token %q provided", option)
+		}
+
+		if d.NextArg() {
+			return nil, d.ArgErr()
+		}
+	}
+
+	return c, nil
+}
+
+// parseBlocklistMirror parses a blocklist mirror, or a snapshot, which
+// is configured the same way:
+//
+//	blocklist_mirror <url> {
+//		api_key <key>
+//		type <ban|captcha>
+//	}
+func parseBlocklistMirror(d *caddyfile.Dispenser) (*BlocklistMirror, error) {
+	directive := d.Val()
+	if !d.NextArg() {
+		return nil, d.ArgErr()
+	}
+
+	m := &BlocklistMirror{URL: d.Val()}
+	if d.NextArg() {
+		return nil, d.ArgErr()
+	}
+
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		option := d.Val()
+		if !d.NextArg() {
+			return nil, d.ArgErr()
+		}
+
+		switch option {
+		case "api_key":
+			m.APIKey = d.Val()
+		case "type":
+			m.Type = d.Val()
+		default:
+			return nil, d.Errf("invalid %s configuration token %q provided", directive, option)
+		}
+
+		if d.NextArg() {
+			return nil, d.ArgErr()
+		}
+	}
+
+	return m, nil
+}
+
+// parseCTI parses a CTI API configuration:
+//
+//	cti <api_key> {
+//		cache_ttl <duration>
+//		cache_size <size>
+//		rate_limit <lookups_per_hour>
+//	}
+func parseCTI(d *caddyfile.Dispenser) (*CTI, error) {
+	if !d.NextArg() {
+		return nil, d.ArgErr()
+	}
+
+	c := &CTI{APIKey: d.Val()}
+	if d.NextArg() {
+		return nil, d.ArgErr()
+	}
+
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		option := d.Val()
+		if !d.NextArg() {
+			return nil, d.ArgErr()
+		}
+
+		switch option {
+		case "cache_ttl":
+			ttl, err := duration.ParseCaddyfile(d, "cti cache_ttl")
+			if err != nil {
+				return nil, err
+			}
+			c.CacheTTL = ttl
+		case "cache_size":
+			v, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return nil, d.Errf("invalid cti cache size %q: %v", d.Val(), err)
+			}
+			c.CacheSize = v
+		case "rate_limit":
+			v, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return nil, d.Errf("invalid cti rate limit %q: %v", d.Val(), err)
+			}
+			c.RateLimit = v
+		default:
+			return nil, d.Errf("invalid cti configuration token %q provided", option)
+		}
+
+		if d.NextArg() {
+			return nil, d.ArgErr()
+		}
+	}
+
+	return c, nil
+}
+
+// parseAlerts parses the machine used for sending alerts:
+//
+//	alerts {
+//		machine_id <id>
+//		password <password>
+//		decision_duration <duration|off>
+//	}
+func parseAlerts(d *caddyfile.Dispenser) (*Alerts, error) {
+	if d.NextArg() {
+		return nil, d.ArgErr()
+	}
+
+	a := &Alerts{}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		option := d.Val()
+		if !d.NextArg() {
+			return nil, d.ArgErr()
+		}
+
+		switch option {
+		case "machine_id":
+			a.MachineID = d.Val()
+		case "password":
+			a.Password = d.Val()
+		case "decision_duration":
+			if d.Val() == "off" {
+				a.DecisionDuration = caddy.Duration(-1)
+				break
+			}
+			dur, err := duration.ParseCaddyfile(d, "alerts decision_duration")
+			if err != nil {
+				return nil, err
+			}
+			a.DecisionDuration = dur
+		default:
+			return nil, d.Errf("invalid alerts configuration token %q provided", option)
+		}
+
+		if d.NextArg() {
+			return nil, d.ArgErr()
+		}
+	}
+
+	return a, nil
+}
+
+// parseClient parses the configuration for tuning the HTTP clients:
+//
+//	client {
+//		max_idle_conns <count>
+//		max_idle_conns_per_host <count>
+//		idle_conn_timeout <duration>
+//		keepalive <duration>
+//		tls_handshake_timeout <duration>
+//		disable_http2
+//	}
+func parseClient(d *caddyfile.Dispenser) (*Client, error) {
+	if d.NextArg() {
+		return nil, d.ArgErr()
+	}
+
+	c := &Client{}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		option := d.Val()
+		if option == "disable_http2" {
+			if d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			c.DisableHTTP2 = true
+			continue
+		}
+
+		if !d.NextArg() {
+			return nil, d.ArgErr()
+		}
+
+		switch option {
+		case "max_idle_conns", "max_idle_conns_per_host":
+			v, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return nil, d.Errf("invalid maximum number of idle connections %q: %v", d.Val(), err)
+			}
+			if option == "max_idle_conns" {
+				c.MaxIdleConns = v
+			} else {
+				c.MaxIdleConnsPerHost = v
+			}
+		case "idle_conn_timeout":
+			timeout, err := duration.ParseCaddyfile(d, "client idle_conn_timeout")
+			if err != nil {
+				return nil, err
+			}
+			c.IdleConnTimeout = timeout
+		case "keepalive":
+			keepAlive, err := duration.ParseCaddyfile(d, "client keepalive")
+			if err != nil {
+				return nil, err
+			}
+			c.KeepAlive = keepAlive
+		case "tls_handshake_timeout":
+			timeout, err := duration.ParseCaddyfile(d, "client tls_handshake_timeout")
+			if err != nil {
+				return nil, err
+			}
+			c.TLSHandshakeTimeout = timeout
+		default:
+			return nil, d.Errf("invalid client configuration token %q provided", option)
+		}
+
+		if d.NextArg() {
+			return nil, d.ArgErr()
+		}
+	}
+
+	return c, nil
+}
+
+// parseAutoBan parses the configuration for banning IPs that get too
+// many error responses:
+//
+//	auto_ban {
+//		threshold <count>
+//		window <duration>
+//		status <codes...>
+//		type <ban|captcha>
+//		duration <duration>
+//	}
+func parseAutoBan(d *caddyfile.Dispenser) (*AutoBan, error) {
+	if d.NextArg() {
+		return nil, d.ArgErr()
+	}
+
+	a := &AutoBan{}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		option := d.Val()
+		if option == "status" {
+			for d.NextArg() {
+				status, err := strconv.Atoi(d.Val())
+				if err != nil {
+					return nil, d.Errf("invalid status code %q: %v", d.Val(), err)
+				}
+				a.Statuses = append(a.Statuses, status)
+			}
+			if len(a.Statuses) == 0 {
+				return nil, d.ArgErr()
+			}
+			continue
+		}
+
+		if !d.NextArg() {
+			return nil, d.ArgErr()
+		}
+
+		switch option {
+		case "threshold":
+			v, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return nil, d.Errf("invalid auto ban threshold %q: %v", d.Val(), err)
+			}
+			a.Threshold = v
+		case "window":
+			window, err := duration.ParseCaddyfile(d, "auto_ban window")
+			if err != nil {
+				return nil, err
+			}
+			a.Window = window
+		case "type":
+			a.Type = d.Val()
+		case "duration":
+			dur, err := duration.ParseCaddyfile(d, "auto_ban duration")
+			if err != nil {
+				return nil, err
+			}
+			a.Duration = dur
+		default:
+			return nil, d.Errf("invalid auto ban configuration token %q provided", option)
+		}
+
+		if d.NextArg() {
+			return nil, d.ArgErr()
+		}
+	}
+
+	return a, nil
+}
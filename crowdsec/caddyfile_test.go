@@ -3,7 +3,9 @@ package crowdsec
 import (
 	"encoding/json"
 	"testing"
+	"time"
 
+	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
 	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
 	"github.com/stretchr/testify/assert"
@@ -130,7 +132,6 @@ func TestUnmarshalCaddyfile(t *testing.T) {
 			expected: &CrowdSec{
 				APIUrl:          "http://127.0.0.1:8080/",
 				APIKey:          "some_random_key",
-				TickerInterval:  "60s",
 				EnableStreaming: &tv,
 				EnableHardFails: &fv,
 			},
@@ -143,11 +144,17 @@ func TestUnmarshalCaddyfile(t *testing.T) {
 		{
 			name: "ok/full",
 			expected: &CrowdSec{
-				APIUrl:          "http://127.0.0.1:8080/",
-				APIKey:          "some_random_key",
-				TickerInterval:  "33s",
-				EnableStreaming: &fv,
-				EnableHardFails: &tv,
+				APIUrl:                    "http://127.0.0.1:8080/",
+				APIKey:                    "some_random_key",
+				TickerInterval:            "33s",
+				EnableStreaming:           &fv,
+				EnableHardFails:           &tv,
+				AppSecFailurePolicy:       "closed",
+				AppSecMaxRetries:          2,
+				AppSecRetryBackoff:        caddy.Duration(250 * time.Millisecond),
+				AppSecHealthCheckInterval: caddy.Duration(30 * time.Second),
+				AppSecCacheTTL:            caddy.Duration(5 * time.Second),
+				AppSecCacheSize:           100,
 			},
 			input: `crowdsec {
 					api_url http://127.0.0.1:8080 
@@ -155,9 +162,722 @@ func TestUnmarshalCaddyfile(t *testing.T) {
 					ticker_interval 33s
 					disable_streaming
 					enable_hard_fails
+					appsec_failure_policy closed
+					appsec_max_retries 2
+					appsec_retry_backoff 250ms
+					appsec_health_check_interval 30s
+					appsec_cache_ttl 5s
+					appsec_cache_size 100
+				}`,
+			wantParseErr: false,
+		},
+		{
+			name: "ok/api-headers",
+			expected: &CrowdSec{
+				APIUrl:          "https://gateway.example.com/crowdsec/",
+				APIKey:          "some_random_key",
+				EnableStreaming: &tv,
+				EnableHardFails: &fv,
+				APIHeaders: map[string]string{
+					"CF-Access-Client-Id":     "client-id",
+					"CF-Access-Client-Secret": "{env.CF_ACCESS_CLIENT_SECRET}",
+				},
+			},
+			input: `crowdsec {
+					api_url https://gateway.example.com/crowdsec
+					api_key some_random_key
+					api_header CF-Access-Client-Id client-id
+					api_header CF-Access-Client-Secret {env.CF_ACCESS_CLIENT_SECRET}
+				}`,
+			wantParseErr: false,
+		},
+		{
+			name:     "fail/api-header",
+			expected: &CrowdSec{},
+			input: `crowdsec {
+					api_url http://127.0.0.1:8080
+					api_key some_random_key
+					api_header X-Only-Name
+				}`,
+			wantParseErr: true,
+		},
+		{
+			name: "ok/module-warnings",
+			expected: &CrowdSec{
+				APIUrl:          "http://127.0.0.1:8080/",
+				APIKey:          "some_random_key",
+				EnableStreaming: &tv,
+				EnableHardFails: &fv,
+				ModuleWarnings:  "off",
+			},
+			input: `crowdsec {
+					api_url http://127.0.0.1:8080 
+					api_key some_random_key
+					module_warnings off
+				}`,
+			wantParseErr: false,
+		},
+		{
+			name: "ok/client",
+			expected: &CrowdSec{
+				APIUrl:          "http://127.0.0.1:8080/",
+				APIKey:          "some_random_key",
+				EnableStreaming: &tv,
+				EnableHardFails: &fv,
+				Client: &Client{
+					MaxIdleConns:        200,
+					MaxIdleConnsPerHost: 50,
+					IdleConnTimeout:     caddy.Duration(90 * time.Second),
+					KeepAlive:           caddy.Duration(15 * time.Second),
+					TLSHandshakeTimeout: caddy.Duration(5 * time.Second),
+					DisableHTTP2:        true,
+				},
+			},
+			input: `crowdsec {
+					api_url http://127.0.0.1:8080 
+					api_key some_random_key
+					client {
+						max_idle_conns 200
+						max_idle_conns_per_host 50
+						idle_conn_timeout 90s
+						keepalive 15s
+						tls_handshake_timeout 5s
+						disable_http2
+					}
+				}`,
+			wantParseErr: false,
+		},
+		{
+			name:     "fail/client",
+			expected: &CrowdSec{},
+			input: `crowdsec {
+					api_url http://127.0.0.1:8080 
+					api_key some_random_key
+					client {
+						max_idle_conns many
+					}
+				}`,
+			wantParseErr: true,
+		},
+		{
+			name: "ok/durations",
+			expected: &CrowdSec{
+				APIUrl:            "http://127.0.0.1:8080/",
+				APIKey:            "some_random_key",
+				TickerInterval:    "1m30s",
+				EnableStreaming:   &tv,
+				EnableHardFails:   &fv,
+				AppSecTimeout:     caddy.Duration(2 * time.Second),
+				BlocklistInterval: caddy.Duration(24 * time.Hour),
+			},
+			input: `crowdsec {
+					api_url http://127.0.0.1:8080 
+					api_key some_random_key
+					ticker_interval 90
+					appsec_timeout 2
+					blocklist_interval 1d
+				}`,
+			wantParseErr: false,
+		},
+		{
+			name:     "fail/negative-duration",
+			expected: &CrowdSec{},
+			input: `crowdsec {
+					api_url http://127.0.0.1:8080 
+					api_key some_random_key
+					appsec_timeout -1s
+				}`,
+			wantParseErr: true,
+		},
+		{
+			name:     "fail/invalid-appsec-max-retries",
+			expected: &CrowdSec{},
+			input: `crowdsec {
+					api_url http://127.0.0.1:8080 
+					api_key some_random_key
+					appsec_max_retries many
+				}`,
+			wantParseErr: true,
+		},
+		{
+			name:     "fail/missing-denylist-values",
+			expected: &CrowdSec{},
+			input: `crowdsec {
+					api_url http://127.0.0.1:8080 
+					api_key some_random_key
+					denylist
+				}`,
+			wantParseErr: true,
+		},
+		{
+			name: "ok/denylist",
+			expected: &CrowdSec{
+				APIUrl:          "http://127.0.0.1:8080/",
+				APIKey:          "some_random_key",
+				EnableStreaming: &tv,
+				EnableHardFails: &fv,
+				Denylist:        []string{"10.0.0.1", "10.1.0.0/16", "2001:db8::/32"},
+				DenylistType:    "captcha",
+			},
+			input: `crowdsec {
+					api_url http://127.0.0.1:8080 
+					api_key some_random_key
+					denylist 10.0.0.1 10.1.0.0/16
+					denylist 2001:db8::/32
+					denylist_type captcha
+				}`,
+			wantParseErr: false,
+		},
+		{
+			name: "ok/admin-rate-limit",
+			expected: &CrowdSec{
+				APIUrl:          "http://127.0.0.1:8080/",
+				APIKey:          "some_random_key",
+				EnableStreaming: &tv,
+				EnableHardFails: &fv,
+				AdminRateLimit:  0.5,
+				AdminRateBurst:  5,
+			},
+			input: `crowdsec {
+					api_url http://127.0.0.1:8080 
+					api_key some_random_key
+					admin_rate_limit 0.5 5
+				}`,
+			wantParseErr: false,
+		},
+		{
+			name:     "fail/invalid-admin-rate-limit",
+			expected: &CrowdSec{},
+			input: `crowdsec {
+					api_url http://127.0.0.1:8080 
+					api_key some_random_key
+					admin_rate_limit fast
+				}`,
+			wantParseErr: true,
+		},
+		{
+			name: "ok/appsec-block",
+			expected: &CrowdSec{
+				APIUrl:                        "http://127.0.0.1:8080/",
+				APIKey:                        "some_random_key",
+				EnableStreaming:               &tv,
+				EnableHardFails:               &fv,
+				AppSecUrl:                     "http://127.0.0.1:7422",
+				AppSecAPIKey:                  "appsec_key",
+				AppSecMaxBodySize:             1024,
+				AppSecTimeout:                 caddy.Duration(2 * time.Second),
+				AppSecFailurePolicy:           "status:503",
+				AppSecMaxRetries:              1,
+				AppSecHeaderAllowlist:         []string{"User-Agent", "Content-Type", "Cookie"},
+				AppSecHeaderDenylist:          []string{"X-Internal-Token"},
+				AppSecMode:                    "async",
+				AppSecQueueSize:               500,
+				AppSecMaxConcurrency:          64,
+				AppSecMaxQueued:               16,
+				AppSecOverflowPolicy:          "closed",
+				AppSecBlockSuspiciousUpgrades: true,
+				AppSecExclude: []*AppSecExclusion{
+					{Paths: []string{"/health", "/uploads/*"}, Methods: []string{"OPTIONS"}},
+					{ContentTypes: []string{"application/octet-stream", "image/*"}, MaxContentLength: 10485760},
+				},
+				AppSecJail: &AppSecJail{
+					Threshold: 5,
+					Window:    caddy.Duration(10 * time.Minute),
+					Duration:  caddy.Duration(2 * time.Hour),
+				},
+			},
+			input: `crowdsec {
+					api_url http://127.0.0.1:8080 
+					api_key some_random_key
+					appsec {
+						url http://127.0.0.1:7422
+						api_key appsec_key
+						max_body_size 1024
+						timeout 2s
+						failure_policy status:503
+						max_retries 1
+						header_allowlist User-Agent Content-Type
+						header_allowlist Cookie
+						header_denylist X-Internal-Token
+						mode async
+						queue_size 500
+						max_concurrency 64
+						max_queued 16
+						overflow_policy closed
+						block_suspicious_upgrades
+						exclude {
+							path /health /uploads/*
+							method OPTIONS
+						}
+						jail {
+							threshold 5
+							window 10m
+							duration 2h
+						}
+					}
+					appsec_exclude {
+						content_type application/octet-stream image/*
+						max_content_length 10485760
+					}
+				}`,
+			wantParseErr: false,
+		},
+		{
+			name: "ok/appsec-options",
+			expected: &CrowdSec{
+				APIUrl:            "http://127.0.0.1:8080/",
+				APIKey:            "some_random_key",
+				EnableStreaming:   &tv,
+				EnableHardFails:   &fv,
+				AppSecUrl:         "http://127.0.0.1:7422",
+				AppSecAPIKey:      "appsec_key",
+				AppSecMaxBodySize: 2048,
+				AppSecTimeout:     caddy.Duration(5 * time.Second),
+			},
+			input: `crowdsec {
+					api_url http://127.0.0.1:8080 
+					api_key some_random_key
+					appsec_url http://127.0.0.1:7422
+					appsec_api_key appsec_key
+					appsec_max_body_bytes 2048
+					appsec_timeout 5s
+				}`,
+			wantParseErr: false,
+		},
+		{
+			name:     "fail/appsec-block-unknown-token",
+			expected: &CrowdSec{},
+			input: `crowdsec {
+					api_url http://127.0.0.1:8080 
+					api_key some_random_key
+					appsec {
+						unknown 42
+					}
+				}`,
+			wantParseErr: true,
+		},
+		{
+			name:     "fail/appsec-jail-invalid-threshold",
+			expected: &CrowdSec{},
+			input: `crowdsec {
+					api_url http://127.0.0.1:8080
+					api_key some_random_key
+					appsec_jail {
+						threshold many
+					}
+				}`,
+			wantParseErr: true,
+		},
+		{
+			name:     "fail/appsec-block-too-many-args",
+			expected: &CrowdSec{},
+			input: `crowdsec {
+					api_url http://127.0.0.1:8080 
+					api_key some_random_key
+					appsec {
+						timeout 1s 2s
+					}
+				}`,
+			wantParseErr: true,
+		},
+		{
+			name: "ok/webhook-blocked-log",
+			expected: &CrowdSec{
+				APIUrl:          "http://127.0.0.1:8080/",
+				APIKey:          "some_random_key",
+				EnableStreaming: &tv,
+				EnableHardFails: &fv,
+				BlockedLog:      true,
+				Webhook: &Webhook{
+					URL:           "https://hooks.example.com/crowdsec",
+					Events:        []string{"remediation", "decision_added"},
+					Template:      `{"text": "{{ len .Events }} events"}`,
+					BatchSize:     10,
+					BatchInterval: caddy.Duration(time.Minute),
+					RateLimit:     2,
+				},
+			},
+			input: `crowdsec {
+					api_url http://127.0.0.1:8080
+					api_key some_random_key
+					blocked_log
+					webhook https://hooks.example.com/crowdsec {
+						events remediation decision_added
+						template ` + "`" + `{"text": "{{ len .Events }} events"}` + "`" + `
+						batch_size 10
+						batch_interval 1m
+						rate_limit 2
+					}
+				}`,
+			wantParseErr: false,
+		},
+		{
+			name: "ok/intervals",
+			expected: &CrowdSec{
+				APIUrl:          "http://127.0.0.1:8080/",
+				APIKey:          "some_random_key",
+				EnableStreaming: &tv,
+				EnableHardFails: &fv,
+				MetricsInterval: new(caddy.Duration),
+				SummaryInterval: caddy.Duration(10 * time.Minute),
+			},
+			input: `crowdsec {
+					api_url http://127.0.0.1:8080
+					api_key some_random_key
+					metrics_interval off
+					summary_interval 10m
+				}`,
+			wantParseErr: false,
+		},
+		{
+			name: "ok/decision-logging",
+			expected: &CrowdSec{
+				APIUrl:               "http://127.0.0.1:8080/",
+				APIKey:               "some_random_key",
+				EnableStreaming:      &tv,
+				EnableHardFails:      &fv,
+				DecisionLogThreshold: new(int),
+				LogManualDecisions:   true,
+			},
+			input: `crowdsec {
+					api_url http://127.0.0.1:8080
+					api_key some_random_key
+					decision_log_threshold 0
+					log_manual_decisions
+				}`,
+			wantParseErr: false,
+		},
+		{
+			name:     "fail/invalid-decision-log-threshold",
+			expected: &CrowdSec{},
+			input: `crowdsec {
+					api_url http://127.0.0.1:8080
+					api_key some_random_key
+					decision_log_threshold many
+				}`,
+			wantParseErr: true,
+		},
+		{
+			name: "ok/capi",
+			expected: &CrowdSec{
+				EnableStreaming: &tv,
+				EnableHardFails: &fv,
+				CAPI: &CAPI{
+					MachineID: "machine",
+					Password:  "{env.CROWDSEC_CAPI_PASSWORD}",
+					Scenarios: []string{"crowdsecurity/http-probing", "crowdsecurity/http-crawl-non_statics"},
+				},
+			},
+			input: `crowdsec {
+					capi {
+						machine_id machine
+						password {env.CROWDSEC_CAPI_PASSWORD}
+						scenarios crowdsecurity/http-probing crowdsecurity/http-crawl-non_statics
+					}
+				}`,
+			wantParseErr: false,
+		},
+		{
+			name:     "fail/capi-unknown-token",
+			expected: &CrowdSec{},
+			input: `crowdsec {
+					capi {
+						login machine
+					}
+				}`,
+			wantParseErr: true,
+		},
+		{
+			name: "ok/blocklists",
+			expected: &CrowdSec{
+				APIUrl:            "http://127.0.0.1:8080/",
+				APIKey:            "some_random_key",
+				EnableStreaming:   &tv,
+				EnableHardFails:   &fv,
+				Blocklists:        []string{"https://iplists.firehol.org/files/firehol_level1.netset", "https://www.spamhaus.org/drop/drop.txt"},
+				BlocklistType:     "captcha",
+				BlocklistInterval: caddy.Duration(6 * time.Hour),
+				BlocklistRollup:   true,
+			},
+			input: `crowdsec {
+					api_url http://127.0.0.1:8080
+					api_key some_random_key
+					blocklists https://iplists.firehol.org/files/firehol_level1.netset
+					blocklists https://www.spamhaus.org/drop/drop.txt
+					blocklist_type captcha
+					blocklist_interval 6h
+					blocklist_rollup
+				}`,
+			wantParseErr: false,
+		},
+		{
+			name:     "fail/invalid-blocklist-interval",
+			expected: &CrowdSec{},
+			input: `crowdsec {
+					api_url http://127.0.0.1:8080
+					api_key some_random_key
+					blocklists https://www.spamhaus.org/drop/drop.txt
+					blocklist_interval daily
+				}`,
+			wantParseErr: true,
+		},
+		{
+			name: "ok/instance-name",
+			expected: &CrowdSec{
+				APIUrl:          "http://127.0.0.1:8080/",
+				APIKey:          "some_random_key",
+				EnableStreaming: &tv,
+				EnableHardFails: &fv,
+				InstanceName:    "web-1",
+			},
+			input: `crowdsec {
+					api_url http://127.0.0.1:8080
+					api_key some_random_key
+					instance_name web-1
 				}`,
 			wantParseErr: false,
 		},
+		{
+			name:     "fail/instance-name-missing",
+			expected: &CrowdSec{},
+			input: `crowdsec {
+					api_url http://127.0.0.1:8080
+					api_key some_random_key
+					instance_name
+				}`,
+			wantParseErr: true,
+		},
+		{
+			name: "ok/feeds",
+			expected: &CrowdSec{
+				APIUrl:          "http://127.0.0.1:8080/",
+				APIKey:          "some_random_key",
+				EnableStreaming: &tv,
+				EnableHardFails: &fv,
+				Feeds: []*Feed{
+					{Name: "customer-a", APIUrl: "https://lapi.customer-a.example.com", APIKey: "key-a"},
+					{Name: "customer-b", APIUrl: "https://lapi.customer-b.example.com", APIKey: "{env.CUSTOMER_B_KEY}"},
+				},
+			},
+			input: `crowdsec {
+					api_url http://127.0.0.1:8080
+					api_key some_random_key
+					feed customer-a https://lapi.customer-a.example.com key-a
+					feed customer-b https://lapi.customer-b.example.com {env.CUSTOMER_B_KEY}
+				}`,
+			wantParseErr: false,
+		},
+		{
+			name:     "fail/feed-missing-api-key",
+			expected: &CrowdSec{},
+			input: `crowdsec {
+					api_url http://127.0.0.1:8080
+					api_key some_random_key
+					feed customer-a https://lapi.customer-a.example.com
+				}`,
+			wantParseErr: true,
+		},
+		{
+			name: "ok/blocklist-mirror",
+			expected: &CrowdSec{
+				EnableStreaming: &tv,
+				EnableHardFails: &fv,
+				BlocklistMirror: &BlocklistMirror{
+					URL:    "http://mirror.example.com:41412/security/blocklist",
+					APIKey: "{env.MIRROR_API_KEY}",
+					Type:   "captcha",
+				},
+			},
+			input: `crowdsec {
+					blocklist_mirror http://mirror.example.com:41412/security/blocklist {
+						api_key {env.MIRROR_API_KEY}
+						type captcha
+					}
+				}`,
+			wantParseErr: false,
+		},
+		{
+			name:     "fail/blocklist-mirror-missing-url",
+			expected: &CrowdSec{},
+			input: `crowdsec {
+					blocklist_mirror {
+						type captcha
+					}
+				}`,
+			wantParseErr: true,
+		},
+		{
+			name: "ok/snapshot",
+			expected: &CrowdSec{
+				APIUrl:          "http://127.0.0.1:8080/",
+				APIKey:          "some_random_key",
+				EnableStreaming: &tv,
+				EnableHardFails: &fv,
+				Snapshot: &BlocklistMirror{
+					URL:    "https://leader.example.com/crowdsec/decisions",
+					APIKey: "{env.EXPORT_API_KEY}",
+				},
+			},
+			input: `crowdsec {
+					api_url http://127.0.0.1:8080
+					api_key some_random_key
+					snapshot https://leader.example.com/crowdsec/decisions {
+						api_key {env.EXPORT_API_KEY}
+					}
+				}`,
+			wantParseErr: false,
+		},
+		{
+			name:     "fail/snapshot-invalid-option",
+			expected: &CrowdSec{},
+			input: `crowdsec {
+					api_url http://127.0.0.1:8080
+					api_key some_random_key
+					snapshot https://leader.example.com/crowdsec/decisions {
+						interval 10s
+					}
+				}`,
+			wantParseErr: true,
+		},
+		{
+			name: "ok/cti",
+			expected: &CrowdSec{
+				APIUrl:          "http://127.0.0.1:8080/",
+				APIKey:          "some_random_key",
+				EnableStreaming: &tv,
+				EnableHardFails: &fv,
+				BlockedLog:      true,
+				CTI: &CTI{
+					APIKey:    "{env.CROWDSEC_CTI_API_KEY}",
+					CacheTTL:  caddy.Duration(12 * time.Hour),
+					CacheSize: 500,
+					RateLimit: 10,
+				},
+			},
+			input: `crowdsec {
+					api_url http://127.0.0.1:8080
+					api_key some_random_key
+					blocked_log
+					cti {env.CROWDSEC_CTI_API_KEY} {
+						cache_ttl 12h
+						cache_size 500
+						rate_limit 10
+					}
+				}`,
+			wantParseErr: false,
+		},
+		{
+			name:     "fail/cti-missing-api-key",
+			expected: &CrowdSec{},
+			input: `crowdsec {
+					api_url http://127.0.0.1:8080
+					api_key some_random_key
+					cti
+				}`,
+			wantParseErr: true,
+		},
+		{
+			name: "ok/alerts",
+			expected: &CrowdSec{
+				APIUrl:          "http://127.0.0.1:8080/",
+				APIKey:          "some_random_key",
+				EnableStreaming: &tv,
+				EnableHardFails: &fv,
+				Alerts: &Alerts{
+					MachineID:        "caddy",
+					Password:         "{env.CROWDSEC_MACHINE_PASSWORD}",
+					DecisionDuration: caddy.Duration(-1),
+				},
+			},
+			input: `crowdsec {
+					api_url http://127.0.0.1:8080
+					api_key some_random_key
+					alerts {
+						machine_id caddy
+						password {env.CROWDSEC_MACHINE_PASSWORD}
+						decision_duration off
+					}
+				}`,
+			wantParseErr: false,
+		},
+		{
+			name:     "fail/alerts-invalid-decision-duration",
+			expected: &CrowdSec{},
+			input: `crowdsec {
+					api_url http://127.0.0.1:8080
+					api_key some_random_key
+					alerts {
+						machine_id caddy
+						password secret
+						decision_duration forever
+					}
+				}`,
+			wantParseErr: true,
+		},
+		{
+			name: "ok/auto-ban",
+			expected: &CrowdSec{
+				APIUrl:          "http://127.0.0.1:8080/",
+				APIKey:          "some_random_key",
+				EnableStreaming: &tv,
+				EnableHardFails: &fv,
+				AutoBan: &AutoBan{
+					Threshold: 20,
+					Window:    caddy.Duration(time.Minute),
+					Statuses:  []int{404, 410},
+					Type:      "captcha",
+					Duration:  caddy.Duration(30 * time.Minute),
+				},
+			},
+			input: `crowdsec {
+					api_url http://127.0.0.1:8080
+					api_key some_random_key
+					auto_ban {
+						threshold 20
+						window 1m
+						status 404 410
+						type captcha
+						duration 30m
+					}
+				}`,
+			wantParseErr: false,
+		},
+		{
+			name:     "fail/auto-ban-invalid-status",
+			expected: &CrowdSec{},
+			input: `crowdsec {
+					api_url http://127.0.0.1:8080
+					api_key some_random_key
+					auto_ban {
+						threshold 20
+						window 1m
+						status not-found
+					}
+				}`,
+			wantParseErr: true,
+		},
+		{
+			name:     "fail/invalid-metrics-interval",
+			expected: &CrowdSec{},
+			input: `crowdsec {
+					api_url http://127.0.0.1:8080
+					api_key some_random_key
+					metrics_interval never
+				}`,
+			wantParseErr: true,
+		},
+		{
+			name:     "fail/webhook-unknown-token",
+			expected: &CrowdSec{},
+			input: `crowdsec {
+					api_url http://127.0.0.1:8080
+					api_key some_random_key
+					webhook https://hooks.example.com/crowdsec {
+						unknown 42
+					}
+				}`,
+			wantParseErr: true,
+		},
 		{
 			name: "ok/env-vars",
 			expected: &CrowdSec{
@@ -206,6 +926,46 @@ func TestUnmarshalCaddyfile(t *testing.T) {
 			assert.Equal(t, tt.expected.TickerInterval, c.TickerInterval)
 			assert.Equal(t, tt.expected.isStreamingEnabled(), c.isStreamingEnabled())
 			assert.Equal(t, tt.expected.shouldFailHard(), c.shouldFailHard())
+			assert.Equal(t, tt.expected.AppSecUrl, c.AppSecUrl)
+			assert.Equal(t, tt.expected.AppSecAPIKey, c.AppSecAPIKey)
+			assert.Equal(t, tt.expected.AppSecMaxBodySize, c.AppSecMaxBodySize)
+			assert.Equal(t, tt.expected.AppSecTimeout, c.AppSecTimeout)
+			assert.Equal(t, tt.expected.AppSecFailurePolicy, c.AppSecFailurePolicy)
+			assert.Equal(t, tt.expected.AppSecMaxRetries, c.AppSecMaxRetries)
+			assert.Equal(t, tt.expected.AppSecRetryBackoff, c.AppSecRetryBackoff)
+			assert.Equal(t, tt.expected.AppSecHealthCheckInterval, c.AppSecHealthCheckInterval)
+			assert.Equal(t, tt.expected.AppSecHeaderAllowlist, c.AppSecHeaderAllowlist)
+			assert.Equal(t, tt.expected.AppSecHeaderDenylist, c.AppSecHeaderDenylist)
+			assert.Equal(t, tt.expected.AppSecExclude, c.AppSecExclude)
+			assert.Equal(t, tt.expected.AppSecJail, c.AppSecJail)
+			assert.Equal(t, tt.expected.AppSecMode, c.AppSecMode)
+			assert.Equal(t, tt.expected.AppSecQueueSize, c.AppSecQueueSize)
+			assert.Equal(t, tt.expected.AppSecCacheTTL, c.AppSecCacheTTL)
+			assert.Equal(t, tt.expected.AppSecCacheSize, c.AppSecCacheSize)
+			assert.Equal(t, tt.expected.AppSecMaxConcurrency, c.AppSecMaxConcurrency)
+			assert.Equal(t, tt.expected.AppSecMaxQueued, c.AppSecMaxQueued)
+			assert.Equal(t, tt.expected.AppSecOverflowPolicy, c.AppSecOverflowPolicy)
+			assert.Equal(t, tt.expected.AppSecBlockSuspiciousUpgrades, c.AppSecBlockSuspiciousUpgrades)
+			assert.Equal(t, tt.expected.Denylist, c.Denylist)
+			assert.Equal(t, tt.expected.DenylistType, c.DenylistType)
+			assert.Equal(t, tt.expected.Blocklists, c.Blocklists)
+			assert.Equal(t, tt.expected.BlocklistType, c.BlocklistType)
+			assert.Equal(t, tt.expected.BlocklistInterval, c.BlocklistInterval)
+			assert.Equal(t, tt.expected.BlockedLog, c.BlockedLog)
+			assert.Equal(t, tt.expected.CTI, c.CTI)
+			assert.Equal(t, tt.expected.Alerts, c.Alerts)
+			assert.Equal(t, tt.expected.AutoBan, c.AutoBan)
+			assert.Equal(t, tt.expected.Client, c.Client)
+			assert.Equal(t, tt.expected.ModuleWarnings, c.ModuleWarnings)
+			assert.Equal(t, tt.expected.APIHeaders, c.APIHeaders)
+			assert.Equal(t, tt.expected.MetricsInterval, c.MetricsInterval)
+			assert.Equal(t, tt.expected.SummaryInterval, c.SummaryInterval)
+			assert.Equal(t, tt.expected.Webhook, c.Webhook)
+			assert.Equal(t, tt.expected.CAPI, c.CAPI)
+			assert.Equal(t, tt.expected.Feeds, c.Feeds)
+			assert.Equal(t, tt.expected.InstanceName, c.InstanceName)
+			assert.Equal(t, tt.expected.BlocklistMirror, c.BlocklistMirror)
+			assert.Equal(t, tt.expected.Snapshot, c.Snapshot)
 		})
 	}
 }
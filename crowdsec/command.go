@@ -0,0 +1,590 @@
+// Copyright 2024 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package crowdsec
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	caddycmd "github.com/caddyserver/caddy/v2/cmd"
+	"github.com/spf13/cobra"
+
+	"github.com/hslatman/caddy-crowdsec-bouncer/internal/bouncer"
+	"github.com/hslatman/caddy-crowdsec-bouncer/internal/version"
+)
+
+func init() {
+	caddycmd.RegisterCommand(caddycmd.Command{
+		Name:  "crowdsec",
+		Usage: "<command>",
+		Short: "Commands for interacting with the CrowdSec app",
+		Long: `
+Commands for interacting with the CrowdSec app of a running Caddy instance.
+The commands use the Caddy admin API, which must be enabled.
+
+Results are printed as a table by default, or as JSON or YAML using the
+--output flag. With --quiet, results aren't printed, so that only the exit
+status can be used in scripts.
+
+The admin API address is determined from the --address flag, from the
+config file given by --config, or defaults to the default admin address.
+
+The version of the CrowdSec app that Caddy was built with is printed
+using --version.`,
+		CobraFunc: func(cmd *cobra.Command) {
+			cmd.Version = version.Current()
+			cmd.SetVersionTemplate("{{ .Version }}\n")
+			cmd.PersistentFlags().String("address", "", "The address to use to reach the admin API endpoint, if not the default")
+			cmd.PersistentFlags().StringP("config", "c", "", "Configuration file to use to parse the admin address, if --address is not used")
+			cmd.PersistentFlags().StringP("adapter", "a", "", "Name of config adapter to apply (when --config is used)")
+			cmd.PersistentFlags().StringP("output", "o", outputTable, "Output format; one of table, json or yaml")
+			cmd.PersistentFlags().BoolP("quiet", "q", false, "Don't print results; only errors are printed")
+
+			cmd.AddCommand(&cobra.Command{
+				Use:   "check [<ip>...]",
+				Short: "Checks if IPs are allowed",
+				Long: `
+Checks if IPs are allowed by the CrowdSec app of the running Caddy
+instance, and prints the result and the reason for each IP. The IPs are
+read from the arguments, or, if there are none or the only argument is
+"-", from stdin, one IP per line. Empty lines are ignored, so that a list
+of IPs from logs can be triaged using:
+
+	awk '{print $1}' access.log | sort -u | caddy crowdsec check
+
+With --quiet, the command fails if any of the IPs is blocked, or
+couldn't be checked.`,
+				RunE: cmdCheck,
+			})
+
+			cmd.AddCommand(&cobra.Command{
+				Use:   "enforcement [enforce|simulate|off]",
+				Short: "Shows or changes the enforcement mode",
+				Long: `
+Shows the current enforcement mode if no mode is provided. Otherwise
+the enforcement mode is changed to the provided mode, which is one of
+"enforce", "simulate" or "off". The mode is reset when the config is
+reloaded.`,
+				Args: cobra.MaximumNArgs(1),
+				RunE: cmdEnforcement,
+			})
+
+			cmd.AddCommand(&cobra.Command{
+				Use:   "mode [streaming|live]",
+				Short: "Shows or changes how decisions are looked up",
+				Long: `
+Shows whether decisions are streamed from the CrowdSec Local API, or
+looked up live, if no mode is provided. Otherwise the mode is changed
+to the provided mode, which is one of "streaming" or "live". The mode
+is reset when the config is reloaded.`,
+				Args: cobra.MaximumNArgs(1),
+				RunE: cmdMode,
+			})
+
+			simulate := &cobra.Command{
+				Use:   "simulate <ip> [--method <method>] [--host <host>] [--path <path>]",
+				Short: "Shows what the crowdsec handlers would do for a request",
+				Long: `
+Shows what each of the crowdsec HTTP handlers of the running Caddy
+instance would do for a request from an IP, without serving the request.
+The result includes whether the request is exempt, the decision that
+matches, and the remediation and status code that would be served.`,
+				Args: cobra.ExactArgs(1),
+				RunE: cmdSimulate,
+			}
+			simulate.Flags().String("method", http.MethodGet, "Method of the request")
+			simulate.Flags().String("host", "localhost", "Host of the request")
+			simulate.Flags().String("path", "/", "Path of the request, optionally with a query")
+			cmd.AddCommand(simulate)
+
+			metrics := &cobra.Command{
+				Use:   "metrics",
+				Short: "Shows the metrics of the CrowdSec app",
+				Long: `
+Shows the counters kept by the CrowdSec app of the running Caddy instance,
+including the number of decisions known to it, the decisions added and
+deleted, the remediations served, and the calls to the CrowdSec Local API
+and the AppSec component.`,
+				Args: cobra.NoArgs,
+				RunE: cmdMetrics,
+			}
+			metrics.Flags().Bool("json", false, "Print the metrics as JSON")
+			_ = metrics.Flags().MarkDeprecated("json", "use --output json instead")
+			cmd.AddCommand(metrics)
+
+			tail := &cobra.Command{
+				Use:   "tail",
+				Short: "Prints decision and remediation events as they happen",
+				Long: `
+Prints the decisions being added to and deleted from the CrowdSec app of
+the running Caddy instance, and the remediations being served, as they
+happen. With --output json, the events are printed as newline delimited
+JSON, which can be processed further using tools like jq.`,
+				Args: cobra.NoArgs,
+				RunE: cmdTail,
+			}
+			tail.Flags().Bool("json", false, "Print the events as newline delimited JSON")
+			_ = tail.Flags().MarkDeprecated("json", "use --output json instead")
+			cmd.AddCommand(tail)
+
+			ban := &cobra.Command{
+				Use:   "ban <ip|cidr> [--duration <duration>] [--reason <reason>]",
+				Short: "Bans an IP or CIDR",
+				Long: `
+Adds a local ban decision for an IP or CIDR to the CrowdSec app of the
+running Caddy instance. Local decisions are enforced immediately, in
+both streaming and live mode, but they're not sent to the CrowdSec
+Local API. They're removed when they expire, and when the config is
+reloaded.`,
+				Args: cobra.ExactArgs(1),
+				RunE: cmdBan,
+			}
+			ban.Flags().String("duration", defaultBanDuration, "Duration of the ban, i.e. 30m, 1h or 7d")
+			ban.Flags().String("reason", "", "Reason for the ban")
+			cmd.AddCommand(ban)
+
+			cmd.AddCommand(&cobra.Command{
+				Use:   "unban <ip|cidr>",
+				Short: "Removes the ban for an IP or CIDR",
+				Long: `
+Removes the local decision for an IP or CIDR, which was added using the
+ban command. Decisions from CrowdSec can't be removed; use cscli to
+remove those.`,
+				Args: cobra.ExactArgs(1),
+				RunE: cmdUnban,
+			})
+
+			decisions := &cobra.Command{
+				Use:   "decisions",
+				Short: "Commands for the decisions known to the CrowdSec app",
+			}
+			list := &cobra.Command{
+				Use:   "list [--type <type>] [--origin <origin>] [--scope <scope>] [--contains <ip>]",
+				Short: "Lists the decisions known to the CrowdSec app",
+				Long: `
+Lists the active decisions held by the CrowdSec app of the running Caddy
+instance, including the ones on the local denylist and the ones added
+using the ban command. This requires the app
+to be in streaming mode.`,
+				Args: cobra.NoArgs,
+				RunE: cmdDecisionsList,
+			}
+			list.Flags().String("type", "", "Only list decisions of this type, i.e. ban")
+			list.Flags().String("origin", "", "Only list decisions from this origin, i.e. crowdsec or CAPI")
+			list.Flags().String("scope", "", "Only list decisions with this scope, i.e. ip or range")
+			list.Flags().String("contains", "", "Only list decisions that apply to this IP")
+			decisions.AddCommand(list)
+			cmd.AddCommand(decisions)
+		},
+	})
+}
+
+func cmdCheck(cmd *cobra.Command, args []string) error {
+	p, err := newPrinter(cmd)
+	if err != nil {
+		return err
+	}
+
+	ips := args
+	if len(args) == 0 || (len(args) == 1 && args[0] == "-") {
+		ips = nil
+		scanner := bufio.NewScanner(cmd.InOrStdin())
+		for scanner.Scan() {
+			if line := strings.TrimSpace(scanner.Text()); line != "" {
+				ips = append(ips, line)
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return fmt.Errorf("failed reading IPs: %w", err)
+		}
+	}
+
+	results := checkBatchResponse{Results: make([]checkResponse, 0, len(ips))}
+	for start := 0; start < len(ips); start += maxCheckIPs {
+		chunk := ips[start:min(start+maxCheckIPs, len(ips))]
+
+		var resp checkBatchResponse
+		if err := adminRequest(cmd, http.MethodPost, adminEndpointBase+"check", checkRequest{IPs: chunk}, &resp); err != nil {
+			return err
+		}
+		results.Results = append(results.Results, resp.Results...)
+	}
+
+	if p.quiet {
+		blocked := 0
+		for _, r := range results.Results {
+			if r.Blocked || r.Error != "" {
+				blocked++
+			}
+		}
+		if blocked > 0 {
+			return fmt.Errorf("%d of %d IPs are blocked or couldn't be checked", blocked, len(results.Results))
+		}
+	}
+
+	return p.print(results, func(tw *tabwriter.Writer) {
+		fmt.Fprintln(tw, "IP\tRESULT\tREASON")
+		for _, r := range results.Results {
+			result, reason := "allowed", r.Reason
+			switch {
+			case r.Error != "":
+				result, reason = "error", r.Error
+			case r.Blocked:
+				result = "blocked"
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\n", r.IP, result, reason)
+		}
+	})
+}
+
+func cmdEnforcement(cmd *cobra.Command, args []string) error {
+	p, err := newPrinter(cmd)
+	if err != nil {
+		return err
+	}
+
+	var (
+		method = http.MethodGet
+		body   any
+	)
+	if len(args) > 0 {
+		method = http.MethodPost
+		body = enforcementRequest{Mode: args[0]}
+	}
+
+	var resp enforcementResponse
+	if err := adminRequest(cmd, method, adminEndpointBase+"enforcement", body, &resp); err != nil {
+		return err
+	}
+
+	return p.print(resp, func(tw *tabwriter.Writer) {
+		fmt.Fprintf(tw, "enforcement mode: %s\n", resp.Mode)
+	})
+}
+
+func cmdMode(cmd *cobra.Command, args []string) error {
+	p, err := newPrinter(cmd)
+	if err != nil {
+		return err
+	}
+
+	var (
+		method = http.MethodGet
+		body   any
+	)
+	if len(args) > 0 {
+		method = http.MethodPost
+		body = modeRequest{Mode: args[0]}
+	}
+
+	var resp modeResponse
+	if err := adminRequest(cmd, method, adminEndpointBase+"mode", body, &resp); err != nil {
+		return err
+	}
+
+	return p.print(resp, func(tw *tabwriter.Writer) {
+		fmt.Fprintf(tw, "mode: %s\n", resp.Mode)
+	})
+}
+
+func cmdSimulate(cmd *cobra.Command, args []string) error {
+	p, err := newPrinter(cmd)
+	if err != nil {
+		return err
+	}
+
+	method, _ := cmd.Flags().GetString("method")
+	host, _ := cmd.Flags().GetString("host")
+	path, _ := cmd.Flags().GetString("path")
+
+	var resp simulateResponse
+	if err := adminRequest(cmd, http.MethodPost, adminEndpointBase+"simulate", simulateRequest{IP: args[0], Method: method, Host: host, Path: path}, &resp); err != nil {
+		return err
+	}
+
+	return p.print(resp, func(tw *tabwriter.Writer) {
+		if len(resp.Handlers) == 0 {
+			fmt.Fprintln(tw, "no crowdsec handlers configured")
+			return
+		}
+
+		fmt.Fprintln(tw, "HANDLER\tRESULT\tREMEDIATION\tSTATUS\tDECISION")
+		for i, s := range resp.Handlers {
+			result := "blocked"
+			switch {
+			case s.Exempt:
+				result = "exempt"
+			case s.Allowed:
+				result = "allowed"
+			case s.Error != "" && s.StatusCode == 0:
+				result = "error: " + s.Error
+			}
+
+			status, decision := "-", "-"
+			if s.StatusCode != 0 {
+				status = strconv.Itoa(s.StatusCode)
+			}
+			if d := s.Decision; d != nil {
+				decision = fmt.Sprintf("%s %s by %s (%s)", d.Type, d.Value, d.Scenario, d.Origin)
+			}
+
+			fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\n", i+1, result, cmp.Or(s.Remediation, "-"), status, decision)
+		}
+	})
+}
+
+func cmdMetrics(cmd *cobra.Command, _ []string) error {
+	p, err := newPrinter(cmd)
+	if err != nil {
+		return err
+	}
+
+	var m bouncer.Metrics
+	if err := adminRequest(cmd, http.MethodGet, adminEndpointBase+"metrics", nil, &m); err != nil {
+		return err
+	}
+
+	return p.print(m, func(tw *tabwriter.Writer) {
+		lastSync := "never"
+		if m.LastSync != nil {
+			lastSync = m.LastSync.Local().Format(time.RFC3339)
+		}
+
+		fmt.Fprintln(tw, "METRIC\tVALUE")
+		fmt.Fprintf(tw, "decisions\t%d\n", m.Decisions)
+		fmt.Fprintf(tw, "decisions added\t%d\n", m.DecisionsAdded)
+		fmt.Fprintf(tw, "decisions deleted\t%d\n", m.DecisionsDeleted)
+		fmt.Fprintf(tw, "decision failures\t%d\n", m.DecisionFailures)
+		fmt.Fprintf(tw, "last sync\t%s\n", lastSync)
+		types := make([]string, 0, len(m.Remediations))
+		for typ := range m.Remediations {
+			types = append(types, typ)
+		}
+		slices.Sort(types)
+		for _, typ := range types {
+			fmt.Fprintf(tw, "remediations (%s)\t%d\n", typ, m.Remediations[typ])
+		}
+		fmt.Fprintf(tw, "lapi calls\t%d\n", m.LAPICalls)
+		fmt.Fprintf(tw, "lapi errors\t%d\n", m.LAPIErrors)
+		fmt.Fprintf(tw, "appsec calls\t%d\n", m.AppSecCalls)
+		fmt.Fprintf(tw, "appsec errors\t%d\n", m.AppSecErrors)
+		fmt.Fprintf(tw, "appsec dropped\t%d\n", m.AppSecDropped)
+		fmt.Fprintf(tw, "appsec overflows\t%d\n", m.AppSecOverflows)
+	})
+}
+
+func cmdTail(cmd *cobra.Command, _ []string) error {
+	p, err := newPrinter(cmd)
+	if err != nil {
+		return err
+	}
+
+	resp, err := adminResponse(cmd, http.MethodGet, adminEndpointBase+"events", nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		if p.quiet {
+			continue
+		}
+
+		// events are printed as newline delimited JSON, as received
+		if p.format == outputJSON {
+			fmt.Fprintln(p.w, scanner.Text())
+			continue
+		}
+
+		var e bouncer.Event
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return fmt.Errorf("failed decoding event: %w", err)
+		}
+
+		if p.format == outputYAML {
+			fmt.Fprintln(p.w, "---")
+			if err := p.printYAML(e); err != nil {
+				return err
+			}
+			continue
+		}
+
+		fmt.Fprintln(p.w, formatEvent(e))
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed reading events: %w", err)
+	}
+
+	return nil
+}
+
+// formatEvent formats an event as a single line of text, i.e.
+// "2024-01-01T12:00:00Z added ban 192.0.2.1 by crowdsecurity/ssh-bf (crowdsec) for 4h0m0s".
+func formatEvent(e bouncer.Event) string {
+	ts := e.Time.Local().Format(time.RFC3339)
+	switch {
+	case e.Type == bouncer.EventRemediation:
+		line := fmt.Sprintf("%s served %s to %s", ts, e.Remediation, e.IP)
+		if e.Origin != "" {
+			line += " (" + e.Origin + ")"
+		}
+		return line
+	case e.Decision != nil:
+		action := "added"
+		if e.Type == bouncer.EventDecisionDeleted {
+			action = "deleted"
+		}
+		d := e.Decision
+		line := fmt.Sprintf("%s %s %s %s", ts, action, d.Type, d.Value)
+		if d.Scenario != "" {
+			line += " by " + d.Scenario
+		}
+		if d.Origin != "" {
+			line += " (" + d.Origin + ")"
+		}
+		if d.Duration != "" && e.Type == bouncer.EventDecisionAdded {
+			line += " for " + d.Duration
+		}
+		return line
+	default:
+		return fmt.Sprintf("%s %s", ts, e.Type)
+	}
+}
+
+func cmdBan(cmd *cobra.Command, args []string) error {
+	p, err := newPrinter(cmd)
+	if err != nil {
+		return err
+	}
+
+	duration, _ := cmd.Flags().GetString("duration")
+	reason, _ := cmd.Flags().GetString("reason")
+
+	var resp banResponse
+	if err := adminRequest(cmd, http.MethodPost, adminEndpointBase+"ban", banRequest{Value: args[0], Duration: duration, Reason: reason}, &resp); err != nil {
+		return err
+	}
+
+	return p.print(resp, func(tw *tabwriter.Writer) {
+		fmt.Fprintf(tw, "banned %s for %s\n", resp.Decision.Value, resp.Decision.Duration)
+	})
+}
+
+func cmdUnban(cmd *cobra.Command, args []string) error {
+	p, err := newPrinter(cmd)
+	if err != nil {
+		return err
+	}
+
+	var resp unbanResponse
+	if err := adminRequest(cmd, http.MethodPost, adminEndpointBase+"unban", unbanRequest{Value: args[0]}, &resp); err != nil {
+		return err
+	}
+
+	return p.print(resp, func(tw *tabwriter.Writer) {
+		fmt.Fprintf(tw, "unbanned %s\n", resp.Value)
+	})
+}
+
+func cmdDecisionsList(cmd *cobra.Command, _ []string) error {
+	p, err := newPrinter(cmd)
+	if err != nil {
+		return err
+	}
+
+	query := url.Values{}
+	for _, name := range []string{"type", "origin", "scope", "contains"} {
+		if v, _ := cmd.Flags().GetString(name); v != "" {
+			query.Set(name, v)
+		}
+	}
+
+	uri := adminEndpointBase + "decisions"
+	if len(query) > 0 {
+		uri += "?" + query.Encode()
+	}
+
+	var resp decisionsResponse
+	if err := adminRequest(cmd, http.MethodGet, uri, nil, &resp); err != nil {
+		return err
+	}
+
+	return p.print(resp, func(tw *tabwriter.Writer) {
+		fmt.Fprintln(tw, "VALUE\tSCOPE\tTYPE\tORIGIN\tSCENARIO\tDURATION")
+		for _, d := range resp.Decisions {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", d.Value, d.Scope, d.Type, d.Origin, d.Scenario, d.Duration)
+		}
+	})
+}
+
+// adminRequest performs a request to the admin API of the running
+// Caddy instance, and decodes the JSON response into v.
+func adminRequest(cmd *cobra.Command, method, uri string, body, v any) error {
+	resp, err := adminResponse(cmd, method, uri, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if v == nil {
+		return nil
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("failed decoding response: %w", err)
+	}
+
+	return nil
+}
+
+// adminResponse performs a request to the admin API of the running
+// Caddy instance. The caller must close the response body.
+func adminResponse(cmd *cobra.Command, method, uri string, body any) (*http.Response, error) {
+	address, _ := cmd.Flags().GetString("address")
+	configFile, _ := cmd.Flags().GetString("config")
+	configAdapter, _ := cmd.Flags().GetString("adapter")
+
+	adminAddr, err := caddycmd.DetermineAdminAPIAddress(address, nil, configFile, configAdapter)
+	if err != nil {
+		return nil, fmt.Errorf("failed determining admin address: %w", err)
+	}
+
+	var (
+		reader  io.Reader
+		headers = http.Header{"User-Agent": []string{"caddy-crowdsec/" + version.Current()}}
+	)
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return nil, fmt.Errorf("failed encoding request: %w", err)
+		}
+		reader = bytes.NewReader(b)
+		headers.Set("Content-Type", "application/json")
+	}
+
+	return caddycmd.AdminAPIRequest(adminAddr, method, uri, headers, reader)
+}
@@ -0,0 +1,234 @@
+package crowdsec
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/spf13/cobra"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/hslatman/caddy-crowdsec-bouncer/crowdsectest"
+	"github.com/hslatman/caddy-crowdsec-bouncer/internal/bouncer"
+)
+
+// newAdminServer serves the routes of a, like the Caddy admin API, and
+// returns the address it listens on.
+func newAdminServer(t *testing.T, a *adminAPI) string {
+	t.Helper()
+
+	mux := http.NewServeMux()
+	for _, route := range a.Routes() {
+		handler := route.Handler
+		mux.HandleFunc(route.Pattern, func(w http.ResponseWriter, r *http.Request) {
+			if err := handler.ServeHTTP(w, r); err != nil {
+				status := http.StatusInternalServerError
+				var apiErr caddy.APIError
+				if errors.As(err, &apiErr) {
+					status = apiErr.HTTPStatus
+				}
+				http.Error(w, err.Error(), status)
+			}
+		})
+	}
+
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+
+	return srv.Listener.Addr().String()
+}
+
+// runCommand runs run with args and the persistent flags of the
+// crowdsec command, against the admin API at address. It returns what
+// was written to stdout.
+func runCommand(t *testing.T, address string, run func(*cobra.Command, []string) error, stdin string, args ...string) (string, error) {
+	t.Helper()
+
+	cmd := &cobra.Command{RunE: run, SilenceUsage: true, SilenceErrors: true}
+	cmd.Flags().String("address", address, "")
+	cmd.Flags().String("config", "", "")
+	cmd.Flags().String("adapter", "", "")
+	cmd.Flags().String("output", outputTable, "")
+	cmd.Flags().Bool("quiet", false, "")
+
+	var out bytes.Buffer
+	cmd.SetOut(&out)
+	cmd.SetIn(strings.NewReader(stdin))
+	cmd.SetArgs(args)
+
+	err := cmd.Execute()
+	return out.String(), err
+}
+
+func Test_formatEvent(t *testing.T) {
+	now := time.Now()
+	ts := now.Local().Format(time.RFC3339)
+	decision := &bouncer.DecisionDetails{
+		Type:     "ban",
+		Scope:    "Ip",
+		Value:    "192.0.2.1",
+		Origin:   "crowdsec",
+		Scenario: "crowdsecurity/ssh-bf",
+		Duration: "4h0m0s",
+	}
+
+	tests := []struct {
+		name  string
+		event bouncer.Event
+		want  string
+	}{
+		{"added", bouncer.Event{Time: now, Type: bouncer.EventDecisionAdded, Decision: decision}, ts + " added ban 192.0.2.1 by crowdsecurity/ssh-bf (crowdsec) for 4h0m0s"},
+		{"deleted", bouncer.Event{Time: now, Type: bouncer.EventDecisionDeleted, Decision: decision}, ts + " deleted ban 192.0.2.1 by crowdsecurity/ssh-bf (crowdsec)"},
+		{"remediation", bouncer.Event{Time: now, Type: bouncer.EventRemediation, IP: "192.0.2.1", Remediation: "ban"}, ts + " served ban to 192.0.2.1"},
+		{"remediation-origin", bouncer.Event{Time: now, Type: bouncer.EventRemediation, IP: "192.0.2.1", Remediation: "ban", Origin: "CAPI"}, ts + " served ban to 192.0.2.1 (CAPI)"},
+		{"unknown", bouncer.Event{Time: now, Type: "unknown"}, ts + " unknown"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, formatEvent(tt.event))
+		})
+	}
+}
+
+func Test_cmdCheck(t *testing.T) {
+	lapi := crowdsectest.NewServer(t)
+	lapi.AddDecisions(crowdsectest.NewDecision("Ip", "192.0.2.1", "ban"))
+	address := newAdminServer(t, newAdminAPI(t, lapi))
+
+	tests := []struct {
+		name    string
+		stdin   string
+		args    []string
+		want    string
+		wantErr string
+	}{
+		{
+			name: "args",
+			args: []string{"192.0.2.1", "10.0.0.1", "invalid"},
+			want: "IP         RESULT   REASON\n" +
+				"192.0.2.1  blocked  ban by crowdsectest (cscli)\n" +
+				"10.0.0.1   allowed  \n" +
+				"invalid    error    invalid IP \"invalid\": ParseAddr(\"invalid\"): unable to parse IP\n",
+		},
+		{
+			name:  "stdin",
+			stdin: "192.0.2.1\n\n 10.0.0.1 \n",
+			want: "IP         RESULT   REASON\n" +
+				"192.0.2.1  blocked  ban by crowdsectest (cscli)\n" +
+				"10.0.0.1   allowed  \n",
+		},
+		{
+			name:  "stdin-dash",
+			stdin: "10.0.0.1\n",
+			args:  []string{"-"},
+			want: "IP        RESULT   REASON\n" +
+				"10.0.0.1  allowed  \n",
+		},
+		{
+			name: "quiet-allowed",
+			args: []string{"--quiet", "10.0.0.1"},
+		},
+		{
+			name:    "quiet-blocked",
+			args:    []string{"--quiet", "192.0.2.1", "10.0.0.1"},
+			wantErr: "1 of 2 IPs are blocked or couldn't be checked",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, err := runCommand(t, address, cmdCheck, tt.stdin, tt.args...)
+			if tt.wantErr != "" {
+				assert.EqualError(t, err, tt.wantErr)
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, out)
+		})
+	}
+
+	t.Run("chunked", func(t *testing.T) {
+		ips := make([]string, maxCheckIPs+1)
+		for i := range ips {
+			ips[i] = "10.0.0.1"
+		}
+		ips[maxCheckIPs] = "192.0.2.1"
+
+		out, err := runCommand(t, address, cmdCheck, strings.Join(ips, "\n"), "--output", "json")
+		require.NoError(t, err)
+
+		var got checkBatchResponse
+		require.NoError(t, json.Unmarshal([]byte(out), &got))
+		require.Len(t, got.Results, maxCheckIPs+1)
+		assert.False(t, got.Results[0].Blocked)
+		assert.True(t, got.Results[maxCheckIPs].Blocked)
+	})
+}
+
+func Test_cmdMetrics(t *testing.T) {
+	lapi := crowdsectest.NewServer(t)
+	address := newAdminServer(t, newAdminAPI(t, lapi))
+
+	c, ok := caddy.ActiveContext().AppIfConfigured("crowdsec").(*CrowdSec)
+	require.True(t, ok)
+
+	ip := netip.MustParseAddr("192.0.2.1")
+	c.RecordRemediation("captcha", "crowdsec", ip)
+	c.RecordRemediation("ban", "crowdsec", ip)
+	c.RecordRemediation("ban", "CAPI", ip)
+
+	// the LAPI calls are counted across all apps in the process
+	lapiCalls := c.Metrics().LAPICalls
+
+	t.Run("table", func(t *testing.T) {
+		out, err := runCommand(t, address, cmdMetrics, "")
+		require.NoError(t, err)
+
+		// the columns are aligned using spaces; compare the fields
+		var lines []string
+		for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+			lines = append(lines, strings.Join(strings.Fields(line), " "))
+		}
+		assert.Equal(t, []string{
+			"METRIC VALUE",
+			"decisions 0",
+			"decisions added 0",
+			"decisions deleted 0",
+			"decision failures 0",
+			"last sync never",
+			"remediations (ban) 2",
+			"remediations (captcha) 1",
+			fmt.Sprintf("lapi calls %d", lapiCalls),
+			"lapi errors 0",
+			"appsec calls 0",
+			"appsec errors 0",
+			"appsec dropped 0",
+			"appsec overflows 0",
+		}, lines)
+	})
+
+	t.Run("json", func(t *testing.T) {
+		out, err := runCommand(t, address, cmdMetrics, "", "--output", "json")
+		require.NoError(t, err)
+
+		var m bouncer.Metrics
+		require.NoError(t, json.Unmarshal([]byte(out), &m))
+		assert.Equal(t, map[string]uint64{"ban": 2, "captcha": 1}, m.Remediations)
+		assert.Nil(t, m.LastSync)
+	})
+
+	t.Run("quiet", func(t *testing.T) {
+		out, err := runCommand(t, address, cmdMetrics, "", "--quiet")
+		require.NoError(t, err)
+		assert.Empty(t, out)
+	})
+}
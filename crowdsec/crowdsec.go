@@ -16,21 +16,30 @@ package crowdsec
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"net/http"
 	"net/netip"
+	"net/url"
+	"os"
 	"reflect"
 	"runtime/debug"
 	"slices"
 	"strings"
+	"time"
 
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
 	"github.com/crowdsecurity/crowdsec/pkg/models"
+	"github.com/prometheus/client_golang/prometheus"
 	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
 
 	"github.com/hslatman/caddy-crowdsec-bouncer/internal/bouncer"
+	"github.com/hslatman/caddy-crowdsec-bouncer/internal/cti"
+	"github.com/hslatman/caddy-crowdsec-bouncer/internal/duration"
+	"github.com/hslatman/caddy-crowdsec-bouncer/internal/logging"
 )
 
 func init() {
@@ -52,18 +61,71 @@ func (CrowdSec) CaddyModule() caddy.ModuleInfo {
 // a request or connection is allowed or not.
 type CrowdSec struct {
 	// APIUrl for the CrowdSec Local API. Defaults to http://127.0.0.1:8080/.
+	// The URL can have a path prefix when the Local API is served behind
+	// a reverse proxy, i.e. https://gateway.example.com/crowdsec/.
 	APIUrl string `json:"api_url,omitempty"`
 	// APIKey for the CrowdSec Local API.
 	APIKey string `json:"api_key"`
+	// APIHeaders are added to all requests to the CrowdSec Local API,
+	// i.e. to authenticate with a reverse proxy in front of it. Values
+	// can contain placeholders, i.e. {env.GATEWAY_TOKEN}.
+	APIHeaders map[string]string `json:"api_headers,omitempty"`
+	// CAPI configures retrieving decisions, including the community
+	// blocklist, directly from the CrowdSec Central API, for deployments
+	// without a CrowdSec Local API. When it's set, the APIUrl and APIKey
+	// are not used. Disabled by default.
+	CAPI *CAPI `json:"capi,omitempty"`
+	// BlocklistMirror configures retrieving decisions from a CrowdSec
+	// blocklist-mirror endpoint, instead of from a CrowdSec Local API, so
+	// that many instances can share decisions without Local API credentials.
+	// When it's set, the APIUrl and APIKey are not used, and the endpoint is
+	// pulled every TickerInterval. Disabled by default.
+	BlocklistMirror *BlocklistMirror `json:"blocklist_mirror,omitempty"`
+	// Snapshot configures an endpoint that decisions are loaded from when
+	// streaming starts, before the initial pull has completed, to shrink
+	// the window in which a freshly started instance doesn't enforce any
+	// decisions. The endpoint is expected to serve the same formats as a
+	// blocklist-mirror endpoint, such as the decisions exported by another
+	// instance. The decisions are replaced by those from the initial pull.
+	// Requires streaming mode. Disabled by default.
+	Snapshot *BlocklistMirror `json:"snapshot,omitempty"`
+	// Feeds are additional CrowdSec Local APIs that decisions are
+	// streamed from, i.e. those of other organizations. Their decisions
+	// are enforced together with those from the primary Local API, with
+	// the name of the feed prefixed to their origin. Feeds require
+	// streaming mode.
+	Feeds []*Feed `json:"feeds,omitempty"`
 	// TickerInterval is the interval the StreamBouncer uses for querying
-	// the CrowdSec Local API. Defaults to "60s".
+	// the CrowdSec Local API. Defaults to "60s". When decisions are
+	// retrieved from the Central API, the minimum is 2h.
 	TickerInterval string `json:"ticker_interval,omitempty"`
+	// InstanceName identifies this instance in logs, in the user agent
+	// and in usage metrics, i.e. "{system.hostname}". By default a
+	// random ID is used, which changes when Caddy is restarted.
+	InstanceName string `json:"instance_name,omitempty"`
 	// EnableStreaming indicates whether the StreamBouncer should be used.
 	// If it's false, the LiveBouncer is used. The StreamBouncer keeps
 	// CrowdSec decisions in memory, resulting in quicker lookups. The
 	// LiveBouncer will perform an API call to your CrowdSec instance.
 	// Defaults to true.
 	EnableStreaming *bool `json:"enable_streaming,omitempty"`
+	// MetricsInterval is the interval at which usage metrics are reported
+	// to the CrowdSec Local API, so that they're shown by `cscli metrics`.
+	// An interval of 0 disables reporting. Defaults to 15m.
+	MetricsInterval *caddy.Duration `json:"metrics_interval,omitempty"`
+	// SummaryInterval is the interval at which a summary of the active
+	// decisions and the remediations served is logged at info level.
+	// Disabled by default.
+	SummaryInterval caddy.Duration `json:"summary_interval,omitempty"`
+	// DecisionLogThreshold is the maximum size of a batch of decisions
+	// retrieved from the CrowdSec Local API for which every decision in
+	// it is logged at debug level. A threshold of 0 disables logging
+	// individual decisions. Defaults to 10.
+	DecisionLogThreshold *int `json:"decision_log_threshold,omitempty"`
+	// LogManualDecisions enables logging decisions made using cscli at
+	// info level, independent of the DecisionLogThreshold. Defaults to
+	// false.
+	LogManualDecisions bool `json:"log_manual_decisions,omitempty"`
 	// EnableHardFails indicates whether calls to the CrowdSec API should
 	// result in hard failures, resulting in Caddy quitting vs.
 	// Caddy continuing operation (with a chance of not performing)
@@ -72,47 +134,439 @@ type CrowdSec struct {
 	// AppSecUrl is the URL of the AppSec component served by your
 	// CrowdSec installation. Disabled by default.
 	AppSecUrl string `json:"appsec_url,omitempty"`
+	// AppSecAPIKey is the API key used to authenticate to the AppSec
+	// component. Defaults to the APIKey.
+	AppSecAPIKey string `json:"appsec_api_key,omitempty"`
+	// AppSecTimeout is the timeout for requests to the AppSec component.
+	// Defaults to 10s.
+	AppSecTimeout caddy.Duration `json:"appsec_timeout,omitempty"`
 	// AppSecMaxBodySize is the maximum number of request body bytes that
 	// will be sent to your AppSec component.
 	AppSecMaxBodySize int `json:"appsec_max_body_bytes,omitempty"`
+	// AppSecFailurePolicy determines what happens with a request when
+	// the AppSec component can't be reached or returns an error. Can
+	// be "open" (allow the request), "closed" (block the request with
+	// status 403) or "status:<code>" (block the request with the
+	// provided status code). Defaults to "open".
+	AppSecFailurePolicy string `json:"appsec_failure_policy,omitempty"`
+	// AppSecMaxRetries is the number of times a request to the AppSec
+	// component is retried when it fails with a connection error or a
+	// 5xx status, before the failure policy is applied. Defaults to 0.
+	AppSecMaxRetries int `json:"appsec_max_retries,omitempty"`
+	// AppSecRetryBackoff is the initial backoff between retries of
+	// requests to the AppSec component. It doubles with every retry,
+	// up to 2s. Defaults to 100ms.
+	AppSecRetryBackoff caddy.Duration `json:"appsec_retry_backoff,omitempty"`
+	// AppSecHealthCheckInterval is the interval at which the AppSec
+	// component is probed to determine its health. The AppSec component
+	// is also probed at startup. Defaults to 1m.
+	AppSecHealthCheckInterval caddy.Duration `json:"appsec_health_check_interval,omitempty"`
+	// AppSecHeaderAllowlist is a list of request headers that are forwarded
+	// to the AppSec component. If empty, all headers are forwarded, except
+	// for the ones in AppSecHeaderDenylist.
+	AppSecHeaderAllowlist []string `json:"appsec_header_allowlist,omitempty"`
+	// AppSecHeaderDenylist is a list of request headers that are never
+	// forwarded to the AppSec component, such as internal headers.
+	AppSecHeaderDenylist []string `json:"appsec_header_denylist,omitempty"`
+	// AppSecExclude is a list of exclusions for requests that should not
+	// be inspected by the AppSec component, such as large binary uploads,
+	// WebSocket endpoints or health checks.
+	AppSecExclude []*AppSecExclusion `json:"appsec_exclude,omitempty"`
+	// AppSecMode is the mode in which the AppSec component is used. In
+	// "inline" mode requests are blocked when an AppSec rule is triggered.
+	// In "async" mode requests are queued for inspection by the AppSec
+	// component and are never blocked, so that AppSec detections can
+	// lead to decisions without adding latency. Defaults to "inline".
+	AppSecMode string `json:"appsec_mode,omitempty"`
+	// AppSecQueueSize is the maximum number of requests queued for
+	// inspection in "async" mode. Requests are dropped when the queue
+	// is full. Defaults to 1000.
+	AppSecQueueSize int `json:"appsec_queue_size,omitempty"`
+	// AppSecCacheTTL is the duration AppSec verdicts for GET requests
+	// without a body are cached for. Verdicts are cached per client IP,
+	// host, URI and forwarded headers. Disabled by default.
+	AppSecCacheTTL caddy.Duration `json:"appsec_cache_ttl,omitempty"`
+	// AppSecCacheSize is the maximum number of cached AppSec verdicts.
+	// Defaults to 10000.
+	AppSecCacheSize int `json:"appsec_cache_size,omitempty"`
+	// AppSecMaxConcurrency is the maximum number of in-flight requests to
+	// the AppSec component. Unlimited by default.
+	AppSecMaxConcurrency int `json:"appsec_max_concurrency,omitempty"`
+	// AppSecMaxQueued is the maximum number of requests waiting for an
+	// in-flight request to the AppSec component to finish, when the
+	// AppSecMaxConcurrency is reached. Defaults to 0.
+	AppSecMaxQueued int `json:"appsec_max_queued,omitempty"`
+	// AppSecOverflowPolicy determines what happens with a request when
+	// the AppSecMaxConcurrency is reached and the queue is full. Can be
+	// "open" (allow the request) or "closed" (block the request with
+	// status 503). Defaults to "open".
+	AppSecOverflowPolicy string `json:"appsec_overflow_policy,omitempty"`
+	// AppSecBlockSuspiciousUpgrades enables blocking upgrade requests,
+	// such as WebSocket handshakes, from IPs that have any active decision,
+	// including captchas, which can't be served over an upgraded connection.
+	// Only the headers of upgrade requests are inspected by the AppSec
+	// component. Defaults to false.
+	AppSecBlockSuspiciousUpgrades bool `json:"appsec_block_suspicious_upgrades,omitempty"`
+	// AppSecJail configures banning IPs locally after they had too many
+	// requests blocked by the AppSec component, so that their requests
+	// are blocked without being inspected again. Disabled by default.
+	AppSecJail *AppSecJail `json:"appsec_jail,omitempty"`
+	// Denylist is a list of IPs and CIDRs that are always denied access,
+	// independent of the decisions made by CrowdSec. Entries are enforced
+	// even when the CrowdSec Local API can't be reached.
+	Denylist []string `json:"denylist,omitempty"`
+	// DenylistType is the remediation applied to clients on the Denylist.
+	// Can be "ban" or "captcha". Defaults to "ban".
+	DenylistType string `json:"denylist_type,omitempty"`
+	// Blocklists are URLs of third-party blocklists, i.e. FireHOL or the
+	// Spamhaus DROP list, with an IP or CIDR per line. Entries on the
+	// blocklists are enforced independent of the decisions made by
+	// CrowdSec, with origin "caddy-blocklist".
+	Blocklists []string `json:"blocklists,omitempty"`
+	// BlocklistType is the remediation applied to clients on one of the
+	// Blocklists. Can be "ban" or "captcha". Defaults to "ban".
+	BlocklistType string `json:"blocklist_type,omitempty"`
+	// BlocklistInterval is the interval at which the Blocklists are
+	// retrieved. Defaults to "1h".
+	BlocklistInterval caddy.Duration `json:"blocklist_interval,omitempty"`
+	// BlocklistRollup enables merging adjacent and overlapping entries
+	// of each of the Blocklists into fewer, larger ranges, reducing the
+	// memory used and speeding up lookups. Disabled by default.
+	BlocklistRollup bool `json:"blocklist_rollup,omitempty"`
+	// AdminRateLimit is the number of requests per second a client can
+	// make to the crowdsec admin API endpoints. A negative value disables
+	// rate limiting. Defaults to 10.
+	AdminRateLimit float64 `json:"admin_rate_limit,omitempty"`
+	// AdminRateBurst is the number of requests a client can make to the
+	// crowdsec admin API endpoints in a burst. Defaults to 20.
+	AdminRateBurst int `json:"admin_rate_burst,omitempty"`
+	// Webhook configures a webhook that is called when remediations
+	// are served, or when decisions are added or deleted. Disabled by
+	// default.
+	Webhook *Webhook `json:"webhook,omitempty"`
+	// BlockedLog enables logging a line for every blocked request to
+	// the "crowdsec.blocked" logger. The log can be written to a file
+	// using the Caddy logging configuration, so that it can be acquired
+	// by the CrowdSec agent. Defaults to false.
+	BlockedLog bool `json:"blocked_log,omitempty"`
+	// CTI enables enriching the blocked request log and the results of
+	// checking an IP using the admin API with information from the
+	// CrowdSec CTI API. Disabled by default.
+	CTI *CTI `json:"cti,omitempty"`
+	// Alerts configures sending alerts to the CrowdSec Local API when
+	// the AppSec component blocks a request, using the credentials of
+	// a machine. Disabled by default.
+	Alerts *Alerts `json:"alerts,omitempty"`
+	// AutoBan configures adding local decisions for IPs that get too
+	// many error responses from the HTTP handler, i.e. when probing for
+	// files. Disabled by default.
+	AutoBan *AutoBan `json:"auto_ban,omitempty"`
+	// Client tunes the connections of the HTTP clients used for the
+	// CrowdSec Local API and the AppSec component.
+	Client *Client `json:"client,omitempty"`
+	// ModuleWarnings determines how it's logged that the HTTP handler
+	// or layer4 matcher isn't available in the Caddy build. Can be
+	// "warn", "info" or "off", which is useful when only one of them
+	// is used intentionally. Defaults to "warn".
+	ModuleWarnings string `json:"module_warnings,omitempty"`
 
-	ctx     caddy.Context
-	logger  *zap.Logger
-	bouncer *bouncer.Bouncer
+	ctx           caddy.Context
+	logger        *zap.Logger
+	blockedLogger *zap.Logger
+	logLevel      *logging.Level
+	bouncer       *bouncer.Bouncer
+	adminLimiter  *rateLimiter
+	simulators    *simulators
+	notifier      *webhookNotifier
+	cti           *cti.Client
 }
 
 // Provision sets up the CrowdSec app.
 func (c *CrowdSec) Provision(ctx caddy.Context) error {
 	c.ctx = ctx
-	c.logger = ctx.Logger(c)
-	defer c.logger.Sync() // nolint
+	c.logLevel = &logging.Level{}
+	c.simulators = &simulators{}
+	c.logger = c.Logger(ctx.Logger(c))
+
+	// options that aren't configured are set from CROWDSEC_* environment
+	// variables, so that containers can run with a minimal config
+	if err := c.applyEnv(os.LookupEnv); err != nil {
+		return err
+	}
+
+	if c.BlockedLog {
+		// not controlled by the log level of the app, as the blocked
+		// request log is meant to be complete
+		c.blockedLogger = ctx.Logger(c).Named(blockedLoggerName)
+	}
 
 	repl := caddy.NewReplacer() // create replacer with the default, global replacement functions, including ".env" env var reading
 	c.APIUrl = repl.ReplaceKnown(c.APIUrl, "")
 	c.APIKey = repl.ReplaceKnown(c.APIKey, "")
+	for name, value := range c.APIHeaders {
+		c.APIHeaders[name] = repl.ReplaceKnown(value, "")
+	}
 	c.TickerInterval = repl.ReplaceKnown(c.TickerInterval, "")
+	c.InstanceName = repl.ReplaceKnown(c.InstanceName, "")
 	c.AppSecUrl = repl.ReplaceKnown(c.AppSecUrl, "")
+	c.AppSecAPIKey = repl.ReplaceKnown(c.AppSecAPIKey, "")
+	if c.Alerts != nil {
+		c.Alerts.MachineID = repl.ReplaceKnown(c.Alerts.MachineID, "")
+		c.Alerts.Password = repl.ReplaceKnown(c.Alerts.Password, "")
+		if c.Alerts.DecisionDuration == 0 {
+			c.Alerts.DecisionDuration = caddy.Duration(defaultAlertDecisionDuration)
+		}
+	}
+	if c.AppSecJail != nil && c.AppSecJail.Duration == 0 {
+		c.AppSecJail.Duration = caddy.Duration(defaultAppSecJailDuration)
+	}
+	if c.AutoBan != nil {
+		if len(c.AutoBan.Statuses) == 0 {
+			c.AutoBan.Statuses = slices.Clone(defaultAutoBanStatuses)
+		}
+		if c.AutoBan.Type == "" {
+			c.AutoBan.Type = "ban"
+		}
+		if c.AutoBan.Duration == 0 {
+			c.AutoBan.Duration = caddy.Duration(defaultAutoBanDuration)
+		}
+	}
+	if c.BlocklistMirror != nil {
+		c.BlocklistMirror.URL = repl.ReplaceKnown(c.BlocklistMirror.URL, "")
+		c.BlocklistMirror.APIKey = repl.ReplaceKnown(c.BlocklistMirror.APIKey, "")
+		if c.BlocklistMirror.Type == "" {
+			c.BlocklistMirror.Type = "ban"
+		}
+	}
+	if c.Snapshot != nil {
+		c.Snapshot.URL = repl.ReplaceKnown(c.Snapshot.URL, "")
+		c.Snapshot.APIKey = repl.ReplaceKnown(c.Snapshot.APIKey, "")
+		if c.Snapshot.Type == "" {
+			c.Snapshot.Type = "ban"
+		}
+	}
+	for _, f := range c.Feeds {
+		f.APIUrl = repl.ReplaceKnown(f.APIUrl, "")
+		f.APIKey = repl.ReplaceKnown(f.APIKey, "")
+	}
+	if c.CAPI != nil {
+		c.CAPI.URL = repl.ReplaceKnown(c.CAPI.URL, "")
+		c.CAPI.MachineID = repl.ReplaceKnown(c.CAPI.MachineID, "")
+		c.CAPI.Password = repl.ReplaceKnown(c.CAPI.Password, "")
+	}
 
 	if c.APIUrl == "" {
 		c.APIUrl = "http://127.0.0.1:8080/"
 	}
+	if !strings.HasSuffix(c.APIUrl, "/") {
+		// a path prefix is only kept when the URL ends with a slash
+		c.APIUrl += "/"
+	}
 	if c.TickerInterval == "" {
 		c.TickerInterval = "60s"
 	}
+	interval, err := duration.Parse("ticker_interval", c.TickerInterval)
+	if err != nil {
+		return err
+	}
+	if interval == 0 {
+		return errors.New("invalid ticker_interval 0s: must be positive")
+	}
+	if _, err := time.ParseDuration(c.TickerInterval); err != nil {
+		// the StreamBouncer only accepts durations in Go syntax
+		c.TickerInterval = interval.String()
+	}
+	if c.DenylistType == "" {
+		c.DenylistType = "ban"
+	}
+	if c.BlocklistType == "" {
+		c.BlocklistType = "ban"
+	}
+	if c.BlocklistInterval == 0 {
+		c.BlocklistInterval = caddy.Duration(defaultBlocklistInterval)
+	}
+	for i, u := range c.Blocklists {
+		c.Blocklists[i] = repl.ReplaceKnown(u, "")
+	}
+	if c.AppSecMode == "" {
+		c.AppSecMode = "inline"
+	}
+	if c.AdminRateLimit == 0 {
+		c.AdminRateLimit = defaultAdminRateLimit
+	}
+	if c.AdminRateBurst == 0 {
+		c.AdminRateBurst = defaultAdminRateBurst
+	}
+	if c.AdminRateLimit > 0 {
+		c.adminLimiter = newRateLimiter(c.AdminRateLimit, c.AdminRateBurst)
+	}
+
+	// Caddy exposes the metrics in the default registry on its metrics endpoint
+	if err := bouncer.RegisterMetrics(prometheus.DefaultRegisterer); err != nil {
+		return err
+	}
 
 	bouncer, err := bouncer.New(c.APIKey, c.APIUrl, c.AppSecUrl, c.AppSecMaxBodySize, c.TickerInterval, c.logger)
 	if err != nil {
 		return err
 	}
 
+	// the instance name is set first, as it's part of the user agent
+	// copied by the clients for other sources of decisions
+	if c.InstanceName != "" {
+		if err := bouncer.SetInstanceName(c.InstanceName); err != nil {
+			return err
+		}
+	}
+
 	if c.isStreamingEnabled() {
 		bouncer.EnableStreaming()
 	}
 
+	if len(c.APIHeaders) > 0 {
+		headers := http.Header{}
+		for name, value := range c.APIHeaders {
+			headers.Set(name, value)
+		}
+		if err := bouncer.SetAPIHeaders(headers); err != nil {
+			return fmt.Errorf("invalid api headers: %w", err)
+		}
+	}
+
 	if c.shouldFailHard() {
 		bouncer.EnableHardFails()
 	}
 
+	if c.CAPI != nil {
+		if err := bouncer.SetCAPI(c.CAPI.URL, c.CAPI.MachineID, c.CAPI.Password, c.CAPI.Scenarios); err != nil {
+			return fmt.Errorf("invalid central API configuration: %w", err)
+		}
+	}
+
+	for _, f := range c.Feeds {
+		if err := bouncer.AddFeed(f.Name, f.APIUrl, f.APIKey); err != nil {
+			return fmt.Errorf("invalid feed configuration: %w", err)
+		}
+	}
+
+	if c.Alerts != nil {
+		if err := bouncer.SetAlerts(c.APIUrl, c.Alerts.MachineID, c.Alerts.Password, time.Duration(c.Alerts.DecisionDuration)); err != nil {
+			return fmt.Errorf("invalid alerts configuration: %w", err)
+		}
+	}
+
+	if c.Client != nil {
+		if err := bouncer.SetClientOptions(c.Client.options()); err != nil {
+			return fmt.Errorf("invalid client configuration: %w", err)
+		}
+	}
+
+	if c.AutoBan != nil {
+		if err := bouncer.SetAutoBan(c.AutoBan.Threshold, time.Duration(c.AutoBan.Window), c.AutoBan.Statuses, c.AutoBan.Type, time.Duration(c.AutoBan.Duration)); err != nil {
+			return fmt.Errorf("invalid auto ban configuration: %w", err)
+		}
+	}
+
+	if c.BlocklistMirror != nil {
+		if err := bouncer.SetMirror(c.BlocklistMirror.URL, c.BlocklistMirror.APIKey, c.BlocklistMirror.Type); err != nil {
+			return err
+		}
+	}
+
+	if c.Snapshot != nil {
+		if err := bouncer.SetSnapshot(c.Snapshot.URL, c.Snapshot.APIKey, c.Snapshot.Type); err != nil {
+			return err
+		}
+	}
+
+	if c.MetricsInterval != nil {
+		bouncer.SetMetricsInterval(time.Duration(*c.MetricsInterval))
+	}
+
+	if c.DecisionLogThreshold != nil {
+		bouncer.SetDecisionLogThreshold(*c.DecisionLogThreshold)
+	}
+	if c.LogManualDecisions {
+		bouncer.EnableManualDecisionLogging()
+	}
+
+	bouncer.SetSummaryInterval(time.Duration(c.SummaryInterval))
+
+	if err := bouncer.SetAppSecFailurePolicy(c.AppSecFailurePolicy); err != nil {
+		return fmt.Errorf("invalid appsec failure policy: %w", err)
+	}
+
+	bouncer.SetAppSecRetries(c.AppSecMaxRetries, time.Duration(c.AppSecRetryBackoff))
+
+	if c.AppSecAPIKey != "" {
+		bouncer.SetAppSecAPIKey(c.AppSecAPIKey)
+	}
+
+	if c.AppSecTimeout > 0 {
+		bouncer.SetAppSecTimeout(time.Duration(c.AppSecTimeout))
+	}
+
+	bouncer.SetAppSecHealthCheckInterval(time.Duration(c.AppSecHealthCheckInterval))
+	bouncer.SetAppSecHeaders(c.AppSecHeaderAllowlist, c.AppSecHeaderDenylist)
+
+	if c.AppSecMode == "async" {
+		bouncer.SetAppSecAsync(c.AppSecQueueSize)
+	}
+
+	bouncer.SetAppSecCache(time.Duration(c.AppSecCacheTTL), c.AppSecCacheSize)
+
+	if c.AppSecBlockSuspiciousUpgrades {
+		bouncer.SetBlockSuspiciousUpgrades()
+	}
+
+	if c.AppSecJail != nil {
+		if err := bouncer.SetAppSecJail(c.AppSecJail.Threshold, time.Duration(c.AppSecJail.Window), time.Duration(c.AppSecJail.Duration)); err != nil {
+			return fmt.Errorf("invalid appsec jail configuration: %w", err)
+		}
+	}
+
+	if err := bouncer.SetAppSecConcurrencyLimit(c.AppSecMaxConcurrency, c.AppSecMaxQueued, c.AppSecOverflowPolicy); err != nil {
+		return fmt.Errorf("invalid appsec concurrency limit: %w", err)
+	}
+
+	for _, e := range c.AppSecExclude {
+		if err := bouncer.AddAppSecExclusion(e.Paths, e.Methods, e.ContentTypes, e.MaxContentLength); err != nil {
+			return fmt.Errorf("invalid appsec exclusion: %w", err)
+		}
+	}
+
+	if len(c.Denylist) > 0 {
+		denylist, err := parsePrefixes(repl, c.Denylist)
+		if err != nil {
+			return fmt.Errorf("invalid denylist: %w", err)
+		}
+		if err := bouncer.SetDenylist(denylist, c.DenylistType); err != nil {
+			return err
+		}
+	}
+
+	if len(c.Blocklists) > 0 {
+		if err := bouncer.SetBlocklists(c.Blocklists, c.BlocklistType, time.Duration(c.BlocklistInterval)); err != nil {
+			return err
+		}
+		if c.BlocklistRollup {
+			bouncer.EnableBlocklistRollup()
+		}
+	}
+
+	if c.CTI != nil {
+		c.CTI.provision(repl)
+		c.cti = cti.New(c.CTI.APIKey, time.Duration(c.CTI.CacheTTL), c.CTI.CacheSize, c.CTI.RateLimit, c.logger.Named("cti"))
+	}
+
+	if c.Webhook != nil {
+		c.Webhook.provision(repl)
+		c.notifier, err = newWebhookNotifier(c.Webhook, c.logger)
+		if err != nil {
+			return err
+		}
+	}
+
 	c.bouncer = bouncer
 
 	return nil
@@ -120,19 +574,312 @@ func (c *CrowdSec) Provision(ctx caddy.Context) error {
 
 // Validate ensures the app's configuration is valid.
 func (c *CrowdSec) Validate() error {
-	if c.APIKey == "" {
+	if c.APIKey == "" && c.CAPI == nil && c.BlocklistMirror == nil {
 		return errors.New("crowdsec API key must not be empty")
 	}
+	if c.CAPI != nil && !c.isStreamingEnabled() {
+		return errors.New("streaming must be enabled when using the central API")
+	}
+	if c.BlocklistMirror != nil {
+		if c.CAPI != nil {
+			return errors.New("the central API and a blocklist mirror can't be used together")
+		}
+		if !c.isStreamingEnabled() {
+			return errors.New("streaming must be enabled when using a blocklist mirror")
+		}
+		if !slices.Contains(denylistTypes, c.BlocklistMirror.Type) {
+			return fmt.Errorf("invalid blocklist mirror type %q; must be one of %v", c.BlocklistMirror.Type, denylistTypes)
+		}
+	}
+	if len(c.Feeds) > 0 && !c.isStreamingEnabled() {
+		return errors.New("streaming must be enabled when using feeds")
+	}
+	if c.Snapshot != nil {
+		if !c.isStreamingEnabled() {
+			return errors.New("streaming must be enabled when using a snapshot")
+		}
+		if !slices.Contains(denylistTypes, c.Snapshot.Type) {
+			return fmt.Errorf("invalid snapshot type %q; must be one of %v", c.Snapshot.Type, denylistTypes)
+		}
+	}
 	if c.bouncer == nil {
 		return errors.New("bouncer instance not available due to (potential) misconfiguration")
 	}
+	if c.DecisionLogThreshold != nil && *c.DecisionLogThreshold < 0 {
+		return fmt.Errorf("invalid decision log threshold %d; must not be negative", *c.DecisionLogThreshold)
+	}
+	if c.MetricsInterval != nil {
+		if err := duration.Check("metrics_interval", *c.MetricsInterval); err != nil {
+			return err
+		}
+	}
+	for field, value := range map[string]caddy.Duration{
+		"summary_interval":             c.SummaryInterval,
+		"blocklist_interval":           c.BlocklistInterval,
+		"appsec_timeout":               c.AppSecTimeout,
+		"appsec_retry_backoff":         c.AppSecRetryBackoff,
+		"appsec_cache_ttl":             c.AppSecCacheTTL,
+		"appsec_health_check_interval": c.AppSecHealthCheckInterval,
+	} {
+		if err := duration.Check(field, value); err != nil {
+			return err
+		}
+	}
+	if c.AppSecMaxRetries < 0 {
+		return errors.New("appsec max retries must not be negative")
+	}
+	if c.ModuleWarnings != "" && !slices.Contains(moduleWarningLevels, c.ModuleWarnings) {
+		return fmt.Errorf("invalid module warnings %q; must be one of %v", c.ModuleWarnings, moduleWarningLevels)
+	}
+	if !slices.Contains(appSecModes, c.AppSecMode) {
+		return fmt.Errorf("invalid appsec mode %q; must be one of %v", c.AppSecMode, appSecModes)
+	}
+	if c.AppSecQueueSize < 0 {
+		return errors.New("appsec queue size must not be negative")
+	}
+	if c.AppSecCacheSize < 0 {
+		return errors.New("appsec cache size must not be negative")
+	}
+	if c.AppSecMaxConcurrency < 0 || c.AppSecMaxQueued < 0 {
+		return errors.New("appsec concurrency limits must not be negative")
+	}
+	if c.AppSecOverflowPolicy != "" && !slices.Contains(appSecOverflowPolicies, c.AppSecOverflowPolicy) {
+		return fmt.Errorf("invalid appsec overflow policy %q; must be one of %v", c.AppSecOverflowPolicy, appSecOverflowPolicies)
+	}
+	for _, e := range c.AppSecExclude {
+		if e.isEmpty() {
+			return errors.New("appsec exclusion must have at least one criterion")
+		}
+	}
+	if c.AdminRateBurst < 0 {
+		return errors.New("admin rate burst must not be negative")
+	}
+	if !slices.Contains(denylistTypes, c.DenylistType) {
+		return fmt.Errorf("invalid denylist type %q; must be one of %v", c.DenylistType, denylistTypes)
+	}
+	if !slices.Contains(denylistTypes, c.BlocklistType) {
+		return fmt.Errorf("invalid blocklist type %q; must be one of %v", c.BlocklistType, denylistTypes)
+	}
+	if c.AutoBan != nil {
+		if err := c.AutoBan.validate(); err != nil {
+			return err
+		}
+	}
+	if c.CTI != nil {
+		if err := c.CTI.validate(); err != nil {
+			return err
+		}
+	}
+	if c.Webhook != nil {
+		if err := c.Webhook.validate(); err != nil {
+			return err
+		}
+	}
 	if err := c.checkModules(); err != nil {
 		return fmt.Errorf("failed checking CrowdSec modules: %w", err)
 	}
 
+	c.logWarnings()
+
 	return nil
 }
 
+// CAPI holds the credentials of a machine registered with the CrowdSec
+// Central API, i.e. using `cscli capi register`.
+type CAPI struct {
+	// URL of the CrowdSec Central API. Defaults to https://api.crowdsec.net/.
+	URL string `json:"url,omitempty"`
+	// MachineID is the login of the registered machine.
+	MachineID string `json:"machine_id"`
+	// Password of the registered machine.
+	Password string `json:"password"`
+	// Scenarios reported to the Central API when authenticating.
+	Scenarios []string `json:"scenarios,omitempty"`
+}
+
+// Feed is an additional CrowdSec Local API that decisions are
+// streamed from.
+type Feed struct {
+	// Name of the feed, which is prefixed to the origin of its decisions.
+	Name string `json:"name"`
+	// APIUrl of the CrowdSec Local API.
+	APIUrl string `json:"api_url"`
+	// APIKey of a bouncer registered with the CrowdSec Local API.
+	APIKey string `json:"api_key"`
+}
+
+// Alerts holds the credentials of a machine used for sending alerts to
+// the CrowdSec Local API, i.e. added using `cscli machines add`.
+type Alerts struct {
+	// MachineID is the login of the machine.
+	MachineID string `json:"machine_id"`
+	// Password of the machine.
+	Password string `json:"password"`
+	// DecisionDuration is the duration of the ban decision included in
+	// alerts. A negative value results in alerts without a decision.
+	// Defaults to "4h".
+	DecisionDuration caddy.Duration `json:"decision_duration,omitempty"`
+}
+
+// Client tunes the connections of the HTTP clients used for the CrowdSec
+// Local API and the AppSec component, so that connections can be reused
+// in high-traffic deployments. Unset options keep the defaults.
+type Client struct {
+	// MaxIdleConns is the maximum number of idle connections.
+	MaxIdleConns int `json:"max_idle_conns,omitempty"`
+	// MaxIdleConnsPerHost is the maximum number of idle connections
+	// to a single host. Defaults to 2.
+	MaxIdleConnsPerHost int `json:"max_idle_conns_per_host,omitempty"`
+	// IdleConnTimeout is how long idle connections are kept.
+	IdleConnTimeout caddy.Duration `json:"idle_conn_timeout,omitempty"`
+	// KeepAlive is the interval between TCP keep-alive probes.
+	KeepAlive caddy.Duration `json:"keepalive,omitempty"`
+	// TLSHandshakeTimeout is the maximum time waiting for a TLS handshake.
+	TLSHandshakeTimeout caddy.Duration `json:"tls_handshake_timeout,omitempty"`
+	// DisableHTTP2 disables HTTP/2.
+	DisableHTTP2 bool `json:"disable_http2,omitempty"`
+}
+
+func (c *Client) options() bouncer.ClientOptions {
+	return bouncer.ClientOptions{
+		MaxIdleConns:        c.MaxIdleConns,
+		MaxIdleConnsPerHost: c.MaxIdleConnsPerHost,
+		IdleConnTimeout:     time.Duration(c.IdleConnTimeout),
+		KeepAlive:           time.Duration(c.KeepAlive),
+		TLSHandshakeTimeout: time.Duration(c.TLSHandshakeTimeout),
+		DisableHTTP2:        c.DisableHTTP2,
+	}
+}
+
+// AutoBan configures adding local decisions for IPs that get too many
+// error responses within a window.
+type AutoBan struct {
+	// Threshold is the number of error responses an IP can get within
+	// the window before a decision is added for it.
+	Threshold int `json:"threshold"`
+	// Window is the duration in which error responses are counted.
+	Window caddy.Duration `json:"window"`
+	// Statuses are the status codes counted as error responses.
+	// Defaults to 401, 403 and 404.
+	Statuses []int `json:"statuses,omitempty"`
+	// Type of the decision. Can be "ban" or "captcha". Defaults to "ban".
+	Type string `json:"type,omitempty"`
+	// Duration of the decision. Defaults to "1h".
+	Duration caddy.Duration `json:"duration,omitempty"`
+}
+
+func (a *AutoBan) validate() error {
+	if a.Threshold <= 0 {
+		return errors.New("auto ban threshold must be positive")
+	}
+	if a.Window <= 0 {
+		return errors.New("auto ban window must be positive")
+	}
+	if a.Duration <= 0 {
+		return errors.New("auto ban duration must be positive")
+	}
+	for _, s := range a.Statuses {
+		if s < 100 || s > 999 {
+			return fmt.Errorf("invalid auto ban status code %d", s)
+		}
+	}
+	if !slices.Contains(denylistTypes, a.Type) {
+		return fmt.Errorf("invalid auto ban type %q; must be one of %v", a.Type, denylistTypes)
+	}
+
+	return nil
+}
+
+// AppSecJail configures banning IPs that had too many requests blocked
+// by the AppSec component within a window.
+type AppSecJail struct {
+	// Threshold is the number of blocked requests an IP can have within
+	// the window before it's banned.
+	Threshold int `json:"threshold"`
+	// Window is the duration in which blocked requests are counted.
+	Window caddy.Duration `json:"window"`
+	// Duration of the ban. Defaults to "1h".
+	Duration caddy.Duration `json:"duration,omitempty"`
+}
+
+// BlocklistMirror configures a CrowdSec blocklist-mirror endpoint.
+type BlocklistMirror struct {
+	// URL of the endpoint. Basic authentication credentials can be
+	// provided in the URL.
+	URL string `json:"url"`
+	// APIKey is sent in the X-Api-Key header, if set.
+	APIKey string `json:"api_key,omitempty"`
+	// Type is the remediation applied to entries of a plain text list.
+	// Decisions in the JSON format have their own type. Can be "ban" or
+	// "captcha". Defaults to "ban".
+	Type string `json:"type,omitempty"`
+}
+
+// AppSecExclusion matches requests that are not inspected by the
+// AppSec component. All configured criteria need to match for a
+// request to be excluded.
+type AppSecExclusion struct {
+	// Paths are glob patterns matched against the request path.
+	Paths []string `json:"paths,omitempty"`
+	// Methods are the request methods to exclude.
+	Methods []string `json:"methods,omitempty"`
+	// ContentTypes are the request media types to exclude. A trailing
+	// wildcard matches all subtypes, i.e. "image/*".
+	ContentTypes []string `json:"content_types,omitempty"`
+	// MaxContentLength excludes requests with a Content-Length
+	// larger than this number of bytes.
+	MaxContentLength int64 `json:"max_content_length,omitempty"`
+}
+
+func (e *AppSecExclusion) isEmpty() bool {
+	return len(e.Paths) == 0 && len(e.Methods) == 0 && len(e.ContentTypes) == 0 && e.MaxContentLength <= 0
+}
+
+const (
+	defaultBlocklistInterval     = time.Hour
+	defaultAlertDecisionDuration = 4 * time.Hour
+	defaultAutoBanDuration       = time.Hour
+	defaultAppSecJailDuration    = time.Hour
+)
+
+var (
+	denylistTypes          = []string{"ban", "captcha"}
+	appSecModes            = []string{"inline", "async"}
+	appSecOverflowPolicies = []string{"open", "closed"}
+	moduleWarningLevels    = []string{"warn", "info", "off"}
+	defaultAutoBanStatuses = []int{401, 403, 404}
+)
+
+// parsePrefixes parses a list of IPs and CIDRs into prefixes. IPs
+// are turned into a prefix with all bits set.
+func parsePrefixes(repl *caddy.Replacer, values []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(values))
+	for _, v := range values {
+		prf, err := parsePrefix(repl.ReplaceKnown(v, ""))
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, prf)
+	}
+
+	return prefixes, nil
+}
+
+// parsePrefix parses an IP or CIDR into a prefix. An IP is turned
+// into a prefix with all bits set.
+func parsePrefix(v string) (netip.Prefix, error) {
+	if ip, err := netip.ParseAddr(v); err == nil {
+		return netip.PrefixFrom(ip, ip.BitLen()), nil
+	}
+
+	prf, err := netip.ParsePrefix(v)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("%q is not a valid IP or CIDR", v)
+	}
+
+	return prf.Masked(), nil
+}
+
 const (
 	appSecHandlerName = "http.handlers.appsec"
 	httpHandlerName   = "http.handlers.crowdsec"
@@ -142,6 +889,15 @@ const (
 var crowdSecModules = []string{httpHandlerName, appSecHandlerName, matcherName}
 
 func (c *CrowdSec) checkModules() error {
+	if c.ModuleWarnings == "off" {
+		return nil
+	}
+
+	log := c.logger.Warn
+	if c.ModuleWarnings == "info" {
+		log = c.logger.Info
+	}
+
 	modules, err := matchModules(crowdSecModules...)
 	if err != nil {
 		return fmt.Errorf("failed retrieving CrowdSec modules: %w", err)
@@ -155,13 +911,13 @@ func (c *CrowdSec) checkModules() error {
 	hasLayer4 := len(layer4) > 0
 	switch {
 	case hasLayer4 && len(modules) == 0:
-		c.logger.Warn(fmt.Sprintf("%s and %s modules are not available", httpHandlerName, matcherName))
+		log("modules are not available", zap.Strings("modules", []string{httpHandlerName, matcherName}))
 	case hasLayer4 && hasModule(modules, matcherName) && !hasModule(modules, httpHandlerName):
-		c.logger.Warn(fmt.Sprintf("%s module is not available", httpHandlerName))
+		log("module is not available", zap.String("module", httpHandlerName))
 	case hasLayer4 && hasModule(modules, httpHandlerName) && !hasModule(modules, matcherName):
-		c.logger.Warn(fmt.Sprintf("%s module is not available", matcherName))
+		log("module is not available", zap.String("module", matcherName))
 	case len(modules) == 0:
-		c.logger.Warn(fmt.Sprintf("%s module is not available", httpHandlerName))
+		log("module is not available", zap.String("module", httpHandlerName))
 	}
 
 	return nil
@@ -237,6 +993,9 @@ func (c *CrowdSec) Cleanup() error {
 	}
 
 	c.logger.Sync() // nolint
+	if c.blockedLogger != nil {
+		c.blockedLogger.Sync() // nolint
+	}
 
 	return nil
 }
@@ -249,11 +1008,19 @@ func (c *CrowdSec) Start() error {
 
 	c.bouncer.Run(context.Background())
 
+	if c.notifier != nil {
+		c.notifier.start(c.bouncer.Subscribe())
+	}
+
 	return nil
 }
 
 // Stop stops the CrowdSec Caddy app
 func (c *CrowdSec) Stop() error {
+	if c.notifier != nil {
+		c.notifier.stop()
+	}
+
 	return c.bouncer.Shutdown()
 }
 
@@ -263,6 +1030,261 @@ func (c *CrowdSec) IsAllowed(ip netip.Addr) (bool, *models.Decision, error) {
 	return c.bouncer.IsAllowed(ip)
 }
 
+// IsAllowedContext is like IsAllowed, but in live mode the lookup in
+// the CrowdSec Local API is canceled when ctx is done, in which case the
+// error of ctx is returned.
+func (c *CrowdSec) IsAllowedContext(ctx context.Context, ip netip.Addr) (bool, *models.Decision, error) {
+	return c.bouncer.IsAllowedContext(ctx, ip)
+}
+
+// IsAllowedRequest is like IsAllowed, but the lookup for ip is shared
+// by the handlers and matchers checking the request with ctx, so that
+// it's only done once per request.
+func (c *CrowdSec) IsAllowedRequest(ctx context.Context, ip netip.Addr) (bool, *models.Decision, error) {
+	return c.bouncer.IsAllowedRequest(ctx, ip)
+}
+
+// Logger returns logger, with its level controlled by the log
+// level of the app, which can be changed at runtime.
+func (c *CrowdSec) Logger(logger *zap.Logger) *zap.Logger {
+	if c.logLevel == nil {
+		return logger
+	}
+
+	return c.logLevel.Wrap(logger)
+}
+
+// SetLogLevel overrides the log level of the app and the modules using
+// it. If revertAfter is positive, the override is removed after that
+// duration.
+func (c *CrowdSec) SetLogLevel(level zapcore.Level, revertAfter time.Duration) {
+	c.logLevel.Set(level, revertAfter)
+}
+
+// ResetLogLevel removes the override of the log level.
+func (c *CrowdSec) ResetLogLevel() {
+	c.logLevel.Reset()
+}
+
+// LogLevel returns the level overriding the log level of the app and
+// the modules using it, if any, and the time the override is removed.
+func (c *CrowdSec) LogLevel() (zapcore.Level, time.Time, bool) {
+	return c.logLevel.Override()
+}
+
+// IsStreaming returns whether decisions are looked up in the local
+// store, instead of being retrieved from the CrowdSec Local API.
+func (c *CrowdSec) IsStreaming() bool {
+	return c.bouncer.IsStreaming()
+}
+
+// SetStreaming switches between looking up decisions in the local store,
+// kept up to date by streaming decisions, and retrieving them from the
+// CrowdSec Local API on every lookup.
+func (c *CrowdSec) SetStreaming(ctx context.Context, enabled bool) error {
+	return c.bouncer.SetStreaming(ctx, enabled)
+}
+
+// Export returns the decisions streamed from the CrowdSec Local API, so
+// that other instances can pull them as a blocklist mirror.
+func (c *CrowdSec) Export() ([]*models.Decision, error) {
+	return c.bouncer.Export()
+}
+
+// Decisions returns the decisions known to the app that match filter.
+func (c *CrowdSec) Decisions(filter bouncer.DecisionFilter) ([]bouncer.DecisionDetails, error) {
+	return c.bouncer.Decisions(filter)
+}
+
+// Ban adds a local ban decision for prf, which expires after duration.
+func (c *CrowdSec) Ban(prf netip.Prefix, duration time.Duration, reason string) (bouncer.DecisionDetails, error) {
+	return c.bouncer.Ban(prf, duration, reason)
+}
+
+// Unban removes the local decision for prf, reporting whether it existed.
+func (c *CrowdSec) Unban(prf netip.Prefix) (bool, error) {
+	return c.bouncer.Unban(prf)
+}
+
+// Covered returns all decisions for prefixes that overlap prf.
+func (c *CrowdSec) Covered(prf netip.Prefix) ([]bouncer.DecisionDetails, error) {
+	return c.bouncer.Covered(prf)
+}
+
+// redacted replaces secrets in the configuration returned by Config.
+const redacted = "REDACTED"
+
+// Config returns the configuration of the app, after placeholders have
+// been replaced and defaults have been applied. Secrets are redacted.
+func (c *CrowdSec) Config() CrowdSec {
+	// a JSON round trip copies the configuration only, without the state
+	// of the app, and without sharing slices with it.
+	cfg := CrowdSec{}
+	b, _ := json.Marshal(c)
+	_ = json.Unmarshal(b, &cfg)
+
+	if cfg.APIKey != "" {
+		cfg.APIKey = redacted
+	}
+	if cfg.AppSecAPIKey != "" {
+		cfg.AppSecAPIKey = redacted
+	}
+	for name := range cfg.APIHeaders {
+		cfg.APIHeaders[name] = redacted
+	}
+	if cfg.Alerts != nil && cfg.Alerts.Password != "" {
+		cfg.Alerts.Password = redacted
+	}
+	if cfg.CTI != nil && cfg.CTI.APIKey != "" {
+		cfg.CTI.APIKey = redacted
+	}
+	if cfg.CAPI != nil && cfg.CAPI.Password != "" {
+		cfg.CAPI.Password = redacted
+	}
+	for _, f := range cfg.Feeds {
+		if f.APIKey != "" {
+			f.APIKey = redacted
+		}
+	}
+	if cfg.BlocklistMirror != nil {
+		if cfg.BlocklistMirror.APIKey != "" {
+			cfg.BlocklistMirror.APIKey = redacted
+		}
+		if u, err := url.Parse(cfg.BlocklistMirror.URL); err == nil {
+			cfg.BlocklistMirror.URL = u.Redacted()
+		}
+	}
+	if cfg.Snapshot != nil {
+		if cfg.Snapshot.APIKey != "" {
+			cfg.Snapshot.APIKey = redacted
+		}
+		if u, err := url.Parse(cfg.Snapshot.URL); err == nil {
+			cfg.Snapshot.URL = u.Redacted()
+		}
+	}
+	if cfg.Webhook != nil && cfg.Webhook.URL != "" {
+		cfg.Webhook.URL = redacted
+	}
+
+	return cfg
+}
+
+// AppSecConfig returns the effective configuration of the
+// AppSec component.
+func (c *CrowdSec) AppSecConfig() bouncer.AppSecConfig {
+	return c.bouncer.AppSecConfig()
+}
+
+// CheckLAPI checks if the CrowdSec Local API is reachable.
+func (c *CrowdSec) CheckLAPI(ctx context.Context) error {
+	return c.bouncer.CheckLAPI(ctx)
+}
+
+// Lookup returns all decisions that apply to ip.
+func (c *CrowdSec) Lookup(ip netip.Addr) ([]bouncer.DecisionDetails, error) {
+	return c.bouncer.Lookup(ip)
+}
+
+// Generation returns a counter that changes whenever the decisions
+// known to the app change. It's used to invalidate cached verdicts.
+func (c *CrowdSec) Generation() uint64 {
+	return c.bouncer.Generation()
+}
+
+// Refresh replaces the decisions in the store with all active decisions
+// retrieved from the CrowdSec Local API. It returns the number of
+// decisions stored afterwards.
+func (c *CrowdSec) Refresh(ctx context.Context) (int, error) {
+	return c.bouncer.Refresh(ctx)
+}
+
+// Verify compares the decisions in the store with the active decisions
+// retrieved from the CrowdSec Local API, refreshing the store afterwards.
+func (c *CrowdSec) Verify(ctx context.Context) (*bouncer.Verification, error) {
+	return c.bouncer.Verify(ctx)
+}
+
+// SetEnforcement sets the enforcement mode, which is one of
+// "enforce", "simulate" or "off".
+func (c *CrowdSec) SetEnforcement(mode string) error {
+	return c.bouncer.SetEnforcement(mode)
+}
+
+// Enforcement returns the enforcement mode.
+func (c *CrowdSec) Enforcement() string {
+	return c.bouncer.Enforcement()
+}
+
+// RecordProcessed counts a request or connection from ip being
+// checked by one of the CrowdSec modules.
+func (c *CrowdSec) RecordProcessed(ip netip.Addr) {
+	c.bouncer.RecordProcessed(ip)
+}
+
+// RecordRemediation counts a remediation of type typ being served
+// to ip by one of the CrowdSec modules, because of a decision or
+// AppSec verdict from origin.
+func (c *CrowdSec) RecordRemediation(typ, origin string, ip netip.Addr) {
+	c.bouncer.RecordRemediation(typ, origin, ip)
+}
+
+// AddVerdicts adds local decisions for alerts raised by CrowdSec, i.e.
+// for out-of-band AppSec rules. Sources of alerts without decisions are
+// banned for duration.
+func (c *CrowdSec) AddVerdicts(alerts []*models.Alert, duration time.Duration) ([]bouncer.DecisionDetails, error) {
+	return c.bouncer.AddVerdicts(alerts, duration)
+}
+
+// AutoBanEnabled returns whether IPs are banned locally after
+// getting too many error responses.
+func (c *CrowdSec) AutoBanEnabled() bool {
+	return c.bouncer.AutoBanEnabled()
+}
+
+// RecordResponse records a response with status being served to ip
+// by the HTTP handler.
+func (c *CrowdSec) RecordResponse(ip netip.Addr, status int) {
+	c.bouncer.RecordResponse(ip, status)
+}
+
+// Subscribe returns a channel receiving decision and remediation events,
+// and a function to cancel the subscription.
+func (c *CrowdSec) Subscribe() (<-chan bouncer.Event, func()) {
+	return c.bouncer.Subscribe()
+}
+
+// Metrics returns the current values of the counters kept by the app.
+func (c *CrowdSec) Metrics() bouncer.Metrics {
+	return c.bouncer.Metrics()
+}
+
+// StreamStats returns statistics about the processing of decisions
+// received from the CrowdSec Local API stream.
+func (c *CrowdSec) StreamStats() bouncer.StreamStats {
+	return c.bouncer.StreamStats()
+}
+
+// Stats returns statistics about the decisions known to the app.
+func (c *CrowdSec) Stats() bouncer.Stats {
+	return c.bouncer.Stats()
+}
+
+// Memory returns the memory used by the decisions known to the app.
+func (c *CrowdSec) Memory() bouncer.Memory {
+	return c.bouncer.Memory()
+}
+
+// Health returns the health of the app and its components.
+func (c *CrowdSec) Health() bouncer.Health {
+	return c.bouncer.Health()
+}
+
+// AppSecHealth returns the result of the most recent health
+// check of the AppSec component.
+func (c *CrowdSec) AppSecHealth() bouncer.AppSecHealth {
+	return c.bouncer.AppSecHealth()
+}
+
 // CheckRequest checks the incoming request against AppSec.
 func (c *CrowdSec) CheckRequest(ctx context.Context, r *http.Request) error {
 	return c.bouncer.CheckRequest(ctx, r)
@@ -62,7 +62,7 @@ func TestCrowdSec_Provision(t *testing.T) {
 				"enable_hard_fails": true
 			}`,
 			assertion: func(tt assert.TestingT, c *CrowdSec) {
-				assert.Equal(tt, "http://localhost:8080", c.APIUrl)
+				assert.Equal(tt, "http://localhost:8080/", c.APIUrl) // a trailing slash is added
 				assert.Equal(tt, "test-key", c.APIKey)
 				assert.Equal(tt, "10s", c.TickerInterval)
 				assert.False(tt, c.isStreamingEnabled())
@@ -70,6 +70,78 @@ func TestCrowdSec_Provision(t *testing.T) {
 			},
 			wantErr: false,
 		},
+		{
+			name:   "env",
+			config: `{}`,
+			env: map[string]string{
+				"CROWDSEC_API_URL":         "http://crowdsec:8080/",
+				"CROWDSEC_API_KEY":         "env-key",
+				"CROWDSEC_TICKER_INTERVAL": "2m",
+				"CROWDSEC_MODE":            "live",
+			},
+			assertion: func(tt assert.TestingT, c *CrowdSec) {
+				assert.Equal(tt, "http://crowdsec:8080/", c.APIUrl)
+				assert.Equal(tt, "env-key", c.APIKey)
+				assert.Equal(tt, "2m", c.TickerInterval)
+				assert.False(tt, c.isStreamingEnabled())
+			},
+		},
+		{
+			name: "path-prefix-and-headers",
+			config: `{
+				"api_url": "https://gateway.example.com/crowdsec",
+				"api_key": "test-key",
+				"api_headers": {
+					"X-Gateway-Token": "{env.CROWDSEC_TEST_GATEWAY_TOKEN}"
+				}
+			}`,
+			env: map[string]string{
+				"CROWDSEC_TEST_GATEWAY_TOKEN": "secret",
+			},
+			assertion: func(tt assert.TestingT, c *CrowdSec) {
+				assert.Equal(tt, "https://gateway.example.com/crowdsec/", c.APIUrl)
+				assert.Equal(tt, map[string]string{"X-Gateway-Token": "secret"}, c.APIHeaders)
+				assert.Equal(tt, map[string]string{"X-Gateway-Token": "REDACTED"}, c.Config().APIHeaders)
+			},
+		},
+		{
+			name: "fail/api-key-header",
+			config: `{
+				"api_key": "test-key",
+				"api_headers": {
+					"x-api-key": "other-key"
+				}
+			}`,
+			wantErr: true,
+		},
+		{
+			name: "ticker-interval-caddy-syntax",
+			config: `{
+				"api_key": "test-key",
+				"ticker_interval": "1d"
+			}`,
+			assertion: func(tt assert.TestingT, c *CrowdSec) {
+				assert.Equal(tt, "24h0m0s", c.TickerInterval)
+			},
+		},
+		{
+			name: "ticker-interval-seconds",
+			config: `{
+				"api_key": "test-key",
+				"ticker_interval": "90"
+			}`,
+			assertion: func(tt assert.TestingT, c *CrowdSec) {
+				assert.Equal(tt, "1m30s", c.TickerInterval)
+			},
+		},
+		{
+			name: "fail/ticker-interval",
+			config: `{
+				"api_key": "test-key",
+				"ticker_interval": "-10s"
+			}`,
+			wantErr: true,
+		},
 		{
 			name:   "defaults",
 			config: `{}`,
@@ -79,25 +151,115 @@ func TestCrowdSec_Provision(t *testing.T) {
 				assert.Equal(tt, "60s", c.TickerInterval)
 				assert.True(tt, c.isStreamingEnabled())
 				assert.False(tt, c.shouldFailHard())
+				assert.Equal(tt, "ban", c.DenylistType)
 			},
 			wantErr: false,
 		},
+		{
+			name: "config",
+			config: `{
+				"api_key": "{env.CROWDSEC_TEST_API_KEY}",
+				"appsec_url": "http://localhost:7422",
+				"appsec_api_key": "appsec-key"
+			}`,
+			env: map[string]string{
+				"CROWDSEC_TEST_API_KEY": "test-key",
+			},
+			assertion: func(tt assert.TestingT, c *CrowdSec) {
+				cfg := c.Config()
+				assert.Equal(tt, "REDACTED", cfg.APIKey)
+				assert.Equal(tt, "REDACTED", cfg.AppSecAPIKey)
+				assert.Equal(tt, "http://127.0.0.1:8080/", cfg.APIUrl)
+				assert.Equal(tt, "60s", cfg.TickerInterval)
+				assert.Equal(tt, "test-key", c.APIKey)
+				assert.True(tt, c.AppSecConfig().Enabled)
+			},
+			wantErr: false,
+		},
+		{
+			name: "denylist",
+			config: `{
+				"api_key": "test-key",
+				"denylist": ["10.0.0.1", "10.1.0.0/16"],
+				"denylist_type": "captcha"
+			}`,
+			assertion: func(tt assert.TestingT, c *CrowdSec) {
+				allowed, decision, err := c.IsAllowed(netip.MustParseAddr("10.1.2.3"))
+				assert.NoError(tt, err)
+				assert.False(tt, allowed)
+				if assert.NotNil(tt, decision) {
+					assert.Equal(tt, "captcha", *decision.Type)
+					assert.Equal(tt, "10.1.0.0/16", *decision.Value)
+				}
+			},
+			wantErr: false,
+		},
+		{
+			name: "instance-name",
+			config: `{
+				"api_key": "test-key",
+				"instance_name": "{env.CROWDSEC_TEST_INSTANCE}"
+			}`,
+			env: map[string]string{
+				"CROWDSEC_TEST_INSTANCE": "web-1",
+			},
+			assertion: func(tt assert.TestingT, c *CrowdSec) {
+				assert.Equal(tt, "web-1", c.bouncer.InstanceID())
+			},
+			wantErr: false,
+		},
+		{
+			name: "fail/invalid-instance-name",
+			config: `{
+				"api_key": "test-key",
+				"instance_name": "web 1"
+			}`,
+			wantErr: true,
+		},
+		{
+			name: "fail/invalid-denylist",
+			config: `{
+				"api_key": "test-key",
+				"denylist": ["10.0.0.1.1"]
+			}`,
+			wantErr: true,
+		},
+		{
+			name: "fail/invalid-appsec-failure-policy",
+			config: `{
+				"api_key": "test-key",
+				"appsec_failure_policy": "sometimes"
+			}`,
+			wantErr: true,
+		},
+		{
+			name: "fail/invalid-appsec-overflow-policy",
+			config: `{
+				"api_key": "test-key",
+				"appsec_max_concurrency": 10,
+				"appsec_overflow_policy": "sometimes"
+			}`,
+			wantErr: true,
+		},
 		{
 			name: "json-env-vars",
 			config: `{
 				"api_url": "{env.CROWDSEC_TEST_API_URL}",
 				"api_key": "{env.CROWDSEC_TEST_API_KEY}",
-				"ticker_interval": "{env.CROWDSEC_TEST_TICKER_INTERVAL}"
+				"ticker_interval": "{env.CROWDSEC_TEST_TICKER_INTERVAL}",
+				"appsec_url": "{env.CROWDSEC_TEST_APPSEC_URL}"
 			}`,
 			env: map[string]string{
 				"CROWDSEC_TEST_API_URL":         "http://127.0.0.2:8080/",
 				"CROWDSEC_TEST_API_KEY":         "env-test-key",
 				"CROWDSEC_TEST_TICKER_INTERVAL": "25s",
+				"CROWDSEC_TEST_APPSEC_URL":      "http://127.0.0.2:7422/",
 			},
 			assertion: func(tt assert.TestingT, c *CrowdSec) {
 				assert.Equal(tt, "http://127.0.0.2:8080/", c.APIUrl)
 				assert.Equal(tt, "env-test-key", c.APIKey)
 				assert.Equal(tt, "25s", c.TickerInterval)
+				assert.Equal(tt, "http://127.0.0.2:7422/", c.AppSecUrl)
 			},
 			wantErr: false,
 		},
@@ -114,6 +276,10 @@ func TestCrowdSec_Provision(t *testing.T) {
 
 			ctx, _ := caddy.NewContext(caddy.Context{Context: context.Background()})
 			err = c.Provision(ctx)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
 			require.NoError(t, err)
 
 			if tt.assertion != nil {
@@ -148,6 +314,157 @@ func TestCrowdSec_Validate(t *testing.T) {
 			}`,
 			wantErr: true,
 		},
+		{
+			name: "ok/module-warnings",
+			config: `{
+				"api_key": "test-key",
+				"module_warnings": "info"
+			}`,
+			wantErr: false,
+		},
+		{
+			name: "fail/module-warnings",
+			config: `{
+				"api_key": "test-key",
+				"module_warnings": "quiet"
+			}`,
+			wantErr: true,
+		},
+		{
+			name: "ok/capi",
+			config: `{
+				"capi": {
+					"machine_id": "machine",
+					"password": "password"
+				}
+			}`,
+			wantErr: false,
+		},
+		{
+			name: "fail/capi-live-mode",
+			config: `{
+				"enable_streaming": false,
+				"capi": {
+					"machine_id": "machine",
+					"password": "password"
+				}
+			}`,
+			wantErr: true,
+		},
+		{
+			name: "fail/feeds-live-mode",
+			config: `{
+				"api_url": "http://localhost:8080",
+				"api_key": "test-key",
+				"enable_streaming": false,
+				"feeds": [{"name": "customer-a", "api_url": "http://localhost:8081", "api_key": "key-a"}]
+			}`,
+			wantErr: true,
+		},
+		{
+			name: "ok/blocklist-mirror",
+			config: `{
+				"blocklist_mirror": {
+					"url": "http://mirror.example.com:41412/security/blocklist"
+				}
+			}`,
+			wantErr: false,
+		},
+		{
+			name: "fail/blocklist-mirror-with-capi",
+			config: `{
+				"blocklist_mirror": {
+					"url": "http://mirror.example.com:41412/security/blocklist"
+				},
+				"capi": {
+					"machine_id": "machine",
+					"password": "password"
+				}
+			}`,
+			wantErr: true,
+		},
+		{
+			name: "ok/appsec-overflow-policy",
+			config: `{
+				"api_url": "http://localhost:8080",
+				"api_key": "test-key",
+				"appsec_overflow_policy": "closed"
+			}`,
+			wantErr: false,
+		},
+		{
+			name: "fail/invalid-appsec-overflow-policy",
+			config: `{
+				"api_url": "http://localhost:8080",
+				"api_key": "test-key",
+				"appsec_overflow_policy": "skip"
+			}`,
+			wantErr: true,
+		},
+		{
+			name: "fail/invalid-denylist-type",
+			config: `{
+				"api_url": "http://localhost:8080",
+				"api_key": "test-key",
+				"denylist": ["10.0.0.1"],
+				"denylist_type": "throttle"
+			}`,
+			wantErr: true,
+		},
+		{
+			name: "fail/invalid-blocklist-type",
+			config: `{
+				"api_url": "http://localhost:8080",
+				"api_key": "test-key",
+				"blocklists": ["https://www.spamhaus.org/drop/drop.txt"],
+				"blocklist_type": "throttle"
+			}`,
+			wantErr: true,
+		},
+		{
+			name: "ok/auto-ban",
+			config: `{
+				"api_url": "http://localhost:8080",
+				"api_key": "test-key",
+				"auto_ban": {"threshold": 20, "window": "1m"}
+			}`,
+		},
+		{
+			name: "fail/invalid-auto-ban-type",
+			config: `{
+				"api_url": "http://localhost:8080",
+				"api_key": "test-key",
+				"auto_ban": {"threshold": 20, "window": "1m", "type": "throttle"}
+			}`,
+			wantErr: true,
+		},
+		{
+			name: "fail/empty-appsec-exclusion",
+			config: `{
+				"api_url": "http://localhost:8080",
+				"api_key": "test-key",
+				"appsec_exclude": [{}]
+			}`,
+			wantErr: true,
+		},
+		{
+			name: "fail/invalid-appsec-mode",
+			config: `{
+				"api_url": "http://localhost:8080",
+				"api_key": "test-key",
+				"appsec_mode": "background"
+			}`,
+			wantErr: true,
+		},
+		{
+			name: "fail/negative-decision-log-threshold",
+			config: `{
+				"api_url": "http://localhost:8080",
+				"api_key": "test-key",
+				"decision_log_threshold": -1
+			}`,
+			wantErr: true,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
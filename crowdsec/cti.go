@@ -0,0 +1,70 @@
+// Copyright 2024 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package crowdsec
+
+import (
+	"errors"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+const (
+	defaultCTICacheTTL  = 24 * time.Hour
+	defaultCTICacheSize = 1000
+	defaultCTIRateLimit = 30
+)
+
+// CTI configures lookups in the CrowdSec CTI API.
+type CTI struct {
+	// APIKey is the CTI API key, which can be created in the CrowdSec
+	// Console.
+	APIKey string `json:"api_key"`
+	// CacheTTL is the duration lookup results are cached for. Defaults
+	// to 24h.
+	CacheTTL caddy.Duration `json:"cache_ttl,omitempty"`
+	// CacheSize is the maximum number of lookup results that are cached.
+	// Defaults to 1000.
+	CacheSize int `json:"cache_size,omitempty"`
+	// RateLimit is the maximum number of lookups per hour, so that the
+	// quota of the API key isn't exhausted. IPs that can't be looked up
+	// are logged without CTI information. A negative value disables rate
+	// limiting. Defaults to 30.
+	RateLimit int `json:"rate_limit,omitempty"`
+}
+
+func (c *CTI) provision(repl *caddy.Replacer) {
+	c.APIKey = repl.ReplaceKnown(c.APIKey, "")
+	if c.CacheTTL == 0 {
+		c.CacheTTL = caddy.Duration(defaultCTICacheTTL)
+	}
+	if c.CacheSize == 0 {
+		c.CacheSize = defaultCTICacheSize
+	}
+	if c.RateLimit == 0 {
+		c.RateLimit = defaultCTIRateLimit
+	}
+}
+
+func (c *CTI) validate() error {
+	if c.APIKey == "" {
+		return errors.New("cti API key must not be empty")
+	}
+	if c.CacheTTL < 0 || c.CacheSize < 0 {
+		return errors.New("cti cache TTL and size must not be negative")
+	}
+
+	return nil
+}
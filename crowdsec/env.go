@@ -0,0 +1,168 @@
+// Copyright 2024 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package crowdsec
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+
+	"github.com/hslatman/caddy-crowdsec-bouncer/internal/duration"
+)
+
+const (
+	envPrefix = "CROWDSEC_"
+
+	// envMode selects streaming or live mode, as an alternative to
+	// CROWDSEC_ENABLE_STREAMING.
+	envMode = envPrefix + "MODE"
+)
+
+var (
+	durationType    = reflect.TypeOf(caddy.Duration(0))
+	durationPtrType = reflect.TypeOf((*caddy.Duration)(nil))
+	boolPtrType     = reflect.TypeOf((*bool)(nil))
+)
+
+// applyEnv sets the options that aren't configured from environment
+// variables, which are looked up using lookup. The name of the variable
+// for an option is its JSON name in upper case, prefixed with CROWDSEC_,
+// i.e. CROWDSEC_API_KEY for api_key. Options of nested objects include
+// the name of the object, i.e. CROWDSEC_CAPI_MACHINE_ID, and the object
+// is created if any of its options is set. Lists are separated by commas
+// or whitespace. Lists of objects, like feeds, can't be configured using
+// environment variables.
+func (c *CrowdSec) applyEnv(lookup func(string) (string, bool)) error {
+	if _, err := applyEnvFields(reflect.ValueOf(c).Elem(), envPrefix, lookup); err != nil {
+		return err
+	}
+
+	if v, ok := lookup(envMode); ok && c.EnableStreaming == nil {
+		var streaming bool
+		switch strings.TrimSpace(v) {
+		case "streaming":
+			streaming = true
+		case "live":
+			streaming = false
+		default:
+			return fmt.Errorf("invalid value for %s %q; must be one of streaming or live", envMode, v)
+		}
+		c.EnableStreaming = &streaming
+	}
+
+	return nil
+}
+
+// applyEnvFields sets the zero fields of the struct v from environment
+// variables prefixed with prefix. It returns whether any field was set.
+func applyEnvFields(v reflect.Value, prefix string, lookup func(string) (string, bool)) (bool, error) {
+	applied := false
+	for i := range v.NumField() {
+		field, value := v.Type().Field(i), v.Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if !field.IsExported() || name == "" || name == "-" || !value.IsZero() {
+			continue
+		}
+
+		key := prefix + strings.ToUpper(name)
+		if field.Type.Kind() == reflect.Pointer && field.Type.Elem().Kind() == reflect.Struct {
+			nested := reflect.New(field.Type.Elem())
+			ok, err := applyEnvFields(nested.Elem(), key+"_", lookup)
+			if err != nil {
+				return false, err
+			}
+			if ok {
+				value.Set(nested)
+				applied = true
+			}
+			continue
+		}
+
+		s, ok := lookup(key)
+		if !ok {
+			continue
+		}
+		ok, err := setEnvValue(value, name, strings.TrimSpace(s))
+		if err != nil {
+			return false, fmt.Errorf("invalid value for %s: %w", key, err)
+		}
+		applied = applied || ok
+	}
+
+	return applied, nil
+}
+
+// setEnvValue sets value to s, parsed according to the type of value. It
+// returns false for types that can't be set from environment variables.
+func setEnvValue(value reflect.Value, name, s string) (bool, error) {
+	switch value.Type() {
+	case durationType, durationPtrType:
+		d, err := duration.Parse(name, s)
+		if err != nil {
+			return false, err
+		}
+		if value.Type() == durationPtrType {
+			value.Set(reflect.ValueOf((*caddy.Duration)(&d)))
+		} else {
+			value.Set(reflect.ValueOf(caddy.Duration(d)))
+		}
+		return true, nil
+	case boolPtrType:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return false, err
+		}
+		value.Set(reflect.ValueOf(&b))
+		return true, nil
+	}
+
+	switch value.Kind() {
+	case reflect.String:
+		value.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return false, err
+		}
+		value.SetBool(b)
+	case reflect.Int:
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return false, err
+		}
+		value.SetInt(int64(n))
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return false, err
+		}
+		value.SetFloat(f)
+	case reflect.Slice:
+		if value.Type().Elem().Kind() != reflect.String {
+			return false, nil
+		}
+		values := strings.FieldsFunc(s, func(r rune) bool {
+			return r == ',' || r == ' ' || r == '\t' || r == '\n'
+		})
+		value.Set(reflect.ValueOf(values).Convert(value.Type()))
+	default:
+		return false, nil
+	}
+
+	return true, nil
+}
@@ -0,0 +1,88 @@
+package crowdsec
+
+import (
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func lookupFrom(env map[string]string) func(string) (string, bool) {
+	return func(key string) (string, bool) {
+		v, ok := env[key]
+		return v, ok
+	}
+}
+
+func TestCrowdSec_applyEnv(t *testing.T) {
+	c := &CrowdSec{
+		APIKey: "configured-key",
+	}
+	err := c.applyEnv(lookupFrom(map[string]string{
+		"CROWDSEC_API_URL":                 "http://crowdsec:8080/",
+		"CROWDSEC_API_KEY":                 "env-key",
+		"CROWDSEC_MODE":                    "live",
+		"CROWDSEC_ENABLE_HARD_FAILS":       "true",
+		"CROWDSEC_METRICS_INTERVAL":        "15m",
+		"CROWDSEC_APPSEC_TIMEOUT":          "2",
+		"CROWDSEC_APPSEC_MAX_BODY_BYTES":   "1024",
+		"CROWDSEC_APPSEC_HEADER_ALLOWLIST": "User-Agent, Content-Type Cookie",
+		"CROWDSEC_ADMIN_RATE_LIMIT":        "2.5",
+		"CROWDSEC_BLOCKED_LOG":             "1",
+		"CROWDSEC_CAPI_MACHINE_ID":         "machine",
+		"CROWDSEC_CAPI_PASSWORD":           "secret",
+	}))
+	require.NoError(t, err)
+
+	fifteen := caddy.Duration(15 * time.Minute)
+	assert.Equal(t, "http://crowdsec:8080/", c.APIUrl)
+	assert.Equal(t, "configured-key", c.APIKey) // configured options take precedence
+	assert.False(t, c.isStreamingEnabled())
+	assert.True(t, c.shouldFailHard())
+	assert.Equal(t, &fifteen, c.MetricsInterval)
+	assert.Equal(t, caddy.Duration(2*time.Second), c.AppSecTimeout)
+	assert.Equal(t, 1024, c.AppSecMaxBodySize)
+	assert.Equal(t, []string{"User-Agent", "Content-Type", "Cookie"}, c.AppSecHeaderAllowlist)
+	assert.Equal(t, 2.5, c.AdminRateLimit)
+	assert.True(t, c.BlockedLog)
+	assert.Equal(t, &CAPI{MachineID: "machine", Password: "secret"}, c.CAPI)
+	assert.Nil(t, c.Alerts) // not created without any of its options
+}
+
+func TestCrowdSec_applyEnvErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     map[string]string
+		wantErr string
+	}{
+		{
+			name:    "mode",
+			env:     map[string]string{"CROWDSEC_MODE": "polling"},
+			wantErr: `invalid value for CROWDSEC_MODE "polling"; must be one of streaming or live`,
+		},
+		{
+			name:    "int",
+			env:     map[string]string{"CROWDSEC_APPSEC_MAX_RETRIES": "many"},
+			wantErr: "invalid value for CROWDSEC_APPSEC_MAX_RETRIES",
+		},
+		{
+			name:    "duration",
+			env:     map[string]string{"CROWDSEC_APPSEC_TIMEOUT": "-1s"},
+			wantErr: "invalid value for CROWDSEC_APPSEC_TIMEOUT: invalid appsec_timeout -1s: must not be negative",
+		},
+		{
+			name:    "nested",
+			env:     map[string]string{"CROWDSEC_AUTO_BAN_THRESHOLD": "ten"},
+			wantErr: "invalid value for CROWDSEC_AUTO_BAN_THRESHOLD",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &CrowdSec{}
+			err := c.applyEnv(lookupFrom(tt.env))
+			assert.ErrorContains(t, err, tt.wantErr)
+		})
+	}
+}
@@ -0,0 +1,101 @@
+// Copyright 2024 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package crowdsec
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"slices"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	outputTable = "table"
+	outputJSON  = "json"
+	outputYAML  = "yaml"
+)
+
+var outputFormats = []string{outputTable, outputJSON, outputYAML}
+
+// printer writes the results of commands in the output format
+// selected using the --output and --quiet flags.
+type printer struct {
+	w      io.Writer
+	format string
+	quiet  bool
+}
+
+func newPrinter(cmd *cobra.Command) (*printer, error) {
+	format, _ := cmd.Flags().GetString("output")
+	quiet, _ := cmd.Flags().GetBool("quiet")
+
+	// the --json flag was supported before --output was added
+	if asJSON, _ := cmd.Flags().GetBool("json"); asJSON {
+		format = outputJSON
+	}
+
+	if !slices.Contains(outputFormats, format) {
+		return nil, fmt.Errorf("invalid output format %q; must be one of %v", format, outputFormats)
+	}
+
+	return &printer{w: cmd.OutOrStdout(), format: format, quiet: quiet}, nil
+}
+
+// print writes v as JSON or YAML, or calls table to write v
+// in a human readable format. Nothing is written in quiet mode.
+func (p *printer) print(v any, table func(tw *tabwriter.Writer)) error {
+	if p.quiet {
+		return nil
+	}
+
+	switch p.format {
+	case outputJSON:
+		enc := json.NewEncoder(p.w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	case outputYAML:
+		return p.printYAML(v)
+	default:
+		tw := tabwriter.NewWriter(p.w, 0, 0, 2, ' ', 0)
+		table(tw)
+		return tw.Flush()
+	}
+}
+
+// printYAML writes v as YAML. The value is converted using its JSON
+// representation, so that the keys are the same in both formats.
+func (p *printer) printYAML(v any) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	var generic any
+	if err := json.Unmarshal(b, &generic); err != nil {
+		return err
+	}
+
+	enc := yaml.NewEncoder(p.w)
+	enc.SetIndent(2)
+	if err := enc.Encode(generic); err != nil {
+		return err
+	}
+
+	return enc.Close()
+}
@@ -0,0 +1,55 @@
+package crowdsec
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_printer(t *testing.T) {
+	v := modeResponse{Mode: modeStreaming}
+	table := func(tw *tabwriter.Writer) {
+		fmt.Fprintf(tw, "mode: %s\n", v.Mode)
+	}
+
+	tests := []struct {
+		name    string
+		args    []string
+		want    string
+		wantErr bool
+	}{
+		{"default", nil, "mode: streaming\n", false},
+		{"table", []string{"--output", "table"}, "mode: streaming\n", false},
+		{"json", []string{"-o", "json"}, "{\n  \"mode\": \"streaming\"\n}\n", false},
+		{"deprecated-json", []string{"--json"}, "{\n  \"mode\": \"streaming\"\n}\n", false},
+		{"yaml", []string{"-o", "yaml"}, "mode: streaming\n", false},
+		{"quiet", []string{"-q", "-o", "json"}, "", false},
+		{"invalid", []string{"-o", "xml"}, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			cmd := &cobra.Command{}
+			cmd.SetOut(&buf)
+			cmd.Flags().StringP("output", "o", outputTable, "")
+			cmd.Flags().BoolP("quiet", "q", false, "")
+			cmd.Flags().Bool("json", false, "")
+			require.NoError(t, cmd.ParseFlags(tt.args))
+
+			p, err := newPrinter(cmd)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+
+			require.NoError(t, p.print(v, table))
+			assert.Equal(t, tt.want, buf.String())
+		})
+	}
+}
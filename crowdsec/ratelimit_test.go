@@ -0,0 +1,33 @@
+package crowdsec
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_rateLimiter_allow(t *testing.T) {
+	l := newRateLimiter(1, 2)
+	now := time.Now()
+
+	ok, _ := l.allow("192.0.2.1", now)
+	assert.True(t, ok)
+	ok, _ = l.allow("192.0.2.1", now)
+	assert.True(t, ok)
+
+	ok, retryAfter := l.allow("192.0.2.1", now)
+	assert.False(t, ok)
+	assert.Equal(t, time.Second, retryAfter)
+
+	// other clients have their own bucket
+	ok, _ = l.allow("192.0.2.2", now)
+	assert.True(t, ok)
+
+	ok, _ = l.allow("192.0.2.1", now.Add(time.Second))
+	assert.True(t, ok)
+
+	// idle clients are removed
+	l.allow("192.0.2.3", now.Add(2*rateLimiterIdleTimeout))
+	assert.Len(t, l.clients, 1)
+}
@@ -0,0 +1,129 @@
+// Copyright 2024 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package crowdsec
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"slices"
+	"sync"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+
+	"github.com/hslatman/caddy-crowdsec-bouncer/internal/bouncer"
+)
+
+// Simulator is implemented by handlers that can report what they would
+// do for a request, without serving it.
+type Simulator interface {
+	Simulate(r *http.Request) Simulation
+}
+
+// Simulation describes what a handler would do for a request.
+type Simulation struct {
+	// Exempt is true if the request matches the exempt matchers
+	// of the handler, so that no decisions are looked up.
+	Exempt bool `json:"exempt"`
+	// Allowed is true if the request would be passed to the next
+	// handler.
+	Allowed bool `json:"allowed"`
+	// Decision is the decision that matches the request, if any.
+	Decision *bouncer.DecisionDetails `json:"decision,omitempty"`
+	// Remediation is the remediation that would be served.
+	Remediation string `json:"remediation,omitempty"`
+	// StatusCode is the status code of the response that would be
+	// served, or of the error returned to the error routes.
+	StatusCode int `json:"status_code,omitempty"`
+	// Header holds the response headers that would be set.
+	Header http.Header `json:"header,omitempty"`
+	// Error is the error that would be returned by the handler.
+	Error string `json:"error,omitempty"`
+}
+
+// simulators holds the handlers registered with the app.
+type simulators struct {
+	mu   sync.RWMutex
+	list []Simulator
+}
+
+func (s *simulators) add(simulator Simulator) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.list = append(s.list, simulator)
+}
+
+func (s *simulators) all() []Simulator {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return slices.Clone(s.list)
+}
+
+// RegisterSimulator registers a handler, so that it's used when
+// simulating requests.
+func (c *CrowdSec) RegisterSimulator(s Simulator) {
+	c.simulators.add(s)
+}
+
+// Simulate reports what each of the registered handlers would do for a
+// request from ip, with the provided method, host and target, which is
+// the path and optional query. The request isn't served, and no
+// remediations are recorded.
+func (c *CrowdSec) Simulate(ip netip.Addr, method, host, target string) ([]Simulation, error) {
+	if !ip.IsValid() {
+		return nil, errors.New("invalid IP address")
+	}
+
+	simulators := c.simulators.all()
+	simulations := make([]Simulation, 0, len(simulators))
+	for _, s := range simulators {
+		r, err := newSimulatedRequest(ip, method, host, target)
+		if err != nil {
+			return nil, err
+		}
+		simulations = append(simulations, s.Simulate(r))
+	}
+
+	return simulations, nil
+}
+
+// newSimulatedRequest returns a request from ip, prepared like Caddy
+// prepares requests it serves, so that matchers and placeholders work.
+func newSimulatedRequest(ip netip.Addr, method, host, target string) (*http.Request, error) {
+	if _, err := url.ParseRequestURI(target); err != nil {
+		return nil, fmt.Errorf("invalid path %q: %w", target, err)
+	}
+
+	r, err := http.NewRequest(method, target, http.NoBody)
+	if err != nil {
+		return nil, fmt.Errorf("invalid request: %w", err)
+	}
+
+	r.Host = host
+	r.RequestURI = target
+	r.RemoteAddr = netip.AddrPortFrom(ip, 0).String()
+
+	repl := caddy.NewReplacer()
+	r = caddyhttp.PrepareRequest(r, repl, httptest.NewRecorder(), nil)
+	caddyhttp.SetVar(r.Context(), caddyhttp.ClientIPVarKey, ip.String())
+
+	return r, nil
+}
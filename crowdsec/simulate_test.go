@@ -0,0 +1,44 @@
+package crowdsec
+
+import (
+	"net/http"
+	"net/netip"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/hslatman/caddy-crowdsec-bouncer/internal/httputils"
+)
+
+type simulatorFunc func(r *http.Request) Simulation
+
+func (f simulatorFunc) Simulate(r *http.Request) Simulation {
+	return f(r)
+}
+
+func TestCrowdSec_Simulate(t *testing.T) {
+	c := &CrowdSec{simulators: &simulators{}}
+	c.RegisterSimulator(simulatorFunc(func(r *http.Request) Simulation {
+		_, ip := httputils.EnsureIP(r.Context())
+		assert.Equal(t, "192.0.2.1", ip.String())
+		assert.Equal(t, "192.0.2.1", caddyhttp.GetVar(r.Context(), caddyhttp.ClientIPVarKey))
+		assert.Equal(t, http.MethodPost, r.Method)
+		assert.Equal(t, "example.com", r.Host)
+		assert.Equal(t, "/login", r.URL.Path)
+		assert.Equal(t, "next=/", r.URL.RawQuery)
+
+		return Simulation{Remediation: "ban", StatusCode: http.StatusForbidden}
+	}))
+
+	simulations, err := c.Simulate(netip.MustParseAddr("192.0.2.1"), http.MethodPost, "example.com", "/login?next=/")
+	require.NoError(t, err)
+	assert.Equal(t, []Simulation{{Remediation: "ban", StatusCode: http.StatusForbidden}}, simulations)
+
+	_, err = c.Simulate(netip.MustParseAddr("192.0.2.1"), http.MethodGet, "example.com", "login")
+	assert.Error(t, err)
+
+	_, err = c.Simulate(netip.MustParseAddr("192.0.2.1"), "GET POST", "example.com", "/")
+	assert.Error(t, err)
+}
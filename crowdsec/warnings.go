@@ -0,0 +1,80 @@
+// Copyright 2024 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package crowdsec
+
+import (
+	"strconv"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	minRecommendedTickerInterval = 10 * time.Second
+	maxRecommendedTickerInterval = 30 * time.Minute
+	maxRecommendedAppSecBodySize = 10 << 20 // 10 MiB
+)
+
+// configWarning describes a configuration value that is valid, but
+// known to cause trouble.
+type configWarning struct {
+	option string
+	value  string
+	reason string
+}
+
+// warnings returns the risky values in the configuration. The
+// configuration must have been provisioned.
+func (c *CrowdSec) warnings() []configWarning {
+	var warnings []configWarning
+	add := func(option, value, reason string) {
+		warnings = append(warnings, configWarning{option: option, value: value, reason: reason})
+	}
+
+	if c.isStreamingEnabled() {
+		interval, err := time.ParseDuration(c.TickerInterval)
+		switch {
+		case err != nil:
+			// reported by Provision
+		case interval < minRecommendedTickerInterval:
+			add("ticker_interval", c.TickerInterval, "decisions are pulled very often, which puts load on the CrowdSec Local API")
+		case interval > maxRecommendedTickerInterval:
+			add("ticker_interval", c.TickerInterval, "new decisions take long to be enforced")
+		}
+	} else if c.shouldFailHard() {
+		add("enable_hard_fails", "true", "in live mode every request fails when the CrowdSec Local API can't be reached")
+	}
+
+	if c.AppSecUrl != "" {
+		switch {
+		case c.AppSecMaxBodySize == 0:
+			add("appsec_max_body_bytes", "0", "request bodies of any size are buffered in memory to be sent to the AppSec component")
+		case c.AppSecMaxBodySize > maxRecommendedAppSecBodySize:
+			add("appsec_max_body_bytes", strconv.Itoa(c.AppSecMaxBodySize), "large request bodies are buffered in memory to be sent to the AppSec component")
+		}
+		if c.AppSecFailurePolicy == "" || c.AppSecFailurePolicy == "open" {
+			add("appsec_failure_policy", "open", "requests are allowed without inspection when the AppSec component can't be reached")
+		}
+	}
+
+	return warnings
+}
+
+// logWarnings logs the risky values in the configuration.
+func (c *CrowdSec) logWarnings() {
+	for _, w := range c.warnings() {
+		c.logger.Warn("risky configuration", zap.String("option", w.option), zap.String("value", w.value), zap.String("reason", w.reason))
+	}
+}
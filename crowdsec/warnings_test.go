@@ -0,0 +1,81 @@
+package crowdsec
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCrowdSec_warnings(t *testing.T) {
+	tv, fv := true, false
+	tests := []struct {
+		name    string
+		c       *CrowdSec
+		options []string
+	}{
+		{
+			name: "defaults",
+			c:    &CrowdSec{TickerInterval: "60s"},
+		},
+		{
+			name:    "short-ticker-interval",
+			c:       &CrowdSec{TickerInterval: "5s"},
+			options: []string{"ticker_interval"},
+		},
+		{
+			name:    "long-ticker-interval",
+			c:       &CrowdSec{TickerInterval: "1h0m0s"},
+			options: []string{"ticker_interval"},
+		},
+		{
+			name: "live-ignores-ticker-interval",
+			c:    &CrowdSec{TickerInterval: "5s", EnableStreaming: &fv},
+		},
+		{
+			name:    "live-hard-fails",
+			c:       &CrowdSec{TickerInterval: "60s", EnableStreaming: &fv, EnableHardFails: &tv},
+			options: []string{"enable_hard_fails"},
+		},
+		{
+			name: "streaming-hard-fails",
+			c:    &CrowdSec{TickerInterval: "60s", EnableHardFails: &tv},
+		},
+		{
+			name: "appsec",
+			c: &CrowdSec{
+				TickerInterval:      "60s",
+				AppSecUrl:           "http://127.0.0.1:7422",
+				AppSecMaxBodySize:   1 << 20,
+				AppSecFailurePolicy: "closed",
+			},
+		},
+		{
+			name: "appsec-risky",
+			c: &CrowdSec{
+				TickerInterval:    "60s",
+				AppSecUrl:         "http://127.0.0.1:7422",
+				AppSecMaxBodySize: 100 << 20,
+			},
+			options: []string{"appsec_max_body_bytes", "appsec_failure_policy"},
+		},
+		{
+			name: "appsec-unlimited-body",
+			c: &CrowdSec{
+				TickerInterval:      "60s",
+				AppSecUrl:           "http://127.0.0.1:7422",
+				AppSecFailurePolicy: "status:503",
+			},
+			options: []string{"appsec_max_body_bytes"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var options []string
+			for _, w := range tt.c.warnings() {
+				assert.NotEmpty(t, w.reason)
+				options = append(options, w.option)
+			}
+			assert.Equal(t, tt.options, options)
+		})
+	}
+}
@@ -0,0 +1,314 @@
+// Copyright 2024 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package crowdsec
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+	"golang.org/x/time/rate"
+
+	"github.com/hslatman/caddy-crowdsec-bouncer/internal/bouncer"
+)
+
+const (
+	defaultWebhookContentType   = "application/json"
+	defaultWebhookBatchSize     = 50
+	defaultWebhookBatchInterval = 30 * time.Second
+	defaultWebhookRateLimit     = 6
+	defaultWebhookTimeout       = 10 * time.Second
+
+	// maxWebhookEvents is the maximum number of distinct events kept
+	// while webhook requests are rate limited. Events beyond this are
+	// only counted.
+	maxWebhookEvents = 1000
+)
+
+var webhookEventTypes = []string{bouncer.EventRemediation, bouncer.EventDecisionAdded, bouncer.EventDecisionDeleted}
+
+// Webhook configures a webhook that is called when remediations are
+// served, or when decisions are added or deleted. Events are batched,
+// and repeated events for the same IP are aggregated.
+type Webhook struct {
+	// URL the webhook request is sent to.
+	URL string `json:"url"`
+	// Events are the types of events that are sent. Can be "remediation",
+	// "decision_added" and "decision_deleted". Defaults to "remediation".
+	Events []string `json:"events,omitempty"`
+	// Template is a Go text/template rendering the request body from the
+	// batch of events. Its data has the fields Time, Events and Dropped.
+	// A "json" function is available for encoding values. Defaults to
+	// the batch encoded as JSON.
+	Template string `json:"template,omitempty"`
+	// ContentType of the request body. Defaults to "application/json".
+	ContentType string `json:"content_type,omitempty"`
+	// BatchSize is the number of distinct events after which a batch is
+	// sent. Defaults to 50.
+	BatchSize int `json:"batch_size,omitempty"`
+	// BatchInterval is the maximum duration events are batched for.
+	// Defaults to 30s.
+	BatchInterval caddy.Duration `json:"batch_interval,omitempty"`
+	// RateLimit is the maximum number of webhook requests per minute.
+	// Events are kept in the batch until a request is allowed. A negative
+	// value disables rate limiting. Defaults to 6.
+	RateLimit int `json:"rate_limit,omitempty"`
+	// Timeout for webhook requests. Defaults to 10s.
+	Timeout caddy.Duration `json:"timeout,omitempty"`
+}
+
+func (w *Webhook) provision(repl *caddy.Replacer) {
+	w.URL = repl.ReplaceKnown(w.URL, "")
+	if len(w.Events) == 0 {
+		w.Events = []string{bouncer.EventRemediation}
+	}
+	if w.ContentType == "" {
+		w.ContentType = defaultWebhookContentType
+	}
+	if w.BatchSize == 0 {
+		w.BatchSize = defaultWebhookBatchSize
+	}
+	if w.BatchInterval == 0 {
+		w.BatchInterval = caddy.Duration(defaultWebhookBatchInterval)
+	}
+	if w.RateLimit == 0 {
+		w.RateLimit = defaultWebhookRateLimit
+	}
+	if w.Timeout == 0 {
+		w.Timeout = caddy.Duration(defaultWebhookTimeout)
+	}
+}
+
+func (w *Webhook) validate() error {
+	u, err := url.Parse(w.URL)
+	if err != nil {
+		return fmt.Errorf("invalid webhook URL: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("webhook URL %q must have an http or https scheme", u.Redacted())
+	}
+	for _, e := range w.Events {
+		if !slices.Contains(webhookEventTypes, e) {
+			return fmt.Errorf("invalid webhook event %q; must be one of %v", e, webhookEventTypes)
+		}
+	}
+	if w.BatchSize < 0 {
+		return errors.New("webhook batch size must not be negative")
+	}
+	if w.BatchInterval < 0 || w.Timeout < 0 {
+		return errors.New("webhook durations must not be negative")
+	}
+
+	return nil
+}
+
+// webhookEvent is an event in a webhook batch, with the number of
+// times it occurred.
+type webhookEvent struct {
+	bouncer.Event
+	Count    int       `json:"count"`
+	LastTime time.Time `json:"last_time"`
+}
+
+// webhookBatch is the data the webhook template is executed with.
+type webhookBatch struct {
+	Time    time.Time       `json:"time"`
+	Events  []*webhookEvent `json:"events"`
+	Dropped int             `json:"dropped,omitempty"`
+}
+
+// webhookNotifier batches events and sends them to a webhook.
+type webhookNotifier struct {
+	cfg      *Webhook
+	tmpl     *template.Template
+	client   *http.Client
+	limiter  *rate.Limiter
+	logger   *zap.Logger
+	batch    []*webhookEvent
+	index    map[string]*webhookEvent
+	dropped  int
+	cancel   func()
+	done     chan struct{}
+	sendFunc func(ctx context.Context, body []byte) error
+}
+
+func newWebhookNotifier(cfg *Webhook, logger *zap.Logger) (*webhookNotifier, error) {
+	tmpl := template.New("webhook").Funcs(template.FuncMap{
+		"json": func(v any) (string, error) {
+			b, err := json.Marshal(v)
+			return string(b), err
+		},
+	})
+	if cfg.Template != "" {
+		var err error
+		if tmpl, err = tmpl.Parse(cfg.Template); err != nil {
+			return nil, fmt.Errorf("invalid webhook template: %w", err)
+		}
+	} else {
+		tmpl = template.Must(tmpl.Parse("{{ json . }}"))
+	}
+
+	n := &webhookNotifier{
+		cfg:    cfg,
+		tmpl:   tmpl,
+		client: &http.Client{Timeout: time.Duration(cfg.Timeout)},
+		logger: logger,
+		index:  map[string]*webhookEvent{},
+	}
+	if cfg.RateLimit > 0 {
+		n.limiter = rate.NewLimiter(rate.Limit(float64(cfg.RateLimit)/60), 1)
+	}
+	n.sendFunc = n.send
+
+	return n, nil
+}
+
+// start sends the events received from the subscription in batches,
+// until stop is called.
+func (n *webhookNotifier) start(events <-chan bouncer.Event, cancel func()) {
+	n.cancel = cancel
+	n.done = make(chan struct{})
+
+	go func() {
+		defer close(n.done)
+
+		ticker := time.NewTicker(time.Duration(n.cfg.BatchInterval))
+		defer ticker.Stop()
+
+		for {
+			select {
+			case e, ok := <-events:
+				if !ok {
+					n.flush(time.Now())
+					return
+				}
+				if n.add(e) {
+					n.flush(time.Now())
+				}
+			case now := <-ticker.C:
+				n.flush(now)
+			}
+		}
+	}()
+}
+
+// stop cancels the subscription and waits for the remaining events
+// to be sent.
+func (n *webhookNotifier) stop() {
+	if n.cancel == nil {
+		return
+	}
+
+	n.cancel()
+	<-n.done
+}
+
+// add adds e to the batch, reporting whether the batch is full.
+func (n *webhookNotifier) add(e bouncer.Event) bool {
+	if !slices.Contains(n.cfg.Events, e.Type) {
+		return false
+	}
+
+	key := webhookEventKey(e)
+	if we, ok := n.index[key]; ok {
+		we.Count++
+		we.LastTime = e.Time
+		return false
+	}
+
+	if len(n.batch) >= maxWebhookEvents {
+		n.dropped++
+		return false
+	}
+
+	we := &webhookEvent{Event: e, Count: 1, LastTime: e.Time}
+	n.batch = append(n.batch, we)
+	n.index[key] = we
+
+	return len(n.batch) >= n.cfg.BatchSize
+}
+
+func webhookEventKey(e bouncer.Event) string {
+	if e.Decision != nil {
+		return strings.Join([]string{e.Type, e.Decision.Type, e.Decision.Value, e.Decision.Origin, e.Decision.Scenario}, "|")
+	}
+
+	return strings.Join([]string{e.Type, e.Remediation, e.IP, e.Origin}, "|")
+}
+
+// flush sends the batch, unless it's empty or the webhook is being rate
+// limited, in which case the events are kept for the next flush.
+func (n *webhookNotifier) flush(now time.Time) {
+	if len(n.batch) == 0 && n.dropped == 0 {
+		return
+	}
+	if n.limiter != nil && !n.limiter.AllowN(now, 1) {
+		return
+	}
+
+	batch := webhookBatch{Time: now, Events: n.batch, Dropped: n.dropped}
+	n.batch, n.index, n.dropped = nil, map[string]*webhookEvent{}, 0
+
+	var buf bytes.Buffer
+	if err := n.tmpl.Execute(&buf, batch); err != nil {
+		n.logger.Error("failed rendering webhook payload", zap.Error(err))
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(n.cfg.Timeout))
+	defer cancel()
+
+	if err := n.sendFunc(ctx, buf.Bytes()); err != nil {
+		n.logger.Warn("failed sending webhook", zap.Int("events", len(batch.Events)), zap.Error(err))
+	}
+}
+
+func (n *webhookNotifier) send(ctx context.Context, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.cfg.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", n.cfg.ContentType)
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		// the URL isn't logged, as it often contains a secret
+		var uerr *url.Error
+		if errors.As(err, &uerr) {
+			return uerr.Err
+		}
+		return err
+	}
+	defer resp.Body.Close()
+
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook returned status %d", resp.StatusCode)
+	}
+
+	return nil
+}
@@ -0,0 +1,99 @@
+package crowdsec
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/hslatman/caddy-crowdsec-bouncer/internal/bouncer"
+)
+
+func newTestWebhookNotifier(t *testing.T, cfg *Webhook) (*webhookNotifier, *[]string) {
+	t.Helper()
+
+	cfg.provision(caddy.NewReplacer())
+	require.NoError(t, cfg.validate())
+
+	n, err := newWebhookNotifier(cfg, zap.NewNop())
+	require.NoError(t, err)
+
+	var sent []string
+	n.sendFunc = func(_ context.Context, body []byte) error {
+		sent = append(sent, string(body))
+		return nil
+	}
+
+	return n, &sent
+}
+
+func Test_webhookNotifier(t *testing.T) {
+	n, sent := newTestWebhookNotifier(t, &Webhook{URL: "https://hooks.example.com/crowdsec", BatchSize: 2, RateLimit: 1})
+
+	now := time.Now()
+	ban := bouncer.Event{Time: now, Type: bouncer.EventRemediation, IP: "192.0.2.1", Remediation: "ban", Origin: "CAPI"}
+	assert.False(t, n.add(ban))
+	assert.False(t, n.add(ban))
+	assert.False(t, n.add(bouncer.Event{Time: now, Type: bouncer.EventDecisionAdded, Decision: &bouncer.DecisionDetails{Value: "192.0.2.2"}}))
+	assert.True(t, n.add(bouncer.Event{Time: now, Type: bouncer.EventRemediation, IP: "192.0.2.3", Remediation: "captcha"}))
+
+	n.flush(now)
+	require.Len(t, *sent, 1)
+
+	var batch struct {
+		Events []struct {
+			IP          string `json:"ip"`
+			Remediation string `json:"remediation"`
+			Origin      string `json:"origin"`
+			Count       int    `json:"count"`
+		} `json:"events"`
+	}
+	require.NoError(t, json.Unmarshal([]byte((*sent)[0]), &batch))
+	require.Len(t, batch.Events, 2)
+	assert.Equal(t, "192.0.2.1", batch.Events[0].IP)
+	assert.Equal(t, "CAPI", batch.Events[0].Origin)
+	assert.Equal(t, 2, batch.Events[0].Count)
+	assert.Equal(t, "captcha", batch.Events[1].Remediation)
+
+	// events are kept while rate limited
+	n.add(ban)
+	n.flush(now.Add(time.Second))
+	assert.Len(t, *sent, 1)
+	n.flush(now.Add(time.Minute))
+	assert.Len(t, *sent, 2)
+
+	// nothing is sent for an empty batch
+	n.flush(now.Add(2 * time.Minute))
+	assert.Len(t, *sent, 2)
+}
+
+func Test_webhookNotifier_template(t *testing.T) {
+	n, sent := newTestWebhookNotifier(t, &Webhook{
+		URL:      "https://hooks.example.com/crowdsec",
+		Template: `{"text": {{ range .Events }}{{ json (printf "%s served to %s" .Remediation .IP) }}{{ end }}}`,
+	})
+
+	n.add(bouncer.Event{Time: time.Now(), Type: bouncer.EventRemediation, IP: "192.0.2.1", Remediation: "ban"})
+	n.flush(time.Now())
+
+	require.Len(t, *sent, 1)
+	assert.JSONEq(t, `{"text": "ban served to 192.0.2.1"}`, (*sent)[0])
+}
+
+func TestWebhook_validate(t *testing.T) {
+	w := &Webhook{URL: "ftp://example.com"}
+	w.provision(caddy.NewReplacer())
+	assert.Error(t, w.validate())
+
+	w = &Webhook{URL: "https://example.com", Events: []string{"unknown"}}
+	w.provision(caddy.NewReplacer())
+	assert.Error(t, w.validate())
+
+	_, err := newWebhookNotifier(&Webhook{URL: "https://example.com", Template: "{{ .Events"}, zap.NewNop())
+	assert.Error(t, err)
+}
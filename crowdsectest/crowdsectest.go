@@ -0,0 +1,380 @@
+// Copyright 2024 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package crowdsectest provides a fake CrowdSec Local API and AppSec
+// component, for testing Caddy configurations that use the CrowdSec
+// app without running CrowdSec. The Server serves the decisions stream
+// used in streaming mode, the decision lookups used in live mode, and
+// the AppSec endpoint, based on decisions and rules set by the test.
+package crowdsectest
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/crowdsecurity/crowdsec/pkg/models"
+)
+
+const (
+	// DefaultAPIKey is the API key accepted by a new Server.
+	DefaultAPIKey = "crowdsectest"
+
+	appSecPath = "/appsec"
+)
+
+// Server is a fake CrowdSec Local API and AppSec component. Like the
+// Local API, it keeps track of the decisions each bouncer, identified
+// by its API key, has pulled from the stream, so that the stream only
+// returns decisions added or deleted since the previous pull.
+type Server struct {
+	srv *httptest.Server
+
+	mu        sync.Mutex
+	apiKey    string
+	nextID    int64
+	decisions []*models.Decision
+	pending   map[string]*models.DecisionsStreamResponse
+	pulls     int
+	lookups   int
+	appSec    []func(r *http.Request) bool
+	delay     time.Duration
+	canceled  int
+}
+
+// NewServer starts a Server, which is closed when the test finishes.
+func NewServer(tb testing.TB) *Server {
+	tb.Helper()
+
+	s := &Server{
+		apiKey:  DefaultAPIKey,
+		nextID:  1,
+		pending: map[string]*models.DecisionsStreamResponse{},
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/decisions/stream", s.authenticated(s.handleStream))
+	mux.HandleFunc("/v1/decisions", s.authenticated(s.handleDecisions))
+	mux.HandleFunc("/v1/usage-metrics", s.authenticated(s.handleUsageMetrics))
+	mux.HandleFunc(appSecPath, s.handleAppSec)
+
+	s.srv = httptest.NewServer(mux)
+	tb.Cleanup(s.srv.Close)
+
+	return s
+}
+
+// URL returns the URL of the Local API, to be configured as `api_url`.
+func (s *Server) URL() string {
+	return s.srv.URL + "/"
+}
+
+// AppSecURL returns the URL of the AppSec component, to be configured
+// as `appsec_url`.
+func (s *Server) AppSecURL() string {
+	return s.srv.URL + appSecPath
+}
+
+// APIKey returns the API key that the Server accepts, to be configured
+// as `api_key`.
+func (s *Server) APIKey() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.apiKey
+}
+
+// SetAPIKey changes the API key that the Server accepts.
+func (s *Server) SetAPIKey(apiKey string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.apiKey = apiKey
+}
+
+// Pulls returns the number of times the decisions stream was pulled.
+// It can be used to wait for a bouncer to have pulled decisions that
+// were added or deleted.
+func (s *Server) Pulls() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.pulls
+}
+
+// Lookups returns the number of times decisions were looked up, i.e.
+// by a bouncer in live mode.
+func (s *Server) Lookups() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.lookups
+}
+
+// NewDecision returns a decision with the given scope, i.e. "Ip" or
+// "Range", value and type, i.e. "ban" or "captcha". The decision has
+// a duration of 4 hours, and is made by cscli.
+func NewDecision(scope, value, typ string) *models.Decision {
+	duration, origin, scenario := "4h", "cscli", "crowdsectest"
+
+	return &models.Decision{
+		Duration: &duration,
+		Origin:   &origin,
+		Scenario: &scenario,
+		Scope:    &scope,
+		Type:     &typ,
+		Value:    &value,
+	}
+}
+
+// AddDecisions adds decisions, which are returned by lookups, and on the
+// next pull of the stream. Decisions without an ID are assigned one.
+func (s *Server) AddDecisions(decisions ...*models.Decision) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, d := range decisions {
+		if d.ID == 0 {
+			d.ID = s.nextID
+		}
+		s.nextID = max(s.nextID, d.ID+1)
+		s.decisions = append(s.decisions, d)
+		for _, p := range s.pending {
+			p.New = append(p.New, d)
+		}
+	}
+}
+
+// DeleteDecisions deletes all decisions with the given scope and value,
+// which are returned as deleted on the next pull of the stream. It
+// returns the number of decisions deleted.
+func (s *Server) DeleteDecisions(scope, value string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var deleted int
+	remaining := s.decisions[:0]
+	for _, d := range s.decisions {
+		if !strings.EqualFold(stringValue(d.Scope), scope) || stringValue(d.Value) != value {
+			remaining = append(remaining, d)
+			continue
+		}
+		deleted++
+		for _, p := range s.pending {
+			p.Deleted = append(p.Deleted, d)
+		}
+	}
+	clear(s.decisions[len(remaining):])
+	s.decisions = remaining
+
+	return deleted
+}
+
+// BlockAppSecRequests makes the AppSec component block the requests that
+// match returns true for. The request passed to match is the request
+// forwarded to the AppSec component; the properties of the original
+// request are available in its X-Crowdsec-Appsec-* headers, i.e.
+// X-Crowdsec-Appsec-Uri, and its body is the body of the original
+// request. Blocked requests get the "ban" remediation.
+func (s *Server) BlockAppSecRequests(match func(r *http.Request) bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.appSec = append(s.appSec, match)
+}
+
+// DelayDecisions delays the responses to decision lookups by d, to
+// simulate a slow Local API.
+func (s *Server) DelayDecisions(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.delay = d
+}
+
+// CanceledLookups returns the number of decision lookups that were
+// canceled by the bouncer while they were being delayed.
+func (s *Server) CanceledLookups() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.canceled
+}
+
+func (s *Server) authenticated(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Api-Key") != s.APIKey() {
+			writeJSON(w, http.StatusForbidden, map[string]string{"message": "access forbidden"})
+			return
+		}
+		next(w, r)
+	}
+}
+
+func (s *Server) handleStream(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	s.mu.Lock()
+	s.pulls++
+	key := r.Header.Get("X-Api-Key")
+	resp, ok := s.pending[key]
+	if !ok || r.URL.Query().Get("startup") == "true" {
+		resp = &models.DecisionsStreamResponse{New: append(models.GetDecisionsResponse{}, s.decisions...)}
+	}
+	s.pending[key] = &models.DecisionsStreamResponse{}
+	s.mu.Unlock()
+
+	if resp.New == nil {
+		resp.New = models.GetDecisionsResponse{}
+	}
+	if resp.Deleted == nil {
+		resp.Deleted = models.GetDecisionsResponse{}
+	}
+
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (s *Server) handleDecisions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	s.mu.Lock()
+	s.lookups++
+	delay := s.delay
+	s.mu.Unlock()
+	if delay > 0 {
+		select {
+		case <-time.After(delay):
+		case <-r.Context().Done():
+			s.mu.Lock()
+			s.canceled++
+			s.mu.Unlock()
+			return
+		}
+	}
+
+	var matches func(*models.Decision) bool
+	q := r.URL.Query()
+	switch {
+	case q.Get("ip") != "":
+		ip, err := netip.ParseAddr(q.Get("ip"))
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"message": err.Error()})
+			return
+		}
+		matches = func(d *models.Decision) bool {
+			prf, ok := decisionPrefix(d)
+			return ok && prf.Contains(ip)
+		}
+	case q.Get("range") != "":
+		rng, err := netip.ParsePrefix(q.Get("range"))
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"message": err.Error()})
+			return
+		}
+		matches = func(d *models.Decision) bool {
+			prf, ok := decisionPrefix(d)
+			return ok && prf.Overlaps(rng)
+		}
+	default:
+		matches = func(*models.Decision) bool { return true }
+	}
+
+	s.mu.Lock()
+	var decisions models.GetDecisionsResponse
+	for _, d := range s.decisions {
+		if matches(d) {
+			decisions = append(decisions, d)
+		}
+	}
+	s.mu.Unlock()
+
+	// like the Local API, null is returned when there are no decisions
+	writeJSON(w, http.StatusOK, decisions)
+}
+
+func (s *Server) handleUsageMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (s *Server) handleAppSec(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("X-Crowdsec-Appsec-Api-Key") != s.APIKey() {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	s.mu.Lock()
+	rules := append([]func(*http.Request) bool{}, s.appSec...)
+	s.mu.Unlock()
+
+	for _, match := range rules {
+		if match(r) {
+			writeJSON(w, http.StatusForbidden, map[string]any{"action": "ban", "http_status": http.StatusForbidden})
+			return
+		}
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{"action": "allow", "http_status": http.StatusOK})
+}
+
+// decisionPrefix returns the prefix a decision with the Ip or Range
+// scope applies to.
+func decisionPrefix(d *models.Decision) (netip.Prefix, bool) {
+	value := stringValue(d.Value)
+	switch strings.ToLower(stringValue(d.Scope)) {
+	case "ip":
+		ip, err := netip.ParseAddr(value)
+		if err != nil {
+			return netip.Prefix{}, false
+		}
+		return netip.PrefixFrom(ip, ip.BitLen()), true
+	case "range":
+		prf, err := netip.ParsePrefix(value)
+		if err != nil {
+			return netip.Prefix{}, false
+		}
+		return prf.Masked(), true
+	default:
+		return netip.Prefix{}, false
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func stringValue(s *string) string {
+	if s == nil {
+		return ""
+	}
+
+	return *s
+}
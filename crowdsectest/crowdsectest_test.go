@@ -0,0 +1,278 @@
+package crowdsectest
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/crowdsecurity/crowdsec/pkg/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/hslatman/caddy-crowdsec-bouncer/internal/httputils"
+	"github.com/hslatman/caddy-crowdsec-bouncer/internal/testutils"
+)
+
+func get(t *testing.T, s *Server, path, apiKey string) *http.Response {
+	t.Helper()
+
+	req, err := http.NewRequest(http.MethodGet, s.srv.URL+path, http.NoBody)
+	require.NoError(t, err)
+	req.Header.Set("X-Api-Key", apiKey)
+
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	t.Cleanup(func() { resp.Body.Close() })
+
+	return resp
+}
+
+func pull(t *testing.T, s *Server, startup bool, apiKey string) *models.DecisionsStreamResponse {
+	t.Helper()
+
+	resp := get(t, s, fmt.Sprintf("/v1/decisions/stream?startup=%t", startup), apiKey)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var stream models.DecisionsStreamResponse
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&stream))
+
+	return &stream
+}
+
+func TestServer_stream(t *testing.T) {
+	s := NewServer(t)
+	s.AddDecisions(NewDecision("Ip", "127.0.0.1", "ban"), NewDecision("Range", "10.0.0.0/24", "captcha"))
+
+	resp := get(t, s, "/v1/decisions/stream?startup=true", "wrong")
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	assert.Equal(t, 0, s.Pulls())
+
+	stream := pull(t, s, true, DefaultAPIKey)
+	require.Len(t, stream.New, 2)
+	assert.Equal(t, int64(1), stream.New[0].ID)
+	assert.Equal(t, int64(2), stream.New[1].ID)
+	assert.Empty(t, stream.Deleted)
+
+	// only changes since the previous pull are returned
+	stream = pull(t, s, false, DefaultAPIKey)
+	assert.Empty(t, stream.New)
+	assert.Empty(t, stream.Deleted)
+
+	s.AddDecisions(NewDecision("Ip", "127.0.0.2", "ban"))
+	assert.Equal(t, 1, s.DeleteDecisions("ip", "127.0.0.1"))
+	assert.Equal(t, 0, s.DeleteDecisions("Ip", "127.0.0.3"))
+
+	stream = pull(t, s, false, DefaultAPIKey)
+	require.Len(t, stream.New, 1)
+	assert.Equal(t, "127.0.0.2", *stream.New[0].Value)
+	require.Len(t, stream.Deleted, 1)
+	assert.Equal(t, "127.0.0.1", *stream.Deleted[0].Value)
+
+	// a startup pull returns all active decisions
+	stream = pull(t, s, true, DefaultAPIKey)
+	assert.Len(t, stream.New, 2)
+	assert.Empty(t, stream.Deleted)
+
+	// bouncers with another API key track their own pulls
+	s.SetAPIKey("other")
+	stream = pull(t, s, false, "other")
+	assert.Len(t, stream.New, 2)
+
+	assert.Equal(t, 5, s.Pulls())
+}
+
+func TestServer_decisions(t *testing.T) {
+	s := NewServer(t)
+	s.AddDecisions(NewDecision("Ip", "127.0.0.1", "ban"), NewDecision("Range", "10.0.0.0/24", "captcha"), NewDecision("Country", "NL", "ban"))
+
+	tests := []struct {
+		name   string
+		query  string
+		status int
+		want   []string
+	}{
+		{name: "ip", query: "ip=127.0.0.1", status: http.StatusOK, want: []string{"127.0.0.1"}},
+		{name: "ip-in-range", query: "ip=10.0.0.5", status: http.StatusOK, want: []string{"10.0.0.0/24"}},
+		{name: "ip-without-decisions", query: "ip=127.0.0.2", status: http.StatusOK},
+		{name: "range", query: "range=10.0.0.0/16", status: http.StatusOK, want: []string{"10.0.0.0/24"}},
+		{name: "all", status: http.StatusOK, want: []string{"127.0.0.1", "10.0.0.0/24", "NL"}},
+		{name: "invalid-ip", query: "ip=invalid", status: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := get(t, s, "/v1/decisions?"+tt.query, DefaultAPIKey)
+			require.Equal(t, tt.status, resp.StatusCode)
+			if tt.status != http.StatusOK {
+				return
+			}
+
+			var decisions models.GetDecisionsResponse
+			require.NoError(t, json.NewDecoder(resp.Body).Decode(&decisions))
+
+			var values []string
+			for _, d := range decisions {
+				values = append(values, *d.Value)
+			}
+			assert.Equal(t, tt.want, values)
+		})
+	}
+
+	assert.Equal(t, len(tests), s.Lookups())
+}
+
+func TestServer_appSec(t *testing.T) {
+	s := NewServer(t)
+	s.BlockAppSecRequests(func(r *http.Request) bool {
+		return r.Header.Get("X-Crowdsec-Appsec-Verb") == http.MethodDelete
+	})
+
+	do := func(apiKey, verb string) int {
+		req, err := http.NewRequest(http.MethodGet, s.AppSecURL(), http.NoBody)
+		require.NoError(t, err)
+		req.Header.Set("X-Crowdsec-Appsec-Api-Key", apiKey)
+		req.Header.Set("X-Crowdsec-Appsec-Verb", verb)
+
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+
+		return resp.StatusCode
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, do("wrong", http.MethodGet))
+	assert.Equal(t, http.StatusOK, do(DefaultAPIKey, http.MethodGet))
+	assert.Equal(t, http.StatusForbidden, do(DefaultAPIKey, http.MethodDelete))
+}
+
+func newCaddyVarsContext() context.Context {
+	return context.WithValue(context.Background(), caddyhttp.VarsCtxKey, map[string]any{})
+}
+
+func TestServer_streamingBouncer(t *testing.T) {
+	ctx := context.Background()
+
+	lapi := NewServer(t)
+	lapi.AddDecisions(NewDecision("Ip", "127.0.0.1", "ban"))
+
+	config := fmt.Sprintf(`{
+		"api_url": %q,
+		"api_key": %q,
+		"ticker_interval": "1s"
+	}`, lapi.URL(), lapi.APIKey())
+
+	crowdsec := testutils.NewCrowdSecModule(t, ctx, config)
+
+	err := crowdsec.Start()
+	require.NoError(t, err)
+
+	// wait for the initial pull to be processed
+	require.Eventually(t, func() bool {
+		allowed, _, err := crowdsec.IsAllowed(netip.MustParseAddr("127.0.0.1"))
+		return err == nil && !allowed
+	}, 5*time.Second, 50*time.Millisecond)
+
+	// add a ban for 10.0.0.0/24, and delete the ban for 127.0.0.1
+	lapi.AddDecisions(NewDecision("Range", "10.0.0.0/24", "ban"))
+	require.Equal(t, 1, lapi.DeleteDecisions("Ip", "127.0.0.1"))
+
+	require.Eventually(t, func() bool {
+		allowed, _, err := crowdsec.IsAllowed(netip.MustParseAddr("10.0.0.1"))
+		return err == nil && !allowed
+	}, 5*time.Second, 50*time.Millisecond)
+
+	allowed, decision, err := crowdsec.IsAllowed(netip.MustParseAddr("127.0.0.1"))
+	assert.NoError(t, err)
+	assert.True(t, allowed)
+	assert.Nil(t, decision)
+
+	err = crowdsec.Stop()
+	require.NoError(t, err)
+
+	err = crowdsec.Cleanup()
+	require.NoError(t, err)
+}
+
+func TestServer_liveBouncer(t *testing.T) {
+	ctx := context.Background()
+
+	lapi := NewServer(t)
+
+	config := fmt.Sprintf(`{
+		"api_url": %q,
+		"api_key": %q,
+		"enable_streaming": false
+	}`, lapi.URL(), lapi.APIKey())
+
+	crowdsec := testutils.NewCrowdSecModule(t, ctx, config)
+
+	err := crowdsec.Start()
+	require.NoError(t, err)
+
+	allowed, decision, err := crowdsec.IsAllowed(netip.MustParseAddr("127.0.0.1"))
+	assert.NoError(t, err)
+	assert.True(t, allowed)
+	assert.Nil(t, decision)
+
+	lapi.AddDecisions(NewDecision("Ip", "127.0.0.1", "captcha"))
+
+	allowed, decision, err = crowdsec.IsAllowed(netip.MustParseAddr("127.0.0.1"))
+	assert.NoError(t, err)
+	assert.False(t, allowed)
+	if assert.NotNil(t, decision) {
+		assert.Equal(t, "captcha", *decision.Type)
+		assert.Equal(t, "127.0.0.1", *decision.Value)
+	}
+
+	err = crowdsec.Stop()
+	require.NoError(t, err)
+
+	err = crowdsec.Cleanup()
+	require.NoError(t, err)
+}
+
+func TestServer_appSecBouncer(t *testing.T) {
+	ctx := newCaddyVarsContext()
+
+	lapi := NewServer(t)
+	lapi.BlockAppSecRequests(func(r *http.Request) bool {
+		u, err := url.Parse(r.Header.Get("X-Crowdsec-Appsec-Uri"))
+		return err == nil && u.Path == "/rpc2"
+	})
+
+	config := fmt.Sprintf(`{
+		"api_url": %q,
+		"api_key": %q,
+		"enable_streaming": false,
+		"appsec_url": %q
+	}`, lapi.URL(), lapi.APIKey(), lapi.AppSecURL())
+
+	caddyhttp.SetVar(ctx, caddyhttp.ClientIPVarKey, "127.0.0.1")
+	ctx, _ = httputils.EnsureIP(ctx)
+	crowdsec := testutils.NewCrowdSecModule(t, ctx, config)
+
+	err := crowdsec.Start()
+	require.NoError(t, err)
+
+	r := httptest.NewRequest(http.MethodGet, "http://www.example.com", http.NoBody)
+	r = r.WithContext(ctx)
+	err = crowdsec.CheckRequest(ctx, r)
+	assert.NoError(t, err)
+
+	r = httptest.NewRequest(http.MethodGet, "http://www.example.com/rpc2", http.NoBody)
+	r = r.WithContext(ctx)
+	err = crowdsec.CheckRequest(ctx, r)
+	assert.Error(t, err)
+
+	err = crowdsec.Stop()
+	require.NoError(t, err)
+
+	err = crowdsec.Cleanup()
+	require.NoError(t, err)
+}
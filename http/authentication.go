@@ -0,0 +1,151 @@
+// Copyright 2024 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package http
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/caddyauth"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+
+	"github.com/hslatman/caddy-crowdsec-bouncer/crowdsec"
+	"github.com/hslatman/caddy-crowdsec-bouncer/internal/httputils"
+)
+
+func init() {
+	caddy.RegisterModule(AuthenticationProvider{})
+}
+
+// AuthenticationProvider is an authentication provider for the Caddy
+// `authentication` handler that fails authentication for clients with an
+// active decision. This allows CrowdSec checks to be composed with an
+// existing authentication setup. Requests from other clients are passed
+// to the wrapped providers, in the order they're configured.
+//
+// The providers of the `authentication` handler are tried until one of
+// them authenticates the request, so other providers should be wrapped
+// by this one, instead of being configured next to it.
+type AuthenticationProvider struct {
+	// ProvidersRaw are the authentication providers that authenticate
+	// requests from clients without an active decision. They're tried
+	// in order, until one of them authenticates the request. At least
+	// one provider is required.
+	ProvidersRaw []json.RawMessage `json:"providers,omitempty" caddy:"namespace=http.authentication.providers inline_key=provider"`
+
+	providers []caddyauth.Authenticator
+	logger    *zap.Logger
+	crowdsec  *crowdsec.CrowdSec
+}
+
+// CaddyModule returns the Caddy module information.
+func (AuthenticationProvider) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.authentication.providers.crowdsec",
+		New: func() caddy.Module { return new(AuthenticationProvider) },
+	}
+}
+
+// Provision sets up the CrowdSec authentication provider.
+func (p *AuthenticationProvider) Provision(ctx caddy.Context) error {
+	crowdsecAppIface, err := ctx.App("crowdsec")
+	if err != nil {
+		return fmt.Errorf("getting crowdsec app: %v", err)
+	}
+	p.crowdsec = crowdsecAppIface.(*crowdsec.CrowdSec)
+
+	p.logger = p.crowdsec.Logger(ctx.Logger(p))
+
+	if p.ProvidersRaw != nil {
+		mods, err := ctx.LoadModule(p, "ProvidersRaw")
+		if err != nil {
+			return fmt.Errorf("loading authentication providers: %w", err)
+		}
+		for _, mod := range mods.([]any) {
+			p.providers = append(p.providers, mod.(caddyauth.Authenticator))
+		}
+	}
+
+	return nil
+}
+
+// Validate ensures the provider's configuration is valid.
+func (p *AuthenticationProvider) Validate() error {
+	if p.crowdsec == nil {
+		return errors.New("crowdsec app not available")
+	}
+	if len(p.providers) == 0 {
+		return errors.New("at least one authentication provider is required")
+	}
+
+	return nil
+}
+
+// Authenticate fails authentication for clients with an active decision,
+// and passes other requests to the wrapped providers.
+func (p *AuthenticationProvider) Authenticate(w http.ResponseWriter, r *http.Request) (caddyauth.User, bool, error) {
+	ctx, ip := httputils.EnsureIP(r.Context())
+	isAllowed, decision, err := p.crowdsec.IsAllowedRequest(ctx, ip)
+	if err != nil {
+		return caddyauth.User{}, false, err
+	}
+
+	p.crowdsec.RecordProcessed(ip)
+
+	if !isAllowed {
+		if ce := p.logger.Check(zapcore.DebugLevel, "authentication denied"); ce != nil {
+			ce.Write(zap.String("ip", ip.String()), zap.Stringp("type", decision.Type))
+		}
+
+		p.crowdsec.RecordRemediation(*decision.Type, stringValue(decision.Origin), ip)
+		p.crowdsec.LogBlocked(crowdsec.BlockedRequest{
+			IP:       ip,
+			Host:     r.Host,
+			Method:   r.Method,
+			Path:     r.URL.Path,
+			Type:     *decision.Type,
+			Origin:   stringValue(decision.Origin),
+			Scenario: stringValue(decision.Scenario),
+			Module:   string(p.CaddyModule().ID),
+		})
+
+		return caddyauth.User{}, false, nil
+	}
+
+	for _, provider := range p.providers {
+		user, authenticated, err := provider.Authenticate(w, r)
+		if err != nil {
+			p.logger.Error("auth provider returned error", zap.String("provider", caddy.GetModuleName(provider)), zap.Error(err))
+			continue
+		}
+		if authenticated {
+			return user, true, nil
+		}
+	}
+
+	return caddyauth.User{}, false, nil
+}
+
+// Interface guards
+var (
+	_ caddy.Module            = (*AuthenticationProvider)(nil)
+	_ caddy.Provisioner       = (*AuthenticationProvider)(nil)
+	_ caddy.Validator         = (*AuthenticationProvider)(nil)
+	_ caddyauth.Authenticator = (*AuthenticationProvider)(nil)
+)
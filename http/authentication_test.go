@@ -0,0 +1,133 @@
+package http
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/caddyauth"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+
+	"github.com/hslatman/caddy-crowdsec-bouncer/crowdsec"
+	"github.com/hslatman/caddy-crowdsec-bouncer/crowdsectest"
+)
+
+type fakeAuthenticator struct {
+	name          string
+	authenticated bool
+	err           error
+	calls         *[]string
+}
+
+func (a fakeAuthenticator) Authenticate(_ http.ResponseWriter, _ *http.Request) (caddyauth.User, bool, error) {
+	*a.calls = append(*a.calls, a.name)
+	if !a.authenticated {
+		return caddyauth.User{}, false, a.err
+	}
+	return caddyauth.User{ID: a.name}, true, nil
+}
+
+func TestAuthenticationProvider_Authenticate(t *testing.T) {
+	lapi := crowdsectest.NewServer(t)
+	lapi.AddDecisions(crowdsectest.NewDecision("Ip", "127.0.0.1", "ban"))
+	cs := newCrowdSec(t, lapi)
+
+	tests := []struct {
+		name          string
+		clientIP      string
+		providers     []fakeAuthenticator
+		authenticated bool
+		user          string
+		calls         []string
+	}{
+		{
+			name:          "banned",
+			clientIP:      "127.0.0.1",
+			providers:     []fakeAuthenticator{{name: "first", authenticated: true}},
+			authenticated: false,
+		},
+		{
+			name:          "allowed",
+			clientIP:      "10.0.0.1",
+			providers:     []fakeAuthenticator{{name: "first", authenticated: true}},
+			authenticated: true,
+			user:          "first",
+			calls:         []string{"first"},
+		},
+		{
+			name:     "allowed/in-order",
+			clientIP: "10.0.0.1",
+			providers: []fakeAuthenticator{
+				{name: "failing", err: errors.New("failed")},
+				{name: "denying"},
+				{name: "second", authenticated: true},
+				{name: "third", authenticated: true},
+			},
+			authenticated: true,
+			user:          "second",
+			calls:         []string{"failing", "denying", "second"},
+		},
+		{
+			name:          "allowed/not-authenticated",
+			clientIP:      "10.0.0.1",
+			providers:     []fakeAuthenticator{{name: "first"}, {name: "second"}},
+			authenticated: false,
+			calls:         []string{"first", "second"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls []string
+			p := &AuthenticationProvider{
+				logger:   zaptest.NewLogger(t),
+				crowdsec: cs,
+			}
+			for _, a := range tt.providers {
+				a.calls = &calls
+				p.providers = append(p.providers, a)
+			}
+
+			r := newRequest(http.MethodGet, "/", tt.clientIP, false)
+			user, authenticated, err := p.Authenticate(httptest.NewRecorder(), r)
+			require.NoError(t, err)
+
+			assert.Equal(t, tt.authenticated, authenticated)
+			assert.Equal(t, tt.user, user.ID)
+			assert.Equal(t, tt.calls, calls)
+		})
+	}
+}
+
+func TestAuthenticationProvider_Validate(t *testing.T) {
+	var calls []string
+	provider := fakeAuthenticator{name: "first", calls: &calls}
+
+	tests := []struct {
+		name      string
+		crowdsec  *crowdsec.CrowdSec
+		providers []caddyauth.Authenticator
+		wantErr   bool
+	}{
+		{name: "ok", crowdsec: &crowdsec.CrowdSec{}, providers: []caddyauth.Authenticator{provider}},
+		{name: "fail/no-crowdsec", providers: []caddyauth.Authenticator{provider}, wantErr: true},
+		{name: "fail/no-providers", crowdsec: &crowdsec.CrowdSec{}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &AuthenticationProvider{
+				crowdsec:  tt.crowdsec,
+				providers: tt.providers,
+			}
+			err := p.Validate()
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+
+			assert.NoError(t, err)
+		})
+	}
+}
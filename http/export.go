@@ -0,0 +1,164 @@
+// Copyright 2024 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package http
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+
+	"github.com/hslatman/caddy-crowdsec-bouncer/crowdsec"
+	"github.com/hslatman/caddy-crowdsec-bouncer/internal/bouncer"
+)
+
+func init() {
+	caddy.RegisterModule(ExportHandler{})
+	httpcaddyfile.RegisterHandlerDirective("crowdsec_export", parseCaddyfileExportDirective)
+}
+
+// ExportHandler is a terminal handler that serves the decisions streamed
+// from the CrowdSec Local API in the JSON format of a blocklist mirror.
+// One instance in a fleet can maintain the stream, while the others pull
+// the decisions from it using `blocklist_mirror`, so that the Local API
+// serves a single stream instead of one per instance.
+type ExportHandler struct {
+	// APIKey is the key that clients must send in the X-Api-Key header.
+	// It's required, so that the decisions, and with them the IPs known
+	// to the Local API, aren't served to anyone who can reach the route.
+	// Supports Caddy placeholders.
+	APIKey string `json:"api_key,omitempty"`
+
+	logger   *zap.Logger
+	crowdsec *crowdsec.CrowdSec
+}
+
+// CaddyModule returns the Caddy module information.
+func (ExportHandler) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.handlers.crowdsec_export",
+		New: func() caddy.Module { return new(ExportHandler) },
+	}
+}
+
+// Provision sets up the CrowdSec export handler.
+func (h *ExportHandler) Provision(ctx caddy.Context) error {
+	crowdsecAppIface, err := ctx.App("crowdsec")
+	if err != nil {
+		return fmt.Errorf("getting crowdsec app: %v", err)
+	}
+	h.crowdsec = crowdsecAppIface.(*crowdsec.CrowdSec)
+
+	h.logger = h.crowdsec.Logger(ctx.Logger(h))
+
+	h.APIKey = caddy.NewReplacer().ReplaceKnown(h.APIKey, "")
+
+	return nil
+}
+
+// Validate ensures the handler's configuration is valid.
+func (h *ExportHandler) Validate() error {
+	if h.crowdsec == nil {
+		return errors.New("crowdsec app not available")
+	}
+	if h.APIKey == "" {
+		return errors.New("api key is required for exporting decisions")
+	}
+
+	return nil
+}
+
+// ServeHTTP is the Caddy handler for serving exported decisions.
+func (h *ExportHandler) ServeHTTP(w http.ResponseWriter, r *http.Request, _ caddyhttp.Handler) error {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		return caddyhttp.Error(http.StatusMethodNotAllowed, fmt.Errorf("method not allowed: %v", r.Method))
+	}
+
+	if subtle.ConstantTimeCompare([]byte(r.Header.Get("X-Api-Key")), []byte(h.APIKey)) != 1 {
+		return caddyhttp.Error(http.StatusForbidden, errors.New("invalid api key"))
+	}
+
+	decisions, err := h.crowdsec.Export()
+	if err != nil {
+		if errors.Is(err, bouncer.ErrNotStreaming) {
+			return caddyhttp.Error(http.StatusServiceUnavailable, errors.New("exporting decisions requires streaming mode"))
+		}
+		return caddyhttp.Error(http.StatusInternalServerError, err)
+	}
+
+	h.logger.Debug("exporting decisions",
+		zap.String("remote_addr", r.RemoteAddr),
+		zap.Int("decisions", len(decisions)),
+	)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	if r.Method == http.MethodHead {
+		return nil
+	}
+
+	return json.NewEncoder(w).Encode(decisions)
+}
+
+// UnmarshalCaddyfile implements caddyfile.Unmarshaler. Syntax:
+//
+//	crowdsec_export {
+//		api_key <key>
+//	}
+func (h *ExportHandler) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+		for d.NextBlock(0) {
+			switch d.Val() {
+			case "api_key":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				h.APIKey = d.Val()
+			default:
+				return d.Errf("invalid configuration token %q provided", d.Val())
+			}
+		}
+	}
+
+	return nil
+}
+
+// parseCaddyfileExportDirective parses the `crowdsec_export` Caddyfile directive
+func parseCaddyfileExportDirective(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error) {
+	var handler ExportHandler
+	err := handler.UnmarshalCaddyfile(h.Dispenser)
+	return &handler, err
+}
+
+// Interface guards
+var (
+	_ caddy.Module                = (*ExportHandler)(nil)
+	_ caddy.Provisioner           = (*ExportHandler)(nil)
+	_ caddy.Validator             = (*ExportHandler)(nil)
+	_ caddyhttp.MiddlewareHandler = (*ExportHandler)(nil)
+	_ caddyfile.Unmarshaler       = (*ExportHandler)(nil)
+)
@@ -0,0 +1,149 @@
+package http
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/crowdsecurity/crowdsec/pkg/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+
+	"github.com/hslatman/caddy-crowdsec-bouncer/crowdsec"
+	"github.com/hslatman/caddy-crowdsec-bouncer/crowdsectest"
+	"github.com/hslatman/caddy-crowdsec-bouncer/internal/testutils"
+)
+
+// newStreamingCrowdSec returns a started CrowdSec app in streaming mode,
+// after it has processed the decisions in lapi.
+func newStreamingCrowdSec(t *testing.T, lapi *crowdsectest.Server, decisions int) *crowdsec.CrowdSec {
+	t.Helper()
+
+	config := fmt.Sprintf(`{
+		"api_url": %q,
+		"api_key": %q,
+		"ticker_interval": "1s"
+	}`, lapi.URL(), lapi.APIKey())
+
+	cs := testutils.NewCrowdSecModule(t, context.Background(), config)
+	require.NoError(t, cs.Start())
+	t.Cleanup(func() {
+		require.NoError(t, cs.Stop())
+		require.NoError(t, cs.Cleanup())
+	})
+
+	require.Eventually(t, func() bool {
+		exported, err := cs.Export()
+		return err == nil && len(exported) == decisions
+	}, 5*time.Second, 50*time.Millisecond)
+
+	return cs
+}
+
+func TestExportHandler_ServeHTTP(t *testing.T) {
+	lapi := crowdsectest.NewServer(t)
+	lapi.AddDecisions(
+		crowdsectest.NewDecision("Ip", "127.0.0.1", "ban"),
+		crowdsectest.NewDecision("Range", "10.0.0.0/24", "captcha"),
+	)
+
+	streaming := &ExportHandler{APIKey: "secret", logger: zaptest.NewLogger(t), crowdsec: newStreamingCrowdSec(t, lapi, 2)}
+	live := &ExportHandler{APIKey: "secret", logger: zaptest.NewLogger(t), crowdsec: newCrowdSec(t, lapi)}
+
+	tests := []struct {
+		name      string
+		handler   *ExportHandler
+		method    string
+		apiKey    string
+		status    int
+		decisions int
+	}{
+		{name: "ok", handler: streaming, method: http.MethodGet, apiKey: "secret", status: http.StatusOK, decisions: 2},
+		{name: "head", handler: streaming, method: http.MethodHead, apiKey: "secret", status: http.StatusOK},
+		{name: "method-not-allowed", handler: streaming, method: http.MethodPost, apiKey: "secret", status: http.StatusMethodNotAllowed},
+		{name: "missing-api-key", handler: streaming, method: http.MethodGet, status: http.StatusForbidden},
+		{name: "wrong-api-key", handler: streaming, method: http.MethodGet, apiKey: "wrong", status: http.StatusForbidden},
+		{name: "not-streaming", handler: live, method: http.MethodGet, apiKey: "secret", status: http.StatusServiceUnavailable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, "/decisions", http.NoBody)
+			if tt.apiKey != "" {
+				r.Header.Set("X-Api-Key", tt.apiKey)
+			}
+
+			w := httptest.NewRecorder()
+			err := tt.handler.ServeHTTP(w, r, nil)
+			if tt.status != http.StatusOK {
+				var handlerErr caddyhttp.HandlerError
+				require.ErrorAs(t, err, &handlerErr)
+				assert.Equal(t, tt.status, handlerErr.StatusCode)
+				if tt.status == http.StatusMethodNotAllowed {
+					assert.Equal(t, "GET, HEAD", w.Header().Get("Allow"))
+				}
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, http.StatusOK, w.Code)
+			assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+			if tt.method == http.MethodHead {
+				assert.Empty(t, w.Body.Bytes())
+				return
+			}
+
+			var decisions []*models.Decision
+			require.NoError(t, json.NewDecoder(w.Body).Decode(&decisions))
+			assert.Len(t, decisions, tt.decisions)
+		})
+	}
+}
+
+func TestExportHandler_Validate(t *testing.T) {
+	lapi := crowdsectest.NewServer(t)
+	cs := newCrowdSec(t, lapi)
+
+	assert.Error(t, (&ExportHandler{APIKey: "secret"}).Validate())
+	assert.EqualError(t, (&ExportHandler{crowdsec: cs}).Validate(), "api key is required for exporting decisions")
+	assert.NoError(t, (&ExportHandler{APIKey: "secret", crowdsec: cs}).Validate())
+}
+
+func TestExportHandler_UnmarshalCaddyfile(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    string
+		wantErr bool
+	}{
+		{name: "ok", input: `crowdsec_export {
+			api_key {env.EXPORT_API_KEY}
+		}`, want: "{env.EXPORT_API_KEY}"},
+		{name: "fail/argument", input: `crowdsec_export secret`, wantErr: true},
+		{name: "fail/missing-api-key-value", input: `crowdsec_export {
+			api_key
+		}`, wantErr: true},
+		{name: "fail/unknown-token", input: `crowdsec_export {
+			format json
+		}`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var h ExportHandler
+			err := h.UnmarshalCaddyfile(caddyfile.NewTestDispenser(tt.input))
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, h.APIKey)
+		})
+	}
+}
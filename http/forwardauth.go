@@ -0,0 +1,179 @@
+// Copyright 2024 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package http
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+
+	"github.com/hslatman/caddy-crowdsec-bouncer/crowdsec"
+	"github.com/hslatman/caddy-crowdsec-bouncer/internal/httputils"
+)
+
+func init() {
+	caddy.RegisterModule(ForwardAuthHandler{})
+	httpcaddyfile.RegisterHandlerDirective("crowdsec_forward_auth", parseCaddyfileForwardAuthDirective)
+}
+
+// ForwardAuthHandler is a terminal handler that exposes the CrowdSec
+// decisions known to the CrowdSec app as a forward authentication
+// endpoint. Proxies like Traefik (forwardAuth) and nginx (auth_request)
+// can use it as their remediation backend. The client IP is taken from
+// the X-Forwarded-For header set by the proxy, which must be configured
+// as a trusted proxy of the Caddy server. A 200 response is returned
+// when the client is allowed; a remediation response otherwise.
+type ForwardAuthHandler struct {
+	logger   *zap.Logger
+	crowdsec *crowdsec.CrowdSec
+}
+
+// CaddyModule returns the Caddy module information.
+func (ForwardAuthHandler) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.handlers.crowdsec_forward_auth",
+		New: func() caddy.Module { return new(ForwardAuthHandler) },
+	}
+}
+
+// Provision sets up the CrowdSec forward auth handler.
+func (h *ForwardAuthHandler) Provision(ctx caddy.Context) error {
+	crowdsecAppIface, err := ctx.App("crowdsec")
+	if err != nil {
+		return fmt.Errorf("getting crowdsec app: %v", err)
+	}
+	h.crowdsec = crowdsecAppIface.(*crowdsec.CrowdSec)
+
+	h.logger = h.crowdsec.Logger(ctx.Logger(h))
+
+	return nil
+}
+
+// Validate ensures the handler's configuration is valid.
+func (h *ForwardAuthHandler) Validate() error {
+	if h.crowdsec == nil {
+		return errors.New("crowdsec app not available")
+	}
+
+	return nil
+}
+
+// ServeHTTP is the Caddy handler for serving forward auth requests.
+func (h *ForwardAuthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request, _ caddyhttp.Handler) error {
+	ip, err := forwardedIP(r)
+	if err != nil {
+		return caddyhttp.Error(http.StatusBadRequest, err)
+	}
+
+	isAllowed, decision, err := h.crowdsec.IsAllowedRequest(r.Context(), ip)
+	if err != nil {
+		return err
+	}
+
+	h.crowdsec.RecordProcessed(ip)
+
+	if !isAllowed {
+		h.logger.Debug("forward auth denied",
+			zap.String("ip", ip.String()),
+			zap.String("host", r.Header.Get("X-Forwarded-Host")),
+		)
+
+		typ := stringValue(decision.Type)
+		h.crowdsec.RecordRemediation(typ, stringValue(decision.Origin), ip)
+		path, _, _ := strings.Cut(r.Header.Get("X-Forwarded-Uri"), "?")
+		h.crowdsec.LogBlocked(crowdsec.BlockedRequest{
+			IP:       ip,
+			Host:     r.Header.Get("X-Forwarded-Host"),
+			Method:   r.Header.Get("X-Forwarded-Method"),
+			Path:     path,
+			Type:     typ,
+			Origin:   stringValue(decision.Origin),
+			Scenario: stringValue(decision.Scenario),
+			Module:   string(h.CaddyModule().ID),
+		})
+
+		return httputils.WriteResponse(w, h.logger, typ, stringValue(decision.Value), stringValue(decision.Duration), 0)
+	}
+
+	w.WriteHeader(http.StatusOK)
+
+	return nil
+}
+
+// forwardedIP returns the client IP to check. When the request was
+// received from a trusted proxy, the rightmost entry of the X-Forwarded-For
+// header is used, as that is the one set by the proxy performing the
+// forward auth request. Otherwise the header may have been set by the
+// client itself, so the client IP determined by Caddy is used.
+func forwardedIP(r *http.Request) (netip.Addr, error) {
+	xff := r.Header.Values("X-Forwarded-For")
+	trusted, _ := caddyhttp.GetVar(r.Context(), caddyhttp.TrustedProxyVarKey).(bool)
+	if !trusted || len(xff) == 0 {
+		_, ip := httputils.EnsureIP(r.Context())
+		if !ip.IsValid() {
+			return netip.Addr{}, errors.New("could not determine client IP")
+		}
+		return ip, nil
+	}
+
+	hops := strings.Split(xff[len(xff)-1], ",")
+	value := strings.TrimSpace(hops[len(hops)-1])
+	ip, err := netip.ParseAddr(value)
+	if err != nil {
+		return netip.Addr{}, fmt.Errorf("invalid X-Forwarded-For value %q", value)
+	}
+
+	return httputils.NormalizeIP(ip), nil
+}
+
+// UnmarshalCaddyfile implements caddyfile.Unmarshaler. Syntax:
+//
+//	crowdsec_forward_auth
+func (h *ForwardAuthHandler) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+		for d.NextBlock(0) {
+			return d.Errf("invalid configuration token %q provided", d.Val())
+		}
+	}
+
+	return nil
+}
+
+// parseCaddyfileForwardAuthDirective parses the `crowdsec_forward_auth` Caddyfile directive
+func parseCaddyfileForwardAuthDirective(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error) {
+	var handler ForwardAuthHandler
+	err := handler.UnmarshalCaddyfile(h.Dispenser)
+	return &handler, err
+}
+
+// Interface guards
+var (
+	_ caddy.Module                = (*ForwardAuthHandler)(nil)
+	_ caddy.Provisioner           = (*ForwardAuthHandler)(nil)
+	_ caddy.Validator             = (*ForwardAuthHandler)(nil)
+	_ caddyhttp.MiddlewareHandler = (*ForwardAuthHandler)(nil)
+	_ caddyfile.Unmarshaler       = (*ForwardAuthHandler)(nil)
+)
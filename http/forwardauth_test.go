@@ -0,0 +1,97 @@
+package http
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+
+	"github.com/hslatman/caddy-crowdsec-bouncer/crowdsectest"
+)
+
+func TestForwardAuthHandler_ServeHTTP(t *testing.T) {
+	lapi := crowdsectest.NewServer(t)
+	lapi.AddDecisions(
+		crowdsectest.NewDecision("Ip", "127.0.0.1", "ban"),
+		crowdsectest.NewDecision("Ip", "127.0.0.2", "captcha"),
+	)
+
+	h := &ForwardAuthHandler{
+		logger:   zaptest.NewLogger(t),
+		crowdsec: newCrowdSec(t, lapi),
+	}
+
+	tests := []struct {
+		name     string
+		clientIP string
+		trusted  bool
+		xff      []string
+		status   int
+		wantErr  bool
+	}{
+		{name: "allowed", clientIP: "10.0.0.1", status: http.StatusOK},
+		{name: "banned", clientIP: "127.0.0.1", status: http.StatusForbidden},
+		{name: "captcha", clientIP: "127.0.0.2", status: http.StatusForbidden},
+		{name: "untrusted-xff-ignored", clientIP: "10.0.0.1", xff: []string{"127.0.0.1"}, status: http.StatusOK},
+		{name: "untrusted-xff-clean-ip", clientIP: "127.0.0.1", xff: []string{"10.0.0.1"}, status: http.StatusForbidden},
+		{name: "trusted-xff-banned", clientIP: "10.0.0.1", trusted: true, xff: []string{"10.0.0.2, 127.0.0.1"}, status: http.StatusForbidden},
+		{name: "trusted-xff-rightmost", clientIP: "10.0.0.1", trusted: true, xff: []string{"127.0.0.1, 10.0.0.2"}, status: http.StatusOK},
+		{name: "trusted-xff-last-header", clientIP: "10.0.0.1", trusted: true, xff: []string{"10.0.0.2", "127.0.0.1"}, status: http.StatusForbidden},
+		{name: "trusted-xff-mapped", clientIP: "10.0.0.1", trusted: true, xff: []string{"::ffff:127.0.0.1"}, status: http.StatusForbidden},
+		{name: "trusted-without-xff", clientIP: "127.0.0.1", trusted: true, status: http.StatusForbidden},
+		{name: "trusted-xff-invalid", clientIP: "10.0.0.1", trusted: true, xff: []string{"invalid"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newRequest(http.MethodGet, "/auth", tt.clientIP, tt.trusted)
+			for _, v := range tt.xff {
+				r.Header.Add("X-Forwarded-For", v)
+			}
+
+			w := httptest.NewRecorder()
+			err := h.ServeHTTP(w, r, nil)
+			if tt.wantErr {
+				var handlerErr caddyhttp.HandlerError
+				require.ErrorAs(t, err, &handlerErr)
+				assert.Equal(t, http.StatusBadRequest, handlerErr.StatusCode)
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, tt.status, w.Code)
+		})
+	}
+}
+
+func TestForwardAuthHandler_UnmarshalCaddyfile(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		wantErr bool
+	}{
+		{name: "ok", input: `crowdsec_forward_auth`},
+		{name: "ok/empty-block", input: `crowdsec_forward_auth {
+		}`},
+		{name: "fail/argument", input: `crowdsec_forward_auth 127.0.0.1`, wantErr: true},
+		{name: "fail/unknown-token", input: `crowdsec_forward_auth {
+			header X-Real-Ip
+		}`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var h ForwardAuthHandler
+			err := h.UnmarshalCaddyfile(caddyfile.NewTestDispenser(tt.input))
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+
+			assert.NoError(t, err)
+		})
+	}
+}
@@ -15,20 +15,29 @@
 package http
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"net/http"
+	"net/http/httptest"
 	"net/netip"
+	"time"
 
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
 	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/crowdsecurity/crowdsec/pkg/models"
 	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
 
 	_ "github.com/hslatman/caddy-crowdsec-bouncer/appsec" // always include AppSec module when HTTP is added
 	"github.com/hslatman/caddy-crowdsec-bouncer/crowdsec"
+	"github.com/hslatman/caddy-crowdsec-bouncer/internal/bouncer"
+	"github.com/hslatman/caddy-crowdsec-bouncer/internal/bypass"
+	"github.com/hslatman/caddy-crowdsec-bouncer/internal/duration"
 	"github.com/hslatman/caddy-crowdsec-bouncer/internal/httputils"
+	"github.com/hslatman/caddy-crowdsec-bouncer/internal/verdict"
 )
 
 func init() {
@@ -38,8 +47,82 @@ func init() {
 
 // Handler matches request IPs to CrowdSec decisions to (dis)allow access.
 type Handler struct {
-	logger   *zap.Logger
-	crowdsec *crowdsec.CrowdSec
+	// ExposeDecisionHeader enables setting the X-CrowdSec-Decision
+	// response header, describing why a request was blocked. This
+	// is intended for debugging, e.g. in staging environments.
+	ExposeDecisionHeader bool `json:"expose_decision_header,omitempty"`
+	// ExemptRaw is a list of matcher sets. Requests matching any of
+	// the sets bypass the CrowdSec decision lookup.
+	ExemptRaw caddyhttp.RawMatcherSets `json:"exempt,omitempty" caddy:"namespace=http.matchers"`
+	// CheckForwardedHops enables checking the IPs in the client IP
+	// headers (X-Forwarded-For by default) against the CrowdSec
+	// decisions, in addition to the client IP. The request is blocked
+	// if any of the hops has an active decision. Hops are only checked
+	// when the request was received from a trusted proxy, and only the
+	// values added by trusted proxies are checked: the hops are walked
+	// from the right, up to and including the first hop that's not in
+	// ForwardedTrustedProxies.
+	CheckForwardedHops bool `json:"check_forwarded_hops,omitempty"`
+	// ForwardedTrustedProxies are the IP ranges of the proxies whose
+	// values in the client IP headers are trusted when checking forwarded
+	// hops. The value `private_ranges` expands to all private IP ranges.
+	// By default, only the rightmost hop, which was added by the trusted
+	// proxy the request was received from, is checked.
+	ForwardedTrustedProxies []string `json:"forwarded_trusted_proxies,omitempty"`
+	// ReturnErrors makes the handler return a Caddy HTTP error for
+	// blocked requests, instead of writing the response directly. The
+	// response can then be customized using the error routes of the
+	// server (i.e. `handle_errors`). Details about the decision are
+	// available through the {http.vars.crowdsec_decision_*} placeholders.
+	ReturnErrors bool `json:"return_errors,omitempty"`
+	// BypassSecret enables signed bypass tokens. A request carrying a
+	// valid token is allowed, even if the client IP has an active
+	// decision. This allows an administrator who accidentally banned
+	// their own IP to still reach the site. Tokens have the format
+	// <expiry>.<signature>, with expiry a Unix timestamp and signature
+	// the hex encoded HMAC-SHA256 of <ip>;<expiry>, keyed with the
+	// secret, so that a token is only valid for the client IP it was
+	// created for.
+	BypassSecret string `json:"bypass_secret,omitempty"`
+	// BypassHeader is the request header the bypass token is read
+	// from. Defaults to "X-Crowdsec-Bypass".
+	BypassHeader string `json:"bypass_header,omitempty"`
+	// BypassQueryParam is the query parameter the bypass token is read
+	// from if it's not in the header. Query parameters end up in access
+	// logs and browser history, so tokens are only read from the query
+	// if this is set.
+	BypassQueryParam string `json:"bypass_query_param,omitempty"`
+	// BypassMaxTTL is the maximum remaining lifetime a bypass token
+	// can have to be accepted. Defaults to 24h.
+	BypassMaxTTL caddy.Duration `json:"bypass_max_ttl,omitempty"`
+	// VerdictSecret enables signed verdict headers for setups with an
+	// edge Caddy instance proxying to an origin Caddy instance. The edge
+	// signs a header stating that the client IP was allowed, and the
+	// origin accepts it instead of checking the client IP again. Both
+	// instances must be configured with the same secret.
+	VerdictSecret string `json:"verdict_secret,omitempty"`
+	// VerdictHeader is the request header carrying the signed verdict.
+	// Defaults to "X-Crowdsec-Verdict".
+	VerdictHeader string `json:"verdict_header,omitempty"`
+	// SignVerdict adds a signed verdict header to allowed requests, so
+	// that the instance they're proxied to can trust it.
+	SignVerdict bool `json:"sign_verdict,omitempty"`
+	// TrustVerdict allows requests carrying a valid verdict header for
+	// the client IP without looking up its decisions.
+	TrustVerdict bool `json:"trust_verdict,omitempty"`
+	// VerdictMaxAge is the maximum age of a verdict header to be
+	// accepted. Defaults to 30s.
+	VerdictMaxAge caddy.Duration `json:"verdict_max_age,omitempty"`
+	// ServerTiming adds a `Server-Timing: crowdsec;dur=<ms>` entry to
+	// responses, with the time it took to check the request, so that
+	// the latency added by the bouncer can be seen in the browser
+	// developer tools.
+	ServerTiming bool `json:"server_timing,omitempty"`
+
+	logger                  *zap.Logger
+	crowdsec                *crowdsec.CrowdSec
+	exempt                  caddyhttp.MatcherSets
+	forwardedTrustedProxies []netip.Prefix
 }
 
 // CaddyModule returns the Caddy module information.
@@ -58,7 +141,59 @@ func (h *Handler) Provision(ctx caddy.Context) error {
 	}
 	h.crowdsec = crowdsecAppIface.(*crowdsec.CrowdSec)
 
-	h.logger = ctx.Logger(h)
+	h.logger = h.crowdsec.Logger(ctx.Logger(h))
+	h.crowdsec.RegisterSimulator(h)
+
+	// options can be set using placeholders, like {env.*}, which are
+	// replaced once
+	repl := caddy.NewReplacer()
+	h.BypassSecret = repl.ReplaceKnown(h.BypassSecret, "")
+	h.BypassHeader = repl.ReplaceKnown(h.BypassHeader, "")
+	h.BypassQueryParam = repl.ReplaceKnown(h.BypassQueryParam, "")
+	h.VerdictSecret = repl.ReplaceKnown(h.VerdictSecret, "")
+	h.VerdictHeader = repl.ReplaceKnown(h.VerdictHeader, "")
+
+	if h.BypassSecret != "" {
+		if h.BypassHeader == "" {
+			h.BypassHeader = "X-Crowdsec-Bypass"
+		}
+		if h.BypassMaxTTL == 0 {
+			h.BypassMaxTTL = caddy.Duration(24 * time.Hour)
+		}
+	}
+
+	if h.VerdictSecret != "" {
+		if h.VerdictHeader == "" {
+			h.VerdictHeader = "X-Crowdsec-Verdict"
+		}
+		if h.VerdictMaxAge == 0 {
+			h.VerdictMaxAge = caddy.Duration(30 * time.Second)
+		}
+	}
+
+	for _, expr := range h.ForwardedTrustedProxies {
+		if expr == "private_ranges" {
+			for _, cidr := range caddyhttp.PrivateRangesCIDR() {
+				h.forwardedTrustedProxies = append(h.forwardedTrustedProxies, netip.MustParsePrefix(cidr))
+			}
+			continue
+		}
+		prefix, err := caddyhttp.CIDRExpressionToPrefix(expr)
+		if err != nil {
+			return fmt.Errorf("invalid forwarded trusted proxy %q: %w", expr, err)
+		}
+		h.forwardedTrustedProxies = append(h.forwardedTrustedProxies, prefix)
+	}
+
+	if h.ExemptRaw != nil {
+		matcherSets, err := ctx.LoadModule(h, "ExemptRaw")
+		if err != nil {
+			return fmt.Errorf("loading exempt matchers: %w", err)
+		}
+		if err := h.exempt.FromInterface(matcherSets); err != nil {
+			return fmt.Errorf("loading exempt matchers: %w", err)
+		}
+	}
 
 	return nil
 }
@@ -68,6 +203,21 @@ func (h *Handler) Validate() error {
 	if h.crowdsec == nil {
 		return errors.New("crowdsec app not available")
 	}
+	if h.VerdictSecret == "" && (h.SignVerdict || h.TrustVerdict) {
+		return errors.New("signing or trusting verdict headers requires a verdict secret")
+	}
+	if h.VerdictSecret != "" && !h.SignVerdict && !h.TrustVerdict {
+		return errors.New("verdict secret requires signing or trusting verdict headers")
+	}
+	if err := duration.Check("verdict max_age", h.VerdictMaxAge); err != nil {
+		return err
+	}
+	if err := duration.Check("bypass max_ttl", h.BypassMaxTTL); err != nil {
+		return err
+	}
+	if len(h.ForwardedTrustedProxies) > 0 && !h.CheckForwardedHops {
+		return errors.New("forwarded trusted proxies require checking forwarded hops")
+	}
 
 	return nil
 }
@@ -81,27 +231,45 @@ func (h *Handler) Cleanup() error {
 
 // ServeHTTP is the Caddy handler for serving HTTP requests.
 func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
-	var (
-		ctx = r.Context()
-		ip  netip.Addr
-	)
+	if len(h.exempt) > 0 && h.exempt.AnyMatch(r) {
+		if h.SignVerdict {
+			r.Header.Del(h.VerdictHeader) // exempt requests weren't checked
+		}
+		return next.ServeHTTP(w, r)
+	}
 
-	ctx, ip = httputils.EnsureIP(ctx)
-	isAllowed, decision, err := h.crowdsec.IsAllowed(ip)
+	start := time.Now()
+	ctx, ip, isAllowed, decision, err := h.evaluate(r)
 	if err != nil {
 		return err // TODO: return error here? Or just log it and continue serving
 	}
+	if h.ServerTiming {
+		httputils.AddServerTiming(w, "crowdsec", time.Since(start))
+	}
 
-	// TODO: if the IP is allowed, should we (temporarily) put it in an explicit allowlist for quicker check?
+	h.crowdsec.RecordProcessed(ip)
 
 	if !isAllowed {
-		// TODO: maybe some configuration to override the type of action with a ban, some default, something like that?
-		// TODO: can we provide the reason for the response to the Caddy logger, like the CrowdSec type, duration, etc.
-		typ := *decision.Type
-		value := *decision.Value
-		duration := *decision.Duration
+		h.crowdsec.RecordRemediation(*decision.Type, stringValue(decision.Origin), ip)
+		h.crowdsec.LogBlocked(crowdsec.BlockedRequest{
+			IP:       ip,
+			Host:     r.Host,
+			Method:   r.Method,
+			Path:     r.URL.Path,
+			Type:     *decision.Type,
+			Origin:   stringValue(decision.Origin),
+			Scenario: stringValue(decision.Scenario),
+			Module:   string(h.CaddyModule().ID),
+		})
+		return h.block(ctx, w, decision)
+	}
+
+	if h.SignVerdict {
+		r.Header.Set(h.VerdictHeader, verdict.New([]byte(h.VerdictSecret), ip, time.Now()))
+	}
 
-		return httputils.WriteResponse(w, h.logger, typ, value, duration, 0)
+	if h.crowdsec.AutoBanEnabled() {
+		return h.serveRecordingStatus(w, r.WithContext(ctx), next, ip)
 	}
 
 	// Continue down the handler stack
@@ -112,15 +280,341 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyht
 	return nil
 }
 
-// UnmarshalCaddyfile implements caddyfile.Unmarshaler.
+// serveRecordingStatus continues down the handler stack, and records
+// the status of the response to ip, so that IPs getting too many error
+// responses can be banned.
+func (h *Handler) serveRecordingStatus(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler, ip netip.Addr) error {
+	rec := caddyhttp.NewResponseRecorder(w, nil, func(int, http.Header) bool { return false })
+	err := next.ServeHTTP(rec, r)
+
+	status := rec.Status()
+	var handlerErr caddyhttp.HandlerError
+	if errors.As(err, &handlerErr) && handlerErr.StatusCode != 0 {
+		status = handlerErr.StatusCode
+	}
+
+	h.crowdsec.RecordResponse(ip, status)
+
+	return err
+}
+
+// Simulate reports what the handler would do for r, using the same code
+// paths as ServeHTTP, without serving the request or recording the
+// remediation.
+func (h *Handler) Simulate(r *http.Request) crowdsec.Simulation {
+	if len(h.exempt) > 0 && h.exempt.AnyMatch(r) {
+		return crowdsec.Simulation{Exempt: true, Allowed: true}
+	}
+
+	ctx, _, isAllowed, decision, err := h.evaluate(r)
+	if err != nil {
+		return crowdsec.Simulation{Error: err.Error()}
+	}
+
+	if isAllowed {
+		return crowdsec.Simulation{Allowed: true}
+	}
+
+	s := crowdsec.Simulation{
+		Decision: &bouncer.DecisionDetails{
+			Type:     stringValue(decision.Type),
+			Scope:    stringValue(decision.Scope),
+			Value:    stringValue(decision.Value),
+			Origin:   stringValue(decision.Origin),
+			Scenario: stringValue(decision.Scenario),
+			Duration: stringValue(decision.Duration),
+		},
+		Remediation: stringValue(decision.Type),
+	}
+
+	rec := httptest.NewRecorder()
+	err = h.block(ctx, rec, decision)
+
+	var handlerErr caddyhttp.HandlerError
+	switch {
+	case errors.As(err, &handlerErr):
+		s.StatusCode = handlerErr.StatusCode
+		s.Error = handlerErr.Error()
+	case err != nil:
+		s.Error = err.Error()
+	default:
+		s.StatusCode = rec.Code
+	}
+
+	if len(rec.Header()) > 0 {
+		s.Header = rec.Header()
+	}
+
+	return s
+}
+
+// evaluate looks up the decision for the client IP of r, and for the
+// forwarded hops if enabled. It returns the context with the client IP
+// stored in it.
+func (h *Handler) evaluate(r *http.Request) (context.Context, netip.Addr, bool, *models.Decision, error) {
+	ctx, ip := httputils.EnsureIP(r.Context())
+	if h.hasValidVerdict(r, ip) {
+		return ctx, ip, true, nil, nil
+	}
+
+	isAllowed, decision, err := h.crowdsec.IsAllowedRequest(ctx, ip)
+	if err != nil {
+		return ctx, ip, false, nil, err
+	}
+
+	if isAllowed && h.CheckForwardedHops {
+		if isAllowed, decision, err = h.checkForwardedHops(r, ip); err != nil {
+			return ctx, ip, false, nil, err
+		}
+	}
+
+	// TODO: if the IP is allowed, should we (temporarily) put it in an explicit allowlist for quicker check?
+
+	if !isAllowed && h.hasValidBypassToken(r, ip) {
+		isAllowed = true
+	}
+
+	return ctx, ip, isAllowed, decision, nil
+}
+
+// block serves the remediation for decision, or returns it as an
+// error if ReturnErrors is enabled.
+func (h *Handler) block(ctx context.Context, w http.ResponseWriter, decision *models.Decision) error {
+	// TODO: maybe some configuration to override the type of action with a ban, some default, something like that?
+	// TODO: can we provide the reason for the response to the Caddy logger, like the CrowdSec type, duration, etc.
+	typ := *decision.Type
+	value := *decision.Value
+	duration := *decision.Duration
+
+	if h.ExposeDecisionHeader {
+		httputils.SetDecisionHeader(w, decision)
+	}
+
+	if h.ReturnErrors {
+		httputils.SetDecisionVars(ctx, typ, value, stringValue(decision.Origin), stringValue(decision.Scenario))
+		return httputils.ErrorResponse(w, typ, duration, 0)
+	}
+
+	return httputils.WriteResponse(w, h.logger, typ, value, duration, 0)
+}
+
+// hasValidBypassToken returns whether the request carries a valid
+// bypass token.
+func (h *Handler) hasValidBypassToken(r *http.Request, ip netip.Addr) bool {
+	if h.BypassSecret == "" {
+		return false
+	}
+
+	token := r.Header.Get(h.BypassHeader)
+	if token == "" && h.BypassQueryParam != "" {
+		token = r.URL.Query().Get(h.BypassQueryParam)
+	}
+	if token == "" {
+		return false
+	}
+
+	if err := bypass.Verify([]byte(h.BypassSecret), token, ip, time.Now(), time.Duration(h.BypassMaxTTL)); err != nil {
+		h.logger.Debug("invalid bypass token", zap.String("ip", ip.String()), zap.Error(err))
+		return false
+	}
+
+	h.logger.Info("decision bypassed using token", zap.String("ip", ip.String()))
+
+	return true
+}
+
+// hasValidVerdict returns whether the request carries a valid verdict
+// header for ip, signed by an instance in front of this one.
+func (h *Handler) hasValidVerdict(r *http.Request, ip netip.Addr) bool {
+	if !h.TrustVerdict {
+		return false
+	}
+
+	value := r.Header.Get(h.VerdictHeader)
+	if value == "" {
+		return false
+	}
+
+	if err := verdict.Verify([]byte(h.VerdictSecret), value, ip, time.Now(), time.Duration(h.VerdictMaxAge)); err != nil {
+		h.logger.Warn("invalid verdict header", zap.String("ip", ip.String()), zap.Error(err))
+		return false
+	}
+
+	return true
+}
+
+func stringValue(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
+
+// checkForwardedHops checks the IPs of the hops in the client IP headers
+// that were added by trusted proxies, except for the client IP, which was
+// checked already.
+func (h *Handler) checkForwardedHops(r *http.Request, clientIP netip.Addr) (bool, *models.Decision, error) {
+	for _, hop := range httputils.ForwardedIPs(r, h.forwardedTrustedProxies) {
+		if hop == clientIP {
+			continue
+		}
+
+		isAllowed, decision, err := h.crowdsec.IsAllowed(hop)
+		if err != nil {
+			return false, nil, err
+		}
+
+		if !isAllowed {
+			if ce := h.logger.Check(zapcore.DebugLevel, "forwarded hop not allowed"); ce != nil {
+				ce.Write(zap.String("ip", clientIP.String()), zap.String("hop", hop.String()))
+			}
+			return false, decision, nil
+		}
+	}
+
+	return true, nil, nil
+}
+
+// UnmarshalCaddyfile implements caddyfile.Unmarshaler. Syntax:
+//
+//	crowdsec {
+//		expose_decision_header
+//		exempt <matcher>
+//		check_forwarded_hops [<trusted_proxies...>]
+//		return_errors
+//		server_timing
+//		bypass <secret> {
+//			header <name>
+//			query <name>
+//			max_ttl <duration>
+//		}
+//		verdict <secret> {
+//			sign
+//			trust
+//			header <name>
+//			max_age <duration>
+//		}
+//	}
 func (h *Handler) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	return h.unmarshalCaddyfile(httpcaddyfile.Helper{Dispenser: d})
+}
+
+func (h *Handler) unmarshalCaddyfile(helper httpcaddyfile.Helper) error {
+	d := helper.Dispenser
+	for d.Next() {
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+		for d.NextBlock(0) {
+			switch d.Val() {
+			case "expose_decision_header":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				h.ExposeDecisionHeader = true
+			case "exempt":
+				matcherSet, err := httputils.ParseMatcherSet(helper)
+				if err != nil {
+					return err
+				}
+				h.ExemptRaw = append(h.ExemptRaw, matcherSet)
+			case "check_forwarded_hops":
+				h.CheckForwardedHops = true
+				h.ForwardedTrustedProxies = append(h.ForwardedTrustedProxies, d.RemainingArgs()...)
+			case "return_errors":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				h.ReturnErrors = true
+			case "server_timing":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				h.ServerTiming = true
+			case "bypass":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				h.BypassSecret = d.Val()
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				for nesting := d.Nesting(); d.NextBlock(nesting); {
+					switch d.Val() {
+					case "header":
+						if !d.NextArg() {
+							return d.ArgErr()
+						}
+						h.BypassHeader = d.Val()
+					case "query":
+						if !d.NextArg() {
+							return d.ArgErr()
+						}
+						h.BypassQueryParam = d.Val()
+					case "max_ttl":
+						if !d.NextArg() {
+							return d.ArgErr()
+						}
+						dur, err := duration.ParseCaddyfile(d, "bypass max_ttl")
+						if err != nil {
+							return err
+						}
+						h.BypassMaxTTL = dur
+					default:
+						return d.Errf("invalid bypass configuration token %q provided", d.Val())
+					}
+				}
+			case "verdict":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				h.VerdictSecret = d.Val()
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				for nesting := d.Nesting(); d.NextBlock(nesting); {
+					switch d.Val() {
+					case "sign":
+						if d.NextArg() {
+							return d.ArgErr()
+						}
+						h.SignVerdict = true
+					case "trust":
+						if d.NextArg() {
+							return d.ArgErr()
+						}
+						h.TrustVerdict = true
+					case "header":
+						if !d.NextArg() {
+							return d.ArgErr()
+						}
+						h.VerdictHeader = d.Val()
+					case "max_age":
+						if !d.NextArg() {
+							return d.ArgErr()
+						}
+						dur, err := duration.ParseCaddyfile(d, "verdict max_age")
+						if err != nil {
+							return err
+						}
+						h.VerdictMaxAge = dur
+					default:
+						return d.Errf("invalid verdict configuration token %q provided", d.Val())
+					}
+				}
+			default:
+				return d.Errf("invalid configuration token %q provided", d.Val())
+			}
+		}
+	}
+
 	return nil
 }
 
 // parseCaddyfileHandlerDirective parses the `crowdsec` Caddyfile directive
 func parseCaddyfileHandlerDirective(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error) {
 	var handler Handler
-	err := handler.UnmarshalCaddyfile(h.Dispenser)
+	err := handler.unmarshalCaddyfile(h)
 	return &handler, err
 }
 
@@ -130,6 +624,7 @@ var (
 	_ caddy.Provisioner           = (*Handler)(nil)
 	_ caddy.Validator             = (*Handler)(nil)
 	_ caddyhttp.MiddlewareHandler = (*Handler)(nil)
+	_ crowdsec.Simulator          = (*Handler)(nil)
 	_ caddyfile.Unmarshaler       = (*Handler)(nil)
 	_ caddy.CleanerUpper          = (*Handler)(nil)
 )
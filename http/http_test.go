@@ -0,0 +1,284 @@
+package http
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+
+	"github.com/hslatman/caddy-crowdsec-bouncer/crowdsec"
+	"github.com/hslatman/caddy-crowdsec-bouncer/crowdsectest"
+	"github.com/hslatman/caddy-crowdsec-bouncer/internal/bypass"
+	"github.com/hslatman/caddy-crowdsec-bouncer/internal/testutils"
+)
+
+// newCrowdSec returns a started CrowdSec app in live mode, which looks
+// up decisions in lapi.
+func newCrowdSec(t *testing.T, lapi *crowdsectest.Server) *crowdsec.CrowdSec {
+	t.Helper()
+
+	config := fmt.Sprintf(`{
+		"api_url": %q,
+		"api_key": %q,
+		"enable_streaming": false
+	}`, lapi.URL(), lapi.APIKey())
+
+	cs := testutils.NewCrowdSecModule(t, context.Background(), config)
+	require.NoError(t, cs.Start())
+	t.Cleanup(func() {
+		require.NoError(t, cs.Stop())
+		require.NoError(t, cs.Cleanup())
+	})
+
+	return cs
+}
+
+// newRequest returns a request with the variables Caddy sets for a
+// request from clientIP, which was received from a trusted proxy if
+// trusted is true.
+func newRequest(method, target, clientIP string, trusted bool) *http.Request {
+	r := httptest.NewRequest(method, target, http.NoBody)
+	vars := map[string]any{
+		caddyhttp.ClientIPVarKey:     clientIP,
+		caddyhttp.TrustedProxyVarKey: trusted,
+	}
+
+	ctx := context.WithValue(r.Context(), caddyhttp.VarsCtxKey, vars)
+	ctx = context.WithValue(ctx, caddy.ReplacerCtxKey, caddy.NewReplacer())
+
+	return r.WithContext(ctx)
+}
+
+// nextHandler is the next handler in tests, which records whether it
+// was called.
+type nextHandler struct {
+	called bool
+}
+
+func (n *nextHandler) ServeHTTP(w http.ResponseWriter, _ *http.Request) error {
+	n.called = true
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+func TestHandler_checkForwardedHops(t *testing.T) {
+	lapi := crowdsectest.NewServer(t)
+	lapi.AddDecisions(
+		crowdsectest.NewDecision("Ip", "192.0.2.66", "ban"),
+		crowdsectest.NewDecision("Ip", "198.51.100.1", "ban"),
+	)
+	cs := newCrowdSec(t, lapi)
+
+	tests := []struct {
+		name           string
+		trusted        bool
+		xff            string
+		trustedProxies []netip.Prefix
+		allowed        bool
+	}{
+		{name: "spoofed-leftmost-hop", trusted: true, xff: "192.0.2.66, 203.0.113.1", allowed: true},
+		{name: "banned-rightmost-hop", trusted: true, xff: "203.0.113.1, 198.51.100.1", allowed: false},
+		{name: "banned-hop-behind-trusted-proxy", trusted: true, xff: "198.51.100.1, 10.0.0.5", trustedProxies: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}, allowed: false},
+		{name: "banned-hop-behind-untrusted-hop", trusted: true, xff: "198.51.100.1, 203.0.113.7, 10.0.0.5", trustedProxies: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}, allowed: true},
+		{name: "ipv4-mapped-hop", trusted: true, xff: "::ffff:198.51.100.1", allowed: false},
+		{name: "untrusted-peer", trusted: false, xff: "198.51.100.1", allowed: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &Handler{
+				CheckForwardedHops:      true,
+				logger:                  zaptest.NewLogger(t),
+				crowdsec:                cs,
+				forwardedTrustedProxies: tt.trustedProxies,
+			}
+
+			r := newRequest(http.MethodGet, "/", "203.0.113.1", tt.trusted)
+			r.Header.Set("X-Forwarded-For", tt.xff)
+
+			w := httptest.NewRecorder()
+			next := &nextHandler{}
+			require.NoError(t, h.ServeHTTP(w, r, next))
+			assert.Equal(t, tt.allowed, next.called)
+			if !tt.allowed {
+				assert.Equal(t, http.StatusForbidden, w.Code)
+			}
+		})
+	}
+}
+
+func TestHandler_bypass(t *testing.T) {
+	lapi := crowdsectest.NewServer(t)
+	lapi.AddDecisions(crowdsectest.NewDecision("Ip", "192.0.2.1", "ban"))
+	cs := newCrowdSec(t, lapi)
+
+	secret := []byte("secret")
+	ip := netip.MustParseAddr("192.0.2.1")
+	valid := bypass.New(secret, ip, time.Now().Add(time.Hour))
+
+	tests := []struct {
+		name       string
+		queryParam string
+		header     string
+		query      string
+		allowed    bool
+	}{
+		{name: "no-token", allowed: false},
+		{name: "header", header: valid, allowed: true},
+		{name: "other-ip", header: bypass.New(secret, netip.MustParseAddr("192.0.2.2"), time.Now().Add(time.Hour)), allowed: false},
+		{name: "wrong-secret", header: bypass.New([]byte("other"), ip, time.Now().Add(time.Hour)), allowed: false},
+		{name: "too-long", header: bypass.New(secret, ip, time.Now().Add(48*time.Hour)), allowed: false},
+		{name: "query-not-enabled", query: valid, allowed: false},
+		{name: "query", queryParam: "crowdsec_bypass", query: valid, allowed: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &Handler{
+				BypassSecret:     string(secret),
+				BypassHeader:     "X-Crowdsec-Bypass",
+				BypassQueryParam: tt.queryParam,
+				BypassMaxTTL:     caddy.Duration(24 * time.Hour),
+				logger:           zaptest.NewLogger(t),
+				crowdsec:         cs,
+			}
+
+			r := newRequest(http.MethodGet, "/?crowdsec_bypass="+tt.query, ip.String(), false)
+			if tt.header != "" {
+				r.Header.Set("X-Crowdsec-Bypass", tt.header)
+			}
+
+			w := httptest.NewRecorder()
+			next := &nextHandler{}
+			require.NoError(t, h.ServeHTTP(w, r, next))
+			assert.Equal(t, tt.allowed, next.called)
+			if !tt.allowed {
+				assert.Equal(t, http.StatusForbidden, w.Code)
+			}
+		})
+	}
+}
+
+func TestHandler_exempt(t *testing.T) {
+	lapi := crowdsectest.NewServer(t)
+	lapi.AddDecisions(crowdsectest.NewDecision("Ip", "192.0.2.1", "ban"))
+
+	h := &Handler{
+		exempt: caddyhttp.MatcherSets{
+			{caddyhttp.MatchPath{"/healthz"}},
+		},
+		logger:   zaptest.NewLogger(t),
+		crowdsec: newCrowdSec(t, lapi),
+	}
+
+	tests := []struct {
+		name    string
+		target  string
+		allowed bool
+		lookups int
+	}{
+		{name: "exempt", target: "/healthz", allowed: true, lookups: 0},
+		{name: "not-exempt", target: "/", allowed: false, lookups: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := lapi.Lookups()
+
+			r := newRequest(http.MethodGet, tt.target, "192.0.2.1", false)
+			w := httptest.NewRecorder()
+			next := &nextHandler{}
+			require.NoError(t, h.ServeHTTP(w, r, next))
+
+			assert.Equal(t, tt.allowed, next.called)
+			assert.Equal(t, tt.lookups, lapi.Lookups()-before)
+		})
+	}
+}
+
+func TestHandler_UnmarshalCaddyfile(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    Handler
+		wantErr string
+	}{
+		{name: "ok", input: `crowdsec`, want: Handler{}},
+		{name: "ok/durations", input: `crowdsec {
+			bypass secret {
+				max_ttl 1h
+			}
+			verdict secret {
+				sign
+				max_age 1m30s
+			}
+		}`, want: Handler{
+			BypassSecret:  "secret",
+			BypassMaxTTL:  caddy.Duration(time.Hour),
+			VerdictSecret: "secret",
+			SignVerdict:   true,
+			VerdictMaxAge: caddy.Duration(90 * time.Second),
+		}},
+		{name: "ok/bypass-query", input: `crowdsec {
+			bypass secret {
+				header X-Bypass
+				query bypass
+			}
+		}`, want: Handler{
+			BypassSecret:     "secret",
+			BypassHeader:     "X-Bypass",
+			BypassQueryParam: "bypass",
+		}},
+		{name: "ok/exempt", input: `crowdsec {
+			exempt /healthz
+			exempt path /.well-known/acme-challenge/*
+		}`, want: Handler{
+			ExemptRaw: caddyhttp.RawMatcherSets{
+				{"path": json.RawMessage(`["/healthz"]`)},
+				{"path": json.RawMessage(`["/.well-known/acme-challenge/*"]`)},
+			},
+		}},
+		{name: "fail/exempt-without-matcher", input: `crowdsec {
+			exempt
+		}`, wantErr: "exempt"},
+		{name: "ok/duration-seconds", input: `crowdsec {
+			bypass secret {
+				max_ttl 3600
+			}
+		}`, want: Handler{
+			BypassSecret: "secret",
+			BypassMaxTTL: caddy.Duration(time.Hour),
+		}},
+		{name: "fail/invalid-duration", input: `crowdsec {
+			bypass secret {
+				max_ttl 1x
+			}
+		}`, wantErr: `invalid bypass max_ttl "1x"`},
+		{name: "fail/negative-duration", input: `crowdsec {
+			verdict secret {
+				max_age -1m
+			}
+		}`, wantErr: "invalid verdict max_age -1m0s: must not be negative"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var h Handler
+			err := h.UnmarshalCaddyfile(caddyfile.NewTestDispenser(tt.input))
+			if tt.wantErr != "" {
+				assert.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, h)
+		})
+	}
+}
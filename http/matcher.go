@@ -0,0 +1,156 @@
+// Copyright 2024 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package http
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+
+	"github.com/hslatman/caddy-crowdsec-bouncer/crowdsec"
+	"github.com/hslatman/caddy-crowdsec-bouncer/internal/httputils"
+)
+
+func init() {
+	caddy.RegisterModule(Matcher{})
+}
+
+// Matcher matches requests based on the CrowdSec decisions known for
+// the client IP. By default it matches requests from clients that have
+// an active decision, so that these can be routed to e.g. a honeypot,
+// a static page or a different upstream.
+type Matcher struct {
+	// Allowed inverts the matcher, resulting in requests to be
+	// matched when the client IP does not have an active decision.
+	Allowed bool `json:"allowed,omitempty"`
+	// Types limits matching to clients with an active decision of
+	// one of the provided types, e.g. "captcha". Defaults to
+	// matching decisions of any type.
+	Types []string `json:"types,omitempty"`
+
+	logger   *zap.Logger
+	crowdsec *crowdsec.CrowdSec
+}
+
+// CaddyModule returns the Caddy module information.
+func (Matcher) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.matchers.crowdsec",
+		New: func() caddy.Module { return new(Matcher) },
+	}
+}
+
+// Provision sets up the CrowdSec matcher.
+func (m *Matcher) Provision(ctx caddy.Context) error {
+	crowdsecAppIface, err := ctx.App("crowdsec")
+	if err != nil {
+		return fmt.Errorf("getting crowdsec app: %v", err)
+	}
+	m.crowdsec = crowdsecAppIface.(*crowdsec.CrowdSec)
+
+	m.logger = m.crowdsec.Logger(ctx.Logger(m))
+
+	repl := caddy.NewReplacer()
+	for i, typ := range m.Types {
+		m.Types[i] = repl.ReplaceKnown(typ, "")
+	}
+
+	return nil
+}
+
+// Validate ensures the matcher's configuration is valid.
+func (m *Matcher) Validate() error {
+	if m.crowdsec == nil {
+		return errors.New("crowdsec app not available")
+	}
+	if m.Allowed && len(m.Types) > 0 {
+		return errors.New("decision types can't be used when matching allowed clients")
+	}
+
+	return nil
+}
+
+// Match returns true if the request matches the configured
+// CrowdSec decision criteria.
+func (m *Matcher) Match(r *http.Request) bool {
+	ctx, ip := httputils.EnsureIP(r.Context())
+	isAllowed, decision, err := m.crowdsec.IsAllowedRequest(ctx, ip)
+	if err != nil {
+		m.logger.Error("failed checking client IP", zap.String("ip", ip.String()), zap.Error(err))
+		return false
+	}
+
+	if m.Allowed {
+		return isAllowed
+	}
+
+	if isAllowed {
+		return false
+	}
+
+	if len(m.Types) == 0 {
+		return true
+	}
+
+	return decision != nil && decision.Type != nil && slices.Contains(m.Types, *decision.Type)
+}
+
+// UnmarshalCaddyfile implements caddyfile.Unmarshaler. Syntax:
+//
+//	crowdsec {
+//		allowed
+//		type <types...>
+//	}
+func (m *Matcher) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+		for d.NextBlock(0) {
+			switch d.Val() {
+			case "allowed":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				m.Allowed = true
+			case "type":
+				types := d.RemainingArgs()
+				if len(types) == 0 {
+					return d.ArgErr()
+				}
+				m.Types = append(m.Types, types...)
+			default:
+				return d.Errf("invalid configuration token %q provided", d.Val())
+			}
+		}
+	}
+
+	return nil
+}
+
+// Interface guards
+var (
+	_ caddy.Module             = (*Matcher)(nil)
+	_ caddy.Provisioner        = (*Matcher)(nil)
+	_ caddy.Validator          = (*Matcher)(nil)
+	_ caddyhttp.RequestMatcher = (*Matcher)(nil)
+	_ caddyfile.Unmarshaler    = (*Matcher)(nil)
+)
@@ -0,0 +1,102 @@
+package http
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+
+	"github.com/hslatman/caddy-crowdsec-bouncer/crowdsectest"
+)
+
+func TestMatcher_Match(t *testing.T) {
+	lapi := crowdsectest.NewServer(t)
+	lapi.AddDecisions(
+		crowdsectest.NewDecision("Ip", "127.0.0.1", "ban"),
+		crowdsectest.NewDecision("Ip", "127.0.0.2", "captcha"),
+	)
+	cs := newCrowdSec(t, lapi)
+
+	tests := []struct {
+		name    string
+		matcher Matcher
+		ip      string
+		want    bool
+	}{
+		{name: "denied", ip: "127.0.0.1", want: true},
+		{name: "denied-captcha", ip: "127.0.0.2", want: true},
+		{name: "allowed", ip: "10.0.0.1", want: false},
+		{name: "inverted-denied", matcher: Matcher{Allowed: true}, ip: "127.0.0.1", want: false},
+		{name: "inverted-allowed", matcher: Matcher{Allowed: true}, ip: "10.0.0.1", want: true},
+		{name: "type-matches", matcher: Matcher{Types: []string{"captcha"}}, ip: "127.0.0.2", want: true},
+		{name: "type-one-of", matcher: Matcher{Types: []string{"ban", "captcha"}}, ip: "127.0.0.1", want: true},
+		{name: "type-mismatch", matcher: Matcher{Types: []string{"captcha"}}, ip: "127.0.0.1", want: false},
+		{name: "type-allowed", matcher: Matcher{Types: []string{"captcha"}}, ip: "10.0.0.1", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := tt.matcher
+			m.logger = zaptest.NewLogger(t)
+			m.crowdsec = cs
+
+			r := newRequest(http.MethodGet, "/", tt.ip, false)
+			assert.Equal(t, tt.want, m.Match(r))
+		})
+	}
+}
+
+func TestMatcher_Validate(t *testing.T) {
+	lapi := crowdsectest.NewServer(t)
+	cs := newCrowdSec(t, lapi)
+
+	assert.EqualError(t, (&Matcher{}).Validate(), "crowdsec app not available")
+	assert.NoError(t, (&Matcher{crowdsec: cs}).Validate())
+	assert.NoError(t, (&Matcher{crowdsec: cs, Allowed: true}).Validate())
+	assert.NoError(t, (&Matcher{crowdsec: cs, Types: []string{"captcha"}}).Validate())
+	assert.EqualError(t, (&Matcher{crowdsec: cs, Allowed: true, Types: []string{"captcha"}}).Validate(),
+		"decision types can't be used when matching allowed clients")
+}
+
+func TestMatcher_UnmarshalCaddyfile(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    Matcher
+		wantErr bool
+	}{
+		{name: "ok", input: `crowdsec`, want: Matcher{}},
+		{name: "ok/allowed", input: `crowdsec {
+			allowed
+		}`, want: Matcher{Allowed: true}},
+		{name: "ok/types", input: `crowdsec {
+			type ban
+			type captcha throttle
+		}`, want: Matcher{Types: []string{"ban", "captcha", "throttle"}}},
+		{name: "fail/argument", input: `crowdsec allowed`, wantErr: true},
+		{name: "fail/allowed-argument", input: `crowdsec {
+			allowed yes
+		}`, wantErr: true},
+		{name: "fail/type-without-types", input: `crowdsec {
+			type
+		}`, wantErr: true},
+		{name: "fail/unknown-token", input: `crowdsec {
+			origin cscli
+		}`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var m Matcher
+			err := m.UnmarshalCaddyfile(caddyfile.NewTestDispenser(tt.input))
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, m)
+		})
+	}
+}
@@ -0,0 +1,125 @@
+// Copyright 2024 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package http
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+	"text/template"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/templates"
+
+	"github.com/hslatman/caddy-crowdsec-bouncer/crowdsec"
+	"github.com/hslatman/caddy-crowdsec-bouncer/internal/bouncer"
+)
+
+func init() {
+	caddy.RegisterModule(TemplateFunctions{})
+}
+
+// TemplateFunctions adds functions to the Caddy `templates` handler for
+// looking up the decisions known to the CrowdSec app, so that pages and
+// dashboards can show whether an IP has active decisions:
+//
+//	{{ if crowdsecBlocked .RemoteIP }}...{{ end }}
+//	{{ range crowdsecDecisions "192.0.2.1" }}{{ .Type }} {{ .Duration }}{{ end }}
+//
+// The functions are available to all templates once the module is
+// included in Caddy; they return an error if the CrowdSec app isn't
+// configured.
+type TemplateFunctions struct{}
+
+// CaddyModule returns the Caddy module information.
+func (TemplateFunctions) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.handlers.templates.functions.crowdsec",
+		New: func() caddy.Module { return new(TemplateFunctions) },
+	}
+}
+
+// CustomTemplateFunctions returns the CrowdSec template functions.
+func (TemplateFunctions) CustomTemplateFunctions() template.FuncMap {
+	return template.FuncMap{
+		"crowdsecBlocked":   templateBlocked,
+		"crowdsecDecisions": templateDecisions,
+	}
+}
+
+// templateBlocked returns whether the IP in value is blocked.
+func templateBlocked(value string) (bool, error) {
+	c, ip, err := templateLookupArgs(value)
+	if err != nil {
+		return false, err
+	}
+
+	isAllowed, _, err := c.IsAllowed(ip)
+	if err != nil {
+		return false, err
+	}
+
+	return !isAllowed, nil
+}
+
+// templateDecisions returns the decisions that apply to the IP in value.
+func templateDecisions(value string) ([]bouncer.DecisionDetails, error) {
+	c, ip, err := templateLookupArgs(value)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.Lookup(ip)
+}
+
+// templateLookupArgs returns the running CrowdSec app and the IP in value.
+// Template function modules aren't provisioned, so the app is retrieved
+// from the active Caddy config.
+func templateLookupArgs(value string) (*crowdsec.CrowdSec, netip.Addr, error) {
+	c, ok := caddy.ActiveContext().AppIfConfigured("crowdsec").(*crowdsec.CrowdSec)
+	if !ok || c == nil {
+		return nil, netip.Addr{}, errors.New("crowdsec app not configured")
+	}
+
+	ip, err := parseTemplateIP(value)
+	if err != nil {
+		return nil, netip.Addr{}, err
+	}
+
+	return c, ip, nil
+}
+
+// parseTemplateIP parses the IP in value, which can include a port.
+func parseTemplateIP(value string) (netip.Addr, error) {
+	value = strings.TrimSpace(value)
+	if host, _, err := net.SplitHostPort(value); err == nil {
+		value = host
+	}
+
+	ip, err := netip.ParseAddr(value)
+	if err != nil {
+		return netip.Addr{}, fmt.Errorf("invalid IP %q", value)
+	}
+
+	return ip.Unmap().WithZone(""), nil
+}
+
+// Interface guards
+var (
+	_ caddy.Module              = (*TemplateFunctions)(nil)
+	_ templates.CustomFunctions = (*TemplateFunctions)(nil)
+)
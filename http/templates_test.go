@@ -0,0 +1,94 @@
+package http
+
+import (
+	"fmt"
+	"net/netip"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/hslatman/caddy-crowdsec-bouncer/crowdsectest"
+)
+
+func Test_parseTemplateIP(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		want    netip.Addr
+		wantErr bool
+	}{
+		{name: "ipv4", value: "127.0.0.1", want: netip.MustParseAddr("127.0.0.1")},
+		{name: "ipv4-with-port", value: "127.0.0.1:443", want: netip.MustParseAddr("127.0.0.1")},
+		{name: "ipv4-with-whitespace", value: " 127.0.0.1 ", want: netip.MustParseAddr("127.0.0.1")},
+		{name: "ipv4-mapped", value: "::ffff:127.0.0.1", want: netip.MustParseAddr("127.0.0.1")},
+		{name: "ipv6", value: "2001:db8::1", want: netip.MustParseAddr("2001:db8::1")},
+		{name: "ipv6-with-port", value: "[2001:db8::1]:443", want: netip.MustParseAddr("2001:db8::1")},
+		{name: "ipv6-with-zone", value: "fe80::1%eth0", want: netip.MustParseAddr("fe80::1")},
+		{name: "fail/empty", value: "", wantErr: true},
+		{name: "fail/hostname", value: "example.com", wantErr: true},
+		{name: "fail/hostname-with-port", value: "example.com:443", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseTemplateIP(tt.value)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestTemplateFunctions(t *testing.T) {
+	_, err := templateBlocked("127.0.0.1")
+	assert.EqualError(t, err, "crowdsec app not configured")
+
+	_, err = templateDecisions("127.0.0.1")
+	assert.EqualError(t, err, "crowdsec app not configured")
+
+	lapi := crowdsectest.NewServer(t)
+	lapi.AddDecisions(crowdsectest.NewDecision("Ip", "127.0.0.1", "ban"))
+
+	config := fmt.Sprintf(`{
+		"admin": {"disabled": true, "config": {"persist": false}},
+		"apps": {
+			"crowdsec": {
+				"api_url": %q,
+				"api_key": %q,
+				"enable_streaming": false
+			}
+		}
+	}`, lapi.URL(), lapi.APIKey())
+
+	require.NoError(t, caddy.Load([]byte(config), true))
+	t.Cleanup(func() { require.NoError(t, caddy.Stop()) })
+
+	blocked, err := templateBlocked("127.0.0.1:443")
+	require.NoError(t, err)
+	assert.True(t, blocked)
+
+	blocked, err = templateBlocked("10.0.0.1")
+	require.NoError(t, err)
+	assert.False(t, blocked)
+
+	_, err = templateBlocked("invalid")
+	assert.EqualError(t, err, `invalid IP "invalid"`)
+
+	decisions, err := templateDecisions("127.0.0.1")
+	require.NoError(t, err)
+	if assert.Len(t, decisions, 1) {
+		assert.Equal(t, "ban", decisions[0].Type)
+	}
+
+	decisions, err = templateDecisions("10.0.0.1")
+	require.NoError(t, err)
+	assert.Empty(t, decisions)
+
+	_, err = templateDecisions("invalid")
+	assert.EqualError(t, err, `invalid IP "invalid"`)
+}
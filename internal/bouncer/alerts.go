@@ -0,0 +1,282 @@
+// Copyright 2024 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bouncer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/crowdsecurity/crowdsec/pkg/apiclient"
+	"github.com/crowdsecurity/crowdsec/pkg/models"
+	"github.com/crowdsecurity/go-cs-lib/ptr"
+	"github.com/go-openapi/strfmt"
+	"go.uber.org/zap"
+
+	"github.com/hslatman/caddy-crowdsec-bouncer/internal/httputils"
+)
+
+const (
+	// appSecAlertScenario is the scenario of alerts for requests
+	// blocked by the AppSec component.
+	appSecAlertScenario = "caddy-crowdsec-bouncer/appsec-block"
+
+	alertBatchInterval = 10 * time.Second
+	alertFlushTimeout  = 5 * time.Second
+
+	// maxPendingAlerts is the maximum number of blocked requests that
+	// are queued to be sent as alerts, and that are sent in a batch.
+	// Blocked requests beyond this are dropped.
+	maxPendingAlerts = 1000
+
+	// maxAlertEvents is the maximum number of events included in an
+	// alert. Further events are only counted.
+	maxAlertEvents = 10
+)
+
+// alertEvent is a blocked request to be sent as part of an alert.
+type alertEvent struct {
+	ip       netip.Addr
+	scenario string
+	action   string
+	method   string
+	host     string
+	path     string
+	time     time.Time
+}
+
+// alerts sends alerts for blocked requests to the CrowdSec Local API.
+type alerts struct {
+	client           *apiclient.ApiClient
+	decisionDuration time.Duration
+	events           chan alertEvent
+}
+
+// SetAlerts enables sending alerts to the CrowdSec Local API at apiURL
+// when the AppSec component blocks a request, so that they're listed by
+// `cscli alerts list`. The alerts are sent using the credentials of a
+// machine, i.e. added with `cscli machines add`, as bouncers can't send
+// alerts. When decisionDuration is positive, alerts include a ban decision
+// with that duration, which is enforced by all bouncers of the Local API.
+func (b *Bouncer) SetAlerts(apiURL, machineID, password string, decisionDuration time.Duration) error {
+	if machineID == "" || password == "" {
+		return errors.New("machine ID and password must not be empty")
+	}
+	if !strings.HasSuffix(apiURL, "/") {
+		apiURL += "/"
+	}
+
+	u, err := url.Parse(apiURL)
+	if err != nil {
+		return fmt.Errorf("invalid local API URL: %w", err)
+	}
+
+	client, err := apiclient.NewClient(&apiclient.Config{
+		MachineID:     machineID,
+		Password:      strfmt.Password(password),
+		Scenarios:     []string{appSecAlertScenario},
+		URL:           u,
+		VersionPrefix: "v1",
+		UserAgent:     b.userAgent,
+	})
+	if err != nil {
+		return fmt.Errorf("failed creating local API client: %w", err)
+	}
+
+	b.alerts = &alerts{
+		client:           client,
+		decisionDuration: decisionDuration,
+		events:           make(chan alertEvent, maxPendingAlerts),
+	}
+
+	return nil
+}
+
+// recordAppSecAlert queues an alert for a request blocked by the
+// AppSec component.
+func (b *Bouncer) recordAppSecAlert(ctx context.Context, r *http.Request, action string) {
+	if b.alerts == nil {
+		return
+	}
+
+	ip, ok := httputils.FromContext(ctx)
+	if !ok {
+		return
+	}
+
+	b.queueAlert(alertEvent{
+		ip:       ip,
+		scenario: appSecAlertScenario,
+		action:   action,
+		method:   r.Method,
+		host:     r.Host,
+		path:     r.URL.Path,
+		time:     time.Now(),
+	})
+}
+
+// queueAlert queues e to be sent as part of an alert, if alerts are
+// enabled. It doesn't block; when the queue is full, e is dropped.
+func (b *Bouncer) queueAlert(e alertEvent) {
+	if b.alerts == nil {
+		return
+	}
+
+	select {
+	case b.alerts.events <- e:
+	default:
+		b.logger.Debug("dropped alert", b.zapField(), zap.String("ip", e.ip.String()))
+	}
+}
+
+func (b *Bouncer) startAlerts(ctx context.Context) {
+	if b.alerts == nil {
+		return
+	}
+
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+
+		ticker := time.NewTicker(alertBatchInterval)
+		defer ticker.Stop()
+
+		var batch []alertEvent
+		for {
+			select {
+			case <-ctx.Done():
+				// the remaining events are sent using a new context, as
+				// ctx is canceled when the Bouncer is shut down
+				flushCtx, cancel := context.WithTimeout(context.Background(), alertFlushTimeout)
+				b.sendAlerts(flushCtx, batch)
+				cancel()
+				return
+			case e := <-b.alerts.events:
+				if len(batch) < maxPendingAlerts {
+					batch = append(batch, e)
+				}
+			case <-ticker.C:
+				b.sendAlerts(ctx, batch)
+				batch = nil
+			}
+		}
+	}()
+}
+
+// sendAlerts sends an alert per IP and scenario in batch.
+func (b *Bouncer) sendAlerts(ctx context.Context, batch []alertEvent) {
+	if len(batch) == 0 {
+		return
+	}
+
+	req := b.newAlerts(batch)
+	if _, _, err := b.alerts.client.Alerts.Add(ctx, req); err != nil {
+		b.logger.Warn("failed sending alerts", b.zapField(), zap.Int("alerts", len(req)), zap.Error(err))
+		return
+	}
+
+	b.logger.Debug("sent alerts", b.zapField(), zap.Int("alerts", len(req)))
+}
+
+// newAlerts aggregates the events in batch into alerts, with an alert
+// per IP and scenario.
+func (b *Bouncer) newAlerts(batch []alertEvent) models.AddAlertsRequest {
+	type key struct {
+		ip       netip.Addr
+		scenario string
+	}
+
+	var (
+		keys   []key
+		groups = map[key][]alertEvent{}
+	)
+	for _, e := range batch {
+		k := key{ip: e.ip, scenario: e.scenario}
+		if _, ok := groups[k]; !ok {
+			keys = append(keys, k)
+		}
+		groups[k] = append(groups[k], e)
+	}
+
+	alerts := make(models.AddAlertsRequest, 0, len(keys))
+	for _, k := range keys {
+		alerts = append(alerts, b.newAlert(k.ip, k.scenario, groups[k]))
+	}
+
+	return alerts
+}
+
+func (b *Bouncer) newAlert(ip netip.Addr, scenario string, events []alertEvent) *models.Alert {
+	value := ip.String()
+	start, stop := events[0].time.UTC().Format(time.RFC3339), events[len(events)-1].time.UTC().Format(time.RFC3339)
+
+	alertEvents := make([]*models.Event, 0, min(len(events), maxAlertEvents))
+	for _, e := range events[:min(len(events), maxAlertEvents)] {
+		meta := models.Meta{}
+		for _, m := range []*models.MetaItems0{
+			{Key: "remediation", Value: e.action},
+			{Key: "http_verb", Value: e.method},
+			{Key: "target_fqdn", Value: e.host},
+			{Key: "http_path", Value: e.path},
+		} {
+			if m.Value != "" {
+				meta = append(meta, m)
+			}
+		}
+		alertEvents = append(alertEvents, &models.Event{
+			Timestamp: ptr.Of(e.time.UTC().Format(time.RFC3339)),
+			Meta:      meta,
+		})
+	}
+
+	alert := &models.Alert{
+		Capacity:        ptr.Of(int32(0)),
+		Events:          alertEvents,
+		EventsCount:     ptr.Of(int32(len(events))),
+		Leakspeed:       ptr.Of("0"),
+		Message:         ptr.Of(fmt.Sprintf("%s performed '%s' (%d events over %s) at %s", value, scenario, len(events), events[len(events)-1].time.Sub(events[0].time).Round(time.Second), stop)),
+		Scenario:        ptr.Of(scenario),
+		ScenarioHash:    ptr.Of(""),
+		ScenarioVersion: ptr.Of(""),
+		Simulated:       ptr.Of(false),
+		Source: &models.Source{
+			IP:    value,
+			Scope: ptr.Of("Ip"),
+			Value: ptr.Of(value),
+		},
+		StartAt:   ptr.Of(start),
+		StopAt:    ptr.Of(stop),
+		Decisions: []*models.Decision{},
+	}
+
+	if b.alerts.decisionDuration > 0 {
+		alert.Decisions = append(alert.Decisions, &models.Decision{
+			Duration:  ptr.Of(b.alerts.decisionDuration.String()),
+			Origin:    ptr.Of("crowdsec"),
+			Scenario:  ptr.Of(scenario),
+			Scope:     ptr.Of("Ip"),
+			Simulated: ptr.Of(false),
+			Type:      ptr.Of("ban"),
+			Value:     ptr.Of(value),
+		})
+	}
+
+	return alert
+}
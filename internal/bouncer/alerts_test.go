@@ -0,0 +1,157 @@
+package bouncer
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/crowdsecurity/crowdsec/pkg/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+
+	"github.com/hslatman/caddy-crowdsec-bouncer/internal/httputils"
+)
+
+func TestBouncer_newAlerts(t *testing.T) {
+	b, err := newBouncer(t)
+	require.NoError(t, err)
+	require.NoError(t, b.SetAlerts("http://127.0.0.1:8080", "machine", "password", time.Hour))
+
+	now := time.Now()
+	ip1, ip2 := netip.MustParseAddr("10.0.0.1"), netip.MustParseAddr("10.0.0.2")
+	alerts := b.newAlerts([]alertEvent{
+		{ip: ip1, scenario: appSecAlertScenario, action: "ban", method: "GET", host: "example.com", path: "/.env", time: now},
+		{ip: ip2, scenario: appSecAlertScenario, action: "ban", method: "POST", host: "example.com", path: "/login", time: now},
+		{ip: ip1, scenario: appSecAlertScenario, action: "ban", method: "GET", host: "example.com", path: "/.git/config", time: now.Add(time.Second)},
+	})
+	require.Len(t, alerts, 2)
+
+	a := alerts[0]
+	require.NoError(t, a.Validate(nil))
+	assert.Equal(t, "10.0.0.1", *a.Source.Value)
+	assert.Equal(t, appSecAlertScenario, *a.Scenario)
+	assert.Equal(t, int32(2), *a.EventsCount)
+	assert.Len(t, a.Events, 2)
+	require.Len(t, a.Decisions, 1)
+	assert.Equal(t, "ban", *a.Decisions[0].Type)
+	assert.Equal(t, "1h0m0s", *a.Decisions[0].Duration)
+	assert.Equal(t, "10.0.0.1", *a.Decisions[0].Value)
+
+	assert.Equal(t, "10.0.0.2", *alerts[1].Source.Value)
+
+	// without decisions
+	require.NoError(t, b.SetAlerts("http://127.0.0.1:8080", "machine", "password", -1))
+	alerts = b.newAlerts([]alertEvent{{ip: ip1, scenario: appSecAlertScenario, action: "ban", time: now}})
+	require.Len(t, alerts, 1)
+	assert.Empty(t, alerts[0].Decisions)
+}
+
+func TestBouncer_sendAlerts(t *testing.T) {
+	received := make(chan models.AddAlertsRequest, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/watchers/login":
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = w.Write([]byte(`{"code": 200, "expire": "` + time.Now().Add(time.Hour).Format(time.RFC3339) + `", "token": "token"}`))
+		case "/v1/alerts":
+			assert.Equal(t, "Bearer token", r.Header.Get("Authorization"))
+			var req models.AddAlertsRequest
+			assert.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+			received <- req
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = w.Write([]byte(`["1"]`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	b, err := newBouncer(t)
+	require.NoError(t, err)
+
+	assert.Error(t, b.SetAlerts(srv.URL, "", "password", time.Hour))
+	require.NoError(t, b.SetAlerts(srv.URL, "machine", "password", time.Hour))
+
+	b.sendAlerts(context.Background(), []alertEvent{
+		{ip: netip.MustParseAddr("10.0.0.1"), scenario: appSecAlertScenario, action: "ban", time: time.Now()},
+	})
+
+	select {
+	case req := <-received:
+		require.Len(t, req, 1)
+		assert.Equal(t, "10.0.0.1", *req[0].Source.Value)
+	case <-time.After(5 * time.Second):
+		t.Fatal("no alerts received")
+	}
+}
+
+func TestBouncer_CheckRequest_alerts(t *testing.T) {
+	ctx := newCaddyVarsContext()
+	caddyhttp.SetVar(ctx, caddyhttp.ClientIPVarKey, "10.0.0.10")
+	ctx, _ = httputils.EnsureIP(ctx)
+
+	inFlight := make(chan struct{})
+	release := make(chan struct{})
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Header.Get("X-Crowdsec-Appsec-Uri") {
+		case "/rule":
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = w.Write([]byte(`{"action": "ban", "http_status": 403}`))
+		case "/slow":
+			inFlight <- struct{}{}
+			<-release
+			w.WriteHeader(http.StatusOK)
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	t.Cleanup(s.Close)
+
+	b, err := New("apiKey", "http://127.0.0.1:8080/", s.URL, 0, "10s", zaptest.NewLogger(t))
+	require.NoError(t, err)
+	require.NoError(t, b.SetAppSecFailurePolicy("closed"))
+	b.SetAppSecRetries(0, 0)
+	require.NoError(t, b.SetAppSecConcurrencyLimit(1, 0, "closed"))
+	require.NoError(t, b.SetAlerts("http://127.0.0.1:8080", "machine", "password", time.Hour))
+
+	check := func(path string) *AppSecError {
+		t.Helper()
+
+		err := b.CheckRequest(ctx, httptest.NewRequest(http.MethodGet, path, http.NoBody))
+		var appSecErr *AppSecError
+		require.ErrorAs(t, err, &appSecErr)
+
+		return appSecErr
+	}
+
+	// a request blocked by a rule is reported
+	appSecErr := check("/rule")
+	assert.True(t, appSecErr.Triggered)
+	assert.Len(t, b.alerts.events, 1)
+
+	// a request blocked by the failure policy isn't
+	appSecErr = check("/error")
+	assert.False(t, appSecErr.Triggered)
+	assert.Len(t, b.alerts.events, 1)
+
+	// neither is a request blocked by the overflow policy
+	done := make(chan error)
+	go func() {
+		done <- b.CheckRequest(ctx, httptest.NewRequest(http.MethodGet, "/slow", http.NoBody))
+	}()
+	<-inFlight
+
+	appSecErr = check("/overflow")
+	assert.False(t, appSecErr.Triggered)
+	assert.Equal(t, http.StatusServiceUnavailable, appSecErr.StatusCode)
+
+	close(release)
+	require.NoError(t, <-done)
+	assert.Len(t, b.alerts.events, 1)
+}
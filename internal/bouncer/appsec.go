@@ -3,26 +3,69 @@ package bouncer
 import (
 	"bytes"
 	"context"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"net"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
-	"github.com/oxtoacart/bpool"
+	"github.com/caddyserver/caddy/v2"
 	"go.uber.org/zap"
 
+	"github.com/hslatman/caddy-crowdsec-bouncer/internal/fingerprint"
 	"github.com/hslatman/caddy-crowdsec-bouncer/internal/httputils"
+	"github.com/hslatman/caddy-crowdsec-bouncer/internal/ttlcache"
 )
 
 type appsec struct {
-	apiURL      string
-	apiKey      string
-	maxBodySize int
-	logger      *zap.Logger
-	client      *http.Client
-	pool        *bpool.BufferPool
+	apiURL        string
+	apiKey        string
+	maxBodySize   int
+	failurePolicy failurePolicy
+	maxRetries    int
+	retryBackoff  time.Duration
+	headers       headerFilter
+	exclusions    []exclusion
+	async         bool
+	queue         chan *http.Request
+	cache         *ttlcache.Cache[string, error]
+	limit         *concurrencyLimit
+	health        appsecHealth
+	logger        *zap.Logger
+	client        *http.Client
+}
+
+// failurePolicy determines what happens with a request when the
+// AppSec component can't be reached or returns an error. With an
+// open policy the request is allowed; otherwise it's blocked with
+// statusCode.
+type failurePolicy struct {
+	open       bool
+	statusCode int
+}
+
+// parseFailurePolicy parses "open", "closed" or "status:<code>"
+// into a failurePolicy. An empty policy is considered open.
+func parseFailurePolicy(policy string) (failurePolicy, error) {
+	switch {
+	case policy == "" || policy == "open":
+		return failurePolicy{open: true}, nil
+	case policy == "closed":
+		return failurePolicy{statusCode: http.StatusForbidden}, nil
+	case strings.HasPrefix(policy, "status:"):
+		code, err := strconv.Atoi(strings.TrimPrefix(policy, "status:"))
+		if err != nil || code < 100 || code > 599 {
+			return failurePolicy{}, fmt.Errorf("invalid status code in failure policy %q", policy)
+		}
+		return failurePolicy{statusCode: code}, nil
+	default:
+		return failurePolicy{}, fmt.Errorf("invalid failure policy %q; must be one of open, closed or status:<code>", policy)
+	}
 }
 
 func newAppSec(apiURL, apiKey string, maxBodySize int, logger *zap.Logger) *appsec {
@@ -46,7 +89,12 @@ func newAppSec(apiURL, apiKey string, maxBodySize int, logger *zap.Logger) *apps
 				ExpectContinueTimeout: 1 * time.Second,
 			},
 		},
-		pool: bpool.NewBufferPool(64),
+		failurePolicy: failurePolicy{open: true},
+		retryBackoff:  100 * time.Millisecond,
+		health: appsecHealth{
+			status:   AppSecHealth{Enabled: apiURL != ""},
+			interval: defaultAppSecHealthCheckInterval,
+		},
 	}
 }
 
@@ -60,45 +108,166 @@ func (a *appsec) checkRequest(ctx context.Context, r *http.Request) error {
 		return nil // AppSec component not enabled; skip check
 	}
 
+	if a.isExcluded(r) {
+		return nil // request excluded from AppSec inspection; skip check
+	}
+
+	if streamingBodyMode(ctx) == StreamingBodySkip && httputils.IsStreamingBody(r) {
+		return nil // streaming request excluded from AppSec inspection; skip check
+	}
+
+	req, err := a.newRequest(ctx, r)
+	if err != nil {
+		return err
+	}
+
+	if a.async {
+		a.enqueue(req)
+		return nil // detection only; never blocks the request
+	}
+
+	key, cacheable := a.cacheKey(r, req)
+	if cacheable {
+		if err, ok := a.cache.Get(key); ok {
+			return err
+		}
+	}
+
+	if a.limit != nil {
+		if !a.limit.acquire(ctx) {
+			return a.overflowed()
+		}
+		defer a.limit.release()
+	}
+
+	verdict, err := a.evaluate(ctx, req)
+	if cacheable && verdict {
+		a.cache.Set(key, err)
+	}
+
+	return err
+}
+
+type maxBodySizeKey struct{}
+
+// WithAppSecMaxBodySize returns a copy of ctx that overrides the maximum
+// number of request body bytes sent to the AppSec component for requests
+// checked with it. A size of 0 or less doesn't override the maximum.
+func WithAppSecMaxBodySize(ctx context.Context, size int) context.Context {
+	if size <= 0 {
+		return ctx
+	}
+
+	return context.WithValue(ctx, maxBodySizeKey{}, size)
+}
+
+// bodyLimit returns the maximum number of request body bytes sent to the
+// AppSec component for the request with ctx. It returns 0 if there's no
+// maximum.
+func (a *appsec) bodyLimit(ctx context.Context) int {
+	if size, ok := ctx.Value(maxBodySizeKey{}).(int); ok {
+		return size
+	}
+
+	return a.maxBodySize
+}
+
+// Modes for sending streaming request bodies, like those of gRPC calls,
+// to the AppSec component.
+const (
+	// StreamingBodyHeaders only sends the headers of the request.
+	StreamingBodyHeaders = "headers"
+	// StreamingBodySkip skips the AppSec check for the request.
+	StreamingBodySkip = "skip"
+	// StreamingBodyPrefix sends the headers and the start of the body,
+	// up to the maximum body size.
+	StreamingBodyPrefix = "prefix"
+)
+
+// defaultStreamingPrefixSize is the size of the body prefix sent for
+// streaming bodies when there's no maximum body size.
+const defaultStreamingPrefixSize = 64 << 10 // 64 KiB
+
+type streamingBodyKey struct{}
+
+// WithAppSecStreamingBody returns a copy of ctx that sets how streaming
+// request bodies are sent to the AppSec component for requests checked
+// with it. An empty mode keeps the default, which is to only send the
+// headers.
+func WithAppSecStreamingBody(ctx context.Context, mode string) context.Context {
+	if mode == "" {
+		return ctx
+	}
+
+	return context.WithValue(ctx, streamingBodyKey{}, mode)
+}
+
+// streamingBodyMode returns how the streaming body of the request with
+// ctx is sent to the AppSec component.
+func streamingBodyMode(ctx context.Context) string {
+	if mode, ok := ctx.Value(streamingBodyKey{}).(string); ok {
+		return mode
+	}
+
+	return StreamingBodyHeaders
+}
+
+// newRequest creates the request to the AppSec component for r.
+func (a *appsec) newRequest(ctx context.Context, r *http.Request) (*http.Request, error) {
 	originalIP, ok := httputils.FromContext(ctx)
 	if !ok {
-		return errors.New("could not retrieve netip.Addr from context")
+		return nil, errors.New("could not retrieve netip.Addr from context")
 	}
 
 	var contentLength int
 	method := http.MethodGet
-	var body io.ReadCloser = http.NoBody
-	if r.Body != nil && r.ContentLength > 0 {
-		originalBody, err := io.ReadAll(r.Body)
-		if err != nil {
-			return err
+	var body io.Reader = http.NoBody
+	// for upgrade requests only the headers are inspected; the upgraded
+	// stream must never be buffered. Streaming bodies are only sent when
+	// a prefix is requested, as reading them can block until the client
+	// receives a response.
+	forwardBody := r.Body != nil && r.ContentLength > 0
+	limit := r.ContentLength
+	if httputils.IsStreamingBody(r) {
+		forwardBody = r.Body != nil && r.Body != http.NoBody && streamingBodyMode(ctx) == StreamingBodyPrefix
+		if limit <= 0 {
+			limit = defaultStreamingPrefixSize
+		}
+	}
+	if forwardBody && !httputils.IsUpgrade(r) {
+		if maxBodySize := a.bodyLimit(ctx); maxBodySize > 0 {
+			limit = min(limit, int64(maxBodySize))
 		}
 
-		buffer := a.pool.Get()
-		defer a.pool.Put(buffer)
-
-		if a.maxBodySize > 0 {
-			len := min(len(originalBody), a.maxBodySize)
-			_, _ = buffer.Write(originalBody[:len])
-
-		} else {
-			_, _ = buffer.Write(originalBody)
+		// only the part of the body that is sent to the AppSec component
+		// is buffered; the remainder is streamed from the original body
+		// when it's read by the next handler. The buffer isn't pooled, as
+		// it's replayed to the next handler, which may not close the body.
+		buffered, err := io.ReadAll(io.LimitReader(r.Body, limit))
+		if err != nil {
+			return nil, err
 		}
 
 		method = http.MethodPost
-		body = io.NopCloser(buffer)
-		contentLength = buffer.Len()
+		body = bytes.NewReader(buffered) // allows the body to be replayed when retrying
+		contentLength = len(buffered)
 
 		// "reset" the original request body
-		r.Body = io.NopCloser(bytes.NewBuffer(originalBody))
+		r.Body = &replayBody{
+			Reader: io.MultiReader(bytes.NewReader(buffered), r.Body),
+			body:   r.Body,
+		}
 	}
 
 	req, err := http.NewRequestWithContext(ctx, method, a.apiURL, body)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	for key, headers := range r.Header {
+		if !a.headers.forward(key) {
+			continue
+		}
 		for _, value := range headers {
 			req.Header.Add(key, value)
 		}
@@ -110,6 +279,8 @@ func (a *appsec) checkRequest(ctx context.Context, r *http.Request) error {
 	req.Header.Set("X-Crowdsec-Appsec-Api-Key", a.apiKey)
 	req.Header.Set("X-Crowdsec-Appsec-User-Agent", r.Header.Get("User-Agent"))
 	req.Header.Set("User-Agent", userAgentName)
+	setConnectionHeaders(req, r)
+	setTLSHeaders(req, r)
 
 	// explicitly setting the content length results in CrowdSec (1.6.4) properly
 	// accepting the request body. Without this the Content-Length header won't be
@@ -119,42 +290,223 @@ func (a *appsec) checkRequest(ctx context.Context, r *http.Request) error {
 	// includes the patch.
 	req.ContentLength = int64(contentLength)
 
-	totalAppSecCalls.Inc()
-	resp, err := a.client.Do(req)
+	return req, nil
+}
+
+// requestIDHeader carries Caddy's request UUID, so that AppSec events can
+// be correlated with access logs.
+const requestIDHeader = "X-Crowdsec-Appsec-Request-Id"
+
+// setConnectionHeaders sets headers with the original scheme and server
+// port of r, and the Caddy request UUID, if available.
+func setConnectionHeaders(req, r *http.Request) {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	req.Header.Set("X-Crowdsec-Appsec-Scheme", scheme)
+
+	if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		if _, port, err := net.SplitHostPort(addr.String()); err == nil {
+			req.Header.Set("X-Crowdsec-Appsec-Port", port)
+		}
+	}
+
+	if repl, ok := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer); ok {
+		if id, ok := repl.GetString("http.request.uuid"); ok && id != "" {
+			req.Header.Set(requestIDHeader, id)
+		}
+	}
+}
+
+// setTLSHeaders sets headers with details about the TLS connection
+// of r, including the JA3 and JA4 fingerprints of the client when they
+// were recorded by the fingerprinting listener wrapper.
+func setTLSHeaders(req, r *http.Request) {
+	if r.TLS == nil {
+		return
+	}
+
+	req.Header.Set("X-Crowdsec-Appsec-Tls-Version", tls.VersionName(r.TLS.Version))
+	req.Header.Set("X-Crowdsec-Appsec-Tls-Cipher", tls.CipherSuiteName(r.TLS.CipherSuite))
+	if r.TLS.ServerName != "" {
+		req.Header.Set("X-Crowdsec-Appsec-Tls-Sni", r.TLS.ServerName)
+	}
+
+	// HTTP/3 connections use QUIC over UDP, and aren't seen by the
+	// listener wrapper; a fingerprint for the same address would belong
+	// to another (TCP) connection.
+	if r.ProtoMajor == 3 {
+		return
+	}
+
+	if fp, ok := fingerprint.Lookup(r.RemoteAddr); ok {
+		req.Header.Set("X-Crowdsec-Appsec-Ja3", fp.JA3)
+		req.Header.Set("X-Crowdsec-Appsec-Ja4", fp.JA4)
+	}
+}
+
+// evaluate sends req to the AppSec component and interprets its response.
+// It reports whether the AppSec component returned a verdict, as opposed
+// to the failure policy being applied.
+func (a *appsec) evaluate(ctx context.Context, req *http.Request) (bool, error) {
+	resp, err := a.do(ctx, req)
 	if err != nil {
-		totalAppSecErrors.Inc()
-		return err
+		return false, a.fail("appsec component request failed", zap.String("appsec_url", a.apiURL), zap.Error(err))
 	}
 	defer resp.Body.Close()
 
 	responseBody, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return err
+		return false, a.fail("failed reading appsec component response", zap.String("appsec_url", a.apiURL), zap.Error(err))
 	}
 
 	switch resp.StatusCode {
 	case 200:
-		return nil
+		return true, nil
 	case 401:
-		a.logger.Error("appsec component not authenticated", zap.String("code", resp.Status), zap.String("appsec_url", a.apiURL))
-		return nil // this fails open, currently; make it fail hard if configured to do so?
+		return false, a.fail("appsec component not authenticated", zap.String("code", resp.Status), zap.String("appsec_url", a.apiURL))
 	case 403:
 		var r appsecResponse
 		if err := json.Unmarshal(responseBody, &r); err != nil {
-			return err
+			return false, a.fail("failed decoding appsec component response", zap.String("appsec_url", a.apiURL), zap.Error(err))
 		}
 
-		return &AppSecError{Err: errors.New("appsec rule triggered"), Action: r.Action, Duration: "", StatusCode: r.StatusCode}
+		return true, &AppSecError{Err: errors.New("appsec rule triggered"), Action: r.Action, Duration: "", StatusCode: r.StatusCode, Triggered: true}
 	case 404:
-		a.logger.Error("appsec component endpoint not found", zap.String("code", resp.Status), zap.String("appsec_url", a.apiURL))
-		return nil
+		return false, a.fail("appsec component endpoint not found", zap.String("code", resp.Status), zap.String("appsec_url", a.apiURL))
 	case 500:
-		a.logger.Error("appsec component internal error", zap.String("code", resp.Status), zap.String("appsec_url", a.apiURL))
-		return nil // this fails open, currently; make it fail hard if configured to do so?
+		return false, a.fail("appsec component internal error", zap.String("code", resp.Status), zap.String("appsec_url", a.apiURL))
 	default:
-		a.logger.Error("appsec component returned unsupported status", zap.String("code", resp.Status), zap.String("appsec_url", a.apiURL))
+		return false, a.fail("appsec component returned unsupported status", zap.String("code", resp.Status), zap.String("appsec_url", a.apiURL))
+	}
+}
+
+// headerFilter determines which request headers are forwarded to
+// the AppSec component. If allow is not empty, only the headers in
+// it are forwarded. Headers in deny are never forwarded.
+type headerFilter struct {
+	allow map[string]struct{}
+	deny  map[string]struct{}
+}
+
+func newHeaderFilter(allow, deny []string) headerFilter {
+	return headerFilter{
+		allow: canonicalHeaderSet(allow),
+		deny:  canonicalHeaderSet(deny),
+	}
+}
+
+func canonicalHeaderSet(headers []string) map[string]struct{} {
+	if len(headers) == 0 {
+		return nil
+	}
+
+	set := make(map[string]struct{}, len(headers))
+	for _, h := range headers {
+		set[http.CanonicalHeaderKey(h)] = struct{}{}
+	}
+
+	return set
+}
+
+func (f headerFilter) forward(key string) bool {
+	key = http.CanonicalHeaderKey(key)
+	if _, ok := f.deny[key]; ok {
+		return false
+	}
+	if len(f.allow) == 0 {
+		return true
+	}
+
+	_, ok := f.allow[key]
+	return ok
+}
+
+// replayBody replays the buffered start of a request body, followed by
+// the unread remainder of the original body, which is closed when the
+// body is closed.
+type replayBody struct {
+	io.Reader
+	body io.ReadCloser
+}
+
+func (b *replayBody) Close() error {
+	return b.body.Close()
+}
+
+// do performs the request to the AppSec component. Requests failing
+// with a connection error or a 5xx status are retried up to maxRetries
+// times, with an exponentially increasing backoff between attempts.
+func (a *appsec) do(ctx context.Context, req *http.Request) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		r := req
+		if attempt > 0 {
+			r = req.Clone(ctx)
+			if req.GetBody != nil {
+				body, err := req.GetBody()
+				if err != nil {
+					return nil, err
+				}
+				r.Body = body
+			}
+		}
+
+		totalAppSecCalls.Inc()
+		resp, err := a.client.Do(r)
+		if err != nil {
+			totalAppSecErrors.Inc()
+		}
+
+		retryable := (err != nil && ctx.Err() == nil) || (err == nil && resp.StatusCode >= 500)
+		if !retryable || attempt >= a.maxRetries {
+			return resp, err
+		}
+
+		if resp != nil {
+			_, _ = io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+
+		backoff := a.backoff(attempt)
+		a.logger.Debug("retrying appsec component request", zap.Int("attempt", attempt+1), zap.Duration("backoff", backoff))
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(backoff):
+		}
+	}
+}
+
+// maxRetryBackoff caps the exponentially increasing backoff between
+// retries of requests to the AppSec component, as requests are held up
+// while retrying. A larger initial backoff is used as is.
+const maxRetryBackoff = 2 * time.Second
+
+// backoff returns the backoff before retrying the request after attempt,
+// which doubles with every attempt until it reaches the cap.
+func (a *appsec) backoff(attempt int) time.Duration {
+	limit := max(a.retryBackoff, maxRetryBackoff)
+
+	backoff := a.retryBackoff
+	for i := 0; i < attempt && backoff < limit; i++ {
+		backoff *= 2
+	}
+
+	return min(backoff, limit)
+}
+
+// fail logs the failure and applies the failure policy. With an open
+// policy the request is allowed; otherwise an [AppSecError] is returned
+// that results in the request being blocked.
+func (a *appsec) fail(msg string, fields ...zap.Field) error {
+	a.logger.Error(msg, fields...)
+	if a.failurePolicy.open {
 		return nil
 	}
+
+	return &AppSecError{Err: errors.New(msg), Action: "ban", StatusCode: a.failurePolicy.statusCode}
 }
 
 func (b *Bouncer) logAppSecStatus() {
@@ -0,0 +1,84 @@
+package bouncer
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"go.uber.org/zap"
+)
+
+const (
+	defaultAppSecQueueSize = 1000
+	appSecAsyncWorkers     = 4
+)
+
+// SetAppSecAsync enables the asynchronous, detection-only AppSec mode. In
+// this mode requests are queued for inspection by the AppSec component,
+// and are never blocked. Requests are dropped when the queue is full.
+func (b *Bouncer) SetAppSecAsync(queueSize int) {
+	if queueSize <= 0 {
+		queueSize = defaultAppSecQueueSize
+	}
+
+	b.appsec.async = true
+	b.appsec.queue = make(chan *http.Request, queueSize)
+}
+
+// enqueue queues req for asynchronous inspection. It never blocks; if
+// the queue is full, the request is dropped.
+func (a *appsec) enqueue(req *http.Request) {
+	select {
+	case a.queue <- req:
+	default:
+		totalAppSecDropped.Inc()
+		a.logger.Debug("appsec queue full; dropping request", zap.String("uri", req.Header.Get("X-Crowdsec-Appsec-Uri")))
+	}
+}
+
+func (b *Bouncer) startAppSecWorkers(ctx context.Context) {
+	if b.appsec.apiURL == "" || !b.appsec.async {
+		return
+	}
+
+	b.logger.Debug("starting appsec workers", b.zapField(), zap.Int("workers", appSecAsyncWorkers), zap.Int("queue_size", cap(b.appsec.queue)))
+	for range appSecAsyncWorkers {
+		b.wg.Add(1)
+		go func() {
+			defer b.wg.Done()
+
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case req := <-b.appsec.queue:
+					b.appsec.inspect(ctx, req)
+				}
+			}
+		}()
+	}
+}
+
+// inspect sends a queued request to the AppSec component. The request
+// is not blocked, so the result is only logged.
+func (a *appsec) inspect(ctx context.Context, req *http.Request) {
+	_, err := a.evaluate(ctx, req.WithContext(ctx))
+
+	var appSecErr *AppSecError
+	if !errors.As(err, &appSecErr) {
+		return
+	}
+
+	fields := []zap.Field{
+		zap.String("ip", req.Header.Get("X-Crowdsec-Appsec-Ip")),
+		zap.String("uri", req.Header.Get("X-Crowdsec-Appsec-Uri")),
+		zap.String("action", appSecErr.Action),
+	}
+	if !appSecErr.Triggered {
+		// the failure or overflow policy was applied
+		a.logger.Warn("appsec check failed (detection only)", append(fields, zap.Error(err))...)
+		return
+	}
+
+	a.logger.Info("appsec rule triggered (detection only)", fields...)
+}
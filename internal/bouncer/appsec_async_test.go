@@ -0,0 +1,107 @@
+package bouncer
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest"
+	"go.uber.org/zap/zaptest/observer"
+
+	"github.com/hslatman/caddy-crowdsec-bouncer/internal/httputils"
+)
+
+func Test_appsec_async(t *testing.T) {
+	ctx := newCaddyVarsContext()
+	caddyhttp.SetVar(ctx, caddyhttp.ClientIPVarKey, "10.0.0.10")
+	ctx, _ = httputils.EnsureIP(ctx)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer wg.Done()
+		b, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		assert.Equal(t, []byte("body"), b)
+		w.WriteHeader(http.StatusForbidden)
+		_, _ = w.Write([]byte(`{"action":"ban","http_status":403}`))
+	}))
+	t.Cleanup(s.Close)
+
+	b, err := New("apiKey", "http://127.0.0.1:8080/", s.URL, 0, "10s", zaptest.NewLogger(t))
+	require.NoError(t, err)
+	b.SetAppSecAsync(1)
+
+	r := httptest.NewRequest(http.MethodPost, "/path", bytes.NewBufferString("body"))
+
+	// the request is queued, and not blocked
+	err = b.CheckRequest(ctx, r)
+	require.NoError(t, err)
+
+	// requests are dropped when the queue is full
+	err = b.CheckRequest(ctx, httptest.NewRequest(http.MethodGet, "/path", http.NoBody))
+	require.NoError(t, err)
+	assert.Len(t, b.appsec.queue, 1)
+
+	// the original body is still available to the next handler
+	body, err := io.ReadAll(r.Body)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("body"), body)
+	require.NoError(t, r.Body.Close())
+
+	b.wg = &sync.WaitGroup{}
+	runCtx, cancel := context.WithCancel(context.Background())
+	b.startAppSecWorkers(runCtx)
+	wg.Wait()
+
+	cancel()
+	b.wg.Wait()
+}
+
+func Test_appsec_inspect(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Crowdsec-Appsec-Uri") == "/rule" {
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = w.Write([]byte(`{"action":"ban","http_status":403}`))
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	t.Cleanup(s.Close)
+
+	tests := []struct {
+		name      string
+		uri       string
+		wantLevel zapcore.Level
+		wantMsg   string
+	}{
+		{name: "rule", uri: "/rule", wantLevel: zapcore.InfoLevel, wantMsg: "appsec rule triggered (detection only)"},
+		{name: "failure", uri: "/error", wantLevel: zapcore.WarnLevel, wantMsg: "appsec check failed (detection only)"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			core, logs := observer.New(zapcore.InfoLevel)
+			a := newAppSec(s.URL, "test-apikey", 0, zap.New(core))
+			a.failurePolicy, _ = parseFailurePolicy("closed")
+
+			req, err := http.NewRequest(http.MethodGet, s.URL, http.NoBody)
+			require.NoError(t, err)
+			req.Header.Set("X-Crowdsec-Appsec-Uri", tt.uri)
+			a.inspect(context.Background(), req)
+
+			entries := logs.FilterMessage(tt.wantMsg).All()
+			require.Len(t, entries, 1)
+			assert.Equal(t, tt.wantLevel, entries[0].Level)
+			assert.Equal(t, tt.uri, entries[0].ContextMap()["uri"])
+		})
+	}
+}
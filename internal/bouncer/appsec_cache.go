@@ -0,0 +1,60 @@
+package bouncer
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/hslatman/caddy-crowdsec-bouncer/internal/httputils"
+	"github.com/hslatman/caddy-crowdsec-bouncer/internal/ttlcache"
+)
+
+const defaultAppSecCacheSize = 10000
+
+// SetAppSecCache enables caching of AppSec verdicts for GET requests
+// without a body. Verdicts are cached for ttl, and at most size verdicts
+// are cached.
+func (b *Bouncer) SetAppSecCache(ttl time.Duration, size int) {
+	if ttl <= 0 {
+		return
+	}
+	if size <= 0 {
+		size = defaultAppSecCacheSize
+	}
+
+	b.appsec.cache = ttlcache.New[string, error](ttl, size)
+}
+
+// cacheKey returns the key to cache the verdict for r by. Only verdicts
+// for GET requests without a body are cached. The key is derived from
+// all headers of the request to the AppSec component, which include the
+// client IP, method, host and URI. The request ID is unique per request,
+// so it's excluded.
+func (a *appsec) cacheKey(r, req *http.Request) (string, bool) {
+	if a.cache == nil || r.Method != http.MethodGet || req.ContentLength > 0 || httputils.IsUpgrade(r) {
+		return "", false
+	}
+
+	keys := make([]string, 0, len(req.Header))
+	for k := range req.Header {
+		if k == requestIDHeader {
+			continue
+		}
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+
+	h := sha256.New()
+	for _, k := range keys {
+		for _, v := range req.Header[k] {
+			h.Write([]byte(k))
+			h.Write([]byte{0})
+			h.Write([]byte(v))
+			h.Write([]byte{0})
+		}
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), true
+}
@@ -0,0 +1,60 @@
+package bouncer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+
+	"github.com/hslatman/caddy-crowdsec-bouncer/internal/httputils"
+)
+
+func Test_appsec_cache(t *testing.T) {
+	ctx := newCaddyVarsContext()
+	caddyhttp.SetVar(ctx, caddyhttp.ClientIPVarKey, "10.0.0.10")
+	ctx, _ = httputils.EnsureIP(ctx)
+
+	calls := 0
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if r.Header.Get("X-Crowdsec-Appsec-Uri") == "/blocked" {
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = w.Write([]byte(`{"action":"ban","http_status":403}`))
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(s.Close)
+
+	b, err := New("apiKey", "http://127.0.0.1:8080/", s.URL, 0, "10s", zaptest.NewLogger(t))
+	require.NoError(t, err)
+	b.SetAppSecCache(time.Minute, 10)
+
+	for range 3 {
+		require.NoError(t, b.CheckRequest(ctx, httptest.NewRequest(http.MethodGet, "/allowed", http.NoBody)))
+	}
+	assert.Equal(t, 1, calls)
+
+	for range 3 {
+		require.Error(t, b.CheckRequest(ctx, httptest.NewRequest(http.MethodGet, "/blocked", http.NoBody)))
+	}
+	assert.Equal(t, 2, calls)
+
+	// different headers result in a different cache key
+	r := httptest.NewRequest(http.MethodGet, "/allowed", http.NoBody)
+	r.Header.Set("User-Agent", "other")
+	require.NoError(t, b.CheckRequest(ctx, r))
+	assert.Equal(t, 3, calls)
+
+	// requests with a body are never cached
+	for range 2 {
+		require.NoError(t, b.CheckRequest(ctx, httptest.NewRequest(http.MethodPost, "/allowed", strings.NewReader("body"))))
+	}
+	assert.Equal(t, 5, calls)
+}
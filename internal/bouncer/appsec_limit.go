@@ -0,0 +1,95 @@
+package bouncer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+)
+
+// overflow policies, applied when the maximum number of in-flight
+// requests to the AppSec component is reached, and the queue is full.
+const (
+	overflowOpen   = "open"
+	overflowClosed = "closed"
+)
+
+// concurrencyLimit limits the number of in-flight requests to the
+// AppSec component. Requests exceeding the limit wait in a queue of
+// size maxQueued for a slot to become available.
+type concurrencyLimit struct {
+	slots     chan struct{}
+	maxQueued int64
+	queued    atomic.Int64
+	overflow  string
+}
+
+// SetAppSecConcurrencyLimit limits the number of in-flight requests to
+// the AppSec component to maxConcurrent. At most maxQueued requests wait
+// for a slot to become available. When the queue is full, the overflow
+// policy is applied, which is either "open" or "closed".
+func (b *Bouncer) SetAppSecConcurrencyLimit(maxConcurrent, maxQueued int, overflow string) error {
+	if maxConcurrent <= 0 {
+		return nil
+	}
+
+	switch overflow {
+	case "":
+		overflow = overflowOpen
+	case overflowOpen, overflowClosed:
+	default:
+		return fmt.Errorf("invalid overflow policy %q; must be either open or closed", overflow)
+	}
+
+	b.appsec.limit = &concurrencyLimit{
+		slots:     make(chan struct{}, maxConcurrent),
+		maxQueued: int64(maxQueued),
+		overflow:  overflow,
+	}
+
+	return nil
+}
+
+// acquire acquires a slot for a request to the AppSec component. It
+// reports false if no slot could be acquired, because the queue is full
+// or because ctx is done while waiting.
+func (l *concurrencyLimit) acquire(ctx context.Context) bool {
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	default:
+	}
+
+	if l.queued.Add(1) > l.maxQueued {
+		l.queued.Add(-1)
+		return false
+	}
+	defer l.queued.Add(-1)
+
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (l *concurrencyLimit) release() {
+	<-l.slots
+}
+
+// overflowed applies the overflow policy to a request that could not
+// be sent to the AppSec component.
+func (a *appsec) overflowed() error {
+	totalAppSecOverflows.Inc()
+
+	switch a.limit.overflow {
+	case overflowClosed:
+		a.logger.Warn("appsec concurrency limit reached; blocking request")
+		return &AppSecError{Err: errors.New("appsec concurrency limit reached"), Action: "ban", StatusCode: http.StatusServiceUnavailable}
+	default:
+		a.logger.Warn("appsec concurrency limit reached; allowing request")
+		return nil
+	}
+}
@@ -0,0 +1,103 @@
+package bouncer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+
+	"github.com/hslatman/caddy-crowdsec-bouncer/internal/httputils"
+)
+
+func Test_appsec_concurrencyLimit(t *testing.T) {
+	ctx := newCaddyVarsContext()
+	caddyhttp.SetVar(ctx, caddyhttp.ClientIPVarKey, "10.0.0.10")
+	ctx, _ = httputils.EnsureIP(ctx)
+
+	tests := []struct {
+		name     string
+		overflow string
+		wantErr  bool
+	}{
+		{"open", "open", false},
+		{"closed", "closed", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls int
+			var mu sync.Mutex
+			inFlight := make(chan struct{})
+			release := make(chan struct{})
+			s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				calls++
+				mu.Unlock()
+				inFlight <- struct{}{}
+				<-release
+				w.WriteHeader(http.StatusOK)
+			}))
+			t.Cleanup(s.Close)
+
+			b, err := New("apiKey", "http://127.0.0.1:8080/", s.URL, 0, "10s", zaptest.NewLogger(t))
+			require.NoError(t, err)
+			require.NoError(t, b.SetAppSecConcurrencyLimit(1, 0, tt.overflow))
+
+			done := make(chan error)
+			go func() {
+				done <- b.CheckRequest(ctx, httptest.NewRequest(http.MethodGet, "/first", http.NoBody))
+			}()
+			<-inFlight
+
+			// the second request exceeds the limit, and there's no queue
+			err = b.CheckRequest(ctx, httptest.NewRequest(http.MethodGet, "/second", http.NoBody))
+			if tt.wantErr {
+				var appSecErr *AppSecError
+				require.ErrorAs(t, err, &appSecErr)
+				assert.Equal(t, http.StatusServiceUnavailable, appSecErr.StatusCode)
+			} else {
+				assert.NoError(t, err)
+			}
+
+			close(release)
+			require.NoError(t, <-done)
+
+			mu.Lock()
+			assert.Equal(t, 1, calls)
+			mu.Unlock()
+		})
+	}
+
+	t.Run("invalid", func(t *testing.T) {
+		b, err := New("apiKey", "http://127.0.0.1:8080/", "http://127.0.0.1:7422/", 0, "10s", zaptest.NewLogger(t))
+		require.NoError(t, err)
+		assert.Error(t, b.SetAppSecConcurrencyLimit(1, 0, "sometimes"))
+	})
+}
+
+func Test_concurrencyLimit_queue(t *testing.T) {
+	l := &concurrencyLimit{slots: make(chan struct{}, 1), maxQueued: 1}
+	ctx := newCaddyVarsContext()
+
+	require.True(t, l.acquire(ctx))
+
+	acquired := make(chan bool)
+	go func() {
+		acquired <- l.acquire(ctx)
+	}()
+
+	// wait for the second acquire to be queued
+	for l.queued.Load() != 1 {
+	}
+
+	// the queue is full
+	assert.False(t, l.acquire(ctx))
+
+	l.release()
+	assert.True(t, <-acquired)
+	l.release()
+}
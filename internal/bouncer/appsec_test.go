@@ -3,17 +3,26 @@ package bouncer
 import (
 	"bytes"
 	"context"
+	"crypto/tls"
+	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/netip"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"go.uber.org/zap/zaptest"
 
+	"github.com/hslatman/caddy-crowdsec-bouncer/internal/fingerprint"
 	"github.com/hslatman/caddy-crowdsec-bouncer/internal/httputils"
+	"github.com/hslatman/caddy-crowdsec-bouncer/internal/ttlcache"
 )
 
 func newCaddyVarsContext() (ctx context.Context) {
@@ -126,3 +135,434 @@ func Test_appsec_checkRequest(t *testing.T) {
 		})
 	}
 }
+
+func Test_parseFailurePolicy(t *testing.T) {
+	tests := []struct {
+		policy  string
+		want    failurePolicy
+		wantErr bool
+	}{
+		{"", failurePolicy{open: true}, false},
+		{"open", failurePolicy{open: true}, false},
+		{"closed", failurePolicy{statusCode: 403}, false},
+		{"status:503", failurePolicy{statusCode: 503}, false},
+		{"status:abc", failurePolicy{}, true},
+		{"status:99", failurePolicy{}, true},
+		{"sometimes", failurePolicy{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			got, err := parseFailurePolicy(tt.policy)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func Test_appsec_failurePolicy(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+	ctx := newCaddyVarsContext()
+	caddyhttp.SetVar(ctx, caddyhttp.ClientIPVarKey, "10.0.0.10")
+	ctx, _ = httputils.EnsureIP(ctx)
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	t.Cleanup(s.Close)
+
+	tests := []struct {
+		name           string
+		apiURL         string
+		policy         string
+		wantStatusCode int
+	}{
+		{"open", s.URL, "open", 0},
+		{"closed", s.URL, "closed", 403},
+		{"status", s.URL, "status:503", 503},
+		{"unreachable-open", "http://127.0.0.1:0", "open", 0},
+		{"unreachable-closed", "http://127.0.0.1:0", "closed", 403},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := newAppSec(tt.apiURL, "test-apikey", 0, logger)
+			a.failurePolicy, _ = parseFailurePolicy(tt.policy)
+
+			r := httptest.NewRequest(http.MethodGet, "/path", http.NoBody)
+			err := a.checkRequest(ctx, r)
+			if tt.wantStatusCode == 0 {
+				assert.NoError(t, err)
+				return
+			}
+
+			var appsecErr *AppSecError
+			require.ErrorAs(t, err, &appsecErr)
+			assert.Equal(t, "ban", appsecErr.Action)
+			assert.Equal(t, tt.wantStatusCode, appsecErr.StatusCode)
+		})
+	}
+}
+
+func Test_appsec_retries(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+	ctx := newCaddyVarsContext()
+	caddyhttp.SetVar(ctx, caddyhttp.ClientIPVarKey, "10.0.0.10")
+	ctx, _ = httputils.EnsureIP(ctx)
+
+	tests := []struct {
+		name         string
+		failures     int
+		maxRetries   int
+		wantAttempts int
+		wantErr      bool
+	}{
+		{"no-retries", 1, 0, 1, true},
+		{"recovered", 2, 2, 3, false},
+		{"exhausted", 3, 2, 3, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			attempts := 0
+			s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				attempts++
+				b, err := io.ReadAll(r.Body)
+				require.NoError(t, err)
+				assert.Equal(t, []byte("body"), b)
+				if attempts <= tt.failures {
+					w.WriteHeader(http.StatusServiceUnavailable)
+					return
+				}
+				w.WriteHeader(http.StatusOK)
+			}))
+			t.Cleanup(s.Close)
+
+			a := newAppSec(s.URL, "test-apikey", 0, logger)
+			a.failurePolicy = failurePolicy{statusCode: 403}
+			a.maxRetries = tt.maxRetries
+			a.retryBackoff = time.Millisecond
+
+			r := httptest.NewRequest(http.MethodPost, "/path", bytes.NewBufferString("body"))
+			err := a.checkRequest(ctx, r)
+			assert.Equal(t, tt.wantAttempts, attempts)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func Test_appsec_backoff(t *testing.T) {
+	tests := []struct {
+		initial time.Duration
+		attempt int
+		want    time.Duration
+	}{
+		{100 * time.Millisecond, 0, 100 * time.Millisecond},
+		{100 * time.Millisecond, 1, 200 * time.Millisecond},
+		{100 * time.Millisecond, 4, 1600 * time.Millisecond},
+		{100 * time.Millisecond, 5, maxRetryBackoff},
+		{100 * time.Millisecond, 100, maxRetryBackoff},
+		{time.Nanosecond, 1000, maxRetryBackoff},
+		{5 * time.Second, 0, 5 * time.Second},
+		{5 * time.Second, 3, 5 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s-%d", tt.initial, tt.attempt), func(t *testing.T) {
+			a := &appsec{retryBackoff: tt.initial}
+			assert.Equal(t, tt.want, a.backoff(tt.attempt))
+		})
+	}
+}
+
+type countingReader struct {
+	r io.Reader
+	n int
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += n
+	return n, err
+}
+
+func Test_appsec_checkRequestReplaysBody(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+	ctx := newCaddyVarsContext()
+	caddyhttp.SetVar(ctx, caddyhttp.ClientIPVarKey, "10.0.0.10")
+	ctx, _ = httputils.EnsureIP(ctx)
+
+	var bodies [][]byte
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		bodies = append(bodies, b)
+		w.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(s.Close)
+
+	content := bytes.Repeat([]byte("a"), 64*1024)
+	original := &countingReader{r: bytes.NewReader(content)}
+	r := httptest.NewRequest(http.MethodPost, "/path", io.NopCloser(original))
+	r.ContentLength = int64(len(content))
+
+	a := newAppSec(s.URL, "test-apikey", 16, logger)
+	err := a.checkRequest(ctx, r)
+	require.NoError(t, err)
+
+	// only the part sent to the AppSec component is read before the next handler
+	assert.Equal(t, 16, original.n)
+
+	// the buffered part isn't shared with requests checked later, as
+	// the next handler may never close the body
+	other := httptest.NewRequest(http.MethodPost, "/path", bytes.NewReader(bytes.Repeat([]byte("b"), 16)))
+	require.NoError(t, a.checkRequest(ctx, other))
+
+	b, err := io.ReadAll(r.Body)
+	require.NoError(t, err)
+	assert.Equal(t, content, b)
+	assert.NoError(t, r.Body.Close())
+
+	assert.Equal(t, [][]byte{bytes.Repeat([]byte("a"), 16), bytes.Repeat([]byte("b"), 16)}, bodies)
+}
+
+func Test_appsec_maxBodySizeOverride(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+	ctx := newCaddyVarsContext()
+	caddyhttp.SetVar(ctx, caddyhttp.ClientIPVarKey, "10.0.0.10")
+	ctx, _ = httputils.EnsureIP(ctx)
+
+	var received atomic.Int64
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		received.Store(int64(len(b)))
+		w.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(s.Close)
+
+	a := newAppSec(s.URL, "test-apikey", 16, logger)
+	content := bytes.Repeat([]byte("a"), 1024)
+	tests := []struct {
+		name string
+		ctx  context.Context
+		want int64
+	}{
+		{name: "default", ctx: ctx, want: 16},
+		{name: "ignored", ctx: WithAppSecMaxBodySize(ctx, 0), want: 16},
+		{name: "larger", ctx: WithAppSecMaxBodySize(ctx, 512), want: 512},
+		{name: "smaller", ctx: WithAppSecMaxBodySize(ctx, 8), want: 8},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/upload", bytes.NewReader(content))
+			require.NoError(t, a.checkRequest(tt.ctx, r))
+			assert.Equal(t, tt.want, received.Load())
+
+			b, err := io.ReadAll(r.Body)
+			require.NoError(t, err)
+			assert.Equal(t, content, b)
+		})
+	}
+}
+
+func Test_appsec_streamingBody(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+	ctx := newCaddyVarsContext()
+	caddyhttp.SetVar(ctx, caddyhttp.ClientIPVarKey, "10.0.0.10")
+	ctx, _ = httputils.EnsureIP(ctx)
+
+	var (
+		calls    atomic.Int64
+		received atomic.Int64
+	)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		calls.Add(1)
+		received.Store(int64(len(b)))
+		w.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(s.Close)
+
+	a := newAppSec(s.URL, "test-apikey", 0, logger)
+	content := bytes.Repeat([]byte("a"), 1024)
+	tests := []struct {
+		name        string
+		ctx         context.Context
+		contentType string
+		length      int64
+		wantCalls   int64
+		want        int64
+	}{
+		{name: "grpc-default", ctx: ctx, contentType: "application/grpc", length: -1, wantCalls: 1, want: 0},
+		{name: "grpc-headers", ctx: WithAppSecStreamingBody(ctx, StreamingBodyHeaders), contentType: "application/grpc+proto", length: 1024, wantCalls: 1, want: 0},
+		{name: "grpc-skip", ctx: WithAppSecStreamingBody(ctx, StreamingBodySkip), contentType: "application/grpc", length: -1, wantCalls: 0, want: 0},
+		{name: "grpc-prefix", ctx: WithAppSecStreamingBody(WithAppSecMaxBodySize(ctx, 16), StreamingBodyPrefix), contentType: "application/grpc", length: -1, wantCalls: 1, want: 16},
+		{name: "unknown-length-prefix", ctx: WithAppSecStreamingBody(ctx, StreamingBodyPrefix), contentType: "application/octet-stream", length: -1, wantCalls: 1, want: 1024},
+		{name: "json-skip", ctx: WithAppSecStreamingBody(ctx, StreamingBodySkip), contentType: "application/json", length: 1024, wantCalls: 1, want: 1024},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls.Store(0)
+			received.Store(0)
+
+			r := httptest.NewRequest(http.MethodPost, "/service/Method", bytes.NewReader(content))
+			r.Header.Set("Content-Type", tt.contentType)
+			r.ContentLength = tt.length
+			require.NoError(t, a.checkRequest(tt.ctx, r))
+			assert.Equal(t, tt.wantCalls, calls.Load())
+			assert.Equal(t, tt.want, received.Load())
+
+			b, err := io.ReadAll(r.Body)
+			require.NoError(t, err)
+			assert.Equal(t, content, b)
+		})
+	}
+}
+
+func Test_headerFilter_forward(t *testing.T) {
+	tests := []struct {
+		name   string
+		allow  []string
+		deny   []string
+		header string
+		want   bool
+	}{
+		{"all", nil, nil, "X-Internal-Token", true},
+		{"denied", nil, []string{"x-internal-token"}, "X-Internal-Token", false},
+		{"allowed", []string{"user-agent"}, nil, "User-Agent", true},
+		{"not-allowed", []string{"user-agent"}, nil, "Cookie", false},
+		{"allowed-and-denied", []string{"cookie"}, []string{"Cookie"}, "Cookie", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newHeaderFilter(tt.allow, tt.deny)
+			assert.Equal(t, tt.want, f.forward(tt.header))
+		})
+	}
+}
+
+func Test_appsec_upgrade(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+	ctx := newCaddyVarsContext()
+	caddyhttp.SetVar(ctx, caddyhttp.ClientIPVarKey, "10.0.0.10")
+	ctx, _ = httputils.EnsureIP(ctx)
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// only the headers of the upgrade request are inspected
+		assert.Equal(t, http.MethodGet, r.Method)
+		assert.Equal(t, int64(0), r.ContentLength)
+		if r.Header.Get("X-Crowdsec-Appsec-Uri") == "/ws" {
+			assert.Equal(t, "websocket", r.Header.Get("Upgrade"))
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(s.Close)
+
+	b, err := New("apiKey", "http://127.0.0.1:8080/", s.URL, 0, "10s", logger)
+	require.NoError(t, err)
+	b.EnableStreaming() // decisions are looked up in the local store
+	b.SetBlockSuspiciousUpgrades()
+
+	newUpgradeRequest := func() *http.Request {
+		r := httptest.NewRequest(http.MethodGet, "/ws", bytes.NewBufferString("stream"))
+		r.Header.Set("Connection", "Upgrade")
+		r.Header.Set("Upgrade", "websocket")
+		return r
+	}
+
+	r := newUpgradeRequest()
+	require.NoError(t, b.CheckRequest(ctx, r))
+
+	// the upgraded stream is not read
+	body, err := io.ReadAll(r.Body)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("stream"), body)
+
+	// upgrades from IPs with an active decision are blocked
+	require.NoError(t, b.SetDenylist([]netip.Prefix{netip.MustParsePrefix("10.0.0.10/32")}, "captcha"))
+
+	// the decision lookup is stored with the request, so a new request
+	// needs a new context
+	ctx = newCaddyVarsContext()
+	caddyhttp.SetVar(ctx, caddyhttp.ClientIPVarKey, "10.0.0.10")
+	ctx, _ = httputils.EnsureIP(ctx)
+
+	err = b.CheckRequest(ctx, newUpgradeRequest())
+	var appSecErr *AppSecError
+	require.ErrorAs(t, err, &appSecErr)
+	assert.Equal(t, http.StatusForbidden, appSecErr.StatusCode)
+
+	// other requests from the IP are inspected as usual
+	require.NoError(t, b.CheckRequest(ctx, httptest.NewRequest(http.MethodGet, "/", http.NoBody)))
+}
+
+func Test_appsec_tlsHeaders(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+	ctx := newCaddyVarsContext()
+	caddyhttp.SetVar(ctx, caddyhttp.ClientIPVarKey, "10.0.0.10")
+	ctx, _ = httputils.EnsureIP(ctx)
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "TLS 1.3", r.Header.Get("X-Crowdsec-Appsec-Tls-Version"))
+		assert.Equal(t, "TLS_AES_128_GCM_SHA256", r.Header.Get("X-Crowdsec-Appsec-Tls-Cipher"))
+		assert.Equal(t, "example.com", r.Header.Get("X-Crowdsec-Appsec-Tls-Sni"))
+		assert.Equal(t, "ja3-hash", r.Header.Get("X-Crowdsec-Appsec-Ja3"))
+		assert.Equal(t, "ja4-fingerprint", r.Header.Get("X-Crowdsec-Appsec-Ja4"))
+		w.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(s.Close)
+
+	r := httptest.NewRequest(http.MethodGet, "https://example.com/path", http.NoBody)
+	r.RemoteAddr = "10.0.0.10:43210"
+	r.TLS = &tls.ConnectionState{
+		Version:     tls.VersionTLS13,
+		CipherSuite: tls.TLS_AES_128_GCM_SHA256,
+		ServerName:  "example.com",
+	}
+
+	fingerprint.Store(r.RemoteAddr, fingerprint.Fingerprint{JA3: "ja3-hash", JA4: "ja4-fingerprint"})
+	t.Cleanup(func() { fingerprint.Delete(r.RemoteAddr) })
+
+	a := newAppSec(s.URL, "test-apikey", 0, logger)
+	require.NoError(t, a.checkRequest(ctx, r))
+}
+
+func Test_appsec_connectionHeaders(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+	ctx := newCaddyVarsContext()
+	caddyhttp.SetVar(ctx, caddyhttp.ClientIPVarKey, "10.0.0.10")
+	ctx, _ = httputils.EnsureIP(ctx)
+
+	var requestIDs []string
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "http", r.Header.Get("X-Crowdsec-Appsec-Scheme"))
+		assert.Equal(t, "8443", r.Header.Get("X-Crowdsec-Appsec-Port"))
+		requestIDs = append(requestIDs, r.Header.Get("X-Crowdsec-Appsec-Request-Id"))
+		w.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(s.Close)
+
+	a := newAppSec(s.URL, "test-apikey", 0, logger)
+	a.cache = ttlcache.New[string, error](time.Minute, 10)
+
+	for _, id := range []string{"request-1", "request-2"} {
+		repl := caddy.NewReplacer()
+		repl.Set("http.request.uuid", id)
+		rctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, repl)
+		rctx = context.WithValue(rctx, http.LocalAddrContextKey, &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 8443})
+
+		r := httptest.NewRequest(http.MethodGet, "/path", http.NoBody).WithContext(rctx)
+		require.NoError(t, a.checkRequest(ctx, r))
+	}
+
+	// the request ID is not part of the cache key
+	assert.Equal(t, []string{"request-1"}, requestIDs)
+}
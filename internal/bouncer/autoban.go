@@ -0,0 +1,158 @@
+// Copyright 2024 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bouncer
+
+import (
+	"fmt"
+	"net/netip"
+	"slices"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// autoBanScenario is the scenario of local decisions for IPs that
+	// got too many error responses.
+	autoBanScenario = "caddy-crowdsec-bouncer/http-errors"
+
+	// maxTrackedOffenders is the maximum number of IPs offenses are
+	// counted for. Offenses of other IPs are ignored until the window
+	// of tracked IPs expired.
+	maxTrackedOffenders = 10000
+)
+
+// offenses counts offenses per IP within a fixed window.
+type offenses struct {
+	threshold int
+	window    time.Duration
+
+	mu     sync.Mutex
+	counts map[netip.Addr]*offenseCount
+}
+
+type offenseCount struct {
+	count int
+	start time.Time
+}
+
+func newOffenses(threshold int, window time.Duration) *offenses {
+	return &offenses{
+		threshold: threshold,
+		window:    window,
+		counts:    map[netip.Addr]*offenseCount{},
+	}
+}
+
+// record records an offense by ip at now. It reports whether ip
+// exceeded the threshold within the window, in which case its count
+// is reset.
+func (o *offenses) record(ip netip.Addr, now time.Time) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	c, ok := o.counts[ip]
+	if !ok || now.Sub(c.start) > o.window {
+		if !ok && len(o.counts) >= maxTrackedOffenders {
+			o.expire(now)
+			if len(o.counts) >= maxTrackedOffenders {
+				return false
+			}
+		}
+		c = &offenseCount{start: now}
+		o.counts[ip] = c
+	}
+
+	c.count++
+	if c.count <= o.threshold {
+		return false
+	}
+
+	delete(o.counts, ip)
+
+	return true
+}
+
+func (o *offenses) expire(now time.Time) {
+	for ip, c := range o.counts {
+		if now.Sub(c.start) > o.window {
+			delete(o.counts, ip)
+		}
+	}
+}
+
+// autoBan adds local decisions for IPs that get too many error responses.
+type autoBan struct {
+	offenses *offenses
+	statuses []int
+	typ      string
+	duration time.Duration
+}
+
+// SetAutoBan enables adding a local decision of type typ for IPs that
+// get more than threshold responses with one of statuses within window,
+// i.e. scanners probing for files. The decision is removed after duration.
+// Like other local decisions, it's enforced immediately, without waiting
+// for the CrowdSec agent to detect the IP.
+func (b *Bouncer) SetAutoBan(threshold int, window time.Duration, statuses []int, typ string, duration time.Duration) error {
+	if threshold <= 0 {
+		return fmt.Errorf("invalid threshold %d; must be positive", threshold)
+	}
+	if window <= 0 || duration <= 0 {
+		return fmt.Errorf("window and duration must be positive")
+	}
+	if len(statuses) == 0 {
+		return fmt.Errorf("at least one status code must be provided")
+	}
+
+	b.autoBan = &autoBan{
+		offenses: newOffenses(threshold, window),
+		statuses: statuses,
+		typ:      typ,
+		duration: duration,
+	}
+
+	return nil
+}
+
+// AutoBanEnabled returns whether IPs are banned based on the status
+// of their responses.
+func (b *Bouncer) AutoBanEnabled() bool {
+	return b.autoBan != nil
+}
+
+// RecordResponse records a response with status to ip. When ip got too
+// many error responses, a local decision is added for it.
+func (b *Bouncer) RecordResponse(ip netip.Addr, status int) {
+	if b.autoBan == nil || !ip.IsValid() || !slices.Contains(b.autoBan.statuses, status) {
+		return
+	}
+
+	if !b.autoBan.offenses.record(ip, time.Now()) {
+		return
+	}
+
+	prf := netip.PrefixFrom(ip, ip.BitLen())
+	if _, err := b.addLocal(prf, b.autoBan.typ, b.autoBan.duration, autoBanScenario); err != nil {
+		b.logger.Error("failed adding local decision", b.zapField(), zap.String("ip", ip.String()), zap.Error(err))
+		return
+	}
+
+	b.logger.Info("added local decision for too many error responses", b.zapField(),
+		zap.String("ip", ip.String()), zap.String("type", b.autoBan.typ), zap.Duration("duration", b.autoBan.duration))
+
+	b.queueAlert(alertEvent{ip: ip, scenario: autoBanScenario, action: b.autoBan.typ, time: time.Now()})
+}
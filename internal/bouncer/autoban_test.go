@@ -0,0 +1,61 @@
+package bouncer
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOffenses_record(t *testing.T) {
+	o := newOffenses(2, time.Minute)
+	ip := netip.MustParseAddr("192.0.2.1")
+	now := time.Now()
+
+	assert.False(t, o.record(ip, now))
+	assert.False(t, o.record(ip, now.Add(time.Second)))
+	assert.True(t, o.record(ip, now.Add(2*time.Second)))
+
+	// the count is reset after exceeding the threshold
+	assert.False(t, o.record(ip, now.Add(3*time.Second)))
+
+	// offenses outside of the window aren't counted
+	assert.False(t, o.record(ip, now.Add(2*time.Minute)))
+	assert.False(t, o.record(ip, now.Add(2*time.Minute+time.Second)))
+	assert.True(t, o.record(ip, now.Add(2*time.Minute+2*time.Second)))
+}
+
+func TestBouncer_RecordResponse(t *testing.T) {
+	b, err := newBouncer(t)
+	require.NoError(t, err)
+
+	assert.Error(t, b.SetAutoBan(0, time.Minute, []int{404}, "ban", time.Hour))
+	assert.Error(t, b.SetAutoBan(2, time.Minute, nil, "ban", time.Hour))
+	require.NoError(t, b.SetAutoBan(2, time.Minute, []int{401, 404}, "captcha", time.Hour))
+	assert.True(t, b.AutoBanEnabled())
+
+	ip := netip.MustParseAddr("192.0.2.1")
+	b.RecordResponse(ip, 404)
+	b.RecordResponse(ip, 200)
+	b.RecordResponse(ip, 401)
+
+	allowed, _, err := b.IsAllowed(ip)
+	require.NoError(t, err)
+	assert.True(t, allowed)
+
+	b.RecordResponse(ip, 404)
+
+	allowed, decision, err := b.IsAllowed(ip)
+	require.NoError(t, err)
+	assert.False(t, allowed)
+	require.NotNil(t, decision)
+	assert.Equal(t, "captcha", *decision.Type)
+	assert.Equal(t, localOrigin, *decision.Origin)
+	assert.Equal(t, autoBanScenario, *decision.Scenario)
+
+	allowed, _, err = b.IsAllowed(netip.MustParseAddr("192.0.2.2"))
+	require.NoError(t, err)
+	assert.True(t, allowed)
+}
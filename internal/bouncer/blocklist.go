@@ -0,0 +1,276 @@
+// Copyright 2024 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bouncer
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/crowdsecurity/crowdsec/pkg/models"
+	"go.uber.org/zap"
+)
+
+const (
+	blocklistOrigin = "caddy-blocklist"
+
+	// maxBlocklistSize is the maximum size of a blocklist that is
+	// downloaded. Larger blocklists are rejected.
+	maxBlocklistSize = 32 << 20
+
+	defaultBlocklistTimeout = 30 * time.Second
+)
+
+// blocklist is a third-party list of IPs and CIDRs that is retrieved
+// periodically.
+type blocklist struct {
+	url          string
+	name         string
+	etag         string
+	lastModified string
+	prefixes     []netip.Prefix
+}
+
+// blocklists holds the configured blocklists, and a store with the
+// decisions for the entries on all of them.
+type blocklists struct {
+	lists    []*blocklist
+	typ      string
+	interval time.Duration
+	rollup   bool
+	client   *http.Client
+	store    *store
+}
+
+// SetBlocklists configures third-party blocklists, i.e. FireHOL or the
+// Spamhaus DROP list, that are retrieved from urls every interval. The
+// blocklists must list an IP or CIDR per line; comments starting with
+// "#" or ";" are ignored. Entries are enforced with a decision of type
+// typ, independent of the decisions known to CrowdSec. When retrieving
+// a blocklist fails, its previous entries are kept.
+func (b *Bouncer) SetBlocklists(urls []string, typ string, interval time.Duration) error {
+	if interval <= 0 {
+		return fmt.Errorf("invalid blocklist interval %s; must be positive", interval)
+	}
+
+	lists := make([]*blocklist, 0, len(urls))
+	for _, v := range urls {
+		u, err := url.Parse(v)
+		if err != nil {
+			return fmt.Errorf("invalid blocklist URL: %w", err)
+		}
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return fmt.Errorf("blocklist URL %q must have an http or https scheme", u.Redacted())
+		}
+
+		lists = append(lists, &blocklist{
+			url:  v,
+			name: u.Host + u.Path, // the query is left out, as it often contains a secret
+		})
+	}
+
+	b.blocklists = &blocklists{
+		lists:    lists,
+		typ:      typ,
+		interval: interval,
+		client:   &http.Client{Timeout: defaultBlocklistTimeout},
+		store:    newStore(),
+	}
+
+	return nil
+}
+
+// EnableBlocklistRollup enables merging the entries of each blocklist
+// into the smallest set of prefixes covering the same IPs, so that
+// i.e. adjacent /24 ranges are stored as a single decision. It must be
+// called after SetBlocklists.
+func (b *Bouncer) EnableBlocklistRollup() {
+	if b.blocklists != nil {
+		b.blocklists.rollup = true
+	}
+}
+
+func (b *Bouncer) retrieveBlocklistDecision(ip netip.Addr) (*models.Decision, error) {
+	if b.blocklists == nil {
+		return nil, nil
+	}
+
+	return b.blocklists.store.get(ip)
+}
+
+func (b *Bouncer) startBlocklists(ctx context.Context) {
+	if b.blocklists == nil {
+		return
+	}
+
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+
+		ticker := time.NewTicker(b.blocklists.interval)
+		defer ticker.Stop()
+
+		b.refreshBlocklists(ctx)
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				b.refreshBlocklists(ctx)
+			}
+		}
+	}()
+}
+
+// refreshBlocklists retrieves all blocklists, and replaces the blocklist
+// decisions if any of the blocklists changed.
+func (b *Bouncer) refreshBlocklists(ctx context.Context) {
+	changed := false
+	for _, l := range b.blocklists.lists {
+		ok, err := b.fetchBlocklist(ctx, l)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			b.logger.Warn("failed retrieving blocklist", b.zapField(), zap.String("blocklist", l.name), zap.Error(err))
+			continue
+		}
+		changed = changed || ok
+	}
+
+	if !changed {
+		return
+	}
+
+	s := newStore()
+	for _, l := range b.blocklists.lists {
+		prefixes := l.prefixes
+		if b.blocklists.rollup {
+			prefixes = rollup(prefixes)
+			b.logger.Debug("rolled up blocklist", b.zapField(), zap.String("blocklist", l.name),
+				zap.Int("entries", len(l.prefixes)), zap.Int("prefixes", len(prefixes)))
+		}
+		for _, p := range prefixes {
+			if err := s.add(newPrefixDecision(p, b.blocklists.typ, blocklistOrigin, l.name, "")); err != nil {
+				b.logger.Warn("failed adding blocklist entry", b.zapField(), zap.String("blocklist", l.name),
+					zap.String("value", p.String()), zap.Error(err))
+			}
+		}
+	}
+
+	b.blocklists.store.replace(s)
+	b.generation.Add(1)
+	b.updateStoreMemory()
+
+	b.logger.Info("blocklists updated", b.zapField(), zap.Int("decisions", s.len()))
+}
+
+// fetchBlocklist retrieves l, reporting whether its entries changed.
+func (b *Bouncer) fetchBlocklist(ctx context.Context, l *blocklist) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, l.url, http.NoBody)
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("User-Agent", b.userAgent)
+	if l.etag != "" {
+		req.Header.Set("If-None-Match", l.etag)
+	}
+	if l.lastModified != "" {
+		req.Header.Set("If-Modified-Since", l.lastModified)
+	}
+
+	resp, err := b.blocklists.client.Do(req)
+	if err != nil {
+		// the URL isn't logged, as it may contain a secret
+		var uerr *url.Error
+		if errors.As(err, &uerr) {
+			return false, uerr.Err
+		}
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified {
+		return false, nil
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return false, fmt.Errorf("blocklist returned status %d", resp.StatusCode)
+	}
+
+	prefixes, invalid, err := parseBlocklist(io.LimitReader(resp.Body, maxBlocklistSize+1))
+	if err != nil {
+		return false, err
+	}
+	if invalid > 0 {
+		b.logger.Debug("skipped invalid blocklist entries", b.zapField(), zap.String("blocklist", l.name), zap.Int("invalid", invalid))
+	}
+
+	l.prefixes = prefixes
+	l.etag = resp.Header.Get("ETag")
+	l.lastModified = resp.Header.Get("Last-Modified")
+
+	return true, nil
+}
+
+// parseBlocklist parses a blocklist with an IP or CIDR at the start
+// of every line. Empty lines and comments are skipped. The number of
+// lines that couldn't be parsed is returned too.
+func parseBlocklist(r io.Reader) ([]netip.Prefix, int, error) {
+	var (
+		prefixes []netip.Prefix
+		invalid  int
+		size     int
+	)
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if size += len(line) + 1; size > maxBlocklistSize {
+			return nil, 0, fmt.Errorf("blocklist is larger than %d bytes", maxBlocklistSize)
+		}
+
+		if i := strings.IndexAny(line, "#;"); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		if ip, err := netip.ParseAddr(fields[0]); err == nil {
+			prefixes = append(prefixes, netip.PrefixFrom(ip, ip.BitLen()))
+			continue
+		}
+		if prf, err := netip.ParsePrefix(fields[0]); err == nil {
+			prefixes = append(prefixes, prf.Masked())
+			continue
+		}
+
+		invalid++
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, 0, fmt.Errorf("failed reading blocklist: %w", err)
+	}
+
+	return prefixes, invalid, nil
+}
@@ -0,0 +1,128 @@
+package bouncer
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_parseBlocklist(t *testing.T) {
+	list := `# FireHOL style comment
+1.2.3.4
+10.0.0.0/8
+;  Spamhaus style comment
+1.10.16.5/20 ; SBL256894
+
+2001:db8::/32 # documentation
+not-an-ip
+`
+	prefixes, invalid, err := parseBlocklist(strings.NewReader(list))
+	require.NoError(t, err)
+
+	assert.Equal(t, []netip.Prefix{
+		netip.MustParsePrefix("1.2.3.4/32"),
+		netip.MustParsePrefix("10.0.0.0/8"),
+		netip.MustParsePrefix("1.10.16.0/20"),
+		netip.MustParsePrefix("2001:db8::/32"),
+	}, prefixes)
+	assert.Equal(t, 1, invalid)
+}
+
+func TestBouncer_SetBlocklists(t *testing.T) {
+	b, err := newBouncer(t)
+	require.NoError(t, err)
+
+	assert.Error(t, b.SetBlocklists([]string{"ftp://example.com/list.txt"}, "ban", time.Hour))
+	assert.Error(t, b.SetBlocklists([]string{"https://example.com/list.txt"}, "ban", 0))
+
+	require.NoError(t, b.SetBlocklists([]string{"https://example.com/list.txt?token=secret"}, "ban", time.Hour))
+	assert.Equal(t, "example.com/list.txt", b.blocklists.lists[0].name)
+}
+
+func TestBouncer_refreshBlocklists(t *testing.T) {
+	var (
+		requests atomic.Int32
+		fail     atomic.Bool
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if fail.Load() {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		_, _ = w.Write([]byte("10.0.0.0/24\n"))
+	}))
+	defer srv.Close()
+
+	b, err := newBouncer(t)
+	require.NoError(t, err)
+	require.NoError(t, b.SetBlocklists([]string{srv.URL + "/list.txt"}, "captcha", time.Hour))
+
+	ctx := context.Background()
+	ip := netip.MustParseAddr("10.0.0.1")
+
+	b.refreshBlocklists(ctx)
+	allowed, decision, err := b.isAllowed(context.Background(), ip)
+	require.NoError(t, err)
+	assert.False(t, allowed)
+	require.NotNil(t, decision)
+	assert.Equal(t, "captcha", *decision.Type)
+	assert.Equal(t, blocklistOrigin, *decision.Origin)
+	assert.Equal(t, "10.0.0.0/24", *decision.Value)
+	generation := b.Generation()
+
+	// the blocklist didn't change
+	b.refreshBlocklists(ctx)
+	assert.Equal(t, generation, b.Generation())
+
+	// failures keep the previous entries
+	fail.Store(true)
+	b.refreshBlocklists(ctx)
+	allowed, _, err = b.isAllowed(context.Background(), ip)
+	require.NoError(t, err)
+	assert.False(t, allowed)
+	assert.Equal(t, int32(3), requests.Load())
+
+	details, err := b.Lookup(ip)
+	require.NoError(t, err)
+	require.Len(t, details, 1)
+	assert.Equal(t, blocklistOrigin, details[0].Origin)
+}
+
+func TestBouncer_refreshBlocklistsRollup(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("10.0.0.0/24\n10.0.1.0/24\n10.0.1.42\n192.0.2.1\n"))
+	}))
+	defer srv.Close()
+
+	b, err := newBouncer(t)
+	require.NoError(t, err)
+	require.NoError(t, b.SetBlocklists([]string{srv.URL + "/list.txt"}, "ban", time.Hour))
+	b.EnableBlocklistRollup()
+
+	b.refreshBlocklists(context.Background())
+	assert.Equal(t, 2, b.blocklists.store.len())
+
+	allowed, decision, err := b.isAllowed(context.Background(), netip.MustParseAddr("10.0.1.1"))
+	require.NoError(t, err)
+	assert.False(t, allowed)
+	require.NotNil(t, decision)
+	assert.Equal(t, "10.0.0.0/23", *decision.Value)
+
+	allowed, _, err = b.isAllowed(context.Background(), netip.MustParseAddr("10.0.2.1"))
+	require.NoError(t, err)
+	assert.True(t, allowed)
+}
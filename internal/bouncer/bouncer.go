@@ -22,24 +22,35 @@ import (
 	"math/rand"
 	"net/http"
 	"net/netip"
+	"regexp"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/crowdsecurity/crowdsec/pkg/models"
 	csbouncer "github.com/crowdsecurity/go-cs-bouncer"
+	"github.com/hslatman/caddy-crowdsec-bouncer/internal/httputils"
 	"github.com/hslatman/caddy-crowdsec-bouncer/internal/version"
 
 	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
 )
 
 const (
-	userAgentName             = "caddy-cs-bouncer"
-	maxNumberOfDecisionsToLog = 10
+	userAgentName               = "caddy-cs-bouncer"
+	defaultDecisionLogThreshold = 10
+
+	// manualOrigin is the origin of decisions made using cscli.
+	manualOrigin = "cscli"
 )
 
 var (
 	userAgent        string
 	userAgentVersion string
+
+	// validInstanceName matches names that can be used in the user agent,
+	// which the CrowdSec Local API splits into a type and version at "/".
+	validInstanceName = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
 )
 
 func init() {
@@ -52,16 +63,46 @@ func init() {
 // backed by an immutable radix tree storing known bad IPs and IP ranges.
 // The live bouncer will reach out to the CrowdSec LAPI on every check.
 type Bouncer struct {
-	streamingBouncer    *csbouncer.StreamBouncer
-	liveBouncer         *csbouncer.LiveBouncer
-	metricsProvider     *csbouncer.MetricsProvider
-	appsec              *appsec
-	store               *store
-	logger              *zap.Logger
-	useStreamingBouncer bool
-	shouldFailHard      bool
-	instantiatedAt      time.Time
-	instanceID          string
+	streamingBouncer        *csbouncer.StreamBouncer
+	liveBouncer             *csbouncer.LiveBouncer
+	metricsProvider         *csbouncer.MetricsProvider
+	metricsInterval         time.Duration
+	capi                    *capi
+	mirror                  *mirror
+	snapshot                *mirror
+	primed                  atomic.Bool
+	feeds                   []*feed
+	summaryInterval         time.Duration
+	appsec                  *appsec
+	store                   *store
+	denylist                *store
+	blocklists              *blocklists
+	alerts                  *alerts
+	autoBan                 *autoBan
+	appSecJail              *appSecJail
+	local                   *store
+	logger                  *zap.Logger
+	useStreamingBouncer     atomic.Bool
+	shouldFailHard          bool
+	blockSuspiciousUpgrades bool
+	decisionLogThreshold    int
+	logManualDecisions      bool
+	instantiatedAt          time.Time
+	instanceID              string
+	instanceName            string
+	userAgent               string
+	clientOptions           *ClientOptions
+	apiHeaders              http.Header
+	generation              atomic.Uint64
+	refreshes               chan refreshRequest
+	decisionsAdded          atomic.Uint64
+	decisionsDeleted        atomic.Uint64
+	remediations            sync.Map
+	events                  *broker
+	enforcement             atomic.Value
+	lapiHealth              lapiHealth
+	stream                  streamStats
+	usage                   *usage
 
 	ctx       context.Context
 	started   bool
@@ -70,6 +111,9 @@ type Bouncer struct {
 	startMu   sync.Mutex
 	cancel    context.CancelFunc
 	wg        *sync.WaitGroup
+
+	streamCancel context.CancelFunc
+	streamWG     *sync.WaitGroup
 }
 
 // New creates a new (streaming) Bouncer with a storage based on immutable radix tree
@@ -96,17 +140,24 @@ func New(apiKey, apiURL, appSecURL string, appSecMaxBodySize int, tickerInterval
 			InsecureSkipVerify: &insecureSkipVerify,
 			UserAgent:          userAgent,
 		},
-		appsec:         newAppSec(appSecURL, apiKey, appSecMaxBodySize, logger.Named("appsec")),
-		store:          newStore(),
-		logger:         logger,
-		instantiatedAt: instantiatedAt,
-		instanceID:     instanceID,
+		appsec:               newAppSec(appSecURL, apiKey, appSecMaxBodySize, logger.Named("appsec")),
+		store:                newStore(),
+		local:                newStore(),
+		refreshes:            make(chan refreshRequest),
+		events:               newBroker(),
+		usage:                newUsage(),
+		metricsInterval:      defaultMetricsInterval,
+		decisionLogThreshold: defaultDecisionLogThreshold,
+		logger:               logger,
+		instantiatedAt:       instantiatedAt,
+		instanceID:           instanceID,
+		userAgent:            userAgent,
 	}, nil
 }
 
 // EnableStreaming enables usage of the StreamBouncer (instead of the LiveBouncer).
 func (b *Bouncer) EnableStreaming() {
-	b.useStreamingBouncer = true
+	b.useStreamingBouncer.Store(true)
 }
 
 // EnableHardFails will make the bouncer fail hard on (connection) errors
@@ -116,22 +167,132 @@ func (b *Bouncer) EnableHardFails() {
 	b.streamingBouncer.RetryInitialConnect = false
 }
 
-// Init initializes the Bouncer
+// SetMetricsInterval sets the interval at which usage metrics are reported
+// to the CrowdSec Local API. An interval of 0 disables reporting.
+func (b *Bouncer) SetMetricsInterval(interval time.Duration) {
+	b.metricsInterval = interval
+}
+
+// SetDecisionLogThreshold sets the maximum size of a batch of decisions
+// for which every decision in it is logged at debug level. Larger batches,
+// like the initial pull, are only summarized. A threshold of 0 disables
+// logging individual decisions.
+func (b *Bouncer) SetDecisionLogThreshold(threshold int) {
+	b.decisionLogThreshold = max(0, threshold)
+}
+
+// EnableManualDecisionLogging enables logging decisions made using cscli
+// at info level, independent of the size of the batch they're in, so
+// that operators can confirm they're enforced.
+func (b *Bouncer) EnableManualDecisionLogging() {
+	b.logManualDecisions = true
+}
+
+// SetAppSecFailurePolicy sets the policy applied when the AppSec component
+// can't be reached or returns an error. The policy is one of "open",
+// "closed" or "status:<code>".
+func (b *Bouncer) SetAppSecFailurePolicy(policy string) error {
+	p, err := parseFailurePolicy(policy)
+	if err != nil {
+		return err
+	}
+
+	b.appsec.failurePolicy = p
+
+	return nil
+}
+
+// SetAppSecRetries configures the number of times a request to the AppSec
+// component is retried after a connection error or a 5xx response, and
+// the initial backoff between attempts.
+func (b *Bouncer) SetAppSecRetries(maxRetries int, backoff time.Duration) {
+	b.appsec.maxRetries = maxRetries
+	if backoff > 0 {
+		b.appsec.retryBackoff = backoff
+	}
+}
+
+// SetAppSecAPIKey sets the API key used to authenticate to the AppSec
+// component, in case it's different from the Local API key.
+func (b *Bouncer) SetAppSecAPIKey(apiKey string) {
+	b.appsec.apiKey = apiKey
+}
+
+// SetAppSecTimeout sets the timeout for requests to the AppSec component.
+func (b *Bouncer) SetAppSecTimeout(timeout time.Duration) {
+	b.appsec.client.Timeout = timeout
+}
+
+// SetAppSecHeaders configures which request headers are forwarded to
+// the AppSec component. If allow is not empty, only the headers in allow
+// are forwarded. Headers in deny are never forwarded.
+func (b *Bouncer) SetAppSecHeaders(allow, deny []string) {
+	b.appsec.headers = newHeaderFilter(allow, deny)
+}
+
+// Init initializes the Bouncer. Errors with a known cause, like an
+// invalid API key, are returned as a LAPIError with a hint.
 func (b *Bouncer) Init() (err error) {
+	defer func() { err = classifyError(err) }()
+
 	// override CrowdSec's default logrus logging
 	b.overrideLogrusLogger()
 
-	// TODO: make metrics gathering/integration optional? I.e. if the metrics
-	// interval is configured to be 0 or smaller, don't start the metrics
-	// provider? Separate setting for gathering metrics vs. pushing to LAPI?
-	metricsInterval := 0 * time.Minute // 1 * time.Minute
+	if b.alerts != nil {
+		b.tuneAPIClient(b.alerts.client)
+	}
+
+	// initialize the CrowdSec streaming bouncer for the Central API
+	if b.capi != nil {
+		b.logger.Info("initializing streaming bouncer for the central API", b.zapField())
+		if err = b.initCAPI(); err != nil {
+			return err
+		}
+		if err = b.initFeeds(); err != nil {
+			return err
+		}
+
+		// usage metrics can only be reported to a Local API; the metrics
+		// provider doesn't report metrics when its interval is 0
+		if b.metricsProvider, err = newMetricsProvider(b.streamingBouncer.APIClient, b.updateMetrics, 0); err != nil {
+			return err
+		}
+
+		b.logAppSecStatus()
+
+		return nil
+	}
+
+	// initialize the CrowdSec streaming bouncer for a blocklist mirror
+	if b.mirror != nil {
+		b.logger.Info("initializing streaming bouncer for a blocklist mirror", b.zapField())
+		if err = b.initMirror(); err != nil {
+			return err
+		}
+		if err = b.initFeeds(); err != nil {
+			return err
+		}
+
+		// without a Local API, there's nothing to report usage metrics to
+		if b.metricsProvider, err = newMetricsProvider(nil, b.updateMetrics, 0); err != nil {
+			return err
+		}
+
+		b.logAppSecStatus()
+
+		return nil
+	}
+
+	// the metrics provider doesn't report metrics when its interval is 0
+	metricsInterval := b.metricsInterval
 
 	// initialize the CrowdSec live bouncer
-	if !b.useStreamingBouncer {
+	if !b.useStreamingBouncer.Load() {
 		b.logger.Info("initializing live bouncer", b.zapField())
 		if err = b.liveBouncer.Init(); err != nil {
 			return err
 		}
+		b.tuneAPIClient(b.liveBouncer.APIClient)
 
 		if b.metricsProvider, err = newMetricsProvider(b.liveBouncer.APIClient, b.updateMetrics, metricsInterval); err != nil {
 			return err
@@ -147,6 +308,10 @@ func (b *Bouncer) Init() (err error) {
 	if err = b.streamingBouncer.Init(); err != nil {
 		return err
 	}
+	b.tuneAPIClient(b.streamingBouncer.APIClient)
+	if err = b.initFeeds(); err != nil {
+		return err
+	}
 
 	if b.metricsProvider, err = newMetricsProvider(b.streamingBouncer.APIClient, b.updateMetrics, metricsInterval); err != nil {
 		return err
@@ -171,11 +336,17 @@ func (b *Bouncer) Run(ctx context.Context) {
 	b.started = true
 	b.startedAt = time.Now()
 	b.logger.Info("started", b.zapField())
+	b.updateStoreMemory()
 
 	// when using the live bouncer only the metrics provider needs
 	// to be initialized. Return early without starting other processes.
-	if !b.useStreamingBouncer {
+	if !b.useStreamingBouncer.Load() {
 		b.startMetricsProvider(b.ctx)
+		b.startAppSecHealthCheck(b.ctx)
+		b.startAppSecWorkers(b.ctx)
+		b.startSummary(b.ctx)
+		b.startBlocklists(b.ctx)
+		b.startAlerts(b.ctx)
 
 		return
 	}
@@ -187,9 +358,14 @@ func (b *Bouncer) Run(ctx context.Context) {
 	// directly, but we could use the heartbeat service before starting to run?
 	// That can also be useful for testing the LiveBouncer at startup.
 
-	b.startStreamingBouncer(b.ctx)
-	b.startProcessingDecisions(b.ctx)
+	b.startStreaming(b.ctx)
+	b.startFeeds(b.ctx)
 	b.startMetricsProvider(b.ctx)
+	b.startAppSecHealthCheck(b.ctx)
+	b.startAppSecWorkers(b.ctx)
+	b.startSummary(b.ctx)
+	b.startBlocklists(b.ctx)
+	b.startAlerts(b.ctx)
 }
 
 // Shutdown stops the Bouncer
@@ -202,8 +378,10 @@ func (b *Bouncer) Shutdown() error {
 
 	b.logger.Info("stopping ...", b.zapField())
 
+	b.stopStreaming()
 	b.cancel()
 	b.wg.Wait()
+	b.events.close()
 
 	// TODO: clean shutdown of the streaming bouncer channel reading
 	//b.store = nil // TODO(hs): setting this to nil without reinstantiating it, leads to errors; do this properly.
@@ -215,15 +393,52 @@ func (b *Bouncer) Shutdown() error {
 	return nil
 }
 
-// IsAllowed checks if an IP is allowed or not
-func (b *Bouncer) IsAllowed(ip netip.Addr) (bool, *models.Decision, error) {
+// isAllowed checks if an IP is allowed or not
+func (b *Bouncer) isAllowed(ctx context.Context, ip netip.Addr) (bool, *models.Decision, error) {
 	// TODO: perform lookup in explicit allowlist as a kind of quick lookup in front of the CrowdSec lookup list?
 	isAllowed := false
 	if !ip.IsValid() {
 		return isAllowed, nil, errors.New("could not obtain netip.Addr from request") // fail closed
 	}
 
-	decision, err := b.retrieveDecision(ip)
+	// the local denylist, local decisions and blocklists take precedence over CrowdSec decisions
+	decision, err := b.retrieveDenylistDecision(ip)
+	if err != nil {
+		return isAllowed, nil, err // fail closed
+	}
+
+	if decision != nil {
+		return isAllowed, decision, nil
+	}
+
+	decision, err = b.retrieveLocalDecision(ip)
+	if err != nil {
+		return isAllowed, nil, err // fail closed
+	}
+
+	if decision != nil {
+		return isAllowed, decision, nil
+	}
+
+	decision, err = b.retrieveBlocklistDecision(ip)
+	if err != nil {
+		return isAllowed, nil, err // fail closed
+	}
+
+	if decision != nil {
+		return isAllowed, decision, nil
+	}
+
+	decision, err = b.retrieveDecision(ctx, ip)
+	if err != nil {
+		return isAllowed, nil, err // fail closed
+	}
+
+	if decision != nil {
+		return isAllowed, decision, nil
+	}
+
+	decision, err = b.retrieveFeedDecision(ip)
 	if err != nil {
 		return isAllowed, nil, err // fail closed
 	}
@@ -238,10 +453,138 @@ func (b *Bouncer) IsAllowed(ip netip.Addr) (bool, *models.Decision, error) {
 	return isAllowed, nil, nil
 }
 
-func (b *Bouncer) CheckRequest(ctx context.Context, r *http.Request) error {
+// InstanceID returns the identifier of the Bouncer instance. It's the
+// instance name if one was set, and a random ID otherwise.
+func (b *Bouncer) InstanceID() string {
+	return b.instanceID
+}
+
+// SetInstanceName sets a name identifying the Bouncer instance, instead
+// of the random ID that changes when Caddy is restarted. The name is
+// used in logs, in the user agent and in usage metrics, so that they can
+// be correlated across restarts. It must be called before the sources of
+// decisions and alerts are configured, as they copy the user agent.
+func (b *Bouncer) SetInstanceName(name string) error {
+	if !validInstanceName.MatchString(name) {
+		return fmt.Errorf("invalid instance name %q; must only contain letters, digits, '.', '-' and '_'", name)
+	}
+
+	b.instanceID = name
+	b.instanceName = name
+	b.userAgent = fmt.Sprintf("%s (%s)", userAgent, name)
+	b.streamingBouncer.UserAgent = b.userAgent
+	b.liveBouncer.UserAgent = b.userAgent
+
+	return nil
+}
+
+// IsStreaming returns whether the Bouncer uses the StreamBouncer.
+func (b *Bouncer) IsStreaming() bool {
+	return b.useStreamingBouncer.Load()
+}
+
+// SetStreaming switches a running Bouncer between the StreamBouncer and
+// the LiveBouncer. When switching to the StreamBouncer, all active
+// decisions are retrieved before lookups are served from the store.
+// When switching to the LiveBouncer, the stream is stopped and the
+// decisions in the store are cleared.
+func (b *Bouncer) SetStreaming(ctx context.Context, enabled bool) error {
+	b.startMu.Lock()
+	defer b.startMu.Unlock()
+	if !b.started || b.stopped {
+		return errors.New("bouncer is not running")
+	}
+
+	if b.useStreamingBouncer.Load() == enabled {
+		return nil
+	}
+
+	if !enabled {
+		if b.capi != nil {
+			return errors.New("live mode is not supported with the central API")
+		}
+		if b.mirror != nil {
+			return errors.New("live mode is not supported with a blocklist mirror")
+		}
+		if len(b.feeds) > 0 {
+			return errors.New("live mode is not supported with additional feeds")
+		}
+		if b.liveBouncer.APIClient == nil {
+			if err := b.liveBouncer.Init(); err != nil {
+				return fmt.Errorf("failed initializing live bouncer: %w", err)
+			}
+			b.tuneAPIClient(b.liveBouncer.APIClient)
+		}
+
+		b.useStreamingBouncer.Store(false)
+		b.stopStreaming()
+		b.store.replace(newStore())
+		b.generation.Add(1)
+		b.updateActiveDecisions()
+
+		b.logger.Info("switched to live bouncer", b.zapField())
+
+		return nil
+	}
+
+	if b.streamingBouncer.APIClient == nil {
+		if err := b.streamingBouncer.Init(); err != nil {
+			return fmt.Errorf("failed initializing streaming bouncer: %w", err)
+		}
+		b.tuneAPIClient(b.streamingBouncer.APIClient)
+	}
+
+	if r := b.resync(ctx, false); r.err != nil {
+		return r.err
+	}
+
+	b.streamingBouncer.Stream = make(chan *models.DecisionsStreamResponse)
+	b.useStreamingBouncer.Store(true)
+	b.startStreaming(b.ctx)
+
+	b.logger.Info("switched to streaming bouncer", b.zapField())
+
+	return nil
+}
+
+func (b *Bouncer) checkRequest(ctx context.Context, r *http.Request) error {
+	if b.blockSuspiciousUpgrades && httputils.IsUpgrade(r) {
+		if err := b.checkUpgrade(ctx); err != nil {
+			return err
+		}
+	}
+
 	return b.appsec.checkRequest(ctx, r)
 }
 
+// SetBlockSuspiciousUpgrades enables blocking upgrade requests, such as
+// WebSocket handshakes, from IPs that have any active decision. Remediations
+// like captchas can't be served over an upgraded connection.
+func (b *Bouncer) SetBlockSuspiciousUpgrades() {
+	b.blockSuspiciousUpgrades = true
+}
+
+func (b *Bouncer) checkUpgrade(ctx context.Context) error {
+	ip, ok := httputils.FromContext(ctx)
+	if !ok {
+		return errors.New("could not retrieve netip.Addr from context")
+	}
+
+	allowed, decision, err := b.lookupRequest(ctx, ip)
+	if err != nil {
+		return err
+	}
+	if allowed || decision == nil {
+		return nil
+	}
+
+	if ce := b.logger.Check(zapcore.DebugLevel, "blocking upgrade request from suspicious IP"); ce != nil {
+		ce.Write(zap.String("ip", ip.String()), zap.Stringp("type", decision.Type))
+	}
+
+	return &AppSecError{Err: errors.New("upgrade request from suspicious IP"), Action: "ban", StatusCode: http.StatusForbidden}
+}
+
 func generateInstanceID(t time.Time) (string, error) {
 	r := rand.New(rand.NewSource(t.Unix()))
 	b := [4]byte{}
@@ -4,23 +4,29 @@ import (
 	"context"
 	"net/netip"
 	"net/url"
-	"regexp"
 	"testing"
 	"time"
 
 	"github.com/crowdsecurity/crowdsec/pkg/apiclient"
 	"github.com/crowdsecurity/crowdsec/pkg/models"
 	"github.com/google/go-cmp/cmp"
-	"github.com/jarcoal/httpmock"
 	"github.com/stretchr/testify/require"
 	"go.uber.org/zap/zaptest"
+
+	"github.com/hslatman/caddy-crowdsec-bouncer/crowdsectest"
 )
 
 func newBouncer(t *testing.T) (*Bouncer, error) {
 	t.Helper()
 
-	key := "apiKey"
-	host := "http://127.0.0.1:8080/"
+	return newBouncerWithLAPI(t, crowdsectest.NewServer(t))
+}
+
+func newBouncerWithLAPI(t *testing.T, lapi *crowdsectest.Server) (*Bouncer, error) {
+	t.Helper()
+
+	key := lapi.APIKey()
+	host := lapi.URL()
 	tickerInterval := "10s"
 	logger := zaptest.NewLogger(t)
 
@@ -36,14 +42,9 @@ func newBouncer(t *testing.T) (*Bouncer, error) {
 	require.NoError(t, err, "local API Url %q", bouncer.streamingBouncer.APIUrl)
 
 	transport := &apiclient.APIKeyTransport{
-		APIKey:    bouncer.streamingBouncer.APIKey,
-		Transport: httpmock.DefaultTransport, // crucial for httpmock to work correctly
+		APIKey: bouncer.streamingBouncer.APIKey,
 	}
 
-	// logic in the NewDefaultClient is not really nice; it checks for an *http.Transport, which
-	// the httpmock transport isn't, resulting in a panic. We've worked around this by specifying the
-	// Transport in the APIKeyTransport and waiting a bit before the bouncer is ran. This results in
-	// the goal of ensuring the bouncer gets mocked decisions.
 	bouncer.streamingBouncer.APIClient, err = apiclient.NewDefaultClient(apiURL, "v1", bouncer.streamingBouncer.UserAgent, transport.Client())
 	require.NoError(t, err)
 
@@ -123,21 +124,14 @@ func decisions() *models.DecisionsStreamResponse {
 }
 
 func TestStreamingBouncer(t *testing.T) {
-	b, err := newBouncer(t)
-	require.NoError(t, err)
-
-	// activate httpmock so that responses can be mocked
-	httpmock.Activate()
-	defer httpmock.DeactivateAndReset()
+	// the fake LAPI returns all decisions on the first pull of the stream
+	lapi := crowdsectest.NewServer(t)
+	lapi.AddDecisions(decisions().New...)
 
-	// create a mock for the streaming bouncer; results in all mocked responses to be inserted
-	decisions := decisions()
-	urlRegexp := regexp.MustCompile(`http:\/\/127\.0\.0\.1:8080\/v1\/decisions\/stream\?startup=.*`)
-	httpmock.RegisterRegexpResponder("GET", urlRegexp, httpmock.NewJsonResponderOrPanic(200, decisions))
+	b, err := newBouncerWithLAPI(t, lapi)
+	require.NoError(t, err)
 
-	// run the bouncer; makes it make a call to the mocked CrowdSec API
-	// this should be called after the httpmock is activated, because otherwise the bouncer
-	// will try to call an actual CrowdSec instance
+	// run the bouncer; makes it make a call to the fake CrowdSec API
 	b.Run(context.Background())
 
 	// allow the bouncer a bit of time to retrieve and store the mocked rules
@@ -222,8 +216,260 @@ func TestStreamingBouncer(t *testing.T) {
 	}
 }
 
+func TestBouncer_SetStreaming(t *testing.T) {
+	lapi := crowdsectest.NewServer(t)
+	lapi.AddDecisions(decisions().New...)
+
+	b, err := newBouncerWithLAPI(t, lapi)
+	require.NoError(t, err)
+
+	// the live bouncer shares the client
+	b.liveBouncer.APIClient = b.streamingBouncer.APIClient
+
+	require.Error(t, b.SetStreaming(context.Background(), false))
+
+	b.Run(context.Background())
+	t.Cleanup(func() { require.NoError(t, b.Shutdown()) })
+
+	require.NoError(t, b.SetStreaming(context.Background(), false))
+	require.False(t, b.IsStreaming())
+	require.Equal(t, 0, b.store.len())
+
+	require.NoError(t, b.SetStreaming(context.Background(), true))
+	require.True(t, b.IsStreaming())
+	require.Equal(t, 4, b.store.len())
+
+	allowed, _, err := b.IsAllowed(netip.MustParseAddr("127.0.0.1"))
+	require.NoError(t, err)
+	require.False(t, allowed)
+}
+
 func Test_generateInstanceID(t *testing.T) {
 	id, err := generateInstanceID(time.Now())
 	require.NoError(t, err)
 	require.Len(t, id, 8)
 }
+
+func TestBouncer_SetInstanceName(t *testing.T) {
+	b, err := newBouncer(t)
+	require.NoError(t, err)
+	require.Len(t, b.InstanceID(), 8)
+
+	require.Error(t, b.SetInstanceName(""))
+	require.Error(t, b.SetInstanceName("web/1"))
+	require.NoError(t, b.SetInstanceName("web-1.example.com"))
+
+	require.Equal(t, "web-1.example.com", b.InstanceID())
+	require.Equal(t, userAgent+" (web-1.example.com)", b.streamingBouncer.UserAgent)
+	require.Equal(t, userAgent+" (web-1.example.com)", b.liveBouncer.UserAgent)
+}
+
+func TestBouncer_Generation(t *testing.T) {
+	b, err := newBouncer(t)
+	require.NoError(t, err)
+
+	generation := b.Generation()
+
+	duration, origin, scenario, scope, typ, value := "1h", "cscli", "test", "Ip", "ban", "10.0.0.1"
+	decision := &models.Decision{
+		Duration: &duration,
+		Origin:   &origin,
+		Scenario: &scenario,
+		Scope:    &scope,
+		Type:     &typ,
+		Value:    &value,
+	}
+
+	require.NoError(t, b.add(decision))
+	require.Greater(t, b.Generation(), generation)
+	generation = b.Generation()
+
+	require.NoError(t, b.delete(decision))
+	require.Greater(t, b.Generation(), generation)
+	generation = b.Generation()
+
+	require.NoError(t, b.SetDenylist([]netip.Prefix{netip.MustParsePrefix("10.0.0.2/32")}, "ban"))
+	require.Greater(t, b.Generation(), generation)
+}
+
+func TestBouncer_Refresh(t *testing.T) {
+	lapi := crowdsectest.NewServer(t)
+	lapi.AddDecisions(decisions().New...)
+
+	b, err := newBouncerWithLAPI(t, lapi)
+	require.NoError(t, err)
+
+	// a decision that's no longer known to the LAPI
+	duration, origin, scenario, scope, typ, value := "1h", "cscli", "test", "Ip", "ban", "10.1.1.1"
+	require.NoError(t, b.add(&models.Decision{
+		Duration: &duration,
+		Origin:   &origin,
+		Scenario: &scenario,
+		Scope:    &scope,
+		Type:     &typ,
+		Value:    &value,
+	}))
+	generation := b.Generation()
+
+	r := b.resync(context.Background(), true)
+	require.NoError(t, r.err)
+	require.Equal(t, 4, r.decisions)
+	require.Greater(t, b.Generation(), generation)
+
+	require.NotNil(t, r.verification)
+	require.Equal(t, 4, r.verification.Decisions)
+	require.Len(t, r.verification.Missing, 4)
+	require.Len(t, r.verification.Extra, 1)
+	require.Equal(t, "10.1.1.1", r.verification.Extra[0].Value)
+
+	allowed, _, err := b.IsAllowed(netip.MustParseAddr("10.1.1.1"))
+	require.NoError(t, err)
+	require.True(t, allowed)
+
+	allowed, _, err = b.IsAllowed(netip.MustParseAddr("127.0.0.1"))
+	require.NoError(t, err)
+	require.False(t, allowed)
+
+	r = b.resync(context.Background(), true)
+	require.NoError(t, r.err)
+	require.Empty(t, r.verification.Missing)
+	require.Empty(t, r.verification.Extra)
+
+	b.useStreamingBouncer.Store(false)
+	_, err = b.Refresh(context.Background())
+	require.ErrorIs(t, err, ErrNotStreaming)
+	_, err = b.Verify(context.Background())
+	require.ErrorIs(t, err, ErrNotStreaming)
+}
+
+func TestBouncer_Metrics(t *testing.T) {
+	b, err := newBouncer(t)
+	require.NoError(t, err)
+
+	duration, origin, scenario, scope, typ, value := "1h", "cscli", "test", "Ip", "ban", "10.0.0.1"
+	decision := &models.Decision{
+		Duration: &duration,
+		Origin:   &origin,
+		Scenario: &scenario,
+		Scope:    &scope,
+		Type:     &typ,
+		Value:    &value,
+	}
+
+	require.NoError(t, b.add(decision))
+	b.RecordRemediation("ban", "crowdsec", netip.MustParseAddr("10.0.0.1"))
+	b.RecordRemediation("ban", "crowdsec", netip.MustParseAddr("10.0.0.1"))
+	b.RecordRemediation("captcha", "crowdsec", netip.MustParseAddr("10.0.0.1"))
+
+	m := b.Metrics()
+	require.Equal(t, 1, m.Decisions)
+	require.Equal(t, uint64(1), m.DecisionsAdded)
+	require.Equal(t, uint64(0), m.DecisionsDeleted)
+	require.Equal(t, map[string]uint64{"ban": 2, "captcha": 1}, m.Remediations)
+
+	require.NoError(t, b.delete(decision))
+
+	m = b.Metrics()
+	require.Equal(t, 0, m.Decisions)
+	require.Equal(t, uint64(1), m.DecisionsDeleted)
+}
+
+func TestBouncer_Stats(t *testing.T) {
+	b, err := newBouncer(t)
+	require.NoError(t, err)
+
+	stats := b.Stats()
+	require.Equal(t, 0, stats.Decisions)
+	require.Nil(t, stats.LastUpdate)
+
+	for _, d := range decisions().New {
+		_ = b.add(d) // the last decision fails to be inserted
+	}
+
+	duration, origin, scenario, scope, typ, value := "1h", "CAPI", "test", "Ip", "captcha", "2001:db8::1"
+	require.NoError(t, b.add(&models.Decision{
+		Duration: &duration,
+		Origin:   &origin,
+		Scenario: &scenario,
+		Scope:    &scope,
+		Type:     &typ,
+		Value:    &value,
+	}))
+
+	stats = b.Stats()
+	require.Equal(t, 5, stats.Decisions)
+	require.Equal(t, map[string]int{"Ip": 4, "Range": 1}, stats.Scopes)
+	require.Equal(t, map[string]int{"ban": 4, "captcha": 1}, stats.Types)
+	require.Equal(t, map[string]int{"cscli": 4, "CAPI": 1}, stats.Origins)
+	require.Equal(t, map[string]int{"ipv4": 4, "ipv6": 1}, stats.IPVersions)
+	require.Greater(t, stats.MemoryBytes, 0)
+	require.NotNil(t, stats.LastUpdate)
+}
+
+func TestBouncer_Memory(t *testing.T) {
+	b, err := newBouncer(t)
+	require.NoError(t, err)
+
+	empty := b.Memory()
+	require.Contains(t, empty.Stores, "lapi")
+	require.Contains(t, empty.Stores, "local")
+	require.NotContains(t, empty.Stores, "denylist")
+	require.Greater(t, empty.HeapBytes, uint64(0))
+
+	for _, d := range decisions().New {
+		_ = b.add(d) // the last decision fails to be inserted
+	}
+
+	size := 0
+	for _, d := range decisions().New[:4] {
+		size += entrySize(d)
+	}
+
+	m := b.Memory()
+	require.Equal(t, empty.Stores["lapi"]+size, m.Stores["lapi"])
+	require.Equal(t, m.Stores["lapi"], b.Stats().MemoryBytes)
+
+	_, err = b.Ban(netip.MustParsePrefix("192.0.2.0/24"), time.Hour, "test")
+	require.NoError(t, err)
+	require.Greater(t, b.Memory().Stores["local"], empty.Stores["local"])
+	require.Equal(t, m.EstimatedBytes+b.Memory().Stores["local"]-empty.Stores["local"], b.Memory().EstimatedBytes)
+
+	for _, d := range decisions().New[:4] {
+		require.NoError(t, b.delete(d))
+	}
+	require.Equal(t, empty.Stores["lapi"], b.Memory().Stores["lapi"])
+}
+
+func TestBouncer_Lookup(t *testing.T) {
+	b, err := newBouncer(t)
+	require.NoError(t, err)
+
+	for _, d := range decisions().New {
+		_ = b.add(d) // the last decision fails to be inserted
+	}
+	require.NoError(t, b.SetDenylist([]netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}, "captcha"))
+
+	details, err := b.Lookup(netip.MustParseAddr("10.0.0.1"))
+	require.NoError(t, err)
+	require.Len(t, details, 2)
+	require.Equal(t, DecisionDetails{
+		Type:     "captcha",
+		Scope:    "Range",
+		Value:    "10.0.0.0/8",
+		Origin:   denylistOrigin,
+		Scenario: "denylisted by local configuration",
+	}, details[0])
+	require.Equal(t, "ban", details[1].Type)
+	require.Equal(t, "Range", details[1].Scope)
+	require.Equal(t, "10.0.0.1/24", details[1].Value)
+	require.Equal(t, "cscli", details[1].Origin)
+	require.Equal(t, "manual ban ...", details[1].Scenario)
+	require.Equal(t, "2m0s", details[1].Duration)
+
+	details, err = b.Lookup(netip.MustParseAddr("127.0.0.3"))
+	require.NoError(t, err)
+	require.Empty(t, details)
+
+	_, err = b.Lookup(netip.Addr{})
+	require.Error(t, err)
+}
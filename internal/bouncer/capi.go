@@ -0,0 +1,121 @@
+// Copyright 2024 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bouncer
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/crowdsecurity/crowdsec/pkg/apiclient"
+	"github.com/crowdsecurity/crowdsec/pkg/models"
+	"github.com/go-openapi/strfmt"
+	"go.uber.org/zap"
+)
+
+const (
+	// DefaultCAPIURL is the URL of the CrowdSec Central API.
+	DefaultCAPIURL = "https://api.crowdsec.net/"
+
+	// minCAPIPullInterval is the minimum interval between pulls from the
+	// CrowdSec Central API. It's the interval used by the CrowdSec Local
+	// API, which the Central API rate limits are based on.
+	minCAPIPullInterval = 2 * time.Hour
+)
+
+// capi holds the credentials of a machine registered with the CrowdSec
+// Central API.
+type capi struct {
+	url       string
+	machineID string
+	password  string
+	scenarios []string
+}
+
+// SetCAPI makes the Bouncer retrieve decisions, including the community
+// blocklist, directly from the CrowdSec Central API, instead of from a
+// CrowdSec Local API. It authenticates using the credentials of a machine
+// registered with the Central API, i.e. using `cscli capi register`. Only
+// streaming mode is supported, and decisions are pulled at most every two
+// hours.
+func (b *Bouncer) SetCAPI(apiURL, machineID, password string, scenarios []string) error {
+	if machineID == "" || password == "" {
+		return errors.New("central API machine ID and password must not be empty")
+	}
+	if apiURL == "" {
+		apiURL = DefaultCAPIURL
+	}
+
+	b.capi = &capi{
+		url:       apiURL,
+		machineID: machineID,
+		password:  password,
+		scenarios: scenarios,
+	}
+
+	return nil
+}
+
+// IsCAPI returns whether decisions are retrieved from the CrowdSec
+// Central API.
+func (b *Bouncer) IsCAPI() bool {
+	return b.capi != nil
+}
+
+// initCAPI prepares the StreamBouncer for retrieving decisions from the
+// CrowdSec Central API. It takes the place of StreamBouncer.Init, which
+// only supports authenticating to a Local API.
+func (b *Bouncer) initCAPI() error {
+	apiURL := b.capi.url
+	if !strings.HasSuffix(apiURL, "/") {
+		apiURL += "/"
+	}
+
+	u, err := url.Parse(apiURL)
+	if err != nil {
+		return fmt.Errorf("invalid central API URL: %w", err)
+	}
+
+	interval, err := time.ParseDuration(b.streamingBouncer.TickerInterval)
+	if err != nil {
+		return fmt.Errorf("invalid ticker interval %q: %w", b.streamingBouncer.TickerInterval, err)
+	}
+	if interval < minCAPIPullInterval {
+		b.logger.Info("increasing ticker interval for the central API", b.zapField(),
+			zap.Duration("ticker_interval", interval), zap.Duration("interval", minCAPIPullInterval))
+		interval = minCAPIPullInterval
+	}
+
+	client, err := apiclient.NewClient(&apiclient.Config{
+		MachineID:     b.capi.machineID,
+		Password:      strfmt.Password(b.capi.password),
+		Scenarios:     b.capi.scenarios,
+		URL:           u,
+		VersionPrefix: "v3",
+		UserAgent:     b.userAgent,
+	})
+	if err != nil {
+		return fmt.Errorf("failed creating central API client: %w", err)
+	}
+
+	b.streamingBouncer.APIClient = client
+	b.streamingBouncer.TickerIntervalDuration = interval
+	b.streamingBouncer.Opts.Scopes = "ip,range"
+	b.streamingBouncer.Stream = make(chan *models.DecisionsStreamResponse)
+
+	return nil
+}
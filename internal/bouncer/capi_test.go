@@ -0,0 +1,45 @@
+package bouncer
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestBouncer_SetCAPI(t *testing.T) {
+	b, err := New("", "", "", 0, "60s", zaptest.NewLogger(t))
+	require.NoError(t, err)
+
+	assert.Error(t, b.SetCAPI("", "", "password", nil))
+	assert.Error(t, b.SetCAPI("", "machine", "", nil))
+	assert.False(t, b.IsCAPI())
+
+	require.NoError(t, b.SetCAPI("", "machine", "password", []string{"crowdsecurity/http-probing"}))
+	assert.True(t, b.IsCAPI())
+	assert.Equal(t, DefaultCAPIURL, b.capi.url)
+}
+
+func TestBouncer_initCAPI(t *testing.T) {
+	b, err := New("", "", "", 0, "60s", zaptest.NewLogger(t))
+	require.NoError(t, err)
+
+	require.NoError(t, b.SetCAPI("https://capi.example.com", "machine", "password", nil))
+	require.NoError(t, b.initCAPI())
+
+	assert.Equal(t, 2*time.Hour, b.streamingBouncer.TickerIntervalDuration)
+	assert.Equal(t, "ip,range", b.streamingBouncer.Opts.Scopes)
+	assert.NotNil(t, b.streamingBouncer.Stream)
+	require.NotNil(t, b.streamingBouncer.APIClient)
+	assert.Equal(t, "https://capi.example.com/", b.streamingBouncer.APIClient.BaseURL.String())
+	assert.Equal(t, "v3", b.streamingBouncer.APIClient.URLPrefix)
+
+	b, err = New("", "", "", 0, "3h", zaptest.NewLogger(t))
+	require.NoError(t, err)
+
+	require.NoError(t, b.SetCAPI("", "machine", "password", nil))
+	require.NoError(t, b.initCAPI())
+	assert.Equal(t, 3*time.Hour, b.streamingBouncer.TickerIntervalDuration)
+}
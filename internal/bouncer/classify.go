@@ -0,0 +1,119 @@
+// Copyright 2024 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bouncer
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"syscall"
+)
+
+// Causes of errors connecting to the CrowdSec Local API.
+const (
+	CauseDNS          = "dns"
+	CauseRefused      = "connection_refused"
+	CauseTimeout      = "timeout"
+	CauseUnauthorized = "unauthorized"
+	CauseTLS          = "tls"
+)
+
+var causeHints = map[string]string{
+	CauseDNS:          "check that the host in api_url resolves; in Docker, use the name of the CrowdSec service",
+	CauseRefused:      "check that the CrowdSec Local API is running and listening on the address in api_url",
+	CauseTimeout:      "check that the CrowdSec Local API is reachable from Caddy, i.e. that it isn't blocked by a firewall",
+	CauseUnauthorized: "check the api_key; it's created using `cscli bouncers add <name>`",
+	CauseTLS:          "check the certificate of the CrowdSec Local API, or use http:// in api_url for local connections",
+}
+
+// LAPIError is an error connecting to the CrowdSec Local API, classified
+// by its likely cause, with a hint for resolving it. The errors returned
+// by go-cs-bouncer are opaque, but these causes make up most of the
+// problems when setting up the bouncer.
+type LAPIError struct {
+	Err   error
+	Cause string
+	Hint  string
+}
+
+func (e *LAPIError) Error() string {
+	return fmt.Sprintf("%v (%s)", e.Err, e.Hint)
+}
+
+func (e *LAPIError) Unwrap() error {
+	return e.Err
+}
+
+// classifyError wraps err in a LAPIError if its cause is known. Errors
+// that are already classified, and errors with an unknown cause are
+// returned as is.
+func classifyError(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	var lapiErr *LAPIError
+	if errors.As(err, &lapiErr) {
+		return err
+	}
+
+	cause := errorCause(err)
+	if cause == "" {
+		return err
+	}
+
+	return &LAPIError{Err: err, Cause: cause, Hint: causeHints[cause]}
+}
+
+// errorCause returns the cause of err, or an empty string if it's unknown.
+// Errors logged by go-cs-bouncer only have a message, so the message is
+// inspected when the error chain doesn't tell the cause.
+func errorCause(err error) string {
+	var (
+		dnsErr     *net.DNSError
+		netErr     net.Error
+		unknownErr x509.UnknownAuthorityError
+		hostErr    x509.HostnameError
+		invalidErr x509.CertificateInvalidError
+	)
+	switch {
+	case errors.As(err, &dnsErr):
+		return CauseDNS
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return CauseRefused
+	case errors.As(err, &unknownErr), errors.As(err, &hostErr), errors.As(err, &invalidErr):
+		return CauseTLS
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return CauseTimeout
+	}
+
+	msg := strings.ToLower(err.Error())
+	switch {
+	case strings.Contains(msg, "no such host"), strings.Contains(msg, "server misbehaving"):
+		return CauseDNS
+	case strings.Contains(msg, "connection refused"):
+		return CauseRefused
+	case strings.Contains(msg, "access forbidden"), strings.Contains(msg, "http code 403"), strings.Contains(msg, "http code 401"):
+		return CauseUnauthorized
+	case strings.Contains(msg, "x509:"), strings.Contains(msg, "tls:"):
+		return CauseTLS
+	case strings.Contains(msg, "i/o timeout"), strings.Contains(msg, "deadline exceeded"), strings.Contains(msg, "timeout awaiting"):
+		return CauseTimeout
+	}
+
+	return ""
+}
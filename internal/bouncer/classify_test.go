@@ -0,0 +1,67 @@
+package bouncer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+)
+
+func Test_classifyError(t *testing.T) {
+	tests := []struct {
+		name  string
+		err   error
+		cause string
+	}{
+		{name: "nil"},
+		{name: "unknown", err: errors.New("something went wrong")},
+		{name: "dns", err: fmt.Errorf("get: %w", &net.DNSError{Err: "no such host", Name: "crowdsec"}), cause: CauseDNS},
+		{name: "dns-message", err: errors.New("Get \"http://crowdsec:8080/v1/decisions/stream\": dial tcp: lookup crowdsec on 127.0.0.11:53: no such host"), cause: CauseDNS},
+		{name: "refused-message", err: errors.New("failed to connect to LAPI, retrying in 10s: dial tcp 127.0.0.1:8080: connect: connection refused"), cause: CauseRefused},
+		{name: "forbidden", err: errors.New("API error: access forbidden"), cause: CauseUnauthorized},
+		{name: "unauthorized", err: errors.New("API error: http code 401, no response body"), cause: CauseUnauthorized},
+		{name: "tls", err: errors.New("tls: failed to verify certificate: x509: certificate signed by unknown authority"), cause: CauseTLS},
+		{name: "timeout", err: errors.New("dial tcp 192.0.2.1:8080: i/o timeout"), cause: CauseTimeout},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := classifyError(tt.err)
+			if tt.cause == "" {
+				assert.Equal(t, tt.err, err)
+				return
+			}
+
+			var lapiErr *LAPIError
+			require.ErrorAs(t, err, &lapiErr)
+			assert.Equal(t, tt.cause, lapiErr.Cause)
+			assert.NotEmpty(t, lapiErr.Hint)
+			assert.ErrorIs(t, err, tt.err)
+			assert.Contains(t, err.Error(), lapiErr.Hint)
+
+			// classifying twice doesn't wrap the error again
+			assert.Same(t, lapiErr, classifyError(err))
+		})
+	}
+}
+
+func TestBouncer_CheckLAPIClassifiesErrors(t *testing.T) {
+	// a closed server results in connection refused errors
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	s.Close()
+
+	b, err := New("apiKey", s.URL, "", 0, "10s", zaptest.NewLogger(t))
+	require.NoError(t, err)
+	require.NoError(t, b.liveBouncer.Init())
+
+	err = b.CheckLAPI(context.Background())
+	var lapiErr *LAPIError
+	require.ErrorAs(t, err, &lapiErr)
+	assert.Equal(t, CauseRefused, lapiErr.Cause)
+}
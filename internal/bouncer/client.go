@@ -0,0 +1,181 @@
+// Copyright 2024 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bouncer
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/crowdsecurity/crowdsec/pkg/apiclient"
+)
+
+const defaultDialTimeout = 30 * time.Second
+
+// ClientOptions tune the connections of the HTTP clients used for the
+// CrowdSec Local API, both in streaming and live mode, and the AppSec
+// component. Zero values keep the defaults of the clients.
+type ClientOptions struct {
+	// MaxIdleConns is the maximum number of idle connections.
+	MaxIdleConns int
+	// MaxIdleConnsPerHost is the maximum number of idle connections
+	// to a single host.
+	MaxIdleConnsPerHost int
+	// IdleConnTimeout is how long idle connections are kept.
+	IdleConnTimeout time.Duration
+	// KeepAlive is the interval between TCP keep-alive probes.
+	KeepAlive time.Duration
+	// TLSHandshakeTimeout is the maximum time waiting for a TLS handshake.
+	TLSHandshakeTimeout time.Duration
+	// DisableHTTP2 disables HTTP/2, so that requests are sent using
+	// HTTP/1.1 over multiple connections.
+	DisableHTTP2 bool
+}
+
+// SetClientOptions sets the options for the HTTP clients. The AppSec
+// client is tuned immediately; the Local API clients are tuned when
+// they're initialized.
+func (b *Bouncer) SetClientOptions(opts ClientOptions) error {
+	if opts.MaxIdleConns < 0 || opts.MaxIdleConnsPerHost < 0 {
+		return errors.New("maximum number of idle connections must not be negative")
+	}
+	if opts.IdleConnTimeout < 0 || opts.KeepAlive < 0 || opts.TLSHandshakeTimeout < 0 {
+		return errors.New("client timeouts must not be negative")
+	}
+
+	b.clientOptions = &opts
+	if t, ok := b.appsec.client.Transport.(*http.Transport); ok {
+		opts.apply(t)
+	}
+
+	return nil
+}
+
+// apply sets the options on t.
+func (o ClientOptions) apply(t *http.Transport) {
+	if o.MaxIdleConns > 0 {
+		t.MaxIdleConns = o.MaxIdleConns
+	}
+	if o.MaxIdleConnsPerHost > 0 {
+		t.MaxIdleConnsPerHost = o.MaxIdleConnsPerHost
+	}
+	if o.IdleConnTimeout > 0 {
+		t.IdleConnTimeout = o.IdleConnTimeout
+	}
+	if o.KeepAlive > 0 {
+		t.DialContext = (&net.Dialer{
+			Timeout:   defaultDialTimeout,
+			KeepAlive: o.KeepAlive,
+		}).DialContext
+	}
+	if o.TLSHandshakeTimeout > 0 {
+		t.TLSHandshakeTimeout = o.TLSHandshakeTimeout
+	}
+	if o.DisableHTTP2 {
+		t.ForceAttemptHTTP2 = false
+		t.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+}
+
+// SetAPIHeaders sets headers that are added to all requests to the
+// CrowdSec Local API, i.e. to authenticate with a reverse proxy in front
+// of it. The X-Api-Key header can't be set, as it's used to authenticate
+// the bouncer.
+func (b *Bouncer) SetAPIHeaders(headers http.Header) error {
+	h := http.Header{}
+	for name, values := range headers {
+		name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+		if name == "" {
+			return errors.New("header name must not be empty")
+		}
+		if name == "X-Api-Key" {
+			return fmt.Errorf("header %q can't be set; it's used for the api_key", name)
+		}
+		h[name] = values
+	}
+
+	b.apiHeaders = h
+
+	return nil
+}
+
+// tuneAPIClient applies the client options and API headers to the
+// transport of client, which is created by go-cs-bouncer or the CrowdSec
+// API client when it's initialized. The transport is only replaced for
+// API key and machine authentication; with TLS client certificates it's
+// kept as is.
+func (b *Bouncer) tuneAPIClient(client *apiclient.ApiClient) {
+	if b.clientOptions == nil && len(b.apiHeaders) == 0 {
+		return
+	}
+	if client == nil || client.GetClient() == nil {
+		return
+	}
+
+	switch t := client.GetClient().Transport.(type) {
+	case *apiclient.APIKeyTransport:
+		t.Transport = b.apiTransport(t.Transport)
+	case *apiclient.JWTTransport:
+		t.Transport = b.apiTransport(t.Transport)
+	}
+}
+
+// apiTransport returns rt with the client options and API headers
+// applied. A nil rt is the default transport.
+func (b *Bouncer) apiTransport(rt http.RoundTripper) http.RoundTripper {
+	if b.clientOptions != nil {
+		switch v := rt.(type) {
+		case nil:
+			t := http.DefaultTransport.(*http.Transport).Clone()
+			b.clientOptions.apply(t)
+			rt = t
+		case *http.Transport:
+			t := v.Clone()
+			b.clientOptions.apply(t)
+			rt = t
+		}
+	}
+
+	if len(b.apiHeaders) > 0 {
+		rt = &headerTransport{headers: b.apiHeaders, next: rt}
+	}
+
+	return rt
+}
+
+// headerTransport adds headers to requests before sending them using next.
+type headerTransport struct {
+	headers http.Header
+	next    http.RoundTripper
+}
+
+func (t *headerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// a RoundTripper must not modify the request
+	req = req.Clone(req.Context())
+	for name, values := range t.headers {
+		req.Header[name] = values
+	}
+
+	next := t.next
+	if next == nil {
+		next = http.DefaultTransport
+	}
+
+	return next.RoundTrip(req)
+}
@@ -0,0 +1,137 @@
+package bouncer
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/crowdsecurity/crowdsec/pkg/apiclient"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestBouncer_SetClientOptions(t *testing.T) {
+	b, err := newBouncer(t)
+	require.NoError(t, err)
+
+	assert.Error(t, b.SetClientOptions(ClientOptions{MaxIdleConns: -1}))
+	assert.Error(t, b.SetClientOptions(ClientOptions{KeepAlive: -time.Second}))
+
+	opts := ClientOptions{
+		MaxIdleConns:        200,
+		MaxIdleConnsPerHost: 50,
+		IdleConnTimeout:     90 * time.Second,
+		KeepAlive:           15 * time.Second,
+		TLSHandshakeTimeout: 5 * time.Second,
+		DisableHTTP2:        true,
+	}
+	require.NoError(t, b.SetClientOptions(opts))
+
+	assertTuned := func(t *testing.T, rt http.RoundTripper) {
+		t.Helper()
+		tr, ok := rt.(*http.Transport)
+		require.True(t, ok)
+		assert.Equal(t, 200, tr.MaxIdleConns)
+		assert.Equal(t, 50, tr.MaxIdleConnsPerHost)
+		assert.Equal(t, 90*time.Second, tr.IdleConnTimeout)
+		assert.Equal(t, 5*time.Second, tr.TLSHandshakeTimeout)
+		assert.False(t, tr.ForceAttemptHTTP2)
+		assert.NotNil(t, tr.TLSNextProto)
+		assert.Empty(t, tr.TLSNextProto)
+	}
+
+	assertTuned(t, b.appsec.client.Transport)
+
+	require.NoError(t, b.liveBouncer.Init())
+	b.tuneAPIClient(b.liveBouncer.APIClient)
+	keyTransport, ok := b.liveBouncer.APIClient.GetClient().Transport.(*apiclient.APIKeyTransport)
+	require.True(t, ok)
+	assertTuned(t, keyTransport.Transport)
+
+	// the default transport is cloned, not modified
+	assert.NotEqual(t, 200, http.DefaultTransport.(*http.Transport).MaxIdleConns)
+}
+
+func TestBouncer_SetAPIHeaders(t *testing.T) {
+	b, err := newBouncer(t)
+	require.NoError(t, err)
+
+	assert.Error(t, b.SetAPIHeaders(http.Header{"x-api-key": {"other-key"}}))
+	assert.Error(t, b.SetAPIHeaders(http.Header{" ": {"value"}}))
+	require.NoError(t, b.SetAPIHeaders(http.Header{"x-gateway-token": {"secret"}}))
+	assert.Equal(t, http.Header{"X-Gateway-Token": {"secret"}}, b.apiHeaders)
+}
+
+func TestBouncer_pathPrefix(t *testing.T) {
+	const decision = `{"duration": "1h", "origin": "crowdsec", "scenario": "crowdsecurity/http-probing", "scope": "Ip", "type": "ban", "value": "192.0.2.1"}`
+
+	var (
+		mu    sync.Mutex
+		paths []string
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if rest, ok := strings.CutPrefix(r.URL.Path, "/legacy/"); ok {
+			http.Redirect(w, r, "/crowdsec/"+rest+"?"+r.URL.RawQuery, http.StatusPermanentRedirect)
+			return
+		}
+		if r.Header.Get("X-Gateway-Token") != "secret" || r.Header.Get("X-Api-Key") != "apiKey" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		mu.Lock()
+		paths = append(paths, r.URL.Path)
+		mu.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/crowdsec/health":
+			_, _ = w.Write([]byte(`{}`))
+		case "/crowdsec/v1/decisions/stream":
+			_, _ = w.Write([]byte(`{"new": [` + decision + `], "deleted": []}`))
+		case "/crowdsec/v1/decisions":
+			_, _ = w.Write([]byte(`[` + decision + `]`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	for _, prefix := range []string{"/crowdsec/", "/legacy/"} {
+		t.Run(prefix, func(t *testing.T) {
+			mu.Lock()
+			paths = nil
+			mu.Unlock()
+
+			b, err := New("apiKey", srv.URL+prefix, "", 0, "10s", zaptest.NewLogger(t))
+			require.NoError(t, err)
+			require.NoError(t, b.SetAPIHeaders(http.Header{"X-Gateway-Token": {"secret"}}))
+
+			// live mode lookups and the health check
+			require.NoError(t, b.liveBouncer.Init())
+			b.tuneAPIClient(b.liveBouncer.APIClient)
+			require.NoError(t, b.CheckLAPI(context.Background()))
+			details, err := b.Lookup(netip.MustParseAddr("192.0.2.1"))
+			require.NoError(t, err)
+			assert.Len(t, details, 1)
+
+			// streaming mode
+			b.EnableStreaming()
+			require.NoError(t, b.streamingBouncer.Init())
+			b.tuneAPIClient(b.streamingBouncer.APIClient)
+			decisions, err := b.retrieveAllDecisions(context.Background())
+			require.NoError(t, err)
+			assert.Len(t, decisions, 1)
+
+			mu.Lock()
+			defer mu.Unlock()
+			assert.Equal(t, []string{"/crowdsec/health", "/crowdsec/v1/decisions", "/crowdsec/v1/decisions/stream"}, paths)
+		})
+	}
+}
@@ -0,0 +1,78 @@
+// Copyright 2024 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bouncer
+
+import (
+	"strconv"
+)
+
+// AppSecConfig is the effective configuration of the AppSec
+// component, including defaults.
+type AppSecConfig struct {
+	Enabled             bool   `json:"enabled"`
+	Mode                string `json:"mode"`
+	MaxBodySize         int    `json:"max_body_bytes"`
+	Timeout             string `json:"timeout"`
+	FailurePolicy       string `json:"failure_policy"`
+	MaxRetries          int    `json:"max_retries"`
+	RetryBackoff        string `json:"retry_backoff"`
+	HealthCheckInterval string `json:"health_check_interval"`
+	QueueSize           int    `json:"queue_size,omitempty"`
+	CacheTTL            string `json:"cache_ttl,omitempty"`
+	CacheSize           int    `json:"cache_size,omitempty"`
+	MaxConcurrency      int    `json:"max_concurrency,omitempty"`
+	MaxQueued           int    `json:"max_queued,omitempty"`
+	OverflowPolicy      string `json:"overflow_policy,omitempty"`
+	Exclusions          int    `json:"exclusions"`
+}
+
+// AppSecConfig returns the effective configuration of the
+// AppSec component.
+func (b *Bouncer) AppSecConfig() AppSecConfig {
+	a := b.appsec
+	c := AppSecConfig{
+		Enabled:             a.apiURL != "",
+		Mode:                "inline",
+		MaxBodySize:         a.maxBodySize,
+		Timeout:             a.client.Timeout.String(),
+		FailurePolicy:       "open",
+		MaxRetries:          a.maxRetries,
+		RetryBackoff:        a.retryBackoff.String(),
+		HealthCheckInterval: a.health.interval.String(),
+		Exclusions:          len(a.exclusions),
+	}
+
+	if !a.failurePolicy.open {
+		c.FailurePolicy = "status:" + strconv.Itoa(a.failurePolicy.statusCode)
+	}
+
+	if a.async {
+		c.Mode = "async"
+		c.QueueSize = cap(a.queue)
+	}
+
+	if a.cache != nil {
+		c.CacheTTL = a.cache.TTL().String()
+		c.CacheSize = a.cache.Size()
+	}
+
+	if a.limit != nil {
+		c.MaxConcurrency = cap(a.limit.slots)
+		c.MaxQueued = int(a.limit.maxQueued)
+		c.OverflowPolicy = a.limit.overflow
+	}
+
+	return c
+}
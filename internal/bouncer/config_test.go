@@ -0,0 +1,40 @@
+package bouncer
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestBouncer_AppSecConfig(t *testing.T) {
+	b, err := New("apiKey", "http://127.0.0.1:8080/", "http://127.0.0.1:7422/", 1024, "10s", zaptest.NewLogger(t))
+	require.NoError(t, err)
+
+	c := b.AppSecConfig()
+	assert.True(t, c.Enabled)
+	assert.Equal(t, "inline", c.Mode)
+	assert.Equal(t, 1024, c.MaxBodySize)
+	assert.Equal(t, "10s", c.Timeout)
+	assert.Equal(t, "open", c.FailurePolicy)
+	assert.Equal(t, "100ms", c.RetryBackoff)
+	assert.Equal(t, "1m0s", c.HealthCheckInterval)
+	assert.Empty(t, c.CacheTTL)
+
+	require.NoError(t, b.SetAppSecFailurePolicy("closed"))
+	b.SetAppSecAsync(0)
+	b.SetAppSecCache(5*time.Second, 0)
+	require.NoError(t, b.SetAppSecConcurrencyLimit(8, 4, "closed"))
+
+	c = b.AppSecConfig()
+	assert.Equal(t, "status:403", c.FailurePolicy)
+	assert.Equal(t, "async", c.Mode)
+	assert.Equal(t, 1000, c.QueueSize)
+	assert.Equal(t, "5s", c.CacheTTL)
+	assert.Equal(t, 10000, c.CacheSize)
+	assert.Equal(t, 8, c.MaxConcurrency)
+	assert.Equal(t, 4, c.MaxQueued)
+	assert.Equal(t, "closed", c.OverflowPolicy)
+}
@@ -2,80 +2,255 @@ package bouncer
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net/netip"
+	"runtime"
+	"sync"
+	"time"
 
+	"github.com/crowdsecurity/crowdsec/pkg/apiclient"
 	"github.com/crowdsecurity/crowdsec/pkg/models"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 )
 
+// startStreaming starts receiving and processing decisions from the
+// StreamBouncer, until stopStreaming is called or ctx is canceled.
+func (b *Bouncer) startStreaming(ctx context.Context) {
+	ctx, b.streamCancel = context.WithCancel(ctx)
+	b.streamWG = &sync.WaitGroup{}
+	b.resetInitialPull()
+	b.primed.Store(false)
+
+	b.startStreamingBouncer(ctx)
+	b.startProcessingDecisions(ctx)
+}
+
+// stopStreaming stops receiving and processing decisions. The stream is
+// drained while waiting, because the StreamBouncer blocks on sending
+// decisions, even after its context has been canceled.
+func (b *Bouncer) stopStreaming() {
+	if b.streamCancel == nil {
+		return
+	}
+
+	b.streamCancel()
+	b.streamCancel = nil
+
+	done := make(chan struct{})
+	go func() {
+		b.streamWG.Wait()
+		close(done)
+	}()
+
+	stream := b.streamingBouncer.Stream
+	for {
+		select {
+		case <-done:
+			return
+		case _, ok := <-stream:
+			if !ok {
+				stream = nil
+			}
+		}
+	}
+}
+
 func (b *Bouncer) startStreamingBouncer(ctx context.Context) {
-	b.wg.Add(1)
+	b.streamWG.Add(1)
 	go func() {
-		defer b.wg.Done()
+		defer b.streamWG.Done()
+		if b.mirror != nil {
+			b.logger.Debug("starting blocklist mirror", b.zapField())
+			b.runMirror(ctx)
+			return
+		}
+
 		b.logger.Debug("starting streaming bouncer", b.zapField())
 		b.streamingBouncer.Run(ctx)
 	}()
 }
 
 func (b *Bouncer) startProcessingDecisions(ctx context.Context) {
-	b.wg.Add(1)
+	b.streamWG.Add(1)
 	go func() {
-		defer b.wg.Done()
+		defer b.streamWG.Done()
 
 		b.logger.Debug("starting decision processing", b.zapField())
 
+		b.primeFromSnapshot(ctx)
+
 		for {
 			select {
 			case <-ctx.Done():
 				b.logger.Info("processing new and deleted decisions stopped", b.zapField())
 				return
+			case req := <-b.refreshes:
+				req.result <- b.resync(req.ctx, req.verify)
 			case decisions := <-b.streamingBouncer.Stream:
 				if decisions == nil {
 					continue
 				}
-				// TODO: deletions seem to include all old decisions that had already expired; CrowdSec bug or intended behavior?
-				// TODO: process in separate goroutines/waitgroup?
-				if numberOfDeletedDecisions := len(decisions.Deleted); numberOfDeletedDecisions > 0 {
-					b.logger.Debug(fmt.Sprintf("processing %d deleted decisions", numberOfDeletedDecisions), b.zapField())
-					for _, decision := range decisions.Deleted {
-						if err := b.delete(decision); err != nil {
-							b.logger.Error(fmt.Sprintf("unable to delete decision for %q: %s", *decision.Value, err), b.zapField())
-						} else {
-							if numberOfDeletedDecisions <= maxNumberOfDecisionsToLog {
-								b.logger.Debug(fmt.Sprintf("deleted %q (scope: %s)", *decision.Value, *decision.Scope), b.zapField())
-							}
-						}
-					}
-					if numberOfDeletedDecisions > maxNumberOfDecisionsToLog {
-						b.logger.Debug(fmt.Sprintf("skipped logging for %d deleted decisions", numberOfDeletedDecisions), b.zapField())
-					}
-					b.logger.Debug(fmt.Sprintf("finished processing %d deleted decisions", numberOfDeletedDecisions), b.zapField())
-				}
-
-				// TODO: process in separate goroutines/waitgroup?
-				if numberOfNewDecisions := len(decisions.New); numberOfNewDecisions > 0 {
-					b.logger.Debug(fmt.Sprintf("processing %d new decisions", numberOfNewDecisions), b.zapField())
-					for _, decision := range decisions.New {
-						if err := b.add(decision); err != nil {
-							b.logger.Error(fmt.Sprintf("unable to insert decision for %q: %s", *decision.Value, err), b.zapField())
-						} else {
-							if numberOfNewDecisions <= maxNumberOfDecisionsToLog {
-								b.logger.Debug(fmt.Sprintf("adding %q (scope: %s) for %q", *decision.Value, *decision.Scope, *decision.Duration), b.zapField())
-							}
-						}
-					}
-					if numberOfNewDecisions > maxNumberOfDecisionsToLog {
-						b.logger.Debug(fmt.Sprintf("skipped logging for %d new decisions", numberOfNewDecisions), b.zapField())
-					}
-					b.logger.Debug(fmt.Sprintf("finished processing %d new decisions", numberOfNewDecisions), b.zapField())
-				}
+				b.processStreamDecisions(ctx, decisions)
 			}
 		}
 	}()
 }
 
+// decisionChunkSize is the number of decisions from a batch that
+// are processed before yielding and logging progress. The initial
+// pull from the CrowdSec Local API can hold hundreds of thousands of
+// decisions.
+const decisionChunkSize = 10_000
+
+// processStreamDecisions processes a batch of deleted and new decisions
+// received from the stream. Large batches are processed in chunks, so
+// that progress is logged while the store is warming up, and so that
+// other goroutines get to run in between. Processing stops early when
+// ctx is canceled.
+func (b *Bouncer) processStreamDecisions(ctx context.Context, decisions *models.DecisionsStreamResponse) {
+	b.recordLAPISuccess()
+	b.recordBatch(len(decisions.New), len(decisions.Deleted))
+	initial := b.startInitialPull(len(decisions.New))
+
+	// when the store was primed from a snapshot, the initial pull is
+	// processed into a new store, which replaces the decisions from the
+	// snapshot once it's complete.
+	target := b.store
+	if initial && b.primed.Swap(false) {
+		target = newStore()
+	}
+
+	// while the store is empty, i.e. when processing the initial pull,
+	// there's no previous state that lookups could observe partially
+	// changed, so the batch is processed in chunks. Otherwise, the batch
+	// is applied at once, and its decisions are reported afterwards.
+	deleteErr := func(_ int, decision *models.Decision) error { return target.delete(decision) }
+	addErr := func(_ int, decision *models.Decision) error { return target.add(decision) }
+	if target.len() > 0 {
+		if ctx.Err() != nil {
+			return
+		}
+		deleteErrs, addErrs := b.store.apply(decisions.Deleted, decisions.New)
+		deleteErr = func(i int, _ *models.Decision) error { return deleteErrs[i] }
+		addErr = func(i int, _ *models.Decision) error { return addErrs[i] }
+		ctx = context.WithoutCancel(ctx) // the batch was applied, so it's reported completely
+	}
+
+	// TODO: deletions seem to include all old decisions that had already expired; CrowdSec bug or intended behavior?
+	if numberOfDeletedDecisions := len(decisions.Deleted); numberOfDeletedDecisions > 0 {
+		b.logger.Debug("processing deleted decisions", b.zapField(), zap.Int("batch_size", numberOfDeletedDecisions))
+		b.processChunked(ctx, "deleted", decisions.Deleted, func(i int, decision *models.Decision) {
+			if err := deleteErr(i, decision); err != nil {
+				b.recordDecisionFailure("delete")
+				b.logger.Error("unable to delete decision", b.decisionFields(decision, zap.Error(err))...)
+			} else {
+				b.recordDeleted(decision)
+				b.logDecision("deleted decision", decision, numberOfDeletedDecisions)
+			}
+		})
+		if numberOfDeletedDecisions > b.decisionLogThreshold {
+			b.logger.Debug("skipped logging deleted decisions", b.zapField(), zap.Int("batch_size", numberOfDeletedDecisions))
+		}
+		b.logger.Debug("finished processing deleted decisions", b.zapField(), zap.Int("batch_size", numberOfDeletedDecisions))
+	}
+
+	if numberOfNewDecisions := len(decisions.New); numberOfNewDecisions > 0 {
+		b.logger.Debug("processing new decisions", b.zapField(), zap.Int("batch_size", numberOfNewDecisions))
+		b.processChunked(ctx, "new", decisions.New, func(i int, decision *models.Decision) {
+			if err := addErr(i, decision); err != nil {
+				b.recordDecisionFailure("add")
+				b.logger.Error("unable to insert decision", b.decisionFields(decision, zap.Error(err))...)
+			} else {
+				b.recordAdded(decision)
+				b.logDecision("added decision", decision, numberOfNewDecisions, zap.Stringp("duration", decision.Duration))
+			}
+		})
+		if numberOfNewDecisions > b.decisionLogThreshold {
+			b.logger.Debug("skipped logging new decisions", b.zapField(), zap.Int("batch_size", numberOfNewDecisions))
+		}
+		b.logger.Debug("finished processing new decisions", b.zapField(), zap.Int("batch_size", numberOfNewDecisions))
+	}
+
+	if target != b.store && ctx.Err() == nil {
+		b.store.replace(target)
+		b.generation.Add(1)
+		b.updateActiveDecisions()
+		b.logger.Info("replaced decisions from snapshot", b.zapField(), zap.Int("decisions", target.len()))
+	}
+
+	b.store.refreshFilter()
+
+	if initial && ctx.Err() == nil {
+		b.finishInitialPull()
+	}
+}
+
+// processChunked calls fn for every decision in decisions, with its
+// index. When there are more than decisionChunkSize decisions, progress
+// is logged after every chunk, and the goroutine yields.
+func (b *Bouncer) processChunked(ctx context.Context, kind string, decisions []*models.Decision, fn func(int, *models.Decision)) {
+	total := len(decisions)
+	if total <= decisionChunkSize {
+		for i, decision := range decisions {
+			fn(i, decision)
+		}
+		return
+	}
+
+	start := time.Now()
+	for i := 0; i < total; i += decisionChunkSize {
+		if ctx.Err() != nil {
+			b.logger.Warn("stopped processing decisions", b.zapField(), zap.String("kind", kind),
+				zap.Int("processed", i), zap.Int("batch_size", total))
+			return
+		}
+
+		for j, decision := range decisions[i:min(i+decisionChunkSize, total)] {
+			fn(i+j, decision)
+		}
+
+		processed := min(i+decisionChunkSize, total)
+		b.logger.Info("processing decisions", b.zapField(), zap.String("kind", kind),
+			zap.Int("processed", processed), zap.Int("batch_size", total),
+			zap.Duration("elapsed", time.Since(start)))
+
+		runtime.Gosched()
+	}
+}
+
+// logDecision logs decision being processed as part of a batch of
+// batchSize decisions. Decisions are logged at debug level, unless the
+// batch is larger than the decision log threshold. Manual decisions are
+// logged at info level, independent of the size of the batch, if enabled.
+func (b *Bouncer) logDecision(msg string, decision *models.Decision, batchSize int, fields ...zap.Field) {
+	if b.logManualDecisions && stringValue(decision.Origin) == manualOrigin {
+		b.logger.Info(msg, b.decisionFields(decision, fields...)...)
+		return
+	}
+
+	if batchSize > b.decisionLogThreshold {
+		return
+	}
+
+	if ce := b.logger.Check(zapcore.DebugLevel, msg); ce != nil {
+		ce.Write(b.decisionFields(decision, fields...)...)
+	}
+}
+
+// decisionFields returns the fields used for logging decision,
+// followed by fields.
+func (b *Bouncer) decisionFields(decision *models.Decision, fields ...zap.Field) []zap.Field {
+	return append([]zap.Field{
+		b.zapField(),
+		zap.Stringp("value", decision.Value),
+		zap.Stringp("scope", decision.Scope),
+		zap.Stringp("type", decision.Type),
+		zap.Stringp("origin", decision.Origin),
+	}, fields...)
+}
+
 // Add adds a Decision to the storage
 func (b *Bouncer) add(decision *models.Decision) error {
 
@@ -87,23 +262,66 @@ func (b *Bouncer) add(decision *models.Decision) error {
 	// TODO: store additional data about the decision (i.e. time added to store, etc)
 	// TODO: wrap the *models.Decision in an internal model (after validation)?
 
-	return b.store.add(decision)
+	if err := b.store.add(decision); err != nil {
+		return err
+	}
+
+	b.recordAdded(decision)
+
+	return nil
 }
 
 // Delete removes a Decision from the storage
 func (b *Bouncer) delete(decision *models.Decision) error {
-	return b.store.delete(decision)
+	if err := b.store.delete(decision); err != nil {
+		return err
+	}
+
+	b.recordDeleted(decision)
+
+	return nil
+}
+
+// recordAdded records decision being added to the store.
+func (b *Bouncer) recordAdded(decision *models.Decision) {
+	b.decisionsAdded.Add(1)
+	totalDecisionsAdded.Inc()
+	b.generation.Add(1)
+	b.updateActiveDecisions()
+	b.publishDecision(EventDecisionAdded, decision)
 }
 
-func (b *Bouncer) retrieveDecision(ip netip.Addr) (*models.Decision, error) {
-	if b.useStreamingBouncer {
+// recordDeleted records decision being deleted from the store.
+func (b *Bouncer) recordDeleted(decision *models.Decision) {
+	b.decisionsDeleted.Add(1)
+	totalDecisionsDeleted.Inc()
+	b.generation.Add(1)
+	b.updateActiveDecisions()
+	b.publishDecision(EventDecisionDeleted, decision)
+}
+
+// Generation returns a counter that changes whenever the decisions
+// held by the Bouncer change. It can be used to invalidate verdicts
+// cached outside of the Bouncer.
+func (b *Bouncer) Generation() uint64 {
+	return b.generation.Load()
+}
+
+func (b *Bouncer) retrieveDecision(ctx context.Context, ip netip.Addr) (*models.Decision, error) {
+	if b.useStreamingBouncer.Load() {
 		return b.store.get(ip)
 	}
 
 	totalLAPICalls.Inc() // increment; not built into liveBouncer
-	decision, err := b.liveBouncer.Get(ip.String())
+	decision, err := b.getLiveDecisions(ctx, ip)
 	if err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, ctxErr // the caller gave up; not a failure of the LAPI
+		}
+
+		err = classifyError(err)
 		totalLAPIErrors.Inc() // increment; not built into liveBouncer
+		b.recordLAPIError(err)
 		fields := []zapcore.Field{
 			b.zapField(),
 			zap.String("address", b.liveBouncer.APIUrl),
@@ -119,9 +337,179 @@ func (b *Bouncer) retrieveDecision(ip netip.Addr) (*models.Decision, error) {
 		return nil, nil // when not failing hard, we return no error
 	}
 
+	b.recordLAPISuccess()
+
 	if len(*decision) >= 1 {
 		return (*decision)[0], nil // TODO: decide if choosing the first decision is OK
 	}
 
 	return nil, nil
 }
+
+// getLiveDecisions is like LiveBouncer.Get, but the request to the
+// CrowdSec Local API is canceled when ctx is done.
+func (b *Bouncer) getLiveDecisions(ctx context.Context, ip netip.Addr) (*models.GetDecisionsResponse, error) {
+	value := ip.String()
+	decisions, resp, err := b.liveBouncer.APIClient.Decisions.List(ctx, apiclient.DecisionsListOpts{IPEquals: &value})
+	if resp != nil && resp.Response != nil {
+		resp.Response.Body.Close()
+	}
+
+	return decisions, err
+}
+
+// DecisionDetails describes a decision that applies to an IP.
+type DecisionDetails struct {
+	Type     string `json:"type"`
+	Scope    string `json:"scope"`
+	Value    string `json:"value"`
+	Origin   string `json:"origin"`
+	Scenario string `json:"scenario"`
+	// Duration is the remaining duration of the decision.
+	Duration string `json:"duration,omitempty"`
+}
+
+// Lookup returns all decisions that apply to ip, including those
+// on the local denylist, local decisions, blocklists and feeds. Contrary to IsAllowed, errors when contacting
+// the CrowdSec Local API in live mode are returned.
+func (b *Bouncer) Lookup(ip netip.Addr) ([]DecisionDetails, error) {
+	if !ip.IsValid() {
+		return nil, errors.New("invalid IP address")
+	}
+
+	var details []DecisionDetails
+	if b.denylist != nil {
+		entries, err := b.denylist.getAll(ip)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range entries {
+			details = append(details, newDecisionDetails(e))
+		}
+	}
+
+	entries, err := b.local.getAll(ip)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		details = append(details, newDecisionDetails(e))
+	}
+
+	if b.blocklists != nil {
+		entries, err := b.blocklists.store.getAll(ip)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range entries {
+			details = append(details, newDecisionDetails(e))
+		}
+	}
+
+	for _, f := range b.feeds {
+		entries, err := f.store.getAll(ip)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range entries {
+			details = append(details, newDecisionDetails(e))
+		}
+	}
+
+	if b.useStreamingBouncer.Load() {
+		entries, err := b.store.getAll(ip)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range entries {
+			details = append(details, newDecisionDetails(e))
+		}
+
+		return details, nil
+	}
+
+	totalLAPICalls.Inc()
+	decisions, err := b.liveBouncer.Get(ip.String())
+	if err != nil {
+		err = classifyError(err)
+		totalLAPIErrors.Inc()
+		b.recordLAPIError(err)
+		return nil, fmt.Errorf("failed retrieving decisions: %w", err)
+	}
+
+	b.recordLAPISuccess()
+
+	// the Local API returns the remaining duration
+	for _, d := range *decisions {
+		details = append(details, newDecisionDetails(entry{decision: d}))
+	}
+
+	return details, nil
+}
+
+// Covered returns all decisions for prefixes that overlap prf, including
+// those on the local denylist and local decisions. Both decisions for prefixes containing prf
+// and decisions for prefixes within prf are returned. It requires the
+// StreamBouncer, because the CrowdSec Local API can't be queried for
+// overlapping decisions.
+func (b *Bouncer) Covered(prf netip.Prefix) ([]DecisionDetails, error) {
+	if !prf.IsValid() {
+		return nil, errors.New("invalid prefix")
+	}
+	if !b.useStreamingBouncer.Load() {
+		return nil, ErrNotStreaming
+	}
+
+	prf = prf.Masked()
+
+	details := []DecisionDetails{}
+	if b.denylist != nil {
+		for _, e := range b.denylist.overlapping(prf) {
+			details = append(details, newDecisionDetails(e))
+		}
+	}
+
+	for _, e := range b.local.overlapping(prf) {
+		details = append(details, newDecisionDetails(e))
+	}
+
+	for _, e := range b.store.overlapping(prf) {
+		details = append(details, newDecisionDetails(e))
+	}
+
+	for _, f := range b.feeds {
+		for _, e := range f.store.overlapping(prf) {
+			details = append(details, newDecisionDetails(e))
+		}
+	}
+
+	return details, nil
+}
+
+func newDecisionDetails(e entry) DecisionDetails {
+	d := e.decision
+	return DecisionDetails{
+		Type:     stringValue(d.Type),
+		Scope:    stringValue(d.Scope),
+		Value:    stringValue(d.Value),
+		Origin:   stringValue(d.Origin),
+		Scenario: stringValue(d.Scenario),
+		Duration: remainingDuration(e),
+	}
+}
+
+// remainingDuration returns the duration of the decision in e, minus the
+// time passed since it was added to the store.
+func remainingDuration(e entry) string {
+	duration := stringValue(e.decision.Duration)
+	if e.addedAt.IsZero() {
+		return duration
+	}
+
+	d, err := time.ParseDuration(duration)
+	if err != nil {
+		return duration
+	}
+
+	return max(d-time.Since(e.addedAt), 0).Round(time.Second).String()
+}
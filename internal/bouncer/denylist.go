@@ -0,0 +1,72 @@
+// Copyright 2024 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bouncer
+
+import (
+	"fmt"
+	"net/netip"
+
+	"github.com/crowdsecurity/crowdsec/pkg/models"
+)
+
+const denylistOrigin = "caddy-denylist"
+
+// SetDenylist configures a local, static list of IPs and CIDRs that are
+// denied access independent of the decisions known to CrowdSec. Lookups
+// against the denylist happen before the CrowdSec decisions are checked,
+// so entries are enforced even when the CrowdSec Local API is unreachable.
+func (b *Bouncer) SetDenylist(prefixes []netip.Prefix, typ string) error {
+	denylist := newStore()
+	for _, p := range prefixes {
+		if err := denylist.add(newDenylistDecision(p, typ)); err != nil {
+			return fmt.Errorf("failed adding %q to denylist: %w", p.String(), err)
+		}
+	}
+
+	b.denylist = denylist
+	b.generation.Add(1)
+
+	return nil
+}
+
+func (b *Bouncer) retrieveDenylistDecision(ip netip.Addr) (*models.Decision, error) {
+	if b.denylist == nil {
+		return nil, nil
+	}
+
+	return b.denylist.get(ip)
+}
+
+func newDenylistDecision(p netip.Prefix, typ string) *models.Decision {
+	return newPrefixDecision(p, typ, denylistOrigin, "denylisted by local configuration", "")
+}
+
+// newPrefixDecision returns a decision of type typ for prefix p, with
+// the scope set to "Ip" for single IPs and to "Range" otherwise.
+func newPrefixDecision(p netip.Prefix, typ, origin, scenario, duration string) *models.Decision {
+	scope, value := "Range", p.Masked().String()
+	if p.IsSingleIP() {
+		scope, value = "Ip", p.Addr().String()
+	}
+
+	return &models.Decision{
+		Origin:   &origin,
+		Scenario: &scenario,
+		Scope:    &scope,
+		Type:     &typ,
+		Value:    &value,
+		Duration: &duration,
+	}
+}
@@ -0,0 +1,65 @@
+// Copyright 2024 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bouncer
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBouncer_Denylist(t *testing.T) {
+	b, err := newBouncer(t)
+	require.NoError(t, err)
+
+	err = b.SetDenylist([]netip.Prefix{
+		netip.MustParsePrefix("10.0.0.1/32"),
+		netip.MustParsePrefix("192.168.0.0/16"),
+		netip.MustParsePrefix("2001:db8::/32"),
+	}, "ban")
+	require.NoError(t, err)
+
+	tests := []struct {
+		ip          string
+		wantAllowed bool
+		wantScope   string
+		wantValue   string
+	}{
+		{"10.0.0.1", false, "Ip", "10.0.0.1"},
+		{"10.0.0.2", true, "", ""},
+		{"192.168.42.42", false, "Range", "192.168.0.0/16"},
+		{"2001:db8::1", false, "Range", "2001:db8::/32"},
+		{"2001:db9::1", true, "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.ip, func(t *testing.T) {
+			allowed, decision, err := b.IsAllowed(netip.MustParseAddr(tt.ip))
+			require.NoError(t, err)
+			assert.Equal(t, tt.wantAllowed, allowed)
+			if tt.wantAllowed {
+				assert.Nil(t, decision)
+				return
+			}
+
+			require.NotNil(t, decision)
+			assert.Equal(t, "ban", *decision.Type)
+			assert.Equal(t, tt.wantScope, *decision.Scope)
+			assert.Equal(t, tt.wantValue, *decision.Value)
+			assert.Equal(t, denylistOrigin, *decision.Origin)
+		})
+	}
+}
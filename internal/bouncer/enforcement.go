@@ -0,0 +1,175 @@
+// Copyright 2024 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bouncer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"slices"
+
+	"github.com/crowdsecurity/crowdsec/pkg/models"
+	"go.uber.org/zap"
+
+	"github.com/hslatman/caddy-crowdsec-bouncer/internal/httputils"
+)
+
+const (
+	// EnforcementEnforce applies remediations. This is the default.
+	EnforcementEnforce = "enforce"
+	// EnforcementSimulate looks up decisions and evaluates requests,
+	// logging the remediations that would've been applied.
+	EnforcementSimulate = "simulate"
+	// EnforcementOff allows all requests, without looking up decisions
+	// or evaluating requests.
+	EnforcementOff = "off"
+)
+
+var enforcementModes = []string{EnforcementEnforce, EnforcementSimulate, EnforcementOff}
+
+// SetEnforcement sets the enforcement mode of the Bouncer, which is
+// one of "enforce", "simulate" or "off". It can be changed at runtime.
+// Changing the mode increments the generation, so that verdicts cached
+// in the previous mode aren't used anymore.
+func (b *Bouncer) SetEnforcement(mode string) error {
+	if !slices.Contains(enforcementModes, mode) {
+		return fmt.Errorf("invalid enforcement mode %q; must be one of %v", mode, enforcementModes)
+	}
+
+	previous, ok := b.enforcement.Swap(mode).(string)
+	if !ok {
+		previous = EnforcementEnforce
+	}
+	if previous != mode {
+		b.generation.Add(1)
+	}
+	b.logger.Info("changed enforcement mode", b.zapField(), zap.String("mode", mode))
+
+	return nil
+}
+
+// Enforcement returns the enforcement mode of the Bouncer.
+func (b *Bouncer) Enforcement() string {
+	if mode, ok := b.enforcement.Load().(string); ok {
+		return mode
+	}
+
+	return EnforcementEnforce
+}
+
+// IsAllowed checks if an IP is allowed or not, taking into account the
+// enforcement mode of the Bouncer.
+func (b *Bouncer) IsAllowed(ip netip.Addr) (bool, *models.Decision, error) {
+	return b.IsAllowedContext(context.Background(), ip)
+}
+
+// IsAllowedContext is like IsAllowed, but in live mode the lookup in the
+// CrowdSec Local API is canceled when ctx is done, in which case the
+// error of ctx is returned.
+func (b *Bouncer) IsAllowedContext(ctx context.Context, ip netip.Addr) (bool, *models.Decision, error) {
+	mode := b.Enforcement()
+	if mode == EnforcementOff {
+		return true, nil, nil
+	}
+
+	isAllowed, decision, err := b.observeLookup(ctx, ip)
+
+	return b.enforce(mode, ip, isAllowed, decision, err)
+}
+
+// IsAllowedRequest is like IsAllowed, but the lookup for ip is done once
+// per request. The result is stored with the request, so that the other
+// handlers and matchers checking ip for the same request reuse it.
+func (b *Bouncer) IsAllowedRequest(ctx context.Context, ip netip.Addr) (bool, *models.Decision, error) {
+	mode := b.Enforcement()
+	if mode == EnforcementOff {
+		return true, nil, nil
+	}
+
+	isAllowed, decision, err := b.lookupRequest(ctx, ip)
+
+	return b.enforce(mode, ip, isAllowed, decision, err)
+}
+
+// lookupRequest looks up the decision for ip, or returns the result of
+// the lookup for ip that was done earlier for the request with ctx.
+func (b *Bouncer) lookupRequest(ctx context.Context, ip netip.Addr) (bool, *models.Decision, error) {
+	if isAllowed, decision, ok := httputils.LookupFromContext(ctx, ip); ok {
+		return isAllowed, decision, nil
+	}
+
+	isAllowed, decision, err := b.observeLookup(ctx, ip)
+	if err != nil {
+		return isAllowed, decision, err // not stored, so that it's retried
+	}
+
+	httputils.SetLookup(ctx, ip, isAllowed, decision)
+
+	return isAllowed, decision, nil
+}
+
+// enforce applies the enforcement mode to the result of a lookup.
+func (b *Bouncer) enforce(mode string, ip netip.Addr, isAllowed bool, decision *models.Decision, err error) (bool, *models.Decision, error) {
+	if err != nil || isAllowed || mode == EnforcementEnforce {
+		return isAllowed, decision, err
+	}
+
+	b.logger.Info("simulated remediation", b.zapField(), zap.String("ip", ip.String()), zap.Stringp("type", decision.Type))
+
+	return true, nil, nil
+}
+
+// CheckRequest checks the request against the AppSec component, taking
+// into account the enforcement mode of the Bouncer.
+func (b *Bouncer) CheckRequest(ctx context.Context, r *http.Request) error {
+	mode := b.Enforcement()
+	if mode == EnforcementOff {
+		return nil
+	}
+
+	// requests from jailed IPs are blocked without being forwarded to
+	// the AppSec component, and don't count as new offenses
+	err := b.checkJailed(ctx)
+	jailed := err != nil
+	if !jailed {
+		err = b.checkRequest(ctx, r)
+	}
+	if err == nil {
+		return nil
+	}
+
+	a := &AppSecError{}
+	if !errors.As(err, &a) || a.Action == "allow" || a.Action == "log" {
+		return err
+	}
+
+	if mode == EnforcementEnforce {
+		// only requests blocked by a rule are reported and count as
+		// offenses; requests blocked because the AppSec component
+		// failed weren't inspected
+		if !jailed && a.Triggered {
+			b.recordAppSecAlert(ctx, r, a.Action)
+			b.recordAppSecOffense(ctx)
+		}
+		return err
+	}
+
+	ip, _ := httputils.FromContext(ctx)
+	b.logger.Info("simulated appsec remediation", b.zapField(), zap.String("ip", ip.String()), zap.String("action", a.Action))
+
+	return nil
+}
@@ -0,0 +1,115 @@
+package bouncer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+
+	"github.com/hslatman/caddy-crowdsec-bouncer/internal/httputils"
+)
+
+func TestBouncer_Enforcement(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+	ctx := newCaddyVarsContext()
+	caddyhttp.SetVar(ctx, caddyhttp.ClientIPVarKey, "10.0.0.10")
+	ctx, _ = httputils.EnsureIP(ctx)
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+		_, _ = w.Write([]byte(`{"action": "ban", "http_status": 403}`))
+	}))
+	t.Cleanup(s.Close)
+
+	b, err := New("apiKey", "http://127.0.0.1:8080/", s.URL, 0, "10s", logger)
+	require.NoError(t, err)
+	b.EnableStreaming() // decisions are looked up in the local store
+
+	ip := netip.MustParseAddr("10.0.0.10")
+	require.NoError(t, b.SetDenylist([]netip.Prefix{netip.PrefixFrom(ip, 32)}, "ban"))
+
+	assert.Equal(t, EnforcementEnforce, b.Enforcement())
+
+	tests := []struct {
+		mode        string
+		wantAllowed bool
+		wantErr     bool
+	}{
+		{EnforcementEnforce, false, true},
+		{EnforcementSimulate, true, false},
+		{EnforcementOff, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			require.NoError(t, b.SetEnforcement(tt.mode))
+			assert.Equal(t, tt.mode, b.Enforcement())
+
+			isAllowed, decision, err := b.IsAllowed(ip)
+			require.NoError(t, err)
+			assert.Equal(t, tt.wantAllowed, isAllowed)
+			assert.Equal(t, tt.wantAllowed, decision == nil)
+
+			err = b.CheckRequest(ctx, httptest.NewRequest(http.MethodGet, "/", http.NoBody))
+			if tt.wantErr {
+				var appSecErr *AppSecError
+				require.ErrorAs(t, err, &appSecErr)
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+
+	require.Error(t, b.SetEnforcement("invalid"))
+	assert.Equal(t, EnforcementOff, b.Enforcement())
+
+	// changing the mode invalidates cached verdicts
+	generation := b.Generation()
+	require.NoError(t, b.SetEnforcement(EnforcementOff))
+	assert.Equal(t, generation, b.Generation())
+	require.NoError(t, b.SetEnforcement(EnforcementEnforce))
+	assert.Equal(t, generation+1, b.Generation())
+}
+
+func TestBouncer_IsAllowedRequest(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+	b, err := New("apiKey", "http://127.0.0.1:8080/", "", 0, "10s", logger)
+	require.NoError(t, err)
+	b.EnableStreaming() // decisions are looked up in the local store
+
+	ip := netip.MustParseAddr("10.0.0.10")
+	other := netip.MustParseAddr("10.0.0.11")
+	require.NoError(t, b.SetDenylist([]netip.Prefix{netip.PrefixFrom(ip, 32)}, "ban"))
+
+	ctx := newCaddyVarsContext()
+	isAllowed, decision, err := b.IsAllowedRequest(ctx, ip)
+	require.NoError(t, err)
+	assert.False(t, isAllowed)
+	require.NotNil(t, decision)
+
+	// the result of the lookup is reused for the same request
+	require.NoError(t, b.SetDenylist(nil, "ban"))
+	isAllowed, decision, err = b.IsAllowedRequest(ctx, ip)
+	require.NoError(t, err)
+	assert.False(t, isAllowed)
+	assert.NotNil(t, decision)
+
+	// the enforcement mode is applied to the stored result
+	require.NoError(t, b.SetEnforcement(EnforcementSimulate))
+	isAllowed, _, err = b.IsAllowedRequest(ctx, ip)
+	require.NoError(t, err)
+	assert.True(t, isAllowed)
+	require.NoError(t, b.SetEnforcement(EnforcementEnforce))
+
+	// other IPs and other requests are looked up
+	isAllowed, _, err = b.IsAllowedRequest(ctx, other)
+	require.NoError(t, err)
+	assert.True(t, isAllowed)
+	isAllowed, _, err = b.IsAllowedRequest(newCaddyVarsContext(), ip)
+	require.NoError(t, err)
+	assert.True(t, isAllowed)
+}
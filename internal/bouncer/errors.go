@@ -5,6 +5,10 @@ type AppSecError struct {
 	Action     string
 	Duration   string
 	StatusCode int
+	// Triggered is true if the AppSec component blocked the request
+	// because a rule was triggered, as opposed to the request being
+	// blocked because the failure or overflow policy was applied.
+	Triggered bool
 }
 
 func (a AppSecError) Error() string {
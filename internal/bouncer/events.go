@@ -0,0 +1,120 @@
+// Copyright 2024 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bouncer
+
+import (
+	"sync"
+	"time"
+
+	"github.com/crowdsecurity/crowdsec/pkg/models"
+)
+
+const (
+	EventDecisionAdded   = "decision_added"
+	EventDecisionDeleted = "decision_deleted"
+	EventRemediation     = "remediation"
+)
+
+// Event describes a change to the decisions in the store, or a
+// remediation being served.
+type Event struct {
+	Time        time.Time        `json:"time"`
+	Type        string           `json:"type"`
+	Decision    *DecisionDetails `json:"decision,omitempty"`
+	IP          string           `json:"ip,omitempty"`
+	Remediation string           `json:"remediation,omitempty"`
+	Origin      string           `json:"origin,omitempty"`
+}
+
+// broker distributes events to subscribers. Events are dropped
+// for subscribers that don't keep up.
+type broker struct {
+	mu          sync.RWMutex
+	subscribers map[chan Event]struct{}
+	closed      bool
+}
+
+func newBroker() *broker {
+	return &broker{
+		subscribers: map[chan Event]struct{}{},
+	}
+}
+
+func (br *broker) subscribe(size int) (<-chan Event, func()) {
+	br.mu.Lock()
+	defer br.mu.Unlock()
+
+	ch := make(chan Event, size)
+	if br.closed {
+		close(ch)
+		return ch, func() {}
+	}
+
+	br.subscribers[ch] = struct{}{}
+
+	return ch, func() {
+		br.mu.Lock()
+		defer br.mu.Unlock()
+
+		if _, ok := br.subscribers[ch]; ok {
+			delete(br.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+func (br *broker) publish(fn func() Event) {
+	br.mu.RLock()
+	defer br.mu.RUnlock()
+
+	if len(br.subscribers) == 0 {
+		return
+	}
+
+	e := fn()
+	for ch := range br.subscribers {
+		select {
+		case ch <- e:
+		default: // subscriber isn't keeping up
+		}
+	}
+}
+
+// close closes all subscriptions; new subscriptions are closed
+// immediately.
+func (br *broker) close() {
+	br.mu.Lock()
+	defer br.mu.Unlock()
+
+	for ch := range br.subscribers {
+		delete(br.subscribers, ch)
+		close(ch)
+	}
+	br.closed = true
+}
+
+// Subscribe returns a channel receiving events, and a function to cancel the
+// subscription. The channel is closed when the Bouncer is shut down. Events
+// are dropped when they're not received fast enough.
+func (b *Bouncer) Subscribe() (<-chan Event, func()) {
+	return b.events.subscribe(100)
+}
+
+func (b *Bouncer) publishDecision(typ string, decision *models.Decision) {
+	b.events.publish(func() Event {
+		details := newDecisionDetails(entry{decision: decision})
+		return Event{Time: time.Now(), Type: typ, Decision: &details}
+	})
+}
@@ -0,0 +1,71 @@
+package bouncer
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/crowdsecurity/crowdsec/pkg/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBouncer_Subscribe(t *testing.T) {
+	b, err := newBouncer(t)
+	require.NoError(t, err)
+
+	events, cancel := b.Subscribe()
+
+	duration, origin, scenario, scope, typ, value := "1h", "cscli", "test", "Ip", "ban", "10.0.0.1"
+	decision := &models.Decision{
+		Duration: &duration,
+		Origin:   &origin,
+		Scenario: &scenario,
+		Scope:    &scope,
+		Type:     &typ,
+		Value:    &value,
+	}
+
+	require.NoError(t, b.add(decision))
+	b.RecordRemediation("ban", "crowdsec", netip.MustParseAddr("10.0.0.1"))
+	require.NoError(t, b.delete(decision))
+
+	e := <-events
+	assert.Equal(t, EventDecisionAdded, e.Type)
+	require.NotNil(t, e.Decision)
+	assert.Equal(t, "10.0.0.1", e.Decision.Value)
+	assert.False(t, e.Time.IsZero())
+
+	e = <-events
+	assert.Equal(t, EventRemediation, e.Type)
+	assert.Equal(t, "10.0.0.1", e.IP)
+	assert.Equal(t, "ban", e.Remediation)
+
+	e = <-events
+	assert.Equal(t, EventDecisionDeleted, e.Type)
+
+	cancel()
+	_, ok := <-events
+	assert.False(t, ok)
+	cancel() // canceling twice is a no-op
+}
+
+func Test_broker(t *testing.T) {
+	br := newBroker()
+
+	// events are dropped for subscribers that don't keep up
+	events, cancel := br.subscribe(1)
+	t.Cleanup(cancel)
+	br.publish(func() Event { return Event{Type: "first"} })
+	br.publish(func() Event { return Event{Type: "second"} })
+	assert.Equal(t, "first", (<-events).Type)
+	assert.Len(t, events, 0)
+
+	br.close()
+	_, ok := <-events
+	assert.False(t, ok)
+
+	// subscriptions after closing are closed immediately
+	events, _ = br.subscribe(1)
+	_, ok = <-events
+	assert.False(t, ok)
+}
@@ -0,0 +1,86 @@
+package bouncer
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"path"
+	"slices"
+	"strings"
+)
+
+// exclusion matches requests that are not inspected by the AppSec
+// component. All of the configured criteria need to match for a
+// request to be excluded.
+type exclusion struct {
+	paths            []string
+	methods          []string
+	contentTypes     []string
+	maxContentLength int64
+}
+
+// AddAppSecExclusion adds an exclusion for requests that should not be
+// inspected by the AppSec component. Paths are glob patterns. Requests
+// with a Content-Length larger than maxContentLength are excluded if it's
+// larger than 0. All non-empty criteria need to match for a request to be
+// excluded.
+func (b *Bouncer) AddAppSecExclusion(paths, methods, contentTypes []string, maxContentLength int64) error {
+	for _, p := range paths {
+		if _, err := path.Match(p, ""); err != nil {
+			return fmt.Errorf("invalid path pattern %q: %w", p, err)
+		}
+	}
+
+	e := exclusion{
+		paths:            paths,
+		maxContentLength: maxContentLength,
+	}
+	for _, m := range methods {
+		e.methods = append(e.methods, strings.ToUpper(m))
+	}
+	for _, ct := range contentTypes {
+		e.contentTypes = append(e.contentTypes, strings.ToLower(ct))
+	}
+
+	b.appsec.exclusions = append(b.appsec.exclusions, e)
+
+	return nil
+}
+
+func (e exclusion) matches(r *http.Request) bool {
+	if len(e.paths) > 0 && !slices.ContainsFunc(e.paths, func(p string) bool {
+		ok, _ := path.Match(p, r.URL.Path)
+		return ok
+	}) {
+		return false
+	}
+
+	if len(e.methods) > 0 && !slices.Contains(e.methods, r.Method) {
+		return false
+	}
+
+	if len(e.contentTypes) > 0 {
+		mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if err != nil || !slices.ContainsFunc(e.contentTypes, func(ct string) bool {
+			// a trailing wildcard matches all subtypes, i.e. image/*
+			if prefix, ok := strings.CutSuffix(ct, "*"); ok {
+				return strings.HasPrefix(mediaType, prefix)
+			}
+			return mediaType == ct
+		}) {
+			return false
+		}
+	}
+
+	if e.maxContentLength > 0 && r.ContentLength <= e.maxContentLength {
+		return false
+	}
+
+	return true
+}
+
+func (a *appsec) isExcluded(r *http.Request) bool {
+	return slices.ContainsFunc(a.exclusions, func(e exclusion) bool {
+		return e.matches(r)
+	})
+}
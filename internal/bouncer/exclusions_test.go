@@ -0,0 +1,51 @@
+package bouncer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestBouncer_AddAppSecExclusion(t *testing.T) {
+	b, err := New("apiKey", "http://127.0.0.1:8080/", "http://127.0.0.1:7422/", 0, "10s", zaptest.NewLogger(t))
+	require.NoError(t, err)
+
+	require.NoError(t, b.AddAppSecExclusion([]string{"/health", "/ws/*"}, nil, nil, 0))
+	require.NoError(t, b.AddAppSecExclusion(nil, []string{"put"}, []string{"application/octet-stream", "image/*"}, 0))
+	require.NoError(t, b.AddAppSecExclusion(nil, []string{"POST"}, nil, 1024))
+	assert.Error(t, b.AddAppSecExclusion([]string{"/["}, nil, nil, 0))
+
+	newRequest := func(method, target, contentType string, contentLength int) *http.Request {
+		r := httptest.NewRequest(method, target, strings.NewReader(strings.Repeat("a", contentLength)))
+		if contentType != "" {
+			r.Header.Set("Content-Type", contentType)
+		}
+		return r
+	}
+
+	tests := []struct {
+		name string
+		r    *http.Request
+		want bool
+	}{
+		{"path", newRequest(http.MethodGet, "/health", "", 0), true},
+		{"path-glob", newRequest(http.MethodGet, "/ws/chat", "", 0), true},
+		{"path-no-match", newRequest(http.MethodGet, "/ws/chat/room", "", 0), false},
+		{"method-and-content-type", newRequest(http.MethodPut, "/upload", "application/octet-stream", 10), true},
+		{"method-and-content-type-wildcard", newRequest(http.MethodPut, "/upload", "image/png; charset=binary", 10), true},
+		{"content-type-wrong-method", newRequest(http.MethodPost, "/upload", "application/octet-stream", 10), false},
+		{"method-no-content-type", newRequest(http.MethodPut, "/upload", "", 10), false},
+		{"large-post", newRequest(http.MethodPost, "/form", "", 2048), true},
+		{"small-post", newRequest(http.MethodPost, "/form", "", 512), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, b.appsec.isExcluded(tt.r))
+		})
+	}
+}
@@ -0,0 +1,64 @@
+// Copyright 2024 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bouncer
+
+import (
+	"cmp"
+	"net/netip"
+	"slices"
+
+	"github.com/crowdsecurity/crowdsec/pkg/models"
+)
+
+// Export returns the decisions streamed from the CrowdSec Local API, with
+// their remaining durations, in the JSON format of a blocklist mirror.
+// This allows one instance, the leader, to maintain the stream, while the
+// other instances in a fleet pull the decisions from it using SetMirror,
+// instead of each of them streaming from the Local API. Local decisions,
+// the denylist, blocklists and feeds aren't exported, as they're
+// configured per instance.
+func (b *Bouncer) Export() ([]*models.Decision, error) {
+	if !b.useStreamingBouncer.Load() {
+		return nil, ErrNotStreaming
+	}
+
+	type export struct {
+		prefix   netip.Prefix
+		decision *models.Decision
+	}
+
+	var exports []export
+	b.store.each(func(prf netip.Prefix, e entry) bool {
+		d := *e.decision // the stored decision is shared, and must not be modified
+		duration := remainingDuration(e)
+		d.Duration = &duration
+		exports = append(exports, export{prefix: prf, decision: &d})
+		return true
+	})
+
+	slices.SortFunc(exports, func(a, b export) int {
+		if c := a.prefix.Addr().Compare(b.prefix.Addr()); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.prefix.Bits(), b.prefix.Bits())
+	})
+
+	decisions := make([]*models.Decision, 0, len(exports))
+	for _, e := range exports {
+		decisions = append(decisions, e.decision)
+	}
+
+	return decisions, nil
+}
@@ -0,0 +1,70 @@
+package bouncer
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/crowdsecurity/crowdsec/pkg/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBouncer_Export(t *testing.T) {
+	leader, err := newBouncer(t)
+	require.NoError(t, err)
+
+	for _, v := range []struct{ scope, typ, value string }{
+		{"Ip", "ban", "10.0.0.2"},
+		{"Range", "ban", "10.0.0.0/24"},
+		{"Ip", "captcha", "192.0.2.1"},
+	} {
+		duration, origin, scenario := "1h", "crowdsec", "test"
+		require.NoError(t, leader.add(&models.Decision{
+			Duration: &duration,
+			Origin:   &origin,
+			Scenario: &scenario,
+			Scope:    &v.scope,
+			Type:     &v.typ,
+			Value:    &v.value,
+		}))
+	}
+	_, err = leader.Ban(netip.MustParsePrefix("198.51.100.1/32"), time.Hour, "local decisions aren't exported")
+	require.NoError(t, err)
+
+	decisions, err := leader.Export()
+	require.NoError(t, err)
+	var values []string
+	for _, d := range decisions {
+		values = append(values, *d.Value)
+	}
+	assert.Equal(t, []string{"10.0.0.0/24", "10.0.0.2", "192.0.2.1"}, values)
+
+	// followers pull the exported decisions as a blocklist mirror
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "follower-key", r.Header.Get("X-Api-Key"))
+		decisions, err := leader.Export()
+		require.NoError(t, err)
+		w.Header().Set("Content-Type", "application/json")
+		require.NoError(t, json.NewEncoder(w).Encode(decisions))
+	}))
+	t.Cleanup(s.Close)
+
+	follower, err := newBouncer(t)
+	require.NoError(t, err)
+	require.NoError(t, follower.SetMirror(s.URL, "follower-key", "ban"))
+
+	pulled, err := follower.fetchMirror(context.Background())
+	require.NoError(t, err)
+	require.Len(t, pulled, 3)
+	assert.Equal(t, "captcha", *pulled[2].Type)
+	assert.Equal(t, "test", *pulled[2].Scenario)
+
+	leader.useStreamingBouncer.Store(false)
+	_, err = leader.Export()
+	require.ErrorIs(t, err, ErrNotStreaming)
+}
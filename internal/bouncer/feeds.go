@@ -0,0 +1,176 @@
+// Copyright 2024 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bouncer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+	"slices"
+
+	"github.com/crowdsecurity/crowdsec/pkg/models"
+	csbouncer "github.com/crowdsecurity/go-cs-bouncer"
+	"go.uber.org/zap"
+)
+
+// feed is an additional CrowdSec Local API that decisions are
+// streamed from, i.e. the Local API of another organization.
+type feed struct {
+	name    string
+	bouncer *csbouncer.StreamBouncer
+	store   *store
+}
+
+// AddFeed adds the CrowdSec Local API at apiURL as an additional source
+// of decisions, authenticating with apiKey. Its decisions are kept in
+// their own store, so that decisions for the same IP from different
+// sources don't replace each other, and are enforced together with the
+// decisions from the primary Local API. The origin of its decisions is
+// prefixed with name, i.e. "customer-a/crowdsec". Feeds require the
+// StreamBouncer.
+func (b *Bouncer) AddFeed(name, apiURL, apiKey string) error {
+	if name == "" {
+		return errors.New("feed name must not be empty")
+	}
+	if apiURL == "" || apiKey == "" {
+		return fmt.Errorf("feed %q must have an API URL and API key", name)
+	}
+	if slices.ContainsFunc(b.feeds, func(f *feed) bool { return f.name == name }) {
+		return fmt.Errorf("duplicate feed %q", name)
+	}
+
+	insecureSkipVerify := false
+	b.feeds = append(b.feeds, &feed{
+		name: name,
+		bouncer: &csbouncer.StreamBouncer{
+			APIKey:              apiKey,
+			APIUrl:              apiURL,
+			InsecureSkipVerify:  &insecureSkipVerify,
+			TickerInterval:      b.streamingBouncer.TickerInterval,
+			UserAgent:           b.userAgent,
+			RetryInitialConnect: true,
+		},
+		store: newStore(),
+	})
+
+	return nil
+}
+
+func (b *Bouncer) initFeeds() error {
+	for _, f := range b.feeds {
+		f.bouncer.RetryInitialConnect = b.streamingBouncer.RetryInitialConnect
+		if err := f.bouncer.Init(); err != nil {
+			return fmt.Errorf("failed initializing feed %q: %w", f.name, err)
+		}
+		b.tuneAPIClient(f.bouncer.APIClient)
+	}
+
+	return nil
+}
+
+func (b *Bouncer) retrieveFeedDecision(ip netip.Addr) (*models.Decision, error) {
+	for _, f := range b.feeds {
+		decision, err := f.store.get(ip)
+		if err != nil || decision != nil {
+			return decision, err
+		}
+	}
+
+	return nil, nil
+}
+
+// feedsLen returns the number of decisions from all feeds.
+func (b *Bouncer) feedsLen() int {
+	n := 0
+	for _, f := range b.feeds {
+		n += f.store.len()
+	}
+
+	return n
+}
+
+func (b *Bouncer) startFeeds(ctx context.Context) {
+	for _, f := range b.feeds {
+		b.wg.Add(1)
+		go func() {
+			defer b.wg.Done()
+
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				f.bouncer.Run(ctx)
+			}()
+
+			// the stream is read until the StreamBouncer returned, because
+			// it blocks on sending decisions, even after ctx is canceled
+			stream := f.bouncer.Stream
+			for {
+				select {
+				case <-done:
+					return
+				case decisions, ok := <-stream:
+					if !ok {
+						b.logger.Error("decision stream of feed closed", b.zapField(), zap.String("feed", f.name))
+						stream = nil
+						continue
+					}
+					if decisions != nil && ctx.Err() == nil {
+						b.processFeedDecisions(f, decisions)
+					}
+				}
+			}
+		}()
+	}
+}
+
+// label prefixes the origin of decision with the name of the feed.
+func (f *feed) label(decision *models.Decision) {
+	origin := f.name + "/" + stringValue(decision.Origin)
+	decision.Origin = &origin
+}
+
+func (b *Bouncer) processFeedDecisions(f *feed, decisions *models.DecisionsStreamResponse) {
+	for _, decision := range decisions.Deleted {
+		f.label(decision)
+		if err := f.store.delete(decision); err != nil {
+			b.recordDecisionFailure("delete")
+			b.logger.Error("unable to delete decision", b.decisionFields(decision, zap.String("feed", f.name), zap.Error(err))...)
+			continue
+		}
+		b.decisionsDeleted.Add(1)
+		totalDecisionsDeleted.Inc()
+		b.publishDecision(EventDecisionDeleted, decision)
+	}
+
+	for _, decision := range decisions.New {
+		f.label(decision)
+		if err := f.store.add(decision); err != nil {
+			b.recordDecisionFailure("add")
+			b.logger.Error("unable to insert decision", b.decisionFields(decision, zap.String("feed", f.name), zap.Error(err))...)
+			continue
+		}
+		b.decisionsAdded.Add(1)
+		totalDecisionsAdded.Inc()
+		b.publishDecision(EventDecisionAdded, decision)
+	}
+
+	f.store.refreshFilter()
+	b.generation.Add(1)
+	b.updateActiveDecisions()
+
+	b.logger.Debug("processed decisions from feed", b.zapField(), zap.String("feed", f.name),
+		zap.Int("new", len(decisions.New)), zap.Int("deleted", len(decisions.Deleted)))
+}
@@ -0,0 +1,63 @@
+package bouncer
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBouncer_AddFeed(t *testing.T) {
+	b, err := newBouncer(t)
+	require.NoError(t, err)
+
+	assert.Error(t, b.AddFeed("", "http://127.0.0.1:8081/", "key"))
+	assert.Error(t, b.AddFeed("customer-a", "", "key"))
+	assert.Error(t, b.AddFeed("customer-a", "http://127.0.0.1:8081/", ""))
+	require.NoError(t, b.AddFeed("customer-a", "http://127.0.0.1:8081/", "key"))
+	assert.Error(t, b.AddFeed("customer-a", "http://127.0.0.1:8082/", "key"))
+	require.NoError(t, b.AddFeed("customer-b", "http://127.0.0.1:8082/", "key"))
+	assert.Len(t, b.feeds, 2)
+}
+
+func TestBouncer_startFeeds(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/decisions/stream" || r.Header.Get("X-Api-Key") != "customer-key" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"new": [{"duration": "1h", "origin": "crowdsec", "scenario": "crowdsecurity/http-probing", "scope": "Ip", "type": "ban", "value": "192.0.2.1"}], "deleted": []}`))
+	}))
+	t.Cleanup(srv.Close)
+
+	b, err := newBouncer(t)
+	require.NoError(t, err)
+
+	require.NoError(t, b.AddFeed("customer-a", srv.URL, "customer-key"))
+	require.NoError(t, b.initFeeds())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	b.wg = &sync.WaitGroup{}
+	b.startFeeds(ctx)
+
+	ip := netip.MustParseAddr("192.0.2.1")
+	require.Eventually(t, func() bool {
+		allowed, _, err := b.IsAllowed(ip)
+		return err == nil && !allowed
+	}, 5*time.Second, 10*time.Millisecond)
+
+	details, err := b.Lookup(ip)
+	require.NoError(t, err)
+	require.Len(t, details, 1)
+	assert.Equal(t, "customer-a/crowdsec", details[0].Origin)
+
+	cancel()
+	b.wg.Wait()
+}
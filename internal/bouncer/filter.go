@@ -0,0 +1,134 @@
+// Copyright 2024 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bouncer
+
+import (
+	"encoding/binary"
+	"math/bits"
+	"net/netip"
+	"sync/atomic"
+)
+
+const (
+	// minFilterBits is the minimum size of a prefix filter.
+	minFilterBits = 1 << 12
+	// filterBitsPerPrefix is the number of bits in a prefix filter
+	// per prefix it's sized for. With a single hash function, this
+	// results in roughly 10% false positives when the filter is full.
+	filterBitsPerPrefix = 10
+)
+
+// prefixFilter is a bloom filter with a single hash function over the
+// prefixes in a store. It's used to determine that an IP is definitely
+// not covered by any of the prefixes, without looking it up in the
+// store. Prefixes can only be added; when prefixes are removed, the
+// filter must be rebuilt to clear their bits.
+type prefixFilter struct {
+	bits     []atomic.Uint64
+	mask     uint64
+	capacity int
+	count    atomic.Int64
+
+	// the prefix lengths that were added, per IP version; an
+	// IP has to be checked for each of these lengths
+	lengths4 [1]atomic.Uint64
+	lengths6 [3]atomic.Uint64
+}
+
+// newPrefixFilter returns a prefixFilter sized for n prefixes.
+func newPrefixFilter(n int) *prefixFilter {
+	size := max(minFilterBits, n*filterBitsPerPrefix)
+	size = 1 << bits.Len(uint(size-1)) // round up to a power of two
+
+	return &prefixFilter{
+		bits:     make([]atomic.Uint64, size/64),
+		mask:     uint64(size - 1),
+		capacity: size / filterBitsPerPrefix,
+	}
+}
+
+// add adds prefix prf to the filter.
+func (f *prefixFilter) add(prf netip.Prefix) {
+	setBit(f.lengthsFor(prf.Addr()), prf.Bits())
+	setBit(f.bits, int(hashPrefix(prf)&f.mask))
+	f.count.Add(1)
+}
+
+// mayContain returns whether ip may be covered by a prefix in the
+// filter. If it returns false, ip is definitely not covered.
+func (f *prefixFilter) mayContain(ip netip.Addr) bool {
+	lengths := f.lengthsFor(ip)
+	for i := range lengths {
+		for w := lengths[i].Load(); w != 0; w &= w - 1 {
+			prf, err := ip.Prefix(i*64 + bits.TrailingZeros64(w))
+			if err != nil {
+				continue
+			}
+			if hasBit(f.bits, int(hashPrefix(prf)&f.mask)) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// full returns whether more prefixes were added to the filter
+// than it was sized for.
+func (f *prefixFilter) full() bool {
+	return f.count.Load() > int64(f.capacity)
+}
+
+func (f *prefixFilter) lengthsFor(ip netip.Addr) []atomic.Uint64 {
+	if ip.Is4() {
+		return f.lengths4[:]
+	}
+
+	return f.lengths6[:]
+}
+
+func setBit(words []atomic.Uint64, i int) {
+	word, bit := &words[i/64], uint64(1)<<(i%64)
+	for {
+		old := word.Load()
+		if old&bit != 0 || word.CompareAndSwap(old, old|bit) {
+			return
+		}
+	}
+}
+
+func hasBit(words []atomic.Uint64, i int) bool {
+	return words[i/64].Load()&(uint64(1)<<(i%64)) != 0
+}
+
+// hashPrefix returns a hash of the (masked) prefix prf.
+func hashPrefix(prf netip.Prefix) uint64 {
+	a := prf.Addr().As16()
+	hi := binary.BigEndian.Uint64(a[:8])
+	lo := binary.BigEndian.Uint64(a[8:])
+
+	return mix(hi ^ mix(lo^uint64(prf.Bits())))
+}
+
+// mix is the finalizer of SplitMix64.
+func mix(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+
+	return x
+}
@@ -0,0 +1,73 @@
+package bouncer
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/crowdsecurity/crowdsec/pkg/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPrefixFilter(t *testing.T) {
+	f := newPrefixFilter(0)
+	assert.False(t, f.mayContain(netip.MustParseAddr("192.0.2.1")))
+
+	f.add(netip.MustParsePrefix("192.0.2.1/32"))
+	f.add(netip.MustParsePrefix("198.51.100.0/24"))
+	f.add(netip.MustParsePrefix("2001:db8::/32"))
+
+	assert.True(t, f.mayContain(netip.MustParseAddr("192.0.2.1")))
+	assert.True(t, f.mayContain(netip.MustParseAddr("198.51.100.42")))
+	assert.True(t, f.mayContain(netip.MustParseAddr("2001:db8::1")))
+	assert.False(t, f.mayContain(netip.MustParseAddr("::ffff:192.0.2.1")))
+
+	misses := 0
+	for i := range 1000 {
+		if !f.mayContain(netip.AddrFrom4([4]byte{10, 0, byte(i >> 8), byte(i)})) {
+			misses++
+		}
+	}
+	assert.Greater(t, misses, 950)
+	assert.False(t, f.full())
+}
+
+func TestStore_refreshFilter(t *testing.T) {
+	scope, value, typ := "Ip", "192.0.2.1", "ban"
+	d := &models.Decision{Scope: &scope, Value: &value, Type: &typ}
+
+	s := newStore()
+	require.NoError(t, s.add(d))
+	require.True(t, s.filter.Load().mayContain(netip.MustParseAddr(value)))
+
+	// IPv4-mapped IPv6 addresses are looked up as IPv4
+	got, err := s.get(netip.MustParseAddr("::ffff:" + value))
+	require.NoError(t, err)
+	require.Equal(t, d, got)
+	entries, err := s.getAll(netip.MustParseAddr("::ffff:" + value))
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+
+	// removing a decision leaves its bits set until the filter is refreshed
+	require.NoError(t, s.delete(d))
+	require.True(t, s.filter.Load().mayContain(netip.MustParseAddr(value)))
+	got, err = s.get(netip.MustParseAddr(value))
+	require.NoError(t, err)
+	require.Nil(t, got)
+
+	s.refreshFilter()
+	require.False(t, s.filter.Load().mayContain(netip.MustParseAddr(value)))
+
+	// a full filter is resized
+	for i := range minFilterBits / filterBitsPerPrefix * 2 {
+		v := netip.AddrFrom4([4]byte{10, byte(i >> 16), byte(i >> 8), byte(i)}).String()
+		require.NoError(t, s.add(&models.Decision{Scope: &scope, Value: &v, Type: &typ}))
+	}
+	require.True(t, s.filter.Load().full())
+	s.refreshFilter()
+	require.False(t, s.filter.Load().full())
+
+	got, err = s.get(netip.MustParseAddr("10.0.0.1"))
+	require.NoError(t, err)
+	require.NotNil(t, got)
+}
@@ -0,0 +1,287 @@
+package bouncer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const defaultAppSecHealthCheckInterval = 1 * time.Minute
+
+// AppSecHealth is the result of the most recent health check
+// of the AppSec component.
+type AppSecHealth struct {
+	Enabled     bool      `json:"enabled"`
+	Healthy     bool      `json:"healthy"`
+	LastChecked time.Time `json:"last_checked,omitempty"`
+	Error       string    `json:"error,omitempty"`
+}
+
+type appsecHealth struct {
+	mu       sync.RWMutex
+	status   AppSecHealth
+	interval time.Duration
+}
+
+// SetAppSecHealthCheckInterval sets the interval at which the AppSec
+// component is probed. The AppSec component is always probed once at
+// startup.
+func (b *Bouncer) SetAppSecHealthCheckInterval(interval time.Duration) {
+	if interval > 0 {
+		b.appsec.health.interval = interval
+	}
+}
+
+// AppSecHealth returns the result of the most recent health check
+// of the AppSec component.
+func (b *Bouncer) AppSecHealth() AppSecHealth {
+	b.appsec.health.mu.RLock()
+	defer b.appsec.health.mu.RUnlock()
+
+	return b.appsec.health.status
+}
+
+func (b *Bouncer) startAppSecHealthCheck(ctx context.Context) {
+	if b.appsec.apiURL == "" {
+		return
+	}
+
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+
+		b.logger.Debug("starting appsec health check", b.zapField(), zap.Duration("interval", b.appsec.health.interval))
+		b.appsec.checkHealth(ctx)
+
+		ticker := time.NewTicker(b.appsec.health.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				b.logger.Info("appsec health check stopped", b.zapField())
+				return
+			case <-ticker.C:
+				b.appsec.checkHealth(ctx)
+			}
+		}
+	}()
+}
+
+// checkHealth probes the AppSec component with a minimal request
+// and records the result. A response indicating the request was
+// evaluated, either allowing or blocking it, is considered healthy.
+func (a *appsec) checkHealth(ctx context.Context) {
+	err := a.probe(ctx)
+
+	a.health.mu.Lock()
+	defer a.health.mu.Unlock()
+
+	wasHealthy := a.health.status.Healthy
+	a.health.status = AppSecHealth{
+		Enabled:     true,
+		Healthy:     err == nil,
+		LastChecked: time.Now(),
+	}
+
+	switch {
+	case err != nil:
+		a.health.status.Error = err.Error()
+		a.logger.Warn("appsec component health check failed", zap.String("appsec_url", a.apiURL), zap.Error(err))
+	case !wasHealthy:
+		a.logger.Info("appsec component healthy", zap.String("appsec_url", a.apiURL))
+	}
+}
+
+func (a *appsec) probe(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, a.apiURL, http.NoBody)
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("X-Crowdsec-Appsec-Ip", "127.0.0.1")
+	req.Header.Set("X-Crowdsec-Appsec-Uri", "/")
+	req.Header.Set("X-Crowdsec-Appsec-Host", "localhost")
+	req.Header.Set("X-Crowdsec-Appsec-Verb", http.MethodGet)
+	req.Header.Set("X-Crowdsec-Appsec-Api-Key", a.apiKey)
+	req.Header.Set("User-Agent", userAgentName)
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusForbidden:
+		return nil
+	case http.StatusUnauthorized:
+		return fmt.Errorf("appsec component not authenticated: %s", resp.Status)
+	default:
+		return fmt.Errorf("appsec component returned unexpected status: %s", resp.Status)
+	}
+}
+
+// CheckLAPI checks if the CrowdSec Local API is reachable, using its
+// unauthenticated health endpoint.
+func (b *Bouncer) CheckLAPI(ctx context.Context) error {
+	if b.mirror != nil {
+		return errors.New("decisions are retrieved from a blocklist mirror")
+	}
+
+	client := b.liveBouncer.APIClient
+	if b.useStreamingBouncer.Load() {
+		client = b.streamingBouncer.APIClient
+	}
+	if client == nil {
+		return errors.New("bouncer is not initialized")
+	}
+
+	req, err := client.NewRequest(http.MethodGet, "health", nil)
+	if err != nil {
+		return fmt.Errorf("failed creating request: %w", err)
+	}
+
+	if _, err := client.Do(ctx, req, nil); err != nil {
+		return classifyError(err)
+	}
+
+	return nil
+}
+
+const (
+	// HealthStatusHealthy indicates all components are functioning.
+	HealthStatusHealthy = "healthy"
+	// HealthStatusDegraded indicates decisions are enforced, but they
+	// may be outdated, or the AppSec component is unavailable.
+	HealthStatusDegraded = "degraded"
+	// HealthStatusUnhealthy indicates decisions can't be enforced.
+	HealthStatusUnhealthy = "unhealthy"
+)
+
+// staleTickerIntervals is the number of ticker intervals after which
+// decisions are considered stale when no pull succeeded.
+const staleTickerIntervals = 3
+
+// Health describes the health of the Bouncer and its components.
+type Health struct {
+	Status    string          `json:"status"`
+	Decisions DecisionsHealth `json:"decisions"`
+	AppSec    AppSecHealth    `json:"appsec"`
+}
+
+// DecisionsHealth describes the health of retrieving decisions
+// from the CrowdSec Local API.
+type DecisionsHealth struct {
+	Status      string     `json:"status"`
+	Mode        string     `json:"mode"`
+	LastSuccess *time.Time `json:"last_success,omitempty"`
+	LastError   *time.Time `json:"last_error,omitempty"`
+	Error       string     `json:"error,omitempty"`
+}
+
+type lapiHealth struct {
+	mu          sync.RWMutex
+	lastSuccess time.Time
+	lastError   time.Time
+	err         string
+}
+
+func (b *Bouncer) recordLAPISuccess() {
+	b.lapiHealth.mu.Lock()
+	defer b.lapiHealth.mu.Unlock()
+
+	b.lapiHealth.lastSuccess = time.Now()
+	lastSyncTimestamp.Set(float64(b.lapiHealth.lastSuccess.Unix()))
+}
+
+func (b *Bouncer) recordLAPIError(err error) {
+	b.lapiHealth.mu.Lock()
+	defer b.lapiHealth.mu.Unlock()
+
+	b.lapiHealth.lastError = time.Now()
+	b.lapiHealth.err = err.Error()
+}
+
+// Health returns the health of the Bouncer. In streaming mode decisions
+// are degraded when no pull succeeded for a number of ticker intervals,
+// and unhealthy when no decisions were retrieved at all. In live mode
+// decisions are unhealthy when the most recent lookup failed. The Bouncer
+// is degraded when the AppSec component is enabled, but unhealthy.
+func (b *Bouncer) Health() Health {
+	h := Health{
+		Decisions: b.decisionsHealth(time.Now()),
+		AppSec:    b.AppSecHealth(),
+	}
+
+	h.Status = h.Decisions.Status
+	if h.Status == HealthStatusHealthy && h.AppSec.Enabled && !h.AppSec.Healthy {
+		h.Status = HealthStatusDegraded
+	}
+
+	return h
+}
+
+func (b *Bouncer) decisionsHealth(now time.Time) DecisionsHealth {
+	b.startMu.Lock()
+	running, startedAt := b.started && !b.stopped, b.startedAt
+	b.startMu.Unlock()
+
+	b.lapiHealth.mu.RLock()
+	lastSuccess, lastError, lastErr := b.lapiHealth.lastSuccess, b.lapiHealth.lastError, b.lapiHealth.err
+	b.lapiHealth.mu.RUnlock()
+
+	h := DecisionsHealth{Status: HealthStatusHealthy, Mode: "live"}
+	if !lastSuccess.IsZero() {
+		h.LastSuccess = &lastSuccess
+	}
+	if !lastError.IsZero() {
+		h.LastError = &lastError
+		h.Error = lastErr
+	}
+
+	if !running {
+		h.Status = HealthStatusUnhealthy
+		h.Error = "bouncer is not running"
+		return h
+	}
+
+	if !b.useStreamingBouncer.Load() {
+		if lastError.After(lastSuccess) {
+			h.Status = HealthStatusUnhealthy
+		}
+		return h
+	}
+
+	h.Mode = "streaming"
+	staleAfter := staleTickerIntervals * b.streamingBouncer.TickerIntervalDuration
+	switch {
+	case lastSuccess.IsZero() && now.Sub(startedAt) > staleAfter:
+		h.Status = HealthStatusUnhealthy
+		if h.Error == "" {
+			h.Error = "no decisions retrieved"
+		}
+	case lastSuccess.IsZero():
+		h.Status = HealthStatusDegraded
+		if h.Error == "" {
+			h.Error = "waiting for decisions"
+		}
+	case now.Sub(lastSuccess) > staleAfter:
+		h.Status = HealthStatusDegraded
+		if h.Error == "" {
+			h.Error = "decisions are stale"
+		}
+	case lastError.After(lastSuccess):
+		h.Status = HealthStatusDegraded
+	}
+
+	return h
+}
@@ -0,0 +1,108 @@
+package bouncer
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+)
+
+func Test_appsec_checkHealth(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+
+	tests := []struct {
+		name        string
+		statusCode  int
+		wantHealthy bool
+	}{
+		{"ok", http.StatusOK, true},
+		{"blocked", http.StatusForbidden, true},
+		{"unauthenticated", http.StatusUnauthorized, false},
+		{"internal-error", http.StatusInternalServerError, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				assert.Equal(t, "test-apikey", r.Header.Get("X-Crowdsec-Appsec-Api-Key"))
+				w.WriteHeader(tt.statusCode)
+			}))
+			t.Cleanup(s.Close)
+
+			a := newAppSec(s.URL, "test-apikey", 0, logger)
+			a.checkHealth(context.Background())
+
+			got := a.health.status
+			assert.True(t, got.Enabled)
+			assert.Equal(t, tt.wantHealthy, got.Healthy)
+			assert.False(t, got.LastChecked.IsZero())
+			if tt.wantHealthy {
+				assert.Empty(t, got.Error)
+			} else {
+				assert.NotEmpty(t, got.Error)
+			}
+		})
+	}
+
+	t.Run("unreachable", func(t *testing.T) {
+		s := httptest.NewServer(http.NotFoundHandler())
+		s.Close()
+
+		a := newAppSec(s.URL, "test-apikey", 0, logger)
+		a.checkHealth(context.Background())
+
+		assert.False(t, a.health.status.Healthy)
+		assert.NotEmpty(t, a.health.status.Error)
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		a := newAppSec("", "test-apikey", 0, logger)
+
+		assert.False(t, a.health.status.Enabled)
+	})
+}
+
+func TestBouncer_decisionsHealth(t *testing.T) {
+	b, err := newBouncer(t)
+	require.NoError(t, err)
+
+	now := time.Now()
+	assert.Equal(t, HealthStatusUnhealthy, b.decisionsHealth(now).Status)
+
+	b.started = true
+	b.startedAt = now
+	h := b.decisionsHealth(now)
+	assert.Equal(t, HealthStatusDegraded, h.Status)
+	assert.Equal(t, "streaming", h.Mode)
+	assert.Equal(t, "waiting for decisions", h.Error)
+
+	assert.Equal(t, HealthStatusUnhealthy, b.decisionsHealth(now.Add(time.Minute)).Status)
+
+	b.recordLAPISuccess()
+	h = b.decisionsHealth(time.Now())
+	assert.Equal(t, HealthStatusHealthy, h.Status)
+	assert.NotNil(t, h.LastSuccess)
+	assert.Empty(t, h.Error)
+
+	h = b.decisionsHealth(time.Now().Add(time.Minute))
+	assert.Equal(t, HealthStatusDegraded, h.Status)
+	assert.Equal(t, "decisions are stale", h.Error)
+
+	b.recordLAPIError(errors.New("connection refused"))
+	h = b.decisionsHealth(time.Now())
+	assert.Equal(t, HealthStatusDegraded, h.Status)
+	assert.Equal(t, "connection refused", h.Error)
+
+	b.useStreamingBouncer.Store(false)
+	h = b.decisionsHealth(time.Now())
+	assert.Equal(t, HealthStatusUnhealthy, h.Status)
+	assert.Equal(t, "live", h.Mode)
+
+	b.recordLAPISuccess()
+	assert.Equal(t, HealthStatusHealthy, b.decisionsHealth(time.Now()).Status)
+}
@@ -0,0 +1,100 @@
+// Copyright 2024 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bouncer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/hslatman/caddy-crowdsec-bouncer/internal/httputils"
+)
+
+// appSecJailScenario is the scenario of local decisions for IPs that
+// triggered the AppSec component too often.
+const appSecJailScenario = "caddy-crowdsec-bouncer/appsec-jail"
+
+// appSecJail bans IPs that trigger the AppSec component repeatedly.
+type appSecJail struct {
+	offenses *offenses
+	duration time.Duration
+}
+
+// SetAppSecJail enables adding a local ban decision for IPs that have
+// more than threshold requests blocked by the AppSec component within
+// window. The decision is removed after duration. While an IP is jailed,
+// its requests are blocked without being forwarded to the AppSec component.
+func (b *Bouncer) SetAppSecJail(threshold int, window, duration time.Duration) error {
+	if threshold <= 0 {
+		return fmt.Errorf("invalid threshold %d; must be positive", threshold)
+	}
+	if window <= 0 || duration <= 0 {
+		return fmt.Errorf("window and duration must be positive")
+	}
+
+	b.appSecJail = &appSecJail{
+		offenses: newOffenses(threshold, window),
+		duration: duration,
+	}
+
+	return nil
+}
+
+// checkJailed returns an error if the IP in ctx has a local decision,
+// so that the request isn't forwarded to the AppSec component.
+func (b *Bouncer) checkJailed(ctx context.Context) error {
+	if b.appSecJail == nil {
+		return nil
+	}
+
+	ip, ok := httputils.FromContext(ctx)
+	if !ok {
+		return nil
+	}
+
+	decision, err := b.retrieveLocalDecision(ip)
+	if err != nil || decision == nil {
+		return err
+	}
+
+	return &AppSecError{Err: errors.New("request from jailed IP"), Action: *decision.Type, StatusCode: http.StatusForbidden}
+}
+
+// recordAppSecOffense records a request blocked by an AppSec rule, and
+// adds a local decision for the IP in ctx when it was blocked too often.
+func (b *Bouncer) recordAppSecOffense(ctx context.Context) {
+	if b.appSecJail == nil {
+		return
+	}
+
+	ip, ok := httputils.FromContext(ctx)
+	if !ok || !b.appSecJail.offenses.record(ip, time.Now()) {
+		return
+	}
+
+	prf := netip.PrefixFrom(ip, ip.BitLen())
+	if _, err := b.addLocal(prf, "ban", b.appSecJail.duration, appSecJailScenario); err != nil {
+		b.logger.Error("failed adding local decision", b.zapField(), zap.String("ip", ip.String()), zap.Error(err))
+		return
+	}
+
+	b.logger.Info("jailed IP for repeated appsec blocks", b.zapField(),
+		zap.String("ip", ip.String()), zap.Duration("duration", b.appSecJail.duration))
+}
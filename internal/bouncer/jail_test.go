@@ -0,0 +1,95 @@
+package bouncer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+
+	"github.com/hslatman/caddy-crowdsec-bouncer/internal/httputils"
+)
+
+func TestBouncer_AppSecJail(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+	ctx := newCaddyVarsContext()
+	caddyhttp.SetVar(ctx, caddyhttp.ClientIPVarKey, "10.0.0.10")
+	ctx, _ = httputils.EnsureIP(ctx)
+
+	var calls atomic.Int32
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.WriteHeader(http.StatusForbidden)
+		_, _ = w.Write([]byte(`{"action": "ban", "http_status": 403}`))
+	}))
+	t.Cleanup(s.Close)
+
+	b, err := New("apiKey", "http://127.0.0.1:8080/", s.URL, 0, "10s", logger)
+	require.NoError(t, err)
+	b.EnableStreaming()
+
+	assert.Error(t, b.SetAppSecJail(0, time.Minute, time.Hour))
+	require.NoError(t, b.SetAppSecJail(2, time.Minute, time.Hour))
+
+	for range 3 {
+		err := b.CheckRequest(ctx, httptest.NewRequest(http.MethodGet, "/", http.NoBody))
+		var appSecErr *AppSecError
+		require.ErrorAs(t, err, &appSecErr)
+	}
+	assert.Equal(t, int32(3), calls.Load())
+
+	ip := netip.MustParseAddr("10.0.0.10")
+	allowed, decision, err := b.IsAllowed(ip)
+	require.NoError(t, err)
+	assert.False(t, allowed)
+	require.NotNil(t, decision)
+	assert.Equal(t, appSecJailScenario, *decision.Scenario)
+
+	// jailed requests aren't forwarded to the AppSec component
+	err = b.CheckRequest(ctx, httptest.NewRequest(http.MethodGet, "/", http.NoBody))
+	var appSecErr *AppSecError
+	require.ErrorAs(t, err, &appSecErr)
+	assert.Equal(t, "ban", appSecErr.Action)
+	assert.Equal(t, int32(3), calls.Load())
+}
+
+func TestBouncer_AppSecJail_failurePolicy(t *testing.T) {
+	ctx := newCaddyVarsContext()
+	caddyhttp.SetVar(ctx, caddyhttp.ClientIPVarKey, "10.0.0.10")
+	ctx, _ = httputils.EnsureIP(ctx)
+
+	var calls atomic.Int32
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	t.Cleanup(s.Close)
+
+	b, err := New("apiKey", "http://127.0.0.1:8080/", s.URL, 0, "10s", zaptest.NewLogger(t))
+	require.NoError(t, err)
+	b.EnableStreaming()
+	require.NoError(t, b.SetAppSecFailurePolicy("closed"))
+	b.SetAppSecRetries(0, 0)
+	require.NoError(t, b.SetAppSecJail(2, time.Minute, time.Hour))
+
+	// requests blocked by the failure policy don't count as offenses,
+	// so every request is forwarded to the AppSec component
+	for range 5 {
+		err := b.CheckRequest(ctx, httptest.NewRequest(http.MethodGet, "/", http.NoBody))
+		var appSecErr *AppSecError
+		require.ErrorAs(t, err, &appSecErr)
+		assert.False(t, appSecErr.Triggered)
+	}
+	assert.Equal(t, int32(5), calls.Load())
+
+	allowed, decision, err := b.IsAllowed(netip.MustParseAddr("10.0.0.10"))
+	require.NoError(t, err)
+	assert.True(t, allowed)
+	assert.Nil(t, decision)
+}
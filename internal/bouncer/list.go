@@ -0,0 +1,98 @@
+// Copyright 2024 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bouncer
+
+import (
+	"cmp"
+	"net/netip"
+	"slices"
+	"strings"
+)
+
+// DecisionFilter selects decisions. Empty fields match all decisions.
+type DecisionFilter struct {
+	Type   string
+	Origin string
+	// Scope is matched case-insensitively.
+	Scope string
+	// Contains selects decisions that apply to the IP.
+	Contains netip.Addr
+}
+
+func (f DecisionFilter) matches(prf netip.Prefix, e entry) bool {
+	d := e.decision
+	switch {
+	case f.Type != "" && stringValue(d.Type) != f.Type:
+		return false
+	case f.Origin != "" && stringValue(d.Origin) != f.Origin:
+		return false
+	case f.Scope != "" && !strings.EqualFold(stringValue(d.Scope), f.Scope):
+		return false
+	case f.Contains.IsValid() && !prf.Contains(f.Contains):
+		return false
+	}
+
+	return true
+}
+
+// Decisions returns the decisions known to the Bouncer that match
+// filter, including those on the local denylist, local decisions,
+// blocklists and feeds. Decisions are ordered
+// by the prefix they apply to. It requires the StreamBouncer, because
+// decisions are only kept locally in streaming mode.
+func (b *Bouncer) Decisions(filter DecisionFilter) ([]DecisionDetails, error) {
+	if !b.useStreamingBouncer.Load() {
+		return nil, ErrNotStreaming
+	}
+
+	type match struct {
+		prefix netip.Prefix
+		entry  entry
+	}
+
+	var matches []match
+	collect := func(prf netip.Prefix, e entry) bool {
+		if filter.matches(prf, e) {
+			matches = append(matches, match{prefix: prf, entry: e})
+		}
+		return true
+	}
+
+	if b.denylist != nil {
+		b.denylist.each(collect)
+	}
+	b.local.each(collect)
+	if b.blocklists != nil {
+		b.blocklists.store.each(collect)
+	}
+	b.store.each(collect)
+	for _, f := range b.feeds {
+		f.store.each(collect)
+	}
+
+	slices.SortStableFunc(matches, func(a, b match) int {
+		if c := a.prefix.Addr().Compare(b.prefix.Addr()); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.prefix.Bits(), b.prefix.Bits())
+	})
+
+	details := make([]DecisionDetails, 0, len(matches))
+	for _, m := range matches {
+		details = append(details, newDecisionDetails(m.entry))
+	}
+
+	return details, nil
+}
@@ -0,0 +1,52 @@
+package bouncer
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/crowdsecurity/crowdsec/pkg/models"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBouncer_Decisions(t *testing.T) {
+	b, err := newBouncer(t)
+	require.NoError(t, err)
+
+	for _, v := range []struct{ origin, scope, typ, value string }{
+		{"crowdsec", "Ip", "ban", "10.0.0.2"},
+		{"cscli", "Range", "ban", "10.0.0.0/24"},
+		{"CAPI", "Ip", "captcha", "192.0.2.1"},
+	} {
+		duration, scenario := "1h", "test"
+		require.NoError(t, b.add(&models.Decision{
+			Duration: &duration,
+			Origin:   &v.origin,
+			Scenario: &scenario,
+			Scope:    &v.scope,
+			Type:     &v.typ,
+			Value:    &v.value,
+		}))
+	}
+	require.NoError(t, b.SetDenylist([]netip.Prefix{netip.MustParsePrefix("198.51.100.0/24")}, "ban"))
+
+	values := func(filter DecisionFilter) []string {
+		details, err := b.Decisions(filter)
+		require.NoError(t, err)
+		var r []string
+		for _, d := range details {
+			r = append(r, d.Value)
+		}
+		return r
+	}
+
+	require.Equal(t, []string{"10.0.0.0/24", "10.0.0.2", "192.0.2.1", "198.51.100.0/24"}, values(DecisionFilter{}))
+	require.Equal(t, []string{"192.0.2.1"}, values(DecisionFilter{Type: "captcha"}))
+	require.Equal(t, []string{"10.0.0.0/24"}, values(DecisionFilter{Origin: "cscli"}))
+	require.Equal(t, []string{"10.0.0.2", "192.0.2.1"}, values(DecisionFilter{Scope: "ip"}))
+	require.Equal(t, []string{"10.0.0.0/24", "10.0.0.2"}, values(DecisionFilter{Contains: netip.MustParseAddr("10.0.0.2")}))
+	require.Empty(t, values(DecisionFilter{Contains: netip.MustParseAddr("203.0.113.1")}))
+
+	b.useStreamingBouncer.Store(false)
+	_, err = b.Decisions(DecisionFilter{})
+	require.ErrorIs(t, err, ErrNotStreaming)
+}
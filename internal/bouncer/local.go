@@ -0,0 +1,105 @@
+// Copyright 2024 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bouncer
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"time"
+
+	"github.com/crowdsecurity/crowdsec/pkg/models"
+)
+
+const (
+	localOrigin       = "caddy-local"
+	defaultBanReason  = "manual ban"
+	localDecisionType = "ban"
+)
+
+// Ban adds a local ban decision for prf, which is removed after duration.
+// Like the denylist, local decisions are enforced independent of the
+// decisions known to CrowdSec, in both streaming and live mode. They're
+// not sent to the CrowdSec Local API, and they're lost when the
+// configuration is reloaded. An existing local decision for prf is
+// replaced.
+func (b *Bouncer) Ban(prf netip.Prefix, duration time.Duration, reason string) (DecisionDetails, error) {
+	if !prf.IsValid() {
+		return DecisionDetails{}, errors.New("invalid prefix")
+	}
+	if duration <= 0 {
+		return DecisionDetails{}, fmt.Errorf("invalid duration %s; must be positive", duration)
+	}
+	if reason == "" {
+		reason = defaultBanReason
+	}
+
+	decision, err := b.addLocal(prf, localDecisionType, duration, reason)
+	if err != nil {
+		return DecisionDetails{}, err
+	}
+
+	return newDecisionDetails(entry{decision: decision}), nil
+}
+
+// addLocal adds a local decision of type typ for prf, which is removed
+// after duration.
+func (b *Bouncer) addLocal(prf netip.Prefix, typ string, duration time.Duration, reason string) (*models.Decision, error) {
+	decision := newPrefixDecision(prf, typ, localOrigin, reason, duration.String())
+	if err := b.local.add(decision); err != nil {
+		return nil, fmt.Errorf("failed adding local decision: %w", err)
+	}
+
+	time.AfterFunc(duration, func() {
+		b.removeLocal(prf.Masked(), decision)
+	})
+
+	b.generation.Add(1)
+	b.updateStoreMemory()
+	b.publishDecision(EventDecisionAdded, decision)
+
+	return decision, nil
+}
+
+// Unban removes the local decision for prf. It reports whether
+// a local decision for prf existed. Decisions from CrowdSec and
+// the denylist can't be removed.
+func (b *Bouncer) Unban(prf netip.Prefix) (bool, error) {
+	if !prf.IsValid() {
+		return false, errors.New("invalid prefix")
+	}
+
+	return b.removeLocal(prf.Masked(), nil), nil
+}
+
+// removeLocal removes the local decision for prf. If decision is
+// not nil, it's only removed if it wasn't replaced in the meantime.
+func (b *Bouncer) removeLocal(prf netip.Prefix, decision *models.Decision) bool {
+	e, ok := b.local.remove(prf, decision)
+	if !ok {
+		return false
+	}
+	b.local.refreshFilter()
+
+	b.generation.Add(1)
+	b.updateStoreMemory()
+	b.publishDecision(EventDecisionDeleted, e.decision)
+
+	return true
+}
+
+func (b *Bouncer) retrieveLocalDecision(ip netip.Addr) (*models.Decision, error) {
+	return b.local.get(ip)
+}
@@ -0,0 +1,91 @@
+// Copyright 2024 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bouncer
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBouncer_Ban(t *testing.T) {
+	b, err := newBouncer(t)
+	require.NoError(t, err)
+
+	ip := netip.MustParseAddr("192.0.2.1")
+	generation := b.Generation()
+
+	details, err := b.Ban(netip.MustParsePrefix("192.0.2.0/24"), time.Hour, "")
+	require.NoError(t, err)
+	assert.Equal(t, DecisionDetails{
+		Type:     "ban",
+		Scope:    "Range",
+		Value:    "192.0.2.0/24",
+		Origin:   localOrigin,
+		Scenario: defaultBanReason,
+		Duration: "1h0m0s",
+	}, details)
+	assert.NotEqual(t, generation, b.Generation())
+
+	allowed, decision, err := b.IsAllowed(ip)
+	require.NoError(t, err)
+	assert.False(t, allowed)
+	require.NotNil(t, decision)
+	assert.Equal(t, localOrigin, *decision.Origin)
+
+	removed, err := b.Unban(netip.MustParsePrefix("192.0.2.1/32"))
+	require.NoError(t, err)
+	assert.False(t, removed)
+
+	removed, err = b.Unban(netip.MustParsePrefix("192.0.2.0/24"))
+	require.NoError(t, err)
+	assert.True(t, removed)
+
+	allowed, _, err = b.IsAllowed(ip)
+	require.NoError(t, err)
+	assert.True(t, allowed)
+
+	_, err = b.Ban(netip.PrefixFrom(ip, 32), 0, "")
+	assert.Error(t, err)
+}
+
+func TestBouncer_BanExpires(t *testing.T) {
+	b, err := newBouncer(t)
+	require.NoError(t, err)
+
+	ip := netip.MustParseAddr("192.0.2.1")
+	_, err = b.Ban(netip.PrefixFrom(ip, 32), 50*time.Millisecond, "testing")
+	require.NoError(t, err)
+
+	// a replaced decision isn't removed when the original one expires
+	_, err = b.Ban(netip.PrefixFrom(ip, 32), time.Hour, "testing")
+	require.NoError(t, err)
+
+	time.Sleep(100 * time.Millisecond)
+	allowed, _, err := b.IsAllowed(ip)
+	require.NoError(t, err)
+	assert.False(t, allowed)
+
+	_, err = b.Ban(netip.PrefixFrom(ip, 32), 50*time.Millisecond, "testing")
+	require.NoError(t, err)
+
+	assert.Eventually(t, func() bool {
+		allowed, _, err := b.IsAllowed(ip)
+		return err == nil && allowed
+	}, time.Second, 10*time.Millisecond)
+}
@@ -33,6 +33,7 @@ func (b *Bouncer) overrideLogrusLogger() {
 		shouldFailHard: b.shouldFailHard,
 		address:        b.streamingBouncer.APIUrl,
 		instanceID:     b.instanceID,
+		onError:        b.recordLAPIError,
 	})
 
 	std.ReplaceHooks(hooks)
@@ -47,6 +48,7 @@ type zapAdapterHook struct {
 	shouldFailHard bool
 	address        string
 	instanceID     string
+	onError        func(error)
 }
 
 func (zh *zapAdapterHook) Levels() []logrus.Level {
@@ -68,7 +70,11 @@ func (zh *zapAdapterHook) Fire(entry *logrus.Entry) error {
 	fields := []zapcore.Field{zap.String("instance_id", zh.instanceID), zap.String("address", zh.address)}
 	switch {
 	case entry.Level <= logrus.ErrorLevel: // error, fatal, panic
-		fields = append(fields, zap.Error(errors.New(msg)))
+		err := classifyError(errors.New(msg))
+		fields = append(fields, zap.Error(err))
+		if zh.onError != nil {
+			zh.onError(err) // errors logged by go-cs-bouncer result from calls to the LAPI
+		}
 		if zh.shouldFailHard {
 			// TODO: if we keep this Fatal and the "shouldFailhard" around, ensure we
 			// shut the bouncer down nicely
@@ -2,7 +2,13 @@ package bouncer
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"net/netip"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/crowdsecurity/crowdsec/pkg/apiclient"
@@ -10,6 +16,7 @@ import (
 	csbouncer "github.com/crowdsecurity/go-cs-bouncer"
 	"github.com/crowdsecurity/go-cs-lib/ptr"
 	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
 	"go.uber.org/zap"
 )
 
@@ -27,8 +34,161 @@ var (
 		Name: "lapi_appsec_requests_failures_total",
 		Help: "The total number of failed calls to CrowdSec LAPI AppSec component",
 	})
+	totalAppSecDropped = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "lapi_appsec_requests_dropped_total",
+		Help: "The total number of requests dropped from the CrowdSec LAPI AppSec component queue",
+	})
+	totalAppSecOverflows = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "lapi_appsec_requests_overflows_total",
+		Help: "The total number of requests exceeding the CrowdSec LAPI AppSec component concurrency limit",
+	})
+
+	// bouncer metrics
+	activeDecisions = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "caddy",
+		Subsystem: "crowdsec",
+		Name:      "active_decisions",
+		Help:      "The number of active decisions known to the bouncer in streaming mode",
+	})
+	totalRemediations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "caddy",
+		Subsystem: "crowdsec",
+		Name:      "remediations_total",
+		Help:      "The total number of remediations served, by type",
+	}, []string{"type"})
+	totalStreamBatches = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "caddy",
+		Subsystem: "crowdsec",
+		Name:      "stream_batches_total",
+		Help:      "The total number of batches of decisions processed from the CrowdSec LAPI stream",
+	})
+	totalDecisionsAdded = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "caddy",
+		Subsystem: "crowdsec",
+		Name:      "decisions_added_total",
+		Help:      "The total number of decisions added to the store",
+	})
+	totalDecisionsDeleted = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "caddy",
+		Subsystem: "crowdsec",
+		Name:      "decisions_deleted_total",
+		Help:      "The total number of decisions deleted from the store",
+	})
+	totalDecisionFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "caddy",
+		Subsystem: "crowdsec",
+		Name:      "decision_failures_total",
+		Help:      "The total number of decisions that couldn't be processed, by action",
+	}, []string{"action"})
+	lastSyncTimestamp = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "caddy",
+		Subsystem: "crowdsec",
+		Name:      "last_sync_timestamp_seconds",
+		Help:      "The Unix time decisions were last retrieved from the CrowdSec LAPI successfully",
+	})
+	lastBatchSize = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "caddy",
+		Subsystem: "crowdsec",
+		Name:      "last_batch_size",
+		Help:      "The number of decisions in the most recent batch from the CrowdSec LAPI stream, by kind",
+	}, []string{"kind"})
+	initialPullDuration = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "caddy",
+		Subsystem: "crowdsec",
+		Name:      "initial_pull_duration_seconds",
+		Help:      "The time it took to process the first batch of decisions from the CrowdSec LAPI stream",
+	})
+	storeMemoryBytes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "caddy",
+		Subsystem: "crowdsec",
+		Name:      "store_memory_bytes",
+		Help:      "The estimated number of bytes used by the decisions known to the bouncer, by store",
+	}, []string{"store"})
+	lookupDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "caddy",
+		Subsystem: "crowdsec",
+		Name:      "lookup_duration_seconds",
+		Help:      "The duration of decision lookups, by mode",
+		Buckets:   prometheus.ExponentialBuckets(0.00001, 4, 10), // 10µs to ~2.6s
+	}, []string{"mode"})
+
+	registerMetricsOnce sync.Once
+	registerMetricsErr  error
 )
 
+// RegisterMetrics registers the metrics of the Bouncer with reg, so that
+// they're exposed alongside the metrics of Caddy. The metrics are shared
+// by all Bouncer instances in the process, so they're registered once.
+func RegisterMetrics(reg prometheus.Registerer) error {
+	registerMetricsOnce.Do(func() {
+		for _, c := range []prometheus.Collector{
+			totalLAPICalls,
+			totalLAPIErrors,
+			totalAppSecCalls,
+			totalAppSecErrors,
+			totalAppSecDropped,
+			totalAppSecOverflows,
+			activeDecisions,
+			totalRemediations,
+			totalStreamBatches,
+			totalDecisionsAdded,
+			totalDecisionsDeleted,
+			totalDecisionFailures,
+			lastSyncTimestamp,
+			lastBatchSize,
+			initialPullDuration,
+			storeMemoryBytes,
+			lookupDuration,
+		} {
+			if err := reg.Register(c); err != nil {
+				var are prometheus.AlreadyRegisteredError
+				if !errors.As(err, &are) {
+					registerMetricsErr = fmt.Errorf("failed registering metrics: %w", err)
+					return
+				}
+			}
+		}
+	})
+
+	return registerMetricsErr
+}
+
+// observeLookup looks up the decision for ip, observing the
+// duration of the lookup.
+func (b *Bouncer) observeLookup(ctx context.Context, ip netip.Addr) (bool, *models.Decision, error) {
+	mode := "live"
+	if b.useStreamingBouncer.Load() {
+		mode = "streaming"
+	}
+
+	start := time.Now()
+	defer func() {
+		lookupDuration.WithLabelValues(mode).Observe(time.Since(start).Seconds())
+	}()
+
+	return b.isAllowed(ctx, ip)
+}
+
+// updateActiveDecisions sets the active decisions gauge to the
+// number of decisions in the store and from feeds, and updates
+// the estimated memory usage of the stores.
+func (b *Bouncer) updateActiveDecisions() {
+	activeDecisions.Set(float64(b.store.len() + b.feedsLen()))
+	b.updateStoreMemory()
+}
+
+// updateStoreMemory sets the store memory gauges to the estimated
+// number of bytes used per store.
+func (b *Bouncer) updateStoreMemory() {
+	for store, n := range b.storeMemory() {
+		storeMemoryBytes.WithLabelValues(store).Set(float64(n))
+	}
+}
+
+// defaultMetricsInterval is the default interval at which usage
+// metrics are reported to the CrowdSec Local API.
+const defaultMetricsInterval = 15 * time.Minute
+
 func newMetricsProvider(client *apiclient.ApiClient, updater csbouncer.MetricsUpdater, interval time.Duration) (*csbouncer.MetricsProvider, error) {
 	m, err := csbouncer.NewMetricsProvider(
 		client,
@@ -62,10 +222,156 @@ func (b *Bouncer) startMetricsProvider(ctx context.Context) {
 }
 
 func (b *Bouncer) updateMetrics(m *models.RemediationComponentsMetrics, interval time.Duration) {
-	m.Name = userAgentName // instance ID? Is name provided when creating bouncer in CrowdSec, it seems
+	m.Name = userAgentName
+	if b.instanceName != "" {
+		m.Name = b.instanceName
+	}
 	m.Version = ptr.Of(userAgentVersion)
 	m.Type = userAgentName
+	m.Os = osVersion(m.Os)
+	m.FeatureFlags = b.FeatureFlags()
 	m.UtcStartupTimestamp = ptr.Of(b.startedAt.UTC().Unix())
+	m.Metrics = append(m.Metrics, b.usageMetrics(time.Now(), interval))
+}
+
+// osVersion adds the architecture to the OS detected by the metrics
+// provider, and falls back to the OS Go was built for if it couldn't
+// be detected, so that the platform is visible in the CrowdSec console.
+func osVersion(detected *models.OSversion) *models.OSversion {
+	name, version := runtime.GOOS, ""
+	if detected != nil {
+		if n := stringValue(detected.Name); n != "" {
+			name = n
+		}
+		// the version is "???" when the OS couldn't be detected
+		if v := stringValue(detected.Version); v != "???" {
+			version = v
+		}
+	}
+
+	return &models.OSversion{
+		Name:    ptr.Of(name),
+		Version: ptr.Of(strings.TrimSpace(version + " " + runtime.GOARCH)),
+	}
+}
+
+// FeatureFlags returns the features enabled for the Bouncer, i.e.
+// "streaming" and "appsec". They're reported to the CrowdSec Local
+// API with the usage metrics.
+func (b *Bouncer) FeatureFlags() []string {
+	var flags []string
+	if b.useStreamingBouncer.Load() {
+		flags = append(flags, "streaming")
+	} else {
+		flags = append(flags, "live")
+	}
+	if b.appsec.apiURL != "" {
+		flags = append(flags, "appsec")
+		if b.appsec.async {
+			flags = append(flags, "appsec_async")
+		}
+	}
+	if b.capi != nil {
+		flags = append(flags, "capi")
+	}
+	if b.mirror != nil {
+		flags = append(flags, "blocklist_mirror")
+	}
+	if len(b.feeds) > 0 {
+		flags = append(flags, "feeds")
+	}
+	if b.denylist != nil {
+		flags = append(flags, "denylist")
+	}
+	if b.blocklists != nil {
+		flags = append(flags, "blocklists")
+	}
+	if b.alerts != nil {
+		flags = append(flags, "alerts")
+	}
+	if b.autoBan != nil {
+		flags = append(flags, "auto_ban")
+	}
+	if b.appSecJail != nil {
+		flags = append(flags, "appsec_jail")
+	}
+
+	return flags
+}
+
+// Metrics holds the values of the counters kept by the Bouncer. The LAPI and
+// AppSec counters are shared by all Bouncer instances in the process.
+type Metrics struct {
+	Decisions        int               `json:"decisions"`
+	DecisionsAdded   uint64            `json:"decisions_added"`
+	DecisionsDeleted uint64            `json:"decisions_deleted"`
+	DecisionFailures uint64            `json:"decision_failures"`
+	Remediations     map[string]uint64 `json:"remediations"`
+	LAPICalls        uint64            `json:"lapi_calls"`
+	LAPIErrors       uint64            `json:"lapi_errors"`
+	AppSecCalls      uint64            `json:"appsec_calls"`
+	AppSecErrors     uint64            `json:"appsec_errors"`
+	AppSecDropped    uint64            `json:"appsec_dropped"`
+	AppSecOverflows  uint64            `json:"appsec_overflows"`
+	// LastSync is the last time decisions were retrieved from the
+	// CrowdSec Local API successfully.
+	LastSync *time.Time `json:"last_sync,omitempty"`
+}
+
+// RecordProcessed counts a request or connection from ip being checked
+// against the decisions. It's reported to the CrowdSec Local API.
+func (b *Bouncer) RecordProcessed(ip netip.Addr) {
+	b.usage.recordProcessed(ip)
+}
+
+// RecordRemediation counts a remediation of type typ being served to ip,
+// because of a decision or AppSec verdict from origin.
+func (b *Bouncer) RecordRemediation(typ, origin string, ip netip.Addr) {
+	v, _ := b.remediations.LoadOrStore(typ, new(atomic.Uint64))
+	v.(*atomic.Uint64).Add(1)
+	totalRemediations.WithLabelValues(typ).Inc()
+	b.usage.recordDropped(origin, typ, ip)
+
+	b.events.publish(func() Event {
+		return Event{Time: time.Now(), Type: EventRemediation, IP: ip.String(), Remediation: typ, Origin: origin}
+	})
+}
+
+// Metrics returns the current values of the counters kept by the Bouncer.
+func (b *Bouncer) Metrics() Metrics {
+	m := Metrics{
+		Decisions:        b.store.len(),
+		DecisionsAdded:   b.decisionsAdded.Load(),
+		DecisionsDeleted: b.decisionsDeleted.Load(),
+		DecisionFailures: b.stream.failures.Load(),
+		Remediations:     map[string]uint64{},
+		LAPICalls:        counterValue(totalLAPICalls),
+		LAPIErrors:       counterValue(totalLAPIErrors),
+		AppSecCalls:      counterValue(totalAppSecCalls),
+		AppSecErrors:     counterValue(totalAppSecErrors),
+		AppSecDropped:    counterValue(totalAppSecDropped),
+		AppSecOverflows:  counterValue(totalAppSecOverflows),
+	}
+
+	b.remediations.Range(func(k, v any) bool {
+		m.Remediations[k.(string)] = v.(*atomic.Uint64).Load()
+		return true
+	})
+
+	b.lapiHealth.mu.RLock()
+	if t := b.lapiHealth.lastSuccess; !t.IsZero() {
+		m.LastSync = &t
+	}
+	b.lapiHealth.mu.RUnlock()
+
+	return m
+}
+
+func counterValue(c prometheus.Counter) uint64 {
+	var m dto.Metric
+	if err := c.Write(&m); err != nil {
+		return 0
+	}
 
-	// TODO: add metrics
+	return uint64(m.GetCounter().GetValue())
 }
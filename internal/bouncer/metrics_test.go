@@ -0,0 +1,64 @@
+package bouncer
+
+import (
+	"net/netip"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/crowdsecurity/crowdsec/pkg/models"
+	"github.com/crowdsecurity/go-cs-lib/ptr"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegisterMetrics(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	require.NoError(t, RegisterMetrics(reg))
+	require.NoError(t, RegisterMetrics(reg))
+
+	b, err := newBouncer(t)
+	require.NoError(t, err)
+
+	remediations := testutil.ToFloat64(totalRemediations.WithLabelValues("ban"))
+	b.RecordRemediation("ban", "crowdsec", netip.MustParseAddr("192.0.2.1"))
+	assert.Equal(t, remediations+1, testutil.ToFloat64(totalRemediations.WithLabelValues("ban")))
+
+	_, _, err = b.IsAllowed(netip.MustParseAddr("192.0.2.1"))
+	require.NoError(t, err)
+
+	families, err := reg.Gather()
+	require.NoError(t, err)
+
+	var names []string
+	for _, f := range families {
+		names = append(names, f.GetName())
+	}
+	assert.Contains(t, names, "caddy_crowdsec_remediations_total")
+	assert.Contains(t, names, "caddy_crowdsec_lookup_duration_seconds")
+	assert.Contains(t, names, "lapi_appsec_requests_total")
+}
+
+func TestBouncer_updateMetrics(t *testing.T) {
+	b, err := newBouncer(t)
+	require.NoError(t, err)
+	require.NoError(t, b.SetDenylist([]netip.Prefix{netip.MustParsePrefix("192.0.2.0/24")}, "ban"))
+
+	m := &models.RemediationComponentsMetrics{
+		BaseMetrics: models.BaseMetrics{
+			Os: &models.OSversion{Name: ptr.Of("Ubuntu"), Version: ptr.Of("24.04")},
+		},
+	}
+	b.updateMetrics(m, time.Minute)
+
+	assert.Equal(t, userAgentName, m.Type)
+	assert.Equal(t, userAgentVersion, *m.Version)
+	assert.Equal(t, []string{"streaming", "denylist"}, m.FeatureFlags)
+	assert.Equal(t, "Ubuntu", *m.Os.Name)
+	assert.Equal(t, "24.04 "+runtime.GOARCH, *m.Os.Version)
+
+	os := osVersion(&models.OSversion{Name: ptr.Of("linux"), Version: ptr.Of("???")})
+	assert.Equal(t, runtime.GOARCH, *os.Version)
+}
@@ -0,0 +1,253 @@
+// Copyright 2024 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bouncer
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/crowdsecurity/crowdsec/pkg/models"
+	"go.uber.org/zap"
+)
+
+const mirrorOrigin = "blocklist-mirror"
+
+// mirror is a CrowdSec blocklist-mirror endpoint decisions are pulled from.
+type mirror struct {
+	url    string
+	name   string
+	kind   string
+	origin string
+	apiKey string
+	typ    string
+	client *http.Client
+
+	mu       sync.Mutex
+	previous map[netip.Prefix]*models.Decision
+}
+
+// SetMirror makes the Bouncer retrieve decisions from a CrowdSec
+// blocklist-mirror endpoint, instead of from a CrowdSec Local API, so
+// that many instances can share decisions without each of them having
+// Local API credentials. The endpoint is expected to serve either a
+// plain text list with an IP or CIDR per line, or a JSON array of
+// decisions. Entries on a plain text list are enforced with a decision
+// of type typ. The apiKey is optional; basic authentication can be
+// configured using the userinfo of mirrorURL. Only streaming mode is
+// supported, and the endpoint is pulled every ticker interval.
+func (b *Bouncer) SetMirror(mirrorURL, apiKey, typ string) error {
+	m, err := newMirror("blocklist mirror", mirrorOrigin, mirrorURL, apiKey, typ)
+	if err != nil {
+		return err
+	}
+
+	b.mirror = m
+
+	return nil
+}
+
+// newMirror returns a mirror for the endpoint at rawURL. The kind is
+// used in errors and logs; decisions parsed from a plain text list
+// get origin.
+func newMirror(kind, origin, rawURL, apiKey, typ string) (*mirror, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s URL: %w", kind, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("%s URL %q must have an http or https scheme", kind, u.Redacted())
+	}
+
+	return &mirror{
+		url:    rawURL,
+		name:   u.Host + u.Path, // userinfo and query are left out, as they often contain a secret
+		kind:   kind,
+		origin: origin,
+		apiKey: apiKey,
+		typ:    typ,
+		client: &http.Client{Timeout: defaultBlocklistTimeout},
+	}, nil
+}
+
+// IsMirror returns whether decisions are retrieved from a CrowdSec
+// blocklist-mirror endpoint.
+func (b *Bouncer) IsMirror() bool {
+	return b.mirror != nil
+}
+
+// initMirror prepares the StreamBouncer for receiving decisions pulled
+// from the blocklist mirror. It takes the place of StreamBouncer.Init,
+// which requires a Local API.
+func (b *Bouncer) initMirror() error {
+	interval, err := time.ParseDuration(b.streamingBouncer.TickerInterval)
+	if err != nil {
+		return fmt.Errorf("invalid ticker interval %q: %w", b.streamingBouncer.TickerInterval, err)
+	}
+
+	b.streamingBouncer.TickerIntervalDuration = interval
+	b.streamingBouncer.Stream = make(chan *models.DecisionsStreamResponse)
+
+	return nil
+}
+
+// runMirror pulls decisions from the blocklist mirror every ticker
+// interval, and sends the differences with the previous pull to the
+// stream, like the StreamBouncer does for the Local API.
+func (b *Bouncer) runMirror(ctx context.Context) {
+	ticker := time.NewTicker(b.streamingBouncer.TickerIntervalDuration)
+	defer ticker.Stop()
+
+	for {
+		decisions, err := b.fetchMirror(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			b.recordLAPIError(err)
+			b.logger.Warn("failed retrieving decisions from blocklist mirror", b.zapField(),
+				zap.String("mirror", b.mirror.name), zap.Error(err))
+		} else {
+			select {
+			case b.streamingBouncer.Stream <- b.mirror.diff(decisions):
+			case <-ctx.Done():
+				return
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// diff returns the decisions that are new or deleted compared to the
+// previous pull, and records decisions as the previous pull.
+func (m *mirror) diff(decisions []*models.Decision) *models.DecisionsStreamResponse {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	current := mirrorIndex(decisions)
+	resp := &models.DecisionsStreamResponse{
+		New:     models.GetDecisionsResponse{},
+		Deleted: models.GetDecisionsResponse{},
+	}
+	for prf, d := range current {
+		if p, ok := m.previous[prf]; !ok || stringValue(p.Type) != stringValue(d.Type) {
+			resp.New = append(resp.New, d)
+		}
+	}
+	for prf, p := range m.previous {
+		if _, ok := current[prf]; !ok {
+			resp.Deleted = append(resp.Deleted, p)
+		}
+	}
+
+	m.previous = current
+
+	return resp
+}
+
+// reset records decisions as the previous pull, after they were
+// stored by a refresh.
+func (m *mirror) reset(decisions []*models.Decision) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.previous = mirrorIndex(decisions)
+}
+
+func mirrorIndex(decisions []*models.Decision) map[netip.Prefix]*models.Decision {
+	index := make(map[netip.Prefix]*models.Decision, len(decisions))
+	for _, d := range decisions {
+		if isInvalid(d) {
+			continue
+		}
+		prf, err := decisionPrefix(d)
+		if err != nil {
+			continue
+		}
+		index[prf] = d
+	}
+
+	return index
+}
+
+// fetchMirror retrieves all decisions from the blocklist mirror.
+func (b *Bouncer) fetchMirror(ctx context.Context) ([]*models.Decision, error) {
+	return b.fetchDecisions(ctx, b.mirror)
+}
+
+// fetchDecisions retrieves all decisions from the endpoint m.
+func (b *Bouncer) fetchDecisions(ctx context.Context, m *mirror) ([]*models.Decision, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, m.url, http.NoBody)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", b.userAgent)
+	if m.apiKey != "" {
+		req.Header.Set("X-Api-Key", m.apiKey)
+	}
+
+	resp, err := m.client.Do(req)
+	if err != nil {
+		// the URL isn't logged, as it may contain a secret
+		var uerr *url.Error
+		if errors.As(err, &uerr) {
+			return nil, uerr.Err
+		}
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, fmt.Errorf("%s returned status %d", m.kind, resp.StatusCode)
+	}
+
+	body := io.LimitReader(resp.Body, maxBlocklistSize+1)
+	if mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); mediaType == "application/json" {
+		var decisions []*models.Decision
+		if err := json.NewDecoder(body).Decode(&decisions); err != nil {
+			return nil, fmt.Errorf("failed decoding decisions: %w", err)
+		}
+
+		return decisions, nil
+	}
+
+	prefixes, invalid, err := parseBlocklist(body)
+	if err != nil {
+		return nil, err
+	}
+	if invalid > 0 {
+		b.logger.Debug("skipped invalid "+m.kind+" entries", b.zapField(), zap.String("url", m.name), zap.Int("invalid", invalid))
+	}
+
+	decisions := make([]*models.Decision, 0, len(prefixes))
+	for _, p := range prefixes {
+		decisions = append(decisions, newPrefixDecision(p, m.typ, m.origin, m.name, ""))
+	}
+
+	return decisions, nil
+}
@@ -0,0 +1,205 @@
+// Copyright 2024 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bouncer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+
+	"github.com/crowdsecurity/crowdsec/pkg/apiclient"
+	"github.com/crowdsecurity/crowdsec/pkg/models"
+	"go.uber.org/zap"
+)
+
+// ErrNotStreaming is returned for operations that require the
+// Bouncer to use the StreamBouncer.
+var ErrNotStreaming = errors.New("bouncer is not streaming decisions")
+
+type refreshRequest struct {
+	ctx    context.Context
+	verify bool
+	result chan refreshResult
+}
+
+type refreshResult struct {
+	decisions    int
+	verification *Verification
+	err          error
+}
+
+// Verification holds the differences between the decisions in the store
+// and the active decisions known to the CrowdSec Local API.
+type Verification struct {
+	// Decisions is the number of active decisions in the Local API.
+	Decisions int `json:"decisions"`
+	// Missing are the decisions that were not in the store.
+	Missing []DecisionDetails `json:"missing"`
+	// Extra are the decisions that were in the store, but are not
+	// active in the Local API.
+	Extra []DecisionDetails `json:"extra"`
+}
+
+// Refresh retrieves all active decisions from the CrowdSec Local API,
+// like when the Bouncer starts, and replaces the decisions in the store
+// with them. It returns the number of decisions stored afterwards. The
+// refresh is performed by the goroutine processing decisions, so that it
+// doesn't interleave with updates from the stream.
+func (b *Bouncer) Refresh(ctx context.Context) (int, error) {
+	r, err := b.requestRefresh(ctx, false)
+	if err != nil {
+		return 0, err
+	}
+
+	return r.decisions, nil
+}
+
+// Verify retrieves all active decisions from the CrowdSec Local API, and
+// compares them to the decisions in the store. Retrieving all decisions
+// resets the point from which the Local API streams changes, so the store
+// is refreshed with the retrieved decisions afterwards, like with Refresh.
+func (b *Bouncer) Verify(ctx context.Context) (*Verification, error) {
+	r, err := b.requestRefresh(ctx, true)
+	if err != nil {
+		return nil, err
+	}
+
+	return r.verification, nil
+}
+
+func (b *Bouncer) requestRefresh(ctx context.Context, verify bool) (refreshResult, error) {
+	if !b.useStreamingBouncer.Load() {
+		return refreshResult{}, ErrNotStreaming
+	}
+
+	b.startMu.Lock()
+	running := b.started && !b.stopped
+	b.startMu.Unlock()
+	if !running {
+		return refreshResult{}, errors.New("bouncer is not running")
+	}
+
+	req := refreshRequest{ctx: ctx, verify: verify, result: make(chan refreshResult, 1)}
+	select {
+	case b.refreshes <- req:
+	case <-ctx.Done():
+		return refreshResult{}, ctx.Err()
+	}
+
+	select {
+	case r := <-req.result:
+		return r, r.err
+	case <-ctx.Done():
+		return refreshResult{}, ctx.Err()
+	}
+}
+
+func (b *Bouncer) resync(ctx context.Context, verify bool) refreshResult {
+	decisions, err := b.retrieveAllDecisions(ctx)
+	if err != nil {
+		err = classifyError(err)
+		b.recordLAPIError(err)
+		return refreshResult{err: fmt.Errorf("failed retrieving decisions: %w", err)}
+	}
+
+	b.recordLAPISuccess()
+
+	s := newStore()
+	for _, decision := range decisions {
+		if err := s.add(decision); err != nil {
+			b.recordDecisionFailure("add")
+			b.logger.Error("unable to insert decision", b.decisionFields(decision, zap.Error(err))...)
+		}
+	}
+
+	var verification *Verification
+	if verify {
+		verification = compareStores(b.store, s)
+		b.logger.Info("verified decisions", b.zapField(),
+			zap.Int("decisions", verification.Decisions),
+			zap.Int("missing", len(verification.Missing)),
+			zap.Int("extra", len(verification.Extra)),
+		)
+	}
+
+	b.store.replace(s)
+	b.generation.Add(1)
+	b.updateActiveDecisions()
+
+	n := s.len()
+	b.logger.Info("refreshed decisions", b.zapField(), zap.Int("decisions", n))
+
+	return refreshResult{decisions: n, verification: verification}
+}
+
+// retrieveAllDecisions retrieves all active decisions from the source
+// of decisions.
+func (b *Bouncer) retrieveAllDecisions(ctx context.Context) ([]*models.Decision, error) {
+	if b.mirror != nil {
+		decisions, err := b.fetchMirror(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		// the next pull is compared to the refreshed decisions
+		b.mirror.reset(decisions)
+
+		return decisions, nil
+	}
+
+	opts := apiclient.DecisionsStreamOpts{
+		Startup:                true,
+		Scopes:                 b.streamingBouncer.Opts.Scopes,
+		ScenariosContaining:    b.streamingBouncer.Opts.ScenariosContaining,
+		ScenariosNotContaining: b.streamingBouncer.Opts.ScenariosNotContaining,
+		Origins:                b.streamingBouncer.Opts.Origins,
+	}
+
+	decisions, _, err := b.streamingBouncer.APIClient.Decisions.GetStream(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return decisions.New, nil
+}
+
+// compareStores returns the decisions in expected that are missing in
+// actual, and the decisions in actual that are not in expected. Decisions
+// are considered the same if they apply to the same prefix, and have the
+// same type.
+func compareStores(actual, expected *store) *Verification {
+	v := &Verification{
+		Decisions: expected.len(),
+		Missing:   []DecisionDetails{},
+		Extra:     []DecisionDetails{},
+	}
+
+	expected.each(func(prf netip.Prefix, e entry) bool {
+		if !actual.has(prf, stringValue(e.decision.Type)) {
+			v.Missing = append(v.Missing, newDecisionDetails(e))
+		}
+		return true
+	})
+
+	actual.each(func(prf netip.Prefix, e entry) bool {
+		if !expected.has(prf, stringValue(e.decision.Type)) {
+			v.Extra = append(v.Extra, newDecisionDetails(e))
+		}
+		return true
+	})
+
+	return v
+}
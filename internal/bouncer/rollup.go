@@ -0,0 +1,80 @@
+// Copyright 2024 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bouncer
+
+import (
+	"cmp"
+	"net/netip"
+	"slices"
+)
+
+// rollup returns the smallest set of prefixes covering exactly the
+// same addresses as prefixes. Prefixes contained by other prefixes are
+// dropped, and adjacent prefixes that together form a larger prefix,
+// like 192.0.2.0/25 and 192.0.2.128/25, are merged into it.
+func rollup(prefixes []netip.Prefix) []netip.Prefix {
+	sorted := make([]netip.Prefix, 0, len(prefixes))
+	for _, p := range prefixes {
+		if p.IsValid() {
+			sorted = append(sorted, p.Masked())
+		}
+	}
+
+	slices.SortFunc(sorted, func(a, b netip.Prefix) int {
+		if c := a.Addr().Compare(b.Addr()); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.Bits(), b.Bits())
+	})
+
+	// as prefixes are ordered by address, and shorter prefixes come
+	// first, a prefix is either contained by the last prefix kept, or
+	// by none of the prefixes kept. Siblings end up next to each other,
+	// and merging them can make their parent a sibling of the prefix
+	// before them.
+	result := make([]netip.Prefix, 0, len(sorted))
+	for _, p := range sorted {
+		if n := len(result); n > 0 && result[n-1].Overlaps(p) {
+			continue
+		}
+
+		result = append(result, p)
+		for n := len(result); n >= 2; n = len(result) {
+			parent, ok := siblingsParent(result[n-2], result[n-1])
+			if !ok {
+				break
+			}
+			result = append(result[:n-2], parent)
+		}
+	}
+
+	return result
+}
+
+// siblingsParent returns the prefix that a and b are the two halves of,
+// and whether a and b are siblings.
+func siblingsParent(a, b netip.Prefix) (netip.Prefix, bool) {
+	if a.Bits() != b.Bits() || a.Bits() == 0 || a.Addr().Is4() != b.Addr().Is4() || a == b {
+		return netip.Prefix{}, false
+	}
+
+	pa, _ := a.Addr().Prefix(a.Bits() - 1)
+	pb, _ := b.Addr().Prefix(b.Bits() - 1)
+	if pa != pb {
+		return netip.Prefix{}, false
+	}
+
+	return pa, true
+}
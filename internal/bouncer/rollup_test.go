@@ -0,0 +1,41 @@
+package bouncer
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_rollup(t *testing.T) {
+	prefixes := func(values ...string) []netip.Prefix {
+		r := make([]netip.Prefix, 0, len(values))
+		for _, v := range values {
+			r = append(r, netip.MustParsePrefix(v))
+		}
+		return r
+	}
+
+	tests := []struct {
+		name string
+		in   []netip.Prefix
+		want []netip.Prefix
+	}{
+		{"empty", nil, prefixes()},
+		{"single", prefixes("192.0.2.1/32"), prefixes("192.0.2.1/32")},
+		{"siblings", prefixes("192.0.2.128/25", "192.0.2.0/25"), prefixes("192.0.2.0/24")},
+		{"not-siblings", prefixes("192.0.2.128/25", "192.0.3.0/25"), prefixes("192.0.2.128/25", "192.0.3.0/25")},
+		{"cascade", prefixes("10.0.0.0/24", "10.0.1.0/24", "10.0.2.0/24", "10.0.3.0/24"), prefixes("10.0.0.0/22")},
+		{"cascade-uneven", prefixes("10.0.2.0/23", "10.0.0.0/24", "10.0.1.0/24", "10.0.4.0/24"), prefixes("10.0.0.0/22", "10.0.4.0/24")},
+		{"contained", prefixes("10.0.0.0/8", "10.1.2.3/32", "10.0.0.0/16"), prefixes("10.0.0.0/8")},
+		{"duplicates", prefixes("192.0.2.1/32", "192.0.2.1/32"), prefixes("192.0.2.1/32")},
+		{"unmasked", prefixes("192.0.2.1/24", "192.0.3.1/24"), prefixes("192.0.2.0/23")},
+		{"ipv6", prefixes("2001:db8::/33", "2001:db8:8000::/33", "::1/128"), prefixes("::1/128", "2001:db8::/32")},
+		{"families", prefixes("0.0.0.0/1", "128.0.0.0/1", "::/1", "8000::/1"), prefixes("0.0.0.0/0", "::/0")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, rollup(tt.in))
+		})
+	}
+}
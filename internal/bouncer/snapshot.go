@@ -0,0 +1,89 @@
+// Copyright 2024 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bouncer
+
+import (
+	"context"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	snapshotOrigin = "snapshot"
+
+	// snapshotTimeout is the maximum time spent loading the snapshot,
+	// during which the initial pull isn't processed yet.
+	snapshotTimeout = 10 * time.Second
+)
+
+// SetSnapshot makes the Bouncer load decisions from a snapshot when
+// streaming starts, so that decisions are enforced before the initial
+// pull from the CrowdSec Local API or blocklist mirror has completed.
+// The snapshot is expected to be in one of the formats served by a
+// blocklist-mirror endpoint, such as the decisions exported by another
+// instance. Entries on a plain text list are enforced with a decision
+// of type typ. The decisions from the snapshot are replaced by the
+// decisions from the initial pull once it has been processed.
+func (b *Bouncer) SetSnapshot(snapshotURL, apiKey, typ string) error {
+	m, err := newMirror("snapshot", snapshotOrigin, snapshotURL, apiKey, typ)
+	if err != nil {
+		return err
+	}
+
+	b.snapshot = m
+
+	return nil
+}
+
+// primeFromSnapshot loads the decisions from the snapshot into the
+// store, if a snapshot is configured and the store is still empty.
+// Failing to load the snapshot isn't fatal, as the decisions will be
+// available after the initial pull.
+func (b *Bouncer) primeFromSnapshot(ctx context.Context) {
+	if b.snapshot == nil || b.store.len() > 0 {
+		return
+	}
+
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(ctx, snapshotTimeout)
+	defer cancel()
+
+	decisions, err := b.fetchDecisions(ctx, b.snapshot)
+	if err != nil {
+		b.logger.Warn("failed loading decisions from snapshot", b.zapField(),
+			zap.String("snapshot", b.snapshot.name), zap.Error(err))
+		return
+	}
+
+	s := newStore()
+	for _, decision := range decisions {
+		if err := s.add(decision); err != nil {
+			b.recordDecisionFailure("add")
+			b.logger.Debug("unable to insert decision from snapshot", b.decisionFields(decision, zap.Error(err))...)
+		}
+	}
+
+	b.store.replace(s)
+	b.primed.Store(true)
+	b.generation.Add(1)
+	b.updateActiveDecisions()
+
+	b.logger.Info("loaded decisions from snapshot", b.zapField(),
+		zap.String("snapshot", b.snapshot.name),
+		zap.Int("decisions", s.len()),
+		zap.Duration("duration", time.Since(start)),
+	)
+}
@@ -0,0 +1,78 @@
+package bouncer
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+
+	"github.com/crowdsecurity/crowdsec/pkg/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBouncer_SetSnapshot(t *testing.T) {
+	b, err := newBouncer(t)
+	require.NoError(t, err)
+
+	assert.EqualError(t, b.SetSnapshot("ftp://leader.example.com/crowdsec/decisions", "", "ban"),
+		`snapshot URL "ftp://leader.example.com/crowdsec/decisions" must have an http or https scheme`)
+	assert.Nil(t, b.snapshot)
+
+	require.NoError(t, b.SetSnapshot("https://leader.example.com/crowdsec/decisions?token=secret", "", "ban"))
+	assert.Equal(t, "leader.example.com/crowdsec/decisions", b.snapshot.name)
+	assert.Equal(t, snapshotOrigin, b.snapshot.origin)
+}
+
+func TestBouncer_primeFromSnapshot(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Api-Key") != "secret" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		_, _ = w.Write([]byte("10.0.0.1\n10.1.0.0/16\n"))
+	}))
+	defer srv.Close()
+
+	b, err := newBouncer(t)
+	require.NoError(t, err)
+
+	ctx := context.Background()
+
+	// failing to load the snapshot leaves the store empty
+	require.NoError(t, b.SetSnapshot(srv.URL, "wrong", "ban"))
+	b.primeFromSnapshot(ctx)
+	assert.Equal(t, 0, b.store.len())
+	assert.False(t, b.primed.Load())
+
+	require.NoError(t, b.SetSnapshot(srv.URL, "secret", "ban"))
+	b.primeFromSnapshot(ctx)
+	require.Equal(t, 2, b.store.len())
+	assert.True(t, b.primed.Load())
+
+	d, err := b.retrieveDecision(context.Background(), netip.MustParseAddr("10.1.2.3"))
+	require.NoError(t, err)
+	require.NotNil(t, d)
+	assert.Equal(t, snapshotOrigin, *d.Origin)
+
+	// the initial pull replaces the decisions from the snapshot
+	duration, origin, scenario, scope, typ, value := "1h", "crowdsec", "test", "Ip", "ban", "10.0.0.2"
+	b.processStreamDecisions(ctx, &models.DecisionsStreamResponse{
+		New: []*models.Decision{{Duration: &duration, Origin: &origin, Scenario: &scenario, Scope: &scope, Type: &typ, Value: &value}},
+	})
+	require.Equal(t, 1, b.store.len())
+	assert.False(t, b.primed.Load())
+
+	d, err = b.retrieveDecision(context.Background(), netip.MustParseAddr("10.1.2.3"))
+	require.NoError(t, err)
+	assert.Nil(t, d)
+	d, err = b.retrieveDecision(context.Background(), netip.MustParseAddr("10.0.0.2"))
+	require.NoError(t, err)
+	require.NotNil(t, d)
+
+	// a store that isn't empty isn't primed again
+	b.primeFromSnapshot(ctx)
+	assert.Equal(t, 1, b.store.len())
+	assert.False(t, b.primed.Load())
+}
@@ -0,0 +1,156 @@
+// Copyright 2024 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bouncer
+
+import (
+	"net/netip"
+	"runtime/metrics"
+	"time"
+	"unsafe"
+
+	"github.com/crowdsecurity/crowdsec/pkg/models"
+)
+
+// Stats holds statistics about the decisions in the store.
+type Stats struct {
+	Decisions   int            `json:"decisions"`
+	Scopes      map[string]int `json:"scopes"`
+	Types       map[string]int `json:"types"`
+	Origins     map[string]int `json:"origins"`
+	IPVersions  map[string]int `json:"ip_versions"`
+	MemoryBytes int            `json:"memory_bytes"`
+	LastUpdate  *time.Time     `json:"last_update,omitempty"`
+}
+
+// entryOverhead is a rough estimate of the number of bytes used per
+// decision by the index and the routing table, excluding the decision.
+const entryOverhead = 128
+
+// Stats returns statistics about the decisions in the store. The memory
+// usage is a rough estimate, based on the size of the decisions.
+func (b *Bouncer) Stats() Stats {
+	stats := Stats{
+		Scopes:     map[string]int{},
+		Types:      map[string]int{},
+		Origins:    map[string]int{},
+		IPVersions: map[string]int{},
+	}
+
+	b.store.each(func(prf netip.Prefix, e entry) bool {
+		d := e.decision
+		stats.Decisions++
+		stats.Scopes[stringValue(d.Scope)]++
+		stats.Types[stringValue(d.Type)]++
+		stats.Origins[stringValue(d.Origin)]++
+		if prf.Addr().Is4() {
+			stats.IPVersions["ipv4"]++
+		} else {
+			stats.IPVersions["ipv6"]++
+		}
+		return true
+	})
+	stats.MemoryBytes = b.store.memory()
+
+	if t := b.store.lastUpdate(); !t.IsZero() {
+		stats.LastUpdate = &t
+	}
+
+	return stats
+}
+
+// Memory describes the memory used by the decisions known to the
+// Bouncer, for sizing instances that enforce large blocklists.
+type Memory struct {
+	// Stores is the estimated number of bytes used per store: the
+	// decisions from the CrowdSec Local API (lapi), local decisions,
+	// the denylist, blocklists and feeds.
+	Stores map[string]int `json:"stores"`
+	// EstimatedBytes is the sum of the estimates for all stores.
+	EstimatedBytes int `json:"estimated_bytes"`
+	// HeapBytes is the number of bytes used by live objects on the
+	// heap of the whole process, as sampled from the Go runtime.
+	HeapBytes uint64 `json:"heap_bytes"`
+}
+
+// heapObjectsMetric is the Go runtime metric for the bytes used
+// by live objects on the heap. Contrary to runtime.ReadMemStats,
+// it can be read without stopping the world.
+const heapObjectsMetric = "/memory/classes/heap/objects:bytes"
+
+// Memory returns the memory used by the decisions known to the Bouncer.
+// The usage per store is a rough estimate, based on the size of the
+// decisions; the heap usage is sampled from the Go runtime.
+func (b *Bouncer) Memory() Memory {
+	m := Memory{Stores: b.storeMemory()}
+	for _, n := range m.Stores {
+		m.EstimatedBytes += n
+	}
+
+	sample := []metrics.Sample{{Name: heapObjectsMetric}}
+	metrics.Read(sample)
+	if sample[0].Value.Kind() == metrics.KindUint64 {
+		m.HeapBytes = sample[0].Value.Uint64()
+	}
+
+	return m
+}
+
+// storeMemory returns the estimated number of bytes used per store.
+func (b *Bouncer) storeMemory() map[string]int {
+	stores := map[string]int{
+		"lapi":  b.store.memory(),
+		"local": b.local.memory(),
+	}
+	if b.denylist != nil {
+		stores["denylist"] = b.denylist.memory()
+	}
+	if b.blocklists != nil {
+		stores["blocklists"] = b.blocklists.store.memory()
+	}
+	if len(b.feeds) > 0 {
+		n := 0
+		for _, f := range b.feeds {
+			n += f.store.memory()
+		}
+		stores["feeds"] = n
+	}
+
+	return stores
+}
+
+// entrySize returns an estimate of the number of bytes used by a
+// decision in the store.
+func entrySize(d *models.Decision) int {
+	return decisionSize(d) + entryOverhead
+}
+
+func decisionSize(d *models.Decision) int {
+	size := int(unsafe.Sizeof(*d)) + len(d.Until) + len(d.UUID)
+	for _, s := range []*string{d.Duration, d.Origin, d.Scenario, d.Scope, d.Type, d.Value} {
+		if s != nil {
+			size += int(unsafe.Sizeof(*s)) + len(*s)
+		}
+	}
+
+	return size
+}
+
+func stringValue(s *string) string {
+	if s == nil {
+		return ""
+	}
+
+	return *s
+}
@@ -15,47 +15,251 @@
 package bouncer
 
 import (
+	"cmp"
 	"fmt"
 	"net/netip"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/crowdsecurity/crowdsec/pkg/models"
 	"github.com/hslatman/ipstore"
 )
 
+// numShards is the number of shards the decisions in a store are
+// distributed over, so that lookups and updates for IPs in different
+// parts of the address space don't contend for the same lock.
+const numShards = 16
+
+// The shard of a prefix is determined by its first byte for IPv4, and by
+// its first two bytes for IPv6. Prefixes shorter than that span multiple
+// shards, and are kept in a separate shard that is consulted for every
+// lookup.
+const (
+	shardBitsIPv4 = 8
+	shardBitsIPv6 = 16
+)
+
 type store struct {
+	shards    [numShards]shard
+	wide      shard
+	updatedAt atomic.Int64 // unix nanoseconds; 0 if never updated
+	bytes     atomic.Int64 // estimated size of the entries
+	count     atomic.Int64 // number of entries, so len doesn't lock the shards
+
+	// filter allows lookups for IPs without decisions to skip the
+	// shards. Adding decisions holds filterMu for reading, so that
+	// rebuilding the filter doesn't miss them.
+	filterMu sync.RWMutex
+	filter   atomic.Pointer[prefixFilter]
+	stale    atomic.Bool // set when decisions are removed
+}
+
+type shard struct {
+	mu    sync.RWMutex
 	store *ipstore.Store[*models.Decision]
+	index map[netip.Prefix]entry
+}
+
+// entry is a decision in the store, with the time it was added.
+type entry struct {
+	decision *models.Decision
+	addedAt  time.Time
 }
 
 func newStore() *store {
-	return &store{
-		store: ipstore.New[*models.Decision](),
+	s := &store{}
+	for _, sh := range s.all() {
+		sh.store = ipstore.New[*models.Decision]()
+		sh.index = map[netip.Prefix]entry{}
 	}
+	s.filter.Store(newPrefixFilter(0))
+
+	return s
 }
 
-func (s *store) add(decision *models.Decision) error {
-	if isInvalid(decision) {
-		return nil
+// all returns all shards of the store, with the wide shard last.
+func (s *store) all() []*shard {
+	shards := make([]*shard, 0, numShards+1)
+	for i := range s.shards {
+		shards = append(shards, &s.shards[i])
 	}
 
-	scope := *decision.Scope
-	value := *decision.Value
+	return append(shards, &s.wide)
+}
 
-	switch scope {
-	case "Ip":
-		ip, err := parseIP(value)
-		if err != nil {
-			return err
+// shardFor returns the shard holding prefix prf.
+func (s *store) shardFor(prf netip.Prefix) *shard {
+	addr := prf.Addr()
+	if addr.Is4() {
+		if prf.Bits() < shardBitsIPv4 {
+			return &s.wide
 		}
-		return s.store.Add(ip, decision)
-	case "Range":
-		prf, err := netip.ParsePrefix(value)
-		if err != nil {
-			return err
+		return &s.shards[int(addr.As4()[0])%numShards]
+	}
+
+	if prf.Bits() < shardBitsIPv6 {
+		return &s.wide
+	}
+	b := addr.As16()
+
+	return &s.shards[(int(b[0])<<8|int(b[1]))%numShards]
+}
+
+// lookupShards returns the shards that can hold prefixes containing
+// key, ordered from the most to the least specific prefixes they hold.
+func (s *store) lookupShards(key netip.Addr) [2]*shard {
+	return [2]*shard{s.shardFor(netip.PrefixFrom(key, key.BitLen())), &s.wide}
+}
+
+func (s *store) touch() {
+	s.updatedAt.Store(time.Now().UnixNano())
+}
+
+// replace replaces the decisions in s with the decisions in other.
+// All shards are swapped at once, so that lookups don't observe a
+// mix of old and new decisions.
+func (s *store) replace(other *store) {
+	s.filterMu.Lock()
+	defer s.filterMu.Unlock()
+
+	theirs, ours := other.all(), s.all()
+	for _, sh := range theirs {
+		sh.mu.RLock()
+		defer sh.mu.RUnlock()
+	}
+	for _, sh := range ours {
+		sh.mu.Lock()
+		defer sh.mu.Unlock()
+	}
+
+	for i, sh := range ours {
+		sh.store = theirs[i].store
+		sh.index = theirs[i].index
+	}
+	s.filter.Store(buildFilter(ours))
+	s.stale.Store(false)
+	s.bytes.Store(other.bytes.Load())
+	s.count.Store(other.count.Load())
+	s.touch()
+}
+
+// refreshFilter rebuilds the filter when decisions were removed since
+// it was built, or when it holds more prefixes than it was sized for.
+// It's called after applying a batch of decisions, instead of for every
+// removed decision.
+func (s *store) refreshFilter() {
+	if !s.stale.Load() && !s.filter.Load().full() {
+		return
+	}
+
+	s.filterMu.Lock()
+	defer s.filterMu.Unlock()
+
+	shards := s.all()
+	for _, sh := range shards {
+		sh.mu.RLock()
+		defer sh.mu.RUnlock()
+	}
+
+	s.stale.Store(false)
+	s.filter.Store(buildFilter(shards))
+}
+
+// buildFilter returns a filter with the prefixes in shards. The
+// shards must be locked by the caller.
+func buildFilter(shards []*shard) *prefixFilter {
+	n := 0
+	for _, sh := range shards {
+		n += len(sh.index)
+	}
+
+	f := newPrefixFilter(n)
+	for _, sh := range shards {
+		for prf := range sh.index {
+			f.add(prf)
 		}
-		return s.store.AddCIDR(prf, decision)
-	default:
-		return fmt.Errorf("got unhandled scope: %s", scope)
 	}
+
+	return f
+}
+
+// len returns the number of entries in the store.
+func (s *store) len() int {
+	return int(s.count.Load())
+}
+
+// each calls fn for every entry in the store, for as long as
+// fn returns true. The store can't be modified from fn. Shards
+// are visited one at a time, so fn may observe updates made to
+// shards that weren't visited yet.
+func (s *store) each(fn func(netip.Prefix, entry) bool) {
+	for _, sh := range s.all() {
+		if !sh.each(fn) {
+			return
+		}
+	}
+}
+
+func (sh *shard) each(fn func(netip.Prefix, entry) bool) bool {
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+
+	for prf, e := range sh.index {
+		if !fn(prf, e) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// has returns whether the store holds a decision of type typ
+// for prefix prf.
+func (s *store) has(prf netip.Prefix, typ string) bool {
+	sh := s.shardFor(prf)
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+
+	e, ok := sh.index[prf]
+
+	return ok && stringValue(e.decision.Type) == typ
+}
+
+// memory returns an estimate of the number of bytes used by the
+// decisions in the store, including the filter.
+func (s *store) memory() int {
+	return int(s.bytes.Load()) + 8*len(s.filter.Load().bits)
+}
+
+func (s *store) lastUpdate() time.Time {
+	n := s.updatedAt.Load()
+	if n == 0 {
+		return time.Time{}
+	}
+
+	return time.Unix(0, n)
+}
+
+func (s *store) add(decision *models.Decision) error {
+	if isInvalid(decision) {
+		return nil
+	}
+
+	prf, err := decisionPrefix(decision)
+	if err != nil {
+		return err
+	}
+
+	s.filterMu.RLock()
+	defer s.filterMu.RUnlock()
+
+	sh := s.shardFor(prf)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	return s.addLocked(sh, prf, decision)
 }
 
 func (s *store) delete(decision *models.Decision) error {
@@ -63,47 +267,268 @@ func (s *store) delete(decision *models.Decision) error {
 		return nil
 	}
 
-	scope := *decision.Scope
-	value := *decision.Value
+	prf, err := decisionPrefix(decision)
+	if err != nil {
+		return err
+	}
 
-	switch scope {
-	case "Ip":
-		ip, err := parseIP(value)
-		if err != nil {
-			return err
+	sh := s.shardFor(prf)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	return s.deleteLocked(sh, prf)
+}
+
+// apply deletes the decisions in deleted, and then adds the decisions
+// in added. All shards affected by the batch are locked while it's
+// applied, so that lookups never observe a partially applied batch,
+// like an IP being unbanned between the deletion of its decision and
+// adding it again with a new duration. It returns the errors for the
+// deleted and added decisions, at the same indices.
+func (s *store) apply(deleted, added []*models.Decision) ([]error, []error) {
+	type op struct {
+		prefix netip.Prefix
+		shard  *shard
+		skip   bool
+	}
+
+	var affected [numShards + 1]bool
+	shards := s.all()
+	prepare := func(decisions []*models.Decision) ([]op, []error) {
+		ops, errs := make([]op, len(decisions)), make([]error, len(decisions))
+		for i, d := range decisions {
+			if isInvalid(d) {
+				ops[i].skip = true
+				continue
+			}
+			prf, err := decisionPrefix(d)
+			if err != nil {
+				ops[i].skip, errs[i] = true, err
+				continue
+			}
+			sh := s.shardFor(prf)
+			ops[i] = op{prefix: prf, shard: sh}
+			affected[slices.Index(shards, sh)] = true
 		}
-		_, err = s.store.Remove(ip)
-		return err
-	case "Range":
-		prf, err := netip.ParsePrefix(value)
-		if err != nil {
-			return err
+		return ops, errs
+	}
+
+	deleteOps, deleteErrs := prepare(deleted)
+	addOps, addErrs := prepare(added)
+
+	s.filterMu.RLock()
+	defer s.filterMu.RUnlock()
+
+	for i, sh := range shards {
+		if affected[i] {
+			sh.mu.Lock()
+			defer sh.mu.Unlock()
+		}
+	}
+
+	for i, o := range deleteOps {
+		if !o.skip {
+			deleteErrs[i] = s.deleteLocked(o.shard, o.prefix)
 		}
-		_, err = s.store.RemoveCIDR(prf)
+	}
+	for i, o := range addOps {
+		if !o.skip {
+			addErrs[i] = s.addLocked(o.shard, o.prefix, added[i])
+		}
+	}
+
+	return deleteErrs, addErrs
+}
+
+// addLocked adds decision for prefix prf to shard sh, which must be
+// locked by the caller, as must filterMu for reading.
+func (s *store) addLocked(sh *shard, prf netip.Prefix, decision *models.Decision) error {
+	if err := sh.store.AddCIDR(prf, decision); err != nil {
+		return err
+	}
+
+	if old, ok := sh.index[prf]; ok {
+		s.bytes.Add(-int64(entrySize(old.decision)))
+	} else {
+		s.count.Add(1)
+	}
+	sh.index[prf] = entry{decision: decision, addedAt: time.Now()}
+	s.bytes.Add(int64(entrySize(decision)))
+	s.filter.Load().add(prf)
+	s.touch()
+
+	return nil
+}
+
+// deleteLocked deletes the decision for prefix prf from shard sh, which
+// must be locked by the caller.
+func (s *store) deleteLocked(sh *shard, prf netip.Prefix) error {
+	if _, err := sh.store.RemoveCIDR(prf); err != nil {
 		return err
-	default:
-		return fmt.Errorf("got unhandled scope: %s", scope)
 	}
+
+	if e, ok := sh.index[prf]; ok {
+		s.bytes.Add(-int64(entrySize(e.decision)))
+		s.count.Add(-1)
+	}
+	delete(sh.index, prf)
+	s.stale.Store(true)
+	s.touch()
+
+	return nil
+}
+
+// remove removes the entry for prefix prf. If decision is not nil,
+// the entry is only removed if it holds decision. It returns the
+// removed entry, and whether an entry was removed.
+func (s *store) remove(prf netip.Prefix, decision *models.Decision) (entry, bool) {
+	sh := s.shardFor(prf)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	e, ok := sh.index[prf]
+	if !ok || (decision != nil && e.decision != decision) {
+		return entry{}, false
+	}
+
+	if _, err := sh.store.RemoveCIDR(prf); err != nil {
+		return entry{}, false
+	}
+
+	s.bytes.Add(-int64(entrySize(e.decision)))
+	s.count.Add(-1)
+	delete(sh.index, prf)
+	s.stale.Store(true)
+	s.touch()
+
+	return e, true
 }
 
 func (s *store) get(key netip.Addr) (*models.Decision, error) {
-	r, err := s.store.Get(key)
+	// prefixes are stored unmapped, so IPv4-mapped IPv6 addresses are
+	// looked up as IPv4 in both the filter and the store
+	key = key.Unmap()
+	if !s.filter.Load().mayContain(key) {
+		return nil, nil
+	}
+
+	for _, sh := range s.lookupShards(key) {
+		sh.mu.RLock()
+		r, err := sh.store.Get(key)
+		sh.mu.RUnlock()
+		if err != nil {
+			return nil, err
+		}
+
+		// currently we return the first match, but the IP can exist in multiple
+		// networks (CIDR ranges) and there may thus be multiple Decisions to act
+		// upon. In general, though, the existence of at least a single Decision
+		// means that the IP should not be allowed, so it's relatively safe to use
+		// the first, but there may be 'softer' Decisions that should actually take
+		// precedence.
+		if len(r) > 0 {
+			return r[0], nil
+		}
+	}
+
+	return nil, nil
+}
+
+// getAll returns the entries for all prefixes containing key.
+func (s *store) getAll(key netip.Addr) ([]entry, error) {
+	key = key.Unmap()
+	if !s.filter.Load().mayContain(key) {
+		return nil, nil
+	}
+
+	var entries []entry
+	for _, sh := range s.lookupShards(key) {
+		var err error
+		if entries, err = sh.getAll(key, entries); err != nil {
+			return nil, err
+		}
+	}
+
+	return entries, nil
+}
+
+func (sh *shard) getAll(key netip.Addr, entries []entry) ([]entry, error) {
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+
+	decisions, err := sh.store.Get(key)
 	if err != nil {
 		return nil, err
 	}
 
-	if len(r) == 0 {
-		return nil, nil
+	for _, d := range decisions {
+		e := entry{decision: d}
+		if prf, err := decisionPrefix(d); err == nil {
+			if indexed, ok := sh.index[prf]; ok {
+				e = indexed
+			}
+		}
+		entries = append(entries, e)
 	}
 
-	// currently we return the first match, but the IP can exist in multiple
-	// networks (CIDR ranges) and there may thus be multiple Decisions to act
-	// upon. In general, though, the existence of at least a single Decision
-	// means that the IP should not be allowed, so it's relatively safe to use
-	// the first, but there may be 'softer' Decisions that should actually take
-	// precedence.
+	return entries, nil
+}
 
-	return r[0], err
+// overlapping returns the entries for all prefixes that overlap prf,
+// both the ones containing it and the ones contained by it. Entries
+// are ordered from the least to the most specific prefix.
+func (s *store) overlapping(prf netip.Prefix) []entry {
+	type overlap struct {
+		prefix netip.Prefix
+		entry  entry
+	}
+
+	var overlaps []overlap
+	s.each(func(p netip.Prefix, e entry) bool {
+		if p.Overlaps(prf) {
+			overlaps = append(overlaps, overlap{prefix: p, entry: e})
+		}
+		return true
+	})
+
+	slices.SortFunc(overlaps, func(a, b overlap) int {
+		if c := cmp.Compare(a.prefix.Bits(), b.prefix.Bits()); c != 0 {
+			return c
+		}
+		return a.prefix.Addr().Compare(b.prefix.Addr())
+	})
+
+	entries := make([]entry, 0, len(overlaps))
+	for _, o := range overlaps {
+		entries = append(entries, o.entry)
+	}
+
+	return entries
+}
+
+// decisionPrefix returns the prefix a decision applies to, based
+// on its scope and value.
+func decisionPrefix(decision *models.Decision) (netip.Prefix, error) {
+	scope := *decision.Scope
+	value := *decision.Value
+
+	switch scope {
+	case "Ip":
+		ip, err := parseIP(value)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+		ip = ip.Unmap()
+		return netip.PrefixFrom(ip, ip.BitLen()), nil
+	case "Range":
+		prf, err := netip.ParsePrefix(value)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+		return prf.Masked(), nil
+	default:
+		return netip.Prefix{}, fmt.Errorf("got unhandled scope: %s", scope)
+	}
 }
 
 // parseIP parses a value
@@ -96,7 +96,7 @@ func TestStore(t *testing.T) {
 	require.NoError(t, err)
 	err = s.add(d5)
 	require.Error(t, err)
-	require.Equal(t, 4, s.store.Len())
+	require.Equal(t, 4, s.len())
 
 	ip1 := netip.MustParseAddr(value1)
 	r1, err := s.get(ip1)
@@ -114,3 +114,189 @@ func TestStore(t *testing.T) {
 	require.NoError(t, err)
 	require.Nil(t, r1)
 }
+
+func TestStore_overlapping(t *testing.T) {
+	s := newStore()
+	for _, v := range []struct{ scope, value string }{
+		{"Range", "10.0.0.0/8"},
+		{"Range", "10.1.0.0/16"},
+		{"Ip", "10.1.2.3"},
+		{"Ip", "10.2.0.1"},
+		{"Ip", "192.0.2.1"},
+	} {
+		duration, origin, scenario, typ := "1h", "cscli", "test", "ban"
+		require.NoError(t, s.add(&models.Decision{
+			Duration: &duration,
+			Origin:   &origin,
+			Scenario: &scenario,
+			Scope:    &v.scope,
+			Type:     &typ,
+			Value:    &v.value,
+		}))
+	}
+
+	values := func(entries []entry) []string {
+		var r []string
+		for _, e := range entries {
+			r = append(r, *e.decision.Value)
+		}
+		return r
+	}
+
+	require.Equal(t, []string{"10.0.0.0/8", "10.1.0.0/16", "10.1.2.3"}, values(s.overlapping(netip.MustParsePrefix("10.1.0.0/16"))))
+	require.Equal(t, []string{"10.0.0.0/8", "10.1.0.0/16", "10.1.2.3", "10.2.0.1"}, values(s.overlapping(netip.MustParsePrefix("10.0.0.0/8"))))
+	require.Equal(t, []string{"10.0.0.0/8", "10.1.0.0/16"}, values(s.overlapping(netip.MustParsePrefix("10.1.1.0/24"))))
+	require.Empty(t, s.overlapping(netip.MustParsePrefix("198.51.100.0/24")))
+}
+
+func TestStore_shards(t *testing.T) {
+	s := newStore()
+	for _, v := range []struct{ scope, value string }{
+		{"Range", "0.0.0.0/1"},  // wider than a shard
+		{"Range", "10.0.0.0/8"}, // exactly one shard
+		{"Ip", "10.1.2.3"},
+		{"Ip", "26.1.2.3"}, // same shard as 10.0.0.0/8
+		{"Range", "2000::/3"},
+		{"Range", "2001:db8::/32"},
+		{"Ip", "2001:db8::1"},
+	} {
+		duration, origin, scenario, typ := "1h", "cscli", "test", "ban"
+		require.NoError(t, s.add(&models.Decision{
+			Duration: &duration,
+			Origin:   &origin,
+			Scenario: &scenario,
+			Scope:    &v.scope,
+			Type:     &typ,
+			Value:    &v.value,
+		}))
+	}
+	require.Equal(t, 7, s.len())
+	require.Equal(t, 2, len(s.wide.index))
+
+	values := func(entries []entry) []string {
+		var r []string
+		for _, e := range entries {
+			r = append(r, *e.decision.Value)
+		}
+		return r
+	}
+
+	entries, err := s.getAll(netip.MustParseAddr("10.1.2.3"))
+	require.NoError(t, err)
+	require.Equal(t, []string{"10.1.2.3", "10.0.0.0/8", "0.0.0.0/1"}, values(entries))
+
+	entries, err = s.getAll(netip.MustParseAddr("2001:db8::1"))
+	require.NoError(t, err)
+	require.Equal(t, []string{"2001:db8::1", "2001:db8::/32", "2000::/3"}, values(entries))
+
+	d, err := s.get(netip.MustParseAddr("26.1.2.3"))
+	require.NoError(t, err)
+	require.Equal(t, "26.1.2.3", *d.Value)
+
+	d, err = s.get(netip.MustParseAddr("127.0.0.1"))
+	require.NoError(t, err)
+	require.Equal(t, "0.0.0.0/1", *d.Value)
+
+	d, err = s.get(netip.MustParseAddr("192.0.2.1"))
+	require.NoError(t, err)
+	require.Nil(t, d)
+
+	require.True(t, s.has(netip.MustParsePrefix("0.0.0.0/1"), "ban"))
+	require.Equal(t, []string{"0.0.0.0/1", "10.0.0.0/8", "10.1.2.3"}, values(s.overlapping(netip.MustParsePrefix("10.1.0.0/16"))))
+
+	other := newStore()
+	s.replace(other)
+	require.Equal(t, 0, s.len())
+	require.False(t, s.lastUpdate().IsZero())
+}
+
+func TestStore_len(t *testing.T) {
+	decision := func(value, duration string) *models.Decision {
+		scope, typ := "Ip", "ban"
+		return &models.Decision{Duration: &duration, Scope: &scope, Type: &typ, Value: &value}
+	}
+
+	s := newStore()
+	require.NoError(t, s.add(decision("192.0.2.1", "1h")))
+	require.NoError(t, s.add(decision("192.0.2.1", "2h"))) // replaces the entry
+	require.NoError(t, s.add(decision("192.0.2.2", "1h")))
+	require.Equal(t, 2, s.len())
+
+	require.NoError(t, s.delete(decision("198.51.100.1", "1h"))) // not in the store
+	require.Equal(t, 2, s.len())
+
+	require.NoError(t, s.delete(decision("192.0.2.1", "1h")))
+	require.Equal(t, 1, s.len())
+
+	_, ok := s.remove(netip.MustParsePrefix("192.0.2.2/32"), nil)
+	require.True(t, ok)
+	require.Equal(t, 0, s.len())
+
+	other := newStore()
+	require.NoError(t, other.add(decision("192.0.2.3", "1h")))
+	s.replace(other)
+	require.Equal(t, 1, s.len())
+}
+
+func TestStore_apply(t *testing.T) {
+	decision := func(scope, value, duration string) *models.Decision {
+		origin, scenario, typ := "crowdsec", "test", "ban"
+		return &models.Decision{Duration: &duration, Origin: &origin, Scenario: &scenario, Scope: &scope, Type: &typ, Value: &value}
+	}
+
+	s := newStore()
+	require.NoError(t, s.add(decision("Ip", "192.0.2.1", "1h")))
+	require.NoError(t, s.add(decision("Ip", "192.0.2.2", "1h")))
+
+	deleteErrs, addErrs := s.apply(
+		[]*models.Decision{decision("Ip", "192.0.2.1", "1h"), decision("Ip", "192.0.2.2", "1h"), decision("Ip", "invalid", "1h")},
+		[]*models.Decision{decision("Ip", "192.0.2.1", "2h"), decision("Range", "198.51.100.0/24", "1h"), nil},
+	)
+	require.Len(t, deleteErrs, 3)
+	require.Len(t, addErrs, 3)
+	require.NoError(t, deleteErrs[0])
+	require.NoError(t, deleteErrs[1])
+	require.Error(t, deleteErrs[2])
+	require.NoError(t, addErrs[0])
+	require.NoError(t, addErrs[1])
+	require.NoError(t, addErrs[2])
+
+	// deletes are applied before adds
+	d, err := s.get(netip.MustParseAddr("192.0.2.1"))
+	require.NoError(t, err)
+	require.NotNil(t, d)
+	require.Equal(t, "2h", *d.Duration)
+
+	d, err = s.get(netip.MustParseAddr("192.0.2.2"))
+	require.NoError(t, err)
+	require.Nil(t, d)
+	require.Equal(t, 2, s.len())
+}
+
+func TestStore_applyAtomic(t *testing.T) {
+	scope, value, typ := "Ip", "192.0.2.1", "ban"
+	ip := netip.MustParseAddr(value)
+
+	s := newStore()
+	require.NoError(t, s.add(&models.Decision{Scope: &scope, Value: &value, Type: &typ}))
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for range 1000 {
+			d := &models.Decision{Scope: &scope, Value: &value, Type: &typ}
+			s.apply([]*models.Decision{d}, []*models.Decision{d})
+		}
+	}()
+
+	for {
+		select {
+		case <-done:
+			return
+		default:
+			d, err := s.get(ip)
+			require.NoError(t, err)
+			require.NotNil(t, d, "IP was unbanned while applying a batch")
+		}
+	}
+}
@@ -0,0 +1,165 @@
+// Copyright 2024 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bouncer
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// streamStats tracks the processing of batches of decisions received
+// from the CrowdSec Local API stream.
+type streamStats struct {
+	failures atomic.Uint64
+
+	mu          sync.RWMutex
+	lastBatch   time.Time
+	lastNew     int
+	lastDeleted int
+	initial     InitialPull
+}
+
+// InitialPull describes the processing of the first batch of decisions
+// received from the stream. Until it's finished, requests from IPs with
+// decisions that weren't processed yet are allowed.
+type InitialPull struct {
+	// Decisions is the number of new decisions in the first batch.
+	Decisions int `json:"decisions"`
+	// Started is the time processing the first batch started.
+	Started *time.Time `json:"started,omitempty"`
+	// Finished is the time processing the first batch finished.
+	Finished *time.Time `json:"finished,omitempty"`
+	// Duration is the time it took to process the first batch.
+	Duration string `json:"duration,omitempty"`
+}
+
+// StreamStats describes the processing of decisions received from the
+// CrowdSec Local API stream, so that a stream that stopped delivering
+// decisions, or delivers decisions that can't be processed, is visible.
+type StreamStats struct {
+	// DecisionsAdded is the number of decisions added to the store.
+	DecisionsAdded uint64 `json:"decisions_added"`
+	// DecisionsDeleted is the number of decisions deleted from the store.
+	DecisionsDeleted uint64 `json:"decisions_deleted"`
+	// Failures is the number of decisions that couldn't be processed,
+	// i.e. because their value couldn't be parsed.
+	Failures uint64 `json:"failures"`
+	// LastSync is the last time decisions were retrieved from the
+	// CrowdSec Local API successfully.
+	LastSync *time.Time `json:"last_sync,omitempty"`
+	// LastBatch is the time the most recent batch was processed.
+	LastBatch *time.Time `json:"last_batch,omitempty"`
+	// LastBatchNew is the number of new decisions in the most recent batch.
+	LastBatchNew int `json:"last_batch_new"`
+	// LastBatchDeleted is the number of deleted decisions in the most
+	// recent batch.
+	LastBatchDeleted int `json:"last_batch_deleted"`
+	// InitialPull describes the processing of the first batch, during
+	// which the store is warming up.
+	InitialPull InitialPull `json:"initial_pull"`
+}
+
+// recordBatch records a batch with numNew new and numDeleted deleted
+// decisions being received from the stream.
+func (b *Bouncer) recordBatch(numNew, numDeleted int) {
+	totalStreamBatches.Inc()
+	lastBatchSize.WithLabelValues("new").Set(float64(numNew))
+	lastBatchSize.WithLabelValues("deleted").Set(float64(numDeleted))
+
+	b.stream.mu.Lock()
+	defer b.stream.mu.Unlock()
+
+	b.stream.lastBatch = time.Now()
+	b.stream.lastNew = numNew
+	b.stream.lastDeleted = numDeleted
+}
+
+// startInitialPull records processing the first batch of numNew
+// decisions from the stream starting. It reports whether the batch
+// is the first one since streaming started.
+func (b *Bouncer) startInitialPull(numNew int) bool {
+	b.stream.mu.Lock()
+	defer b.stream.mu.Unlock()
+
+	if b.stream.initial.Started != nil {
+		return false
+	}
+
+	now := time.Now()
+	b.stream.initial = InitialPull{Decisions: numNew, Started: &now}
+
+	return true
+}
+
+// finishInitialPull records processing the first batch of decisions
+// from the stream finishing.
+func (b *Bouncer) finishInitialPull() {
+	b.stream.mu.Lock()
+	now := time.Now()
+	duration := now.Sub(*b.stream.initial.Started)
+	b.stream.initial.Finished = &now
+	b.stream.initial.Duration = duration.String()
+	decisions := b.stream.initial.Decisions
+	b.stream.mu.Unlock()
+
+	initialPullDuration.Set(duration.Seconds())
+	b.logger.Info("processed initial decisions", b.zapField(),
+		zap.Int("decisions", decisions), zap.Duration("duration", duration))
+}
+
+// resetInitialPull resets the initial pull, so that the first batch
+// after streaming (re)starts is tracked.
+func (b *Bouncer) resetInitialPull() {
+	b.stream.mu.Lock()
+	defer b.stream.mu.Unlock()
+
+	b.stream.initial = InitialPull{}
+}
+
+// recordDecisionFailure records a decision that couldn't be processed.
+func (b *Bouncer) recordDecisionFailure(action string) {
+	b.stream.failures.Add(1)
+	totalDecisionFailures.WithLabelValues(action).Inc()
+}
+
+// StreamStats returns statistics about the processing of decisions
+// received from the CrowdSec Local API stream.
+func (b *Bouncer) StreamStats() StreamStats {
+	s := StreamStats{
+		DecisionsAdded:   b.decisionsAdded.Load(),
+		DecisionsDeleted: b.decisionsDeleted.Load(),
+		Failures:         b.stream.failures.Load(),
+	}
+
+	b.stream.mu.RLock()
+	if t := b.stream.lastBatch; !t.IsZero() {
+		s.LastBatch = &t
+	}
+	s.LastBatchNew = b.stream.lastNew
+	s.LastBatchDeleted = b.stream.lastDeleted
+	s.InitialPull = b.stream.initial
+	b.stream.mu.RUnlock()
+
+	b.lapiHealth.mu.RLock()
+	if t := b.lapiHealth.lastSuccess; !t.IsZero() {
+		s.LastSync = &t
+	}
+	b.lapiHealth.mu.RUnlock()
+
+	return s
+}
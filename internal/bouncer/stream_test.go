@@ -0,0 +1,126 @@
+package bouncer
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+
+	"github.com/crowdsecurity/crowdsec/pkg/models"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestBouncer_StreamStats(t *testing.T) {
+	b, err := newBouncer(t)
+	require.NoError(t, err)
+
+	s := b.StreamStats()
+	assert.Nil(t, s.LastBatch)
+	assert.Nil(t, s.LastSync)
+
+	duration, origin, scenario, scope, typ, value := "1h", "cscli", "test", "Ip", "ban", "10.0.0.1"
+	require.NoError(t, b.add(&models.Decision{
+		Duration: &duration,
+		Origin:   &origin,
+		Scenario: &scenario,
+		Scope:    &scope,
+		Type:     &typ,
+		Value:    &value,
+	}))
+
+	failures := testutil.ToFloat64(totalDecisionFailures.WithLabelValues("add"))
+	b.recordLAPISuccess()
+	b.recordBatch(2, 1)
+	b.recordDecisionFailure("add")
+
+	s = b.StreamStats()
+	assert.Equal(t, uint64(1), s.DecisionsAdded)
+	assert.Equal(t, uint64(1), s.Failures)
+	assert.NotNil(t, s.LastBatch)
+	assert.NotNil(t, s.LastSync)
+	assert.Equal(t, 2, s.LastBatchNew)
+	assert.Equal(t, 1, s.LastBatchDeleted)
+
+	assert.Equal(t, failures+1, testutil.ToFloat64(totalDecisionFailures.WithLabelValues("add")))
+	assert.Equal(t, 2.0, testutil.ToFloat64(lastBatchSize.WithLabelValues("new")))
+	assert.Equal(t, float64(s.LastSync.Unix()), testutil.ToFloat64(lastSyncTimestamp))
+	assert.Equal(t, uint64(1), b.Metrics().DecisionFailures)
+}
+
+func TestBouncer_processStreamDecisions(t *testing.T) {
+	b, err := newBouncer(t)
+	require.NoError(t, err)
+
+	batch := &models.DecisionsStreamResponse{}
+	for i := range decisionChunkSize + 5 {
+		duration, origin, scenario, scope, typ := "1h", "CAPI", "test", "Ip", "ban"
+		value := netip.AddrFrom4([4]byte{10, byte(i >> 16), byte(i >> 8), byte(i)}).String()
+		batch.New = append(batch.New, &models.Decision{
+			Duration: &duration,
+			Origin:   &origin,
+			Scenario: &scenario,
+			Scope:    &scope,
+			Type:     &typ,
+			Value:    &value,
+		})
+	}
+
+	b.processStreamDecisions(context.Background(), batch)
+	require.Equal(t, decisionChunkSize+5, b.store.len())
+
+	s := b.StreamStats()
+	assert.Equal(t, decisionChunkSize+5, s.InitialPull.Decisions)
+	require.NotNil(t, s.InitialPull.Started)
+	require.NotNil(t, s.InitialPull.Finished)
+	assert.NotEmpty(t, s.InitialPull.Duration)
+
+	// subsequent batches don't change the initial pull
+	b.processStreamDecisions(context.Background(), &models.DecisionsStreamResponse{Deleted: batch.New[:5]})
+	require.Equal(t, decisionChunkSize, b.store.len())
+	assert.Equal(t, s.InitialPull, b.StreamStats().InitialPull)
+
+	// processing stops when the context is canceled
+	b.resetInitialPull()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	b.processStreamDecisions(ctx, &models.DecisionsStreamResponse{Deleted: batch.New})
+	require.Equal(t, decisionChunkSize, b.store.len())
+	assert.Nil(t, b.StreamStats().InitialPull.Finished)
+}
+
+func TestBouncer_logDecision(t *testing.T) {
+	b, err := newBouncer(t)
+	require.NoError(t, err)
+
+	core, logs := observer.New(zapcore.DebugLevel)
+	b.logger = zap.New(core)
+
+	decision := func(origin, value string) *models.Decision {
+		duration, scenario, scope, typ := "1h", "test", "Ip", "ban"
+		return &models.Decision{Duration: &duration, Origin: &origin, Scenario: &scenario, Scope: &scope, Type: &typ, Value: &value}
+	}
+
+	b.SetDecisionLogThreshold(2)
+	b.processStreamDecisions(context.Background(), &models.DecisionsStreamResponse{
+		New: []*models.Decision{decision("crowdsec", "10.0.0.1"), decision("cscli", "10.0.0.2")},
+	})
+	assert.Equal(t, 2, logs.FilterMessage("added decision").FilterLevelExact(zapcore.DebugLevel).Len())
+
+	b.processStreamDecisions(context.Background(), &models.DecisionsStreamResponse{
+		New: []*models.Decision{decision("crowdsec", "10.0.0.3"), decision("crowdsec", "10.0.0.4"), decision("cscli", "10.0.0.5")},
+	})
+	assert.Equal(t, 2, logs.FilterMessage("added decision").Len())
+	assert.Equal(t, 1, logs.FilterMessage("skipped logging new decisions").Len())
+
+	b.EnableManualDecisionLogging()
+	b.processStreamDecisions(context.Background(), &models.DecisionsStreamResponse{
+		New: []*models.Decision{decision("crowdsec", "10.0.0.6"), decision("crowdsec", "10.0.0.7"), decision("cscli", "10.0.0.8")},
+	})
+	manual := logs.FilterMessage("added decision").FilterLevelExact(zapcore.InfoLevel).All()
+	require.Len(t, manual, 1)
+	assert.Equal(t, "10.0.0.8", manual[0].ContextMap()["value"])
+}
@@ -0,0 +1,121 @@
+// Copyright 2024 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bouncer
+
+import (
+	"context"
+	"net/netip"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// SetSummaryInterval sets the interval at which a summary of the
+// decisions and the remediations served is logged. An interval of 0
+// disables the summary.
+func (b *Bouncer) SetSummaryInterval(interval time.Duration) {
+	b.summaryInterval = interval
+}
+
+// summary is a compact description of what the Bouncer has been
+// doing since the previous summary.
+type summary struct {
+	decisions    int
+	types        map[string]int
+	origins      map[string]int
+	remediations map[string]uint64
+	blocked      uint64
+	streamLag    time.Duration
+}
+
+// summarize returns the summary at now. The number of remediations
+// served is relative to the counts in previous, which is updated.
+func (b *Bouncer) summarize(now time.Time, previous map[string]uint64) summary {
+	s := summary{
+		types:        map[string]int{},
+		origins:      map[string]int{},
+		remediations: map[string]uint64{},
+	}
+
+	b.store.each(func(_ netip.Prefix, e entry) bool {
+		s.decisions++
+		s.types[stringValue(e.decision.Type)]++
+		s.origins[stringValue(e.decision.Origin)]++
+		return true
+	})
+
+	b.remediations.Range(func(k, v any) bool {
+		typ, total := k.(string), v.(*atomic.Uint64).Load()
+		if n := total - previous[typ]; n > 0 {
+			s.remediations[typ] = n
+			s.blocked += n
+		}
+		previous[typ] = total
+		return true
+	})
+
+	if b.useStreamingBouncer.Load() {
+		b.lapiHealth.mu.RLock()
+		if t := b.lapiHealth.lastSuccess; !t.IsZero() {
+			s.streamLag = now.Sub(t)
+		}
+		b.lapiHealth.mu.RUnlock()
+	}
+
+	return s
+}
+
+func (b *Bouncer) logSummary(s summary) {
+	fields := []zap.Field{
+		b.zapField(),
+		zap.Int("decisions", s.decisions),
+		zap.Any("types", s.types),
+		zap.Any("origins", s.origins),
+		zap.Uint64("blocked", s.blocked),
+		zap.Any("remediations", s.remediations),
+	}
+	if b.useStreamingBouncer.Load() {
+		fields = append(fields, zap.Duration("stream_lag", s.streamLag))
+	}
+
+	b.logger.Info("decision summary", fields...)
+}
+
+func (b *Bouncer) startSummary(ctx context.Context) {
+	if b.summaryInterval <= 0 {
+		return
+	}
+
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+
+		ticker := time.NewTicker(b.summaryInterval)
+		defer ticker.Stop()
+
+		previous := map[string]uint64{}
+		b.summarize(time.Now(), previous) // only remediations served from now on are reported
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				b.logSummary(b.summarize(now, previous))
+			}
+		}
+	}()
+}
@@ -0,0 +1,48 @@
+package bouncer
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/crowdsecurity/crowdsec/pkg/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBouncer_summarize(t *testing.T) {
+	b, err := newBouncer(t)
+	require.NoError(t, err)
+
+	duration, origin, scenario, scope, typ, value := "1h", "CAPI", "test", "Ip", "ban", "10.0.0.1"
+	require.NoError(t, b.add(&models.Decision{
+		Duration: &duration,
+		Origin:   &origin,
+		Scenario: &scenario,
+		Scope:    &scope,
+		Type:     &typ,
+		Value:    &value,
+	}))
+
+	previous := map[string]uint64{}
+	b.RecordRemediation("ban", "CAPI", netip.MustParseAddr("10.0.0.1"))
+	b.RecordRemediation("ban", "CAPI", netip.MustParseAddr("10.0.0.1"))
+
+	now := time.Now()
+	b.recordLAPISuccess()
+	s := b.summarize(now.Add(time.Minute), previous)
+	assert.Equal(t, 1, s.decisions)
+	assert.Equal(t, map[string]int{"ban": 1}, s.types)
+	assert.Equal(t, map[string]int{"CAPI": 1}, s.origins)
+	assert.Equal(t, uint64(2), s.blocked)
+	assert.Equal(t, map[string]uint64{"ban": 2}, s.remediations)
+	assert.InDelta(t, time.Minute, s.streamLag, float64(time.Second))
+
+	// only remediations served since the previous summary are counted
+	b.RecordRemediation("captcha", "crowdsec", netip.MustParseAddr("10.0.0.2"))
+	s = b.summarize(now, previous)
+	assert.Equal(t, uint64(1), s.blocked)
+	assert.Equal(t, map[string]uint64{"captcha": 1}, s.remediations)
+
+	b.logSummary(s)
+}
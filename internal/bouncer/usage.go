@@ -0,0 +1,157 @@
+// Copyright 2024 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bouncer
+
+import (
+	"cmp"
+	"net/netip"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/crowdsecurity/crowdsec/pkg/models"
+	"github.com/crowdsecurity/go-cs-lib/ptr"
+)
+
+// usage holds the number of requests processed and dropped since they
+// were last reported to the CrowdSec Local API. The metrics follow the
+// format used by other remediation components, so that they're shown
+// by `cscli metrics`.
+type usage struct {
+	mu        sync.Mutex
+	processed map[string]float64
+	dropped   map[usageKey]float64
+}
+
+type usageKey struct {
+	origin      string
+	remediation string
+	ipType      string
+}
+
+func newUsage() *usage {
+	return &usage{
+		processed: map[string]float64{},
+		dropped:   map[usageKey]float64{},
+	}
+}
+
+func (u *usage) recordProcessed(ip netip.Addr) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.processed[ipType(ip)]++
+}
+
+func (u *usage) recordDropped(origin, remediation string, ip netip.Addr) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.dropped[usageKey{origin: origin, remediation: remediation, ipType: ipType(ip)}]++
+}
+
+// flush returns the metric items for the requests processed and dropped
+// since the previous flush, and resets the counts.
+func (u *usage) flush() []*models.MetricsDetailItem {
+	u.mu.Lock()
+	processed, dropped := u.processed, u.dropped
+	u.processed, u.dropped = map[string]float64{}, map[usageKey]float64{}
+	u.mu.Unlock()
+
+	items := make([]*models.MetricsDetailItem, 0, len(processed)+len(dropped))
+	for typ, v := range processed {
+		items = append(items, &models.MetricsDetailItem{
+			Name:   ptr.Of("processed"),
+			Unit:   ptr.Of("request"),
+			Value:  ptr.Of(v),
+			Labels: models.MetricsLabels{"ip_type": typ},
+		})
+	}
+	for k, v := range dropped {
+		items = append(items, &models.MetricsDetailItem{
+			Name:  ptr.Of("dropped"),
+			Unit:  ptr.Of("request"),
+			Value: ptr.Of(v),
+			Labels: models.MetricsLabels{
+				"origin":      k.origin,
+				"remediation": k.remediation,
+				"ip_type":     k.ipType,
+			},
+		})
+	}
+
+	return items
+}
+
+// activeDecisionItems returns the metric items for the number of
+// decisions in the store, by origin and IP type.
+func (s *store) activeDecisionItems() []*models.MetricsDetailItem {
+	type key struct{ origin, ipType string }
+	counts := map[key]float64{}
+	s.each(func(prf netip.Prefix, e entry) bool {
+		counts[key{origin: stringValue(e.decision.Origin), ipType: ipType(prf.Addr())}]++
+		return true
+	})
+
+	items := make([]*models.MetricsDetailItem, 0, len(counts))
+	for k, v := range counts {
+		items = append(items, &models.MetricsDetailItem{
+			Name:   ptr.Of("active_decisions"),
+			Unit:   ptr.Of("ip"),
+			Value:  ptr.Of(v),
+			Labels: models.MetricsLabels{"origin": k.origin, "ip_type": k.ipType},
+		})
+	}
+
+	return items
+}
+
+// usageMetrics returns the usage metrics for the window of size
+// interval ending at now.
+func (b *Bouncer) usageMetrics(now time.Time, interval time.Duration) *models.DetailedMetrics {
+	items := b.usage.flush()
+	if b.useStreamingBouncer.Load() {
+		items = append(items, b.store.activeDecisionItems()...)
+	}
+
+	// a stable order makes the payload easier to inspect
+	slices.SortFunc(items, func(a, b *models.MetricsDetailItem) int {
+		if c := cmp.Compare(*a.Name, *b.Name); c != 0 {
+			return c
+		}
+		for _, l := range []string{"origin", "remediation", "ip_type"} {
+			if c := cmp.Compare(a.Labels[l], b.Labels[l]); c != 0 {
+				return c
+			}
+		}
+		return 0
+	})
+
+	return &models.DetailedMetrics{
+		Items: items,
+		Meta: &models.MetricsMeta{
+			UtcNowTimestamp:   ptr.Of(now.UTC().Unix()),
+			WindowSizeSeconds: ptr.Of(int64(interval.Seconds())),
+		},
+	}
+}
+
+func ipType(ip netip.Addr) string {
+	if ip.Unmap().Is4() {
+		return "ipv4"
+	}
+
+	return "ipv6"
+}
@@ -0,0 +1,43 @@
+package bouncer
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUsageMetrics(t *testing.T) {
+	b, err := newBouncer(t)
+	require.NoError(t, err)
+
+	b.RecordProcessed(netip.MustParseAddr("192.0.2.1"))
+	b.RecordProcessed(netip.MustParseAddr("192.0.2.2"))
+	b.RecordProcessed(netip.MustParseAddr("2001:db8::1"))
+	b.RecordRemediation("ban", "CAPI", netip.MustParseAddr("192.0.2.1"))
+
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	m := b.usageMetrics(now, 15*time.Minute)
+	require.NotNil(t, m.Meta)
+	assert.Equal(t, now.Unix(), *m.Meta.UtcNowTimestamp)
+	assert.Equal(t, int64(900), *m.Meta.WindowSizeSeconds)
+
+	require.Len(t, m.Items, 3)
+	assert.Equal(t, "dropped", *m.Items[0].Name)
+	assert.Equal(t, 1.0, *m.Items[0].Value)
+	assert.Equal(t, "CAPI", m.Items[0].Labels["origin"])
+	assert.Equal(t, "ban", m.Items[0].Labels["remediation"])
+	assert.Equal(t, "ipv4", m.Items[0].Labels["ip_type"])
+	assert.Equal(t, "processed", *m.Items[1].Name)
+	assert.Equal(t, "ipv4", m.Items[1].Labels["ip_type"])
+	assert.Equal(t, 2.0, *m.Items[1].Value)
+	assert.Equal(t, "processed", *m.Items[2].Name)
+	assert.Equal(t, "ipv6", m.Items[2].Labels["ip_type"])
+	assert.Equal(t, 1.0, *m.Items[2].Value)
+
+	// counts are reset after being reported
+	m = b.usageMetrics(now, 15*time.Minute)
+	assert.Empty(t, m.Items)
+}
@@ -0,0 +1,94 @@
+// Copyright 2024 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bouncer
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/crowdsecurity/crowdsec/pkg/models"
+	"go.uber.org/zap"
+)
+
+// AddVerdicts adds local decisions for the alerts, i.e. those raised by
+// out-of-band AppSec rules, which are evaluated after the request was
+// served. The alerts are sent by a CrowdSec notification plugin, so
+// that follow-up requests from the offending IPs are blocked without
+// waiting for the decisions to be streamed from the Local API. The
+// decisions of an alert are used if it has any; otherwise its source
+// is banned for defaultDuration.
+func (b *Bouncer) AddVerdicts(alerts []*models.Alert, defaultDuration time.Duration) ([]DecisionDetails, error) {
+	if defaultDuration <= 0 {
+		return nil, fmt.Errorf("invalid duration %s; must be positive", defaultDuration)
+	}
+
+	details := []DecisionDetails{}
+	for _, a := range alerts {
+		if a == nil {
+			continue
+		}
+
+		for _, d := range verdictDecisions(a) {
+			prf, err := decisionPrefix(d)
+			if err != nil {
+				b.logger.Debug("skipped verdict", b.zapField(), zap.Stringp("value", d.Value), zap.Error(err))
+				continue
+			}
+
+			duration := defaultDuration
+			if v, err := time.ParseDuration(stringValue(d.Duration)); err == nil && v > 0 {
+				duration = v
+			}
+
+			decision, err := b.addLocal(prf, stringValue(d.Type), duration, stringValue(a.Scenario))
+			if err != nil {
+				return details, err
+			}
+
+			details = append(details, newDecisionDetails(entry{decision: decision}))
+		}
+	}
+
+	return details, nil
+}
+
+// verdictDecisions returns the decisions of alert, or a ban decision
+// for its source if it has none.
+func verdictDecisions(alert *models.Alert) []*models.Decision {
+	var decisions []*models.Decision
+	for _, d := range alert.Decisions {
+		if !isInvalid(d) {
+			decisions = append(decisions, d)
+		}
+	}
+	if len(decisions) > 0 || alert.Source == nil {
+		return decisions
+	}
+
+	value := stringValue(alert.Source.Value)
+	if value == "" {
+		value = alert.Source.IP
+	}
+	if value == "" {
+		return nil
+	}
+
+	scope, typ := stringValue(alert.Source.Scope), localDecisionType
+	if scope == "" {
+		scope = "Ip"
+	}
+
+	return []*models.Decision{{Scope: &scope, Value: &value, Type: &typ}}
+}
@@ -0,0 +1,58 @@
+package bouncer
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/crowdsecurity/crowdsec/pkg/models"
+	"github.com/crowdsecurity/go-cs-lib/ptr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBouncer_AddVerdicts(t *testing.T) {
+	b, err := newBouncer(t)
+	require.NoError(t, err)
+
+	_, err = b.AddVerdicts(nil, 0)
+	assert.Error(t, err)
+
+	details, err := b.AddVerdicts([]*models.Alert{
+		{
+			// without decisions, the source is banned
+			Scenario: ptr.Of("crowdsecurity/vpatch-CVE-2024-4577"),
+			Source:   &models.Source{Scope: ptr.Of("Ip"), Value: ptr.Of("192.0.2.1")},
+		},
+		{
+			Scenario: ptr.Of("crowdsecurity/appsec-vpatch"),
+			Source:   &models.Source{Scope: ptr.Of("Ip"), Value: ptr.Of("192.0.2.2")},
+			Decisions: []*models.Decision{
+				{Scope: ptr.Of("Range"), Value: ptr.Of("198.51.100.0/24"), Type: ptr.Of("captcha"), Duration: ptr.Of("30m")},
+			},
+		},
+		{
+			// invalid sources are skipped
+			Source: &models.Source{Scope: ptr.Of("Ip"), Value: ptr.Of("invalid")},
+		},
+		nil,
+	}, time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, []DecisionDetails{
+		{Type: "ban", Scope: "Ip", Value: "192.0.2.1", Origin: localOrigin, Scenario: "crowdsecurity/vpatch-CVE-2024-4577", Duration: "1h0m0s"},
+		{Type: "captcha", Scope: "Range", Value: "198.51.100.0/24", Origin: localOrigin, Scenario: "crowdsecurity/appsec-vpatch", Duration: "30m0s"},
+	}, details)
+
+	allowed, _, err := b.IsAllowed(netip.MustParseAddr("192.0.2.1"))
+	require.NoError(t, err)
+	assert.False(t, allowed)
+
+	allowed, _, err = b.IsAllowed(netip.MustParseAddr("192.0.2.2"))
+	require.NoError(t, err)
+	assert.True(t, allowed)
+
+	allowed, decision, err := b.IsAllowed(netip.MustParseAddr("198.51.100.10"))
+	require.NoError(t, err)
+	assert.False(t, allowed)
+	assert.Equal(t, "captcha", *decision.Type)
+}
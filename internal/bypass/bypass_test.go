@@ -0,0 +1,58 @@
+// Copyright 2024 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bypass
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVerify(t *testing.T) {
+	secret := []byte("secret")
+	ip := netip.MustParseAddr("192.0.2.1")
+	ipv6 := netip.MustParseAddr("2001:db8::1")
+	now := time.Unix(1700000000, 0)
+	valid := New(secret, ip, now.Add(time.Hour))
+
+	tests := []struct {
+		name    string
+		secret  []byte
+		token   string
+		ip      netip.Addr
+		maxTTL  time.Duration
+		wantErr error
+	}{
+		{"ok", secret, valid, ip, 0, nil},
+		{"ok/max-ttl", secret, valid, ip, 2 * time.Hour, nil},
+		{"ok/ipv6", secret, New(secret, ipv6, now.Add(time.Hour)), ipv6, 0, nil},
+		{"fail/too-long", secret, valid, ip, 30 * time.Minute, ErrTooLong},
+		{"fail/wrong-secret", []byte("other"), valid, ip, 0, ErrSignature},
+		{"fail/other-ip", secret, valid, netip.MustParseAddr("192.0.2.2"), 0, ErrSignature},
+		{"fail/expired", secret, New(secret, ip, now.Add(-time.Second)), ip, 0, ErrExpired},
+		{"fail/empty", secret, "", ip, 0, ErrMalformed},
+		{"fail/no-signature", secret, "1700003600.", ip, 0, ErrMalformed},
+		{"fail/invalid-hex", secret, "1700003600.zz", ip, 0, ErrMalformed},
+		{"fail/tampered-expiry", secret, "1800000000" + valid[10:], ip, 0, ErrSignature},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := Verify(tt.secret, tt.token, tt.ip, now, tt.maxTTL)
+			assert.ErrorIs(t, err, tt.wantErr)
+		})
+	}
+}
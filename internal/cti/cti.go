@@ -0,0 +1,194 @@
+// Copyright 2024 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package cti looks up information about IPs in the CrowdSec Cyber Threat
+// Intelligence (CTI) API. Lookups are cached and rate limited, so that
+// the quota of the API key isn't exhausted by repeated lookups.
+package cti
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/crowdsecurity/crowdsec/pkg/cticlient"
+	"github.com/sirupsen/logrus"
+	"go.uber.org/zap"
+	"golang.org/x/time/rate"
+
+	"github.com/hslatman/caddy-crowdsec-bouncer/internal/ttlcache"
+)
+
+const lookupTimeout = 5 * time.Second
+
+// ErrRateLimited is returned when a lookup isn't performed, because
+// the maximum number of lookups was reached.
+var ErrRateLimited = errors.New("cti lookups are rate limited")
+
+// Info is the information known about an IP by the CTI API.
+type Info struct {
+	// Known indicates whether the IP is known by the CTI API.
+	Known bool `json:"known"`
+	// BackgroundNoiseScore indicates how much the IP is part of the
+	// background noise of the internet, from 0 to 10.
+	BackgroundNoiseScore int `json:"background_noise_score"`
+	// Classifications of the IP, i.e. "community-blocklist".
+	Classifications []string `json:"classifications,omitempty"`
+	// FalsePositives are classifications indicating the IP is
+	// legitimate, i.e. "seo:duckduckbot".
+	FalsePositives []string `json:"false_positives,omitempty"`
+	// Behaviors are the attack categories the IP was seen in,
+	// i.e. "http:scan".
+	Behaviors []string `json:"behaviors,omitempty"`
+	// AttackDetails are the scenarios the IP triggered, i.e.
+	// "crowdsecurity/http-probing".
+	AttackDetails []string `json:"attack_details,omitempty"`
+	// Country the IP is located in.
+	Country string `json:"country,omitempty"`
+	// ASName is the name of the autonomous system the IP belongs to.
+	ASName string `json:"as_name,omitempty"`
+}
+
+func newInfo(item *cticlient.SmokeItem) *Info {
+	info := &Info{
+		Known:                item.Ip != "",
+		BackgroundNoiseScore: item.GetBackgroundNoiseScore(),
+		Behaviors:            item.GetBehaviors(),
+		AttackDetails:        item.GetAttackDetails(),
+		FalsePositives:       item.GetFalsePositives(),
+	}
+	for _, c := range item.Classifications.Classifications {
+		info.Classifications = append(info.Classifications, c.Name)
+	}
+	if item.Location.Country != nil {
+		info.Country = *item.Location.Country
+	}
+	if item.AsName != nil {
+		info.ASName = *item.AsName
+	}
+
+	return info
+}
+
+// Client looks up IPs in the CTI API.
+type Client struct {
+	limiter *rate.Limiter
+	cache   *ttlcache.Cache[netip.Addr, *Info]
+	logger  *zap.Logger
+
+	mu      sync.Mutex
+	pending map[netip.Addr]struct{}
+
+	lookupFunc func(ip string) (*cticlient.SmokeItem, error)
+}
+
+// New returns a Client authenticating with apiKey. Results are cached
+// for ttl, and at most size results are cached. At most perHour lookups
+// are performed per hour; a negative value disables rate limiting.
+func New(apiKey string, ttl time.Duration, size, perHour int, logger *zap.Logger) *Client {
+	// the CTI client logs using logrus; errors are returned, so
+	// its logs are discarded
+	l := logrus.New()
+	l.SetOutput(io.Discard)
+
+	client := cticlient.NewCrowdsecCTIClient(
+		cticlient.WithAPIKey(apiKey),
+		cticlient.WithHTTPClient(&http.Client{Timeout: lookupTimeout}),
+		cticlient.WithLogger(logrus.NewEntry(l)),
+	)
+
+	c := &Client{
+		cache:      ttlcache.New[netip.Addr, *Info](ttl, size),
+		logger:     logger,
+		pending:    map[netip.Addr]struct{}{},
+		lookupFunc: client.GetIPInfo,
+	}
+	if perHour >= 0 {
+		c.limiter = rate.NewLimiter(rate.Limit(float64(perHour)/3600), max(perHour/60, 1))
+	}
+
+	return c
+}
+
+// Cached returns the cached information about ip, if any.
+func (c *Client) Cached(ip netip.Addr) (*Info, bool) {
+	return c.cache.Get(ip)
+}
+
+// Lookup returns information about ip, looking it up in the CTI API if
+// it's not cached. ErrRateLimited is returned if the lookup would exceed
+// the rate limit.
+func (c *Client) Lookup(ip netip.Addr) (*Info, error) {
+	if info, ok := c.Cached(ip); ok {
+		return info, nil
+	}
+	if c.limiter != nil && !c.limiter.Allow() {
+		return nil, ErrRateLimited
+	}
+
+	return c.lookup(ip)
+}
+
+// LookupAsync calls fn with information about ip. If it's cached, fn is
+// called immediately. Otherwise ip is looked up in the background, and
+// fn is called when the lookup finished. If ip can't be looked up, fn is
+// called with nil, so that it's always called exactly once.
+func (c *Client) LookupAsync(ip netip.Addr, fn func(*Info)) {
+	if info, ok := c.Cached(ip); ok {
+		fn(info)
+		return
+	}
+
+	c.mu.Lock()
+	_, pending := c.pending[ip]
+	if pending || (c.limiter != nil && !c.limiter.Allow()) {
+		c.mu.Unlock()
+		fn(nil)
+		return
+	}
+	c.pending[ip] = struct{}{}
+	c.mu.Unlock()
+
+	go func() {
+		defer func() {
+			c.mu.Lock()
+			delete(c.pending, ip)
+			c.mu.Unlock()
+		}()
+
+		info, err := c.lookup(ip)
+		if err != nil {
+			fn(nil)
+			return
+		}
+
+		fn(info)
+	}()
+}
+
+func (c *Client) lookup(ip netip.Addr) (*Info, error) {
+	item, err := c.lookupFunc(ip.String())
+	if err != nil {
+		c.logger.Warn("failed looking up IP in CTI API", zap.String("ip", ip.String()), zap.Error(err))
+		return nil, err
+	}
+
+	info := newInfo(item)
+	c.cache.Set(ip, info)
+
+	return info, nil
+}
@@ -0,0 +1,119 @@
+package cti
+
+import (
+	"errors"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/crowdsecurity/crowdsec/pkg/cticlient"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+)
+
+func newTestClient(t *testing.T, perHour int) (*Client, *atomic.Int32) {
+	t.Helper()
+
+	var lookups atomic.Int32
+	c := New("key", time.Hour, 10, perHour, zaptest.NewLogger(t))
+	c.lookupFunc = func(ip string) (*cticlient.SmokeItem, error) {
+		lookups.Add(1)
+		switch ip {
+		case "10.0.0.1":
+			score, country, as := 8, "NL", "Example AS"
+			return &cticlient.SmokeItem{
+				Ip:                   ip,
+				BackgroundNoiseScore: &score,
+				Behaviors:            []*cticlient.CTIBehavior{{Name: "http:scan"}},
+				AttackDetails:        []*cticlient.CTIAttackDetails{{Name: "crowdsecurity/http-probing"}},
+				Classifications: cticlient.CTIClassifications{
+					Classifications: []cticlient.CTIClassification{{Name: "community-blocklist"}},
+				},
+				Location: cticlient.CTILocationInfo{Country: &country},
+				AsName:   &as,
+			}, nil
+		case "10.0.0.2":
+			return &cticlient.SmokeItem{}, nil // not found
+		default:
+			return nil, errors.New("unexpected http code : 500 Internal Server Error")
+		}
+	}
+
+	return c, &lookups
+}
+
+func TestClient_Lookup(t *testing.T) {
+	c, lookups := newTestClient(t, -1)
+
+	info, err := c.Lookup(netip.MustParseAddr("10.0.0.1"))
+	require.NoError(t, err)
+	assert.Equal(t, &Info{
+		Known:                true,
+		BackgroundNoiseScore: 8,
+		Classifications:      []string{"community-blocklist"},
+		FalsePositives:       []string{},
+		Behaviors:            []string{"http:scan"},
+		AttackDetails:        []string{"crowdsecurity/http-probing"},
+		Country:              "NL",
+		ASName:               "Example AS",
+	}, info)
+
+	// cached
+	_, err = c.Lookup(netip.MustParseAddr("10.0.0.1"))
+	require.NoError(t, err)
+	assert.Equal(t, int32(1), lookups.Load())
+
+	info, err = c.Lookup(netip.MustParseAddr("10.0.0.2"))
+	require.NoError(t, err)
+	assert.False(t, info.Known)
+
+	_, err = c.Lookup(netip.MustParseAddr("10.0.0.3"))
+	assert.Error(t, err)
+	_, ok := c.Cached(netip.MustParseAddr("10.0.0.3"))
+	assert.False(t, ok)
+}
+
+func TestClient_LookupRateLimited(t *testing.T) {
+	c, lookups := newTestClient(t, 1)
+
+	_, err := c.Lookup(netip.MustParseAddr("10.0.0.1"))
+	require.NoError(t, err)
+
+	_, err = c.Lookup(netip.MustParseAddr("10.0.0.2"))
+	assert.ErrorIs(t, err, ErrRateLimited)
+
+	// cached results are returned, even when rate limited
+	_, err = c.Lookup(netip.MustParseAddr("10.0.0.1"))
+	require.NoError(t, err)
+	assert.Equal(t, int32(1), lookups.Load())
+}
+
+func TestClient_LookupAsync(t *testing.T) {
+	c, _ := newTestClient(t, -1)
+
+	results := make(chan *Info, 1)
+	c.LookupAsync(netip.MustParseAddr("10.0.0.1"), func(info *Info) { results <- info })
+
+	select {
+	case info := <-results:
+		require.NotNil(t, info)
+		assert.True(t, info.Known)
+	case <-time.After(time.Second):
+		t.Fatal("lookup didn't finish")
+	}
+
+	// cached results are provided immediately
+	var cached *Info
+	c.LookupAsync(netip.MustParseAddr("10.0.0.1"), func(info *Info) { cached = info })
+	require.NotNil(t, cached)
+
+	c.LookupAsync(netip.MustParseAddr("10.0.0.3"), func(info *Info) { results <- info })
+	select {
+	case info := <-results:
+		assert.Nil(t, info)
+	case <-time.After(time.Second):
+		t.Fatal("lookup didn't finish")
+	}
+}
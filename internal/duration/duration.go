@@ -0,0 +1,75 @@
+// Copyright 2024 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package duration parses and validates the duration options of the
+// CrowdSec app and its handlers, so that all of them accept the same
+// syntax and report errors naming the option.
+package duration
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+// Parse parses the value of the duration option named field. Durations
+// use the Caddy syntax, i.e. 1m30s, 2h or 7d. An integer without a unit
+// is a number of seconds. Negative durations are not allowed.
+func Parse(field, value string) (time.Duration, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, fmt.Errorf("invalid %s: duration must not be empty", field)
+	}
+
+	var (
+		duration time.Duration
+		err      error
+	)
+	if seconds, perr := strconv.ParseInt(value, 10, 64); perr == nil {
+		duration = time.Duration(seconds) * time.Second
+	} else if duration, err = caddy.ParseDuration(value); err != nil {
+		return 0, fmt.Errorf("invalid %s %q: must be a duration like 90s, 1m30s or 2h", field, value)
+	}
+
+	if err := Check(field, duration); err != nil {
+		return 0, err
+	}
+
+	return duration, nil
+}
+
+// Check checks the duration of the option named field, which can be set
+// as a JSON number of nanoseconds, and thus isn't parsed using Parse.
+func Check[T time.Duration | caddy.Duration](field string, duration T) error {
+	if duration < 0 {
+		return fmt.Errorf("invalid %s %s: must not be negative", field, time.Duration(duration))
+	}
+
+	return nil
+}
+
+// ParseCaddyfile parses the current token of d as the value of the
+// duration option named field.
+func ParseCaddyfile(d *caddyfile.Dispenser, field string) (caddy.Duration, error) {
+	duration, err := Parse(field, d.Val())
+	if err != nil {
+		return 0, d.Err(err.Error())
+	}
+
+	return caddy.Duration(duration), nil
+}
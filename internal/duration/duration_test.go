@@ -0,0 +1,68 @@
+package duration
+
+import (
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    time.Duration
+		wantErr string
+	}{
+		{value: "90s", want: 90 * time.Second},
+		{value: "1m30s", want: 90 * time.Second},
+		{value: "2h", want: 2 * time.Hour},
+		{value: "7d", want: 7 * 24 * time.Hour},
+		{value: " 0 ", want: 0},
+		{value: "90", want: 90 * time.Second},
+		{value: " 3600 ", want: time.Hour},
+		{value: "", wantErr: "invalid ticker_interval: duration must not be empty"},
+		{value: "30x", wantErr: `invalid ticker_interval "30x": must be a duration like 90s, 1m30s or 2h`},
+		{value: "1.5", wantErr: `invalid ticker_interval "1.5": must be a duration like 90s, 1m30s or 2h`},
+		{value: "-1m", wantErr: "invalid ticker_interval -1m0s: must not be negative"},
+		{value: "-90", wantErr: "invalid ticker_interval -1m30s: must not be negative"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			got, err := Parse("ticker_interval", tt.value)
+			if tt.wantErr != "" {
+				assert.EqualError(t, err, tt.wantErr)
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestCheck(t *testing.T) {
+	assert.NoError(t, Check("appsec_timeout", caddy.Duration(0)))
+	assert.NoError(t, Check("appsec_timeout", time.Second))
+	assert.EqualError(t, Check("appsec_timeout", caddy.Duration(-time.Second)), "invalid appsec_timeout -1s: must not be negative")
+}
+
+func TestParseCaddyfile(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`timeout 2`)
+	require.True(t, d.Next())
+	require.True(t, d.NextArg())
+
+	got, err := ParseCaddyfile(d, "appsec_timeout")
+	require.NoError(t, err)
+	assert.Equal(t, caddy.Duration(2*time.Second), got)
+
+	d = caddyfile.NewTestDispenser(`timeout 30x`)
+	require.True(t, d.Next())
+	require.True(t, d.NextArg())
+
+	_, err = ParseCaddyfile(d, "appsec_timeout")
+	assert.ErrorContains(t, err, `invalid appsec_timeout "30x"`)
+	assert.ErrorContains(t, err, "Testfile:1")
+}
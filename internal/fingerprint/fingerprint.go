@@ -0,0 +1,401 @@
+// Package fingerprint computes JA3 and JA4 TLS client fingerprints
+// from the raw TLS ClientHello sent by a client.
+package fingerprint
+
+import (
+	"crypto/md5" // nolint:gosec // JA3 is defined as an MD5 hash
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	recordTypeHandshake      = 0x16
+	handshakeTypeClientHello = 0x01
+
+	extensionServerName          = 0x0000
+	extensionSupportedGroups     = 0x000a
+	extensionECPointFormats      = 0x000b
+	extensionSignatureAlgorithms = 0x000d
+	extensionALPN                = 0x0010
+	extensionSupportedVersions   = 0x002b
+)
+
+// ErrIncomplete is returned when the data doesn't contain a complete
+// TLS record yet.
+var ErrIncomplete = errors.New("incomplete TLS record")
+
+// ClientHello holds the fields of a TLS ClientHello that are used to
+// compute fingerprints.
+type ClientHello struct {
+	Version             uint16
+	CipherSuites        []uint16
+	Extensions          []uint16
+	SupportedGroups     []uint16
+	ECPointFormats      []uint8
+	SignatureAlgorithms []uint16
+	SupportedVersions   []uint16
+	ServerName          string
+	ALPNProtocols       []string
+}
+
+// Fingerprint holds the JA3 and JA4 fingerprints of a client.
+type Fingerprint struct {
+	JA3 string
+	JA4 string
+}
+
+// Parse parses the TLS ClientHello from the first TLS record sent by
+// a client. It returns [ErrIncomplete] if data doesn't hold the complete
+// record yet.
+func Parse(data []byte) (*ClientHello, error) {
+	if len(data) < 5 {
+		return nil, ErrIncomplete
+	}
+	if data[0] != recordTypeHandshake {
+		return nil, fmt.Errorf("unexpected TLS record type %d", data[0])
+	}
+
+	length := int(binary.BigEndian.Uint16(data[3:5]))
+	if len(data) < 5+length {
+		return nil, ErrIncomplete
+	}
+
+	r := reader(data[5 : 5+length])
+	msgType, ok := r.uint8()
+	if !ok || msgType != handshakeTypeClientHello {
+		return nil, errors.New("TLS record is not a ClientHello")
+	}
+
+	var (
+		hello     = &ClientHello{}
+		body      reader
+		sessionID reader
+		ciphers   reader
+		methods   reader
+	)
+	if !r.bytes24(&body) {
+		return nil, errors.New("invalid ClientHello length")
+	}
+	if !body.uint16(&hello.Version) || !body.skip(32) || !body.bytes8(&sessionID) ||
+		!body.bytes16(&ciphers) || !body.bytes8(&methods) {
+		return nil, errors.New("malformed ClientHello")
+	}
+
+	for len(ciphers) > 0 {
+		var c uint16
+		if !ciphers.uint16(&c) {
+			return nil, errors.New("malformed ClientHello cipher suites")
+		}
+		hello.CipherSuites = append(hello.CipherSuites, c)
+	}
+
+	if len(body) == 0 {
+		return hello, nil // no extensions
+	}
+
+	var extensions reader
+	if !body.bytes16(&extensions) {
+		return nil, errors.New("malformed ClientHello extensions")
+	}
+
+	for len(extensions) > 0 {
+		var (
+			typ  uint16
+			data reader
+		)
+		if !extensions.uint16(&typ) || !extensions.bytes16(&data) {
+			return nil, errors.New("malformed ClientHello extension")
+		}
+		hello.Extensions = append(hello.Extensions, typ)
+
+		if err := hello.parseExtension(typ, data); err != nil {
+			return nil, err
+		}
+	}
+
+	return hello, nil
+}
+
+func (h *ClientHello) parseExtension(typ uint16, data reader) error {
+	switch typ {
+	case extensionServerName:
+		var names reader
+		if !data.bytes16(&names) {
+			return errors.New("malformed server name extension")
+		}
+		for len(names) > 0 {
+			var (
+				nameType uint8
+				name     reader
+			)
+			if !names.uint8p(&nameType) || !names.bytes16(&name) {
+				return errors.New("malformed server name extension")
+			}
+			if nameType == 0 {
+				h.ServerName = string(name)
+			}
+		}
+	case extensionSupportedGroups:
+		var groups reader
+		if !data.bytes16(&groups) || !groups.uint16s(&h.SupportedGroups) {
+			return errors.New("malformed supported groups extension")
+		}
+	case extensionECPointFormats:
+		var formats reader
+		if !data.bytes8(&formats) {
+			return errors.New("malformed EC point formats extension")
+		}
+		h.ECPointFormats = append(h.ECPointFormats, formats...)
+	case extensionSignatureAlgorithms:
+		var algorithms reader
+		if !data.bytes16(&algorithms) || !algorithms.uint16s(&h.SignatureAlgorithms) {
+			return errors.New("malformed signature algorithms extension")
+		}
+	case extensionALPN:
+		var protocols reader
+		if !data.bytes16(&protocols) {
+			return errors.New("malformed ALPN extension")
+		}
+		for len(protocols) > 0 {
+			var proto reader
+			if !protocols.bytes8(&proto) {
+				return errors.New("malformed ALPN extension")
+			}
+			h.ALPNProtocols = append(h.ALPNProtocols, string(proto))
+		}
+	case extensionSupportedVersions:
+		var versions reader
+		if !data.bytes8(&versions) || !versions.uint16s(&h.SupportedVersions) {
+			return errors.New("malformed supported versions extension")
+		}
+	}
+
+	return nil
+}
+
+// JA3 returns the JA3 fingerprint of the ClientHello, which is the MD5
+// hash of its JA3 string.
+func (h *ClientHello) JA3() string {
+	sum := md5.Sum([]byte(h.JA3String())) // nolint:gosec // JA3 is defined as an MD5 hash
+	return hex.EncodeToString(sum[:])
+}
+
+// JA3String returns the JA3 string of the ClientHello. GREASE values
+// are ignored.
+func (h *ClientHello) JA3String() string {
+	formats := make([]uint16, 0, len(h.ECPointFormats))
+	for _, f := range h.ECPointFormats {
+		formats = append(formats, uint16(f))
+	}
+
+	return strings.Join([]string{
+		strconv.Itoa(int(h.Version)),
+		joinDecimal(h.CipherSuites),
+		joinDecimal(h.Extensions),
+		joinDecimal(h.SupportedGroups),
+		joinDecimal(formats),
+	}, ",")
+}
+
+// JA4 returns the JA4 fingerprint of the ClientHello, received over TCP.
+func (h *ClientHello) JA4() string {
+	ciphers := withoutGREASE(h.CipherSuites)
+	extensions := withoutGREASE(h.Extensions)
+
+	sni := "i"
+	if h.ServerName != "" {
+		sni = "d"
+	}
+
+	alpn := "00"
+	if len(h.ALPNProtocols) > 0 && h.ALPNProtocols[0] != "" {
+		p := h.ALPNProtocols[0]
+		alpn = string(p[0]) + string(p[len(p)-1])
+	}
+
+	a := fmt.Sprintf("t%s%s%02d%02d%s", h.ja4Version(), sni, min(len(ciphers), 99), min(len(extensions), 99), alpn)
+
+	slices.Sort(ciphers)
+	b := truncatedHash(joinHex(ciphers))
+
+	sorted := slices.DeleteFunc(slices.Clone(extensions), func(e uint16) bool {
+		return e == extensionServerName || e == extensionALPN
+	})
+	slices.Sort(sorted)
+	c := joinHex(sorted)
+	if algorithms := withoutGREASE(h.SignatureAlgorithms); len(algorithms) > 0 {
+		c += "_" + joinHex(algorithms)
+	}
+
+	return a + "_" + b + "_" + truncatedHash(c)
+}
+
+func (h *ClientHello) ja4Version() string {
+	version := h.Version
+	if versions := withoutGREASE(h.SupportedVersions); len(versions) > 0 {
+		version = slices.Max(versions)
+	}
+
+	switch version {
+	case 0x0304:
+		return "13"
+	case 0x0303:
+		return "12"
+	case 0x0302:
+		return "11"
+	case 0x0301:
+		return "10"
+	case 0x0300:
+		return "s3"
+	default:
+		return "00"
+	}
+}
+
+// Fingerprint returns the JA3 and JA4 fingerprints of the ClientHello.
+func (h *ClientHello) Fingerprint() Fingerprint {
+	return Fingerprint{JA3: h.JA3(), JA4: h.JA4()}
+}
+
+var fingerprints sync.Map
+
+// Store stores the fingerprint for the connection from addr.
+func Store(addr string, fp Fingerprint) {
+	fingerprints.Store(addr, fp)
+}
+
+// Lookup returns the fingerprint for the connection from addr.
+func Lookup(addr string) (Fingerprint, bool) {
+	v, ok := fingerprints.Load(addr)
+	if !ok {
+		return Fingerprint{}, false
+	}
+
+	return v.(Fingerprint), true
+}
+
+// Delete deletes the fingerprint for the connection from addr.
+func Delete(addr string) {
+	fingerprints.Delete(addr)
+}
+
+// isGREASE reports whether v is a GREASE value, as defined in RFC 8701.
+func isGREASE(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+func withoutGREASE(values []uint16) []uint16 {
+	return slices.DeleteFunc(slices.Clone(values), isGREASE)
+}
+
+func joinDecimal(values []uint16) string {
+	parts := make([]string, 0, len(values))
+	for _, v := range values {
+		if isGREASE(v) {
+			continue
+		}
+		parts = append(parts, strconv.Itoa(int(v)))
+	}
+
+	return strings.Join(parts, "-")
+}
+
+func joinHex(values []uint16) string {
+	parts := make([]string, 0, len(values))
+	for _, v := range values {
+		parts = append(parts, fmt.Sprintf("%04x", v))
+	}
+
+	return strings.Join(parts, ",")
+}
+
+func truncatedHash(s string) string {
+	if s == "" {
+		return "000000000000"
+	}
+
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+// reader is a minimal cursor over TLS handshake data.
+type reader []byte
+
+func (r *reader) skip(n int) bool {
+	if len(*r) < n {
+		return false
+	}
+	*r = (*r)[n:]
+	return true
+}
+
+func (r *reader) uint8() (uint8, bool) {
+	if len(*r) < 1 {
+		return 0, false
+	}
+	v := (*r)[0]
+	*r = (*r)[1:]
+	return v, true
+}
+
+func (r *reader) uint8p(v *uint8) bool {
+	var ok bool
+	*v, ok = r.uint8()
+	return ok
+}
+
+func (r *reader) uint16(v *uint16) bool {
+	if len(*r) < 2 {
+		return false
+	}
+	*v = binary.BigEndian.Uint16(*r)
+	*r = (*r)[2:]
+	return true
+}
+
+func (r *reader) uint16s(values *[]uint16) bool {
+	if len(*r)%2 != 0 {
+		return false
+	}
+	for len(*r) > 0 {
+		var v uint16
+		r.uint16(&v)
+		*values = append(*values, v)
+	}
+	return true
+}
+
+func (r *reader) bytesN(n int, out *reader) bool {
+	if len(*r) < n {
+		return false
+	}
+	*out = (*r)[:n]
+	*r = (*r)[n:]
+	return true
+}
+
+func (r *reader) bytes8(out *reader) bool {
+	n, ok := r.uint8()
+	return ok && r.bytesN(int(n), out)
+}
+
+func (r *reader) bytes16(out *reader) bool {
+	var n uint16
+	return r.uint16(&n) && r.bytesN(int(n), out)
+}
+
+func (r *reader) bytes24(out *reader) bool {
+	if len(*r) < 3 {
+		return false
+	}
+	n := int((*r)[0])<<16 | int((*r)[1])<<8 | int((*r)[2])
+	*r = (*r)[3:]
+	return r.bytesN(n, out)
+}
@@ -0,0 +1,107 @@
+package fingerprint
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// captureClientHello returns the first TLS record sent by a Go TLS client.
+func captureClientHello(t *testing.T, config *tls.Config) []byte {
+	t.Helper()
+
+	client, server := net.Pipe()
+	t.Cleanup(func() { _ = server.Close() })
+
+	go func() {
+		_ = tls.Client(client, config).Handshake()
+		_ = client.Close()
+	}()
+
+	var data []byte
+	buf := make([]byte, 1024)
+	for {
+		n, err := server.Read(buf)
+		require.NoError(t, err)
+		data = append(data, buf[:n]...)
+		if _, err := Parse(data); !errors.Is(err, ErrIncomplete) {
+			return data
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+	data := captureClientHello(t, &tls.Config{
+		ServerName: "example.com",
+		NextProtos: []string{"h2", "http/1.1"},
+		MinVersion: tls.VersionTLS12,
+	})
+
+	hello, err := Parse(data)
+	require.NoError(t, err)
+
+	assert.Equal(t, uint16(tls.VersionTLS12), hello.Version) // legacy version
+	assert.Equal(t, "example.com", hello.ServerName)
+	assert.Equal(t, []string{"h2", "http/1.1"}, hello.ALPNProtocols)
+	assert.Contains(t, hello.SupportedVersions, uint16(tls.VersionTLS13))
+	assert.NotEmpty(t, hello.CipherSuites)
+	assert.NotEmpty(t, hello.SignatureAlgorithms)
+
+	assert.Regexp(t, regexp.MustCompile(`^[0-9a-f]{32}$`), hello.JA3())
+	assert.True(t, strings.HasPrefix(hello.JA3String(), "771,"))
+	assert.Regexp(t, regexp.MustCompile(`^t13d\d{4}h2_[0-9a-f]{12}_[0-9a-f]{12}$`), hello.JA4())
+
+	_, err = Parse(data[:len(data)-1])
+	assert.ErrorIs(t, err, ErrIncomplete)
+
+	_, err = Parse([]byte{0x17, 0x03, 0x03, 0x00, 0x00})
+	assert.Error(t, err)
+}
+
+func TestClientHello(t *testing.T) {
+	hello := &ClientHello{
+		Version:             0x0303,
+		CipherSuites:        []uint16{0x0a0a, 0x1302, 0x1301, 0xc02b},
+		Extensions:          []uint16{0x1a1a, extensionServerName, extensionSupportedGroups, extensionECPointFormats, extensionSignatureAlgorithms, extensionALPN},
+		SupportedGroups:     []uint16{0x2a2a, 0x001d, 0x0017},
+		ECPointFormats:      []uint8{0},
+		SignatureAlgorithms: []uint16{0x0403, 0x0804},
+		ServerName:          "example.com",
+		ALPNProtocols:       []string{"http/1.1"},
+	}
+
+	// GREASE values are ignored
+	assert.Equal(t, "771,4866-4865-49195,0-10-11-13-16,29-23,0", hello.JA3String())
+	assert.Equal(t, "t12d0305h1_5559582ccdc4_876bcc86782c", hello.JA4())
+
+	hello.ALPNProtocols = nil
+	hello.ServerName = ""
+	hello.CipherSuites = nil
+	assert.True(t, strings.HasPrefix(hello.JA4(), "t12i000500_000000000000_"))
+}
+
+func TestStore(t *testing.T) {
+	fp := Fingerprint{JA3: "ja3", JA4: "ja4"}
+	Store("10.0.0.1:1234", fp)
+
+	got, ok := Lookup("10.0.0.1:1234")
+	assert.True(t, ok)
+	assert.Equal(t, fp, got)
+
+	Delete("10.0.0.1:1234")
+	_, ok = Lookup("10.0.0.1:1234")
+	assert.False(t, ok)
+}
+
+func Test_isGREASE(t *testing.T) {
+	assert.True(t, isGREASE(0x0a0a))
+	assert.True(t, isGREASE(0xfafa))
+	assert.False(t, isGREASE(0x0a1a))
+	assert.False(t, isGREASE(0x1301))
+}
@@ -0,0 +1,56 @@
+// Copyright 2024 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httputils
+
+import (
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// ParseMatcherSet parses a matcher set from the arguments or block of the
+// current Caddyfile (sub)directive. A matcher token, like a named matcher
+// (@name) or a path (/path), is resolved using the [httpcaddyfile.Helper].
+// Otherwise the matchers are parsed inline, e.g. `path /healthz` or a block
+// of matchers. An empty matcher set would match all requests, so at least
+// one matcher is required.
+func ParseMatcherSet(h httpcaddyfile.Helper) (caddy.ModuleMap, error) {
+	if h.NextArg() {
+		tkn := h.Val()
+		h.Prev()
+		if strings.HasPrefix(tkn, "@") || strings.HasPrefix(tkn, "/") {
+			matcherSet, _, err := h.MatcherToken()
+			if err != nil {
+				return nil, h.Err(err.Error())
+			}
+			if h.NextArg() {
+				return nil, h.ArgErr()
+			}
+			return matcherSet, nil
+		}
+	}
+
+	matcherSet, err := caddyhttp.ParseCaddyfileNestedMatcherSet(h.Dispenser)
+	if err != nil {
+		return nil, err
+	}
+	if len(matcherSet) == 0 {
+		return nil, h.ArgErr()
+	}
+
+	return matcherSet, nil
+}
@@ -0,0 +1,69 @@
+// Copyright 2024 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httputils
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseMatcherSet(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    caddy.ModuleMap
+		wantErr bool
+	}{
+		{name: "path-token", input: `exempt /healthz`, want: caddy.ModuleMap{
+			"path": json.RawMessage(`["/healthz"]`),
+		}},
+		{name: "inline", input: `exempt path /.well-known/acme-challenge/*`, want: caddy.ModuleMap{
+			"path": json.RawMessage(`["/.well-known/acme-challenge/*"]`),
+		}},
+		{name: "block", input: `exempt {
+			path /healthz
+			remote_ip 10.0.0.0/8
+		}`, want: caddy.ModuleMap{
+			"path":      json.RawMessage(`["/healthz"]`),
+			"remote_ip": json.RawMessage(`{"ranges":["10.0.0.0/8"]}`),
+		}},
+		{name: "fail/empty", input: `exempt`, wantErr: true},
+		{name: "fail/empty-block", input: `exempt {
+		}`, wantErr: true},
+		{name: "fail/path-token-with-argument", input: `exempt /healthz /metrics`, wantErr: true},
+		{name: "fail/undefined-named-matcher", input: `exempt @internal`, wantErr: true},
+		{name: "fail/unknown-matcher", input: `exempt unknown /healthz`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := caddyfile.NewTestDispenser(tt.input)
+			require.True(t, d.Next())
+
+			got, err := ParseMatcherSet(httpcaddyfile.Helper{Dispenser: d})
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+
+			require.NoError(t, err)
+			require.Equal(t, tt.want, got)
+		})
+	}
+}
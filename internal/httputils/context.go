@@ -17,6 +17,9 @@ package httputils
 import (
 	"context"
 	"net/netip"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/crowdsecurity/crowdsec/pkg/models"
 )
 
 type contextKey struct{}
@@ -55,3 +58,34 @@ func FromContext(ctx context.Context) (netip.Addr, bool) {
 
 	return v, true
 }
+
+// lookupVarKey is the name of the request variable holding the result of
+// the decision lookup for the request. The variables of a request are
+// shared by all handlers and matchers, unlike values added to its context.
+const lookupVarKey = "crowdsec_lookup"
+
+// lookup is the result of looking up the decision for an IP.
+type lookup struct {
+	ip       netip.Addr
+	allowed  bool
+	decision *models.Decision
+}
+
+// SetLookup stores the result of the decision lookup for ip in the
+// variables of the request with ctx, so that it can be reused by other
+// handlers and matchers for the same request.
+func SetLookup(ctx context.Context, ip netip.Addr, allowed bool, decision *models.Decision) {
+	caddyhttp.SetVar(ctx, lookupVarKey, &lookup{ip: ip, allowed: allowed, decision: decision})
+}
+
+// LookupFromContext returns the result of the decision lookup for ip
+// stored in the variables of the request with ctx. It reports whether
+// a result for ip was stored.
+func LookupFromContext(ctx context.Context, ip netip.Addr) (bool, *models.Decision, bool) {
+	l, ok := caddyhttp.GetVar(ctx, lookupVarKey).(*lookup)
+	if !ok || l.ip != ip {
+		return false, nil, false
+	}
+
+	return l.allowed, l.decision, true
+}
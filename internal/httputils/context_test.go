@@ -20,6 +20,7 @@ import (
 	"testing"
 
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/crowdsecurity/crowdsec/pkg/models"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -93,3 +94,26 @@ func TestFromContext(t *testing.T) {
 	require.True(t, ok)
 	require.Equal(t, ip, got)
 }
+
+func TestLookupFromContext(t *testing.T) {
+	ip := netip.MustParseAddr("10.0.0.10")
+	typ := "ban"
+
+	ctx := newCaddyVarsContext()
+	_, _, ok := LookupFromContext(ctx, ip)
+	assert.False(t, ok)
+
+	SetLookup(ctx, ip, false, &models.Decision{Type: &typ})
+	isAllowed, decision, ok := LookupFromContext(ctx, ip)
+	require.True(t, ok)
+	assert.False(t, isAllowed)
+	assert.Equal(t, "ban", *decision.Type)
+
+	_, _, ok = LookupFromContext(ctx, netip.MustParseAddr("10.0.0.11"))
+	assert.False(t, ok)
+
+	// without request variables nothing is stored
+	SetLookup(context.Background(), ip, true, nil)
+	_, _, ok = LookupFromContext(context.Background(), ip)
+	assert.False(t, ok)
+}
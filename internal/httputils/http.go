@@ -20,9 +20,12 @@ import (
 	"fmt"
 	"net/http"
 	"net/netip"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/crowdsecurity/crowdsec/pkg/models"
 	"go.uber.org/zap"
 )
 
@@ -52,7 +55,98 @@ func determineIPFromRequest(ctx context.Context) (netip.Addr, error) {
 		return zero, fmt.Errorf("could not parse %q into netip.Addr", clientIP)
 	}
 
-	return ip, nil
+	return NormalizeIP(ip), nil
+}
+
+// NormalizeIP returns ip in the form used for decisions. IPv4 clients
+// connecting to a dual-stack socket, which is common for HTTP/3 over
+// QUIC, have an IPv4-mapped IPv6 address, like ::ffff:192.0.2.1, that
+// wouldn't match decisions for the IPv4 address. Zones are removed too,
+// as they're meaningless outside of the host.
+func NormalizeIP(ip netip.Addr) netip.Addr {
+	return ip.Unmap().WithZone("")
+}
+
+// ForwardedIPs returns the valid IPs in the client IP headers of the
+// request that were added by trusted proxies, starting with the nearest
+// hop. It only returns IPs when the request was received from a trusted
+// proxy, which added the rightmost value. The values are walked from the
+// right, and the walk stops after the first hop that isn't in trusted,
+// as the values to the left of it could've been written by anyone. The
+// client IP headers configured for the Caddy server are used, with
+// X-Forwarded-For as the default.
+func ForwardedIPs(r *http.Request, trusted []netip.Prefix) []netip.Addr {
+	if fromTrustedProxy, _ := caddyhttp.GetVar(r.Context(), caddyhttp.TrustedProxyVarKey).(bool); !fromTrustedProxy {
+		return nil
+	}
+
+	headers := []string{"X-Forwarded-For"}
+	if srv, ok := r.Context().Value(caddyhttp.ServerCtxKey).(*caddyhttp.Server); ok && len(srv.ClientIPHeaders) > 0 {
+		headers = srv.ClientIPHeaders
+	}
+
+	var values []string
+	for _, field := range headers {
+		values = append(values, r.Header.Values(field)...)
+	}
+
+	var ips []netip.Addr
+	hops := strings.Split(strings.Join(values, ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		v, _, _ := strings.Cut(strings.TrimSpace(hops[i]), "%")
+		ip, err := netip.ParseAddr(v)
+		if err != nil {
+			// an invalid value can't be attributed to a trusted proxy
+			break
+		}
+		ip = NormalizeIP(ip)
+		ips = append(ips, ip)
+		if !containsIP(trusted, ip) {
+			break
+		}
+	}
+
+	return ips
+}
+
+func containsIP(prefixes []netip.Prefix, ip netip.Addr) bool {
+	for _, p := range prefixes {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// IsUpgrade returns whether the request is a connection upgrade
+// request, such as a WebSocket handshake.
+func IsUpgrade(r *http.Request) bool {
+	if r.Header.Get("Upgrade") == "" {
+		return false
+	}
+
+	for _, v := range r.Header.Values("Connection") {
+		for _, token := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// IsStreamingBody returns whether the request has a streaming body, like
+// gRPC calls, or bodies of unknown length, which are common for h2c and
+// HTTP/2 clients. These bodies may not end until the response is (partly)
+// written, so they can't be buffered completely.
+func IsStreamingBody(r *http.Request) bool {
+	if strings.HasPrefix(strings.ToLower(r.Header.Get("Content-Type")), "application/grpc") {
+		return true
+	}
+
+	return r.ContentLength < 0 && r.Body != nil && r.Body != http.NoBody
 }
 
 // WriteResponse writes a response to the [http.ResponseWriter] based on the typ, value,
@@ -60,21 +154,81 @@ func determineIPFromRequest(ctx context.Context) (netip.Addr, error) {
 func WriteResponse(w http.ResponseWriter, logger *zap.Logger, typ, value, duration string, statusCode int) error {
 	switch typ {
 	case "ban":
-		logger.Debug(fmt.Sprintf("serving ban response to %s", value))
+		logger.Debug("serving ban response", zap.String("value", value))
 		return writeBanResponse(w, statusCode)
 	case "captcha":
-		logger.Debug(fmt.Sprintf("serving captcha (ban) response to %s", value))
+		logger.Debug("serving captcha (ban) response", zap.String("value", value))
 		return writeCaptchaResponse(w, statusCode)
 	case "throttle":
-		logger.Debug(fmt.Sprintf("serving throttle response to %s", value))
+		logger.Debug("serving throttle response", zap.String("value", value), zap.String("duration", duration))
 		return writeThrottleResponse(w, duration)
 	default:
-		logger.Warn(fmt.Sprintf("got crowdsec decision type: %s", typ))
-		logger.Debug(fmt.Sprintf("serving ban response to %s", value))
+		logger.Warn("got unknown crowdsec decision type", zap.String("type", typ))
+		logger.Debug("serving ban response", zap.String("value", value))
 		return writeBanResponse(w, statusCode)
 	}
 }
 
+// AddServerTiming adds a Server-Timing entry named name to the response
+// headers, with d as its duration in milliseconds, i.e. crowdsec;dur=0.123.
+// The entries show up in the network panel of the browser developer tools.
+func AddServerTiming(w http.ResponseWriter, name string, d time.Duration) {
+	ms := strconv.FormatFloat(float64(d)/float64(time.Millisecond), 'f', 3, 64)
+	w.Header().Add("Server-Timing", name+";dur="+ms)
+}
+
+// DecisionHeader is the name of the response header describing the
+// decision that resulted in a request being blocked.
+const DecisionHeader = "X-CrowdSec-Decision"
+
+// SetDecisionHeader sets a response header describing the decision
+// that resulted in the request being blocked, e.g. "ban; scenario=http-probing".
+func SetDecisionHeader(w http.ResponseWriter, decision *models.Decision) {
+	if decision == nil || decision.Type == nil {
+		return
+	}
+
+	parts := []string{*decision.Type}
+	if decision.Scenario != nil && *decision.Scenario != "" {
+		parts = append(parts, "scenario="+*decision.Scenario)
+	}
+	if decision.Origin != nil && *decision.Origin != "" {
+		parts = append(parts, "origin="+*decision.Origin)
+	}
+
+	w.Header().Set(DecisionHeader, strings.Join(parts, "; "))
+}
+
+// ErrorResponse returns a Caddy HTTP error for the remediation, instead of
+// writing a response directly. This allows the response to be customized in
+// the error routes of the server, i.e. using `handle_errors`.
+func ErrorResponse(w http.ResponseWriter, typ, duration string, statusCode int) error {
+	code := statusCode
+	switch typ {
+	case "throttle":
+		if d, err := time.ParseDuration(duration); err == nil {
+			w.Header().Add("Retry-After", fmt.Sprintf("%.0f", d.Seconds()))
+		}
+		code = http.StatusTooManyRequests
+	default:
+		if code <= 0 {
+			code = http.StatusForbidden
+		}
+	}
+
+	return caddyhttp.Error(code, fmt.Errorf("request blocked by crowdsec: %s", typ))
+}
+
+// SetDecisionVars stores details about the decision that blocked the
+// request in the request variables, so that they can be used through
+// placeholders like {http.vars.crowdsec_decision_type}.
+func SetDecisionVars(ctx context.Context, typ, value, origin, scenario string) {
+	caddyhttp.SetVar(ctx, "crowdsec_decision_type", typ)
+	caddyhttp.SetVar(ctx, "crowdsec_decision_value", value)
+	caddyhttp.SetVar(ctx, "crowdsec_decision_origin", origin)
+	caddyhttp.SetVar(ctx, "crowdsec_decision_scenario", scenario)
+}
+
 // writeBanResponse writes a 403 status as response
 func writeBanResponse(w http.ResponseWriter, statusCode int) error {
 	code := statusCode
@@ -16,10 +16,16 @@ package httputils
 
 import (
 	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
 	"net/netip"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/crowdsecurity/crowdsec/pkg/models"
 	"github.com/stretchr/testify/require"
 )
 
@@ -38,6 +44,10 @@ func Test_determineIPFromRequest(t *testing.T) {
 	caddyhttp.SetVar(emptyIPCtx, caddyhttp.ClientIPVarKey, "")
 	invalidIPCtx := newCaddyVarsContext()
 	caddyhttp.SetVar(invalidIPCtx, caddyhttp.ClientIPVarKey, "127.0.0.1.x")
+	mappedIPCtx := newCaddyVarsContext()
+	caddyhttp.SetVar(mappedIPCtx, caddyhttp.ClientIPVarKey, "::ffff:192.0.2.1")
+	zonedIPCtx := newCaddyVarsContext()
+	caddyhttp.SetVar(zonedIPCtx, caddyhttp.ClientIPVarKey, "fe80::1%eth0")
 	type args struct {
 		ctx context.Context
 	}
@@ -52,6 +62,8 @@ func Test_determineIPFromRequest(t *testing.T) {
 		{"wrong-type", args{wrongTypeCtx}, netip.Addr{}, true},
 		{"empty-ip", args{emptyIPCtx}, netip.Addr{}, true},
 		{"invalid-ip", args{invalidIPCtx}, netip.Addr{}, true},
+		{"ipv4-mapped", args{mappedIPCtx}, netip.MustParseAddr("192.0.2.1"), false},
+		{"zoned", args{zonedIPCtx}, netip.MustParseAddr("fe80::1"), false},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -67,3 +79,159 @@ func Test_determineIPFromRequest(t *testing.T) {
 		})
 	}
 }
+
+func TestSetDecisionHeader(t *testing.T) {
+	typ := "ban"
+	scenario := "crowdsecurity/http-probing"
+	origin := "crowdsec"
+	empty := ""
+
+	tests := []struct {
+		name     string
+		decision *models.Decision
+		want     string
+	}{
+		{"nil", nil, ""},
+		{"type-only", &models.Decision{Type: &typ}, "ban"},
+		{"empty-scenario", &models.Decision{Type: &typ, Scenario: &empty}, "ban"},
+		{"full", &models.Decision{Type: &typ, Scenario: &scenario, Origin: &origin}, "ban; scenario=crowdsecurity/http-probing; origin=crowdsec"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			SetDecisionHeader(w, tt.decision)
+			require.Equal(t, tt.want, w.Header().Get(DecisionHeader))
+		})
+	}
+}
+
+func TestForwardedIPs(t *testing.T) {
+	newRequest := func(trusted bool, xff ...string) *http.Request {
+		ctx := newCaddyVarsContext()
+		caddyhttp.SetVar(ctx, caddyhttp.TrustedProxyVarKey, trusted)
+		r := httptest.NewRequest(http.MethodGet, "/", http.NoBody)
+		for _, v := range xff {
+			r.Header.Add("X-Forwarded-For", v)
+		}
+		return r.WithContext(ctx)
+	}
+
+	trusted := []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8"), netip.MustParsePrefix("2001:db8::/32")}
+
+	tests := []struct {
+		name    string
+		r       *http.Request
+		trusted []netip.Prefix
+		want    []netip.Addr
+	}{
+		{"untrusted", newRequest(false, "10.0.0.1"), trusted, nil},
+		{"no-header", newRequest(true), trusted, nil},
+		{"single", newRequest(true, "192.0.2.1"), trusted, []netip.Addr{netip.MustParseAddr("192.0.2.1")}},
+		{"chain", newRequest(true, "192.0.2.1, 10.0.0.2", "2001:db8::1"), trusted, []netip.Addr{
+			netip.MustParseAddr("2001:db8::1"),
+			netip.MustParseAddr("10.0.0.2"),
+			netip.MustParseAddr("192.0.2.1"),
+		}},
+		{"stop-at-untrusted", newRequest(true, "192.0.2.9, 192.0.2.1, 10.0.0.2"), trusted, []netip.Addr{
+			netip.MustParseAddr("10.0.0.2"),
+			netip.MustParseAddr("192.0.2.1"),
+		}},
+		{"only-rightmost-without-trusted", newRequest(true, "10.0.0.1, 10.0.0.2"), nil, []netip.Addr{netip.MustParseAddr("10.0.0.2")}},
+		{"stop-at-invalid", newRequest(true, "192.0.2.1, unknown, 10.0.0.2"), trusted, []netip.Addr{netip.MustParseAddr("10.0.0.2")}},
+		{"ipv4-mapped", newRequest(true, "192.0.2.1, ::ffff:10.0.0.1"), trusted, []netip.Addr{
+			netip.MustParseAddr("10.0.0.1"),
+			netip.MustParseAddr("192.0.2.1"),
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.want, ForwardedIPs(tt.r, tt.trusted))
+		})
+	}
+}
+
+func TestErrorResponse(t *testing.T) {
+	tests := []struct {
+		name           string
+		typ            string
+		duration       string
+		statusCode     int
+		wantStatusCode int
+		wantRetryAfter string
+	}{
+		{"ban", "ban", "4h", 0, http.StatusForbidden, ""},
+		{"ban-status", "ban", "4h", http.StatusUnauthorized, http.StatusUnauthorized, ""},
+		{"captcha", "captcha", "4h", 0, http.StatusForbidden, ""},
+		{"throttle", "throttle", "1m", 0, http.StatusTooManyRequests, "60"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			err := ErrorResponse(w, tt.typ, tt.duration, tt.statusCode)
+
+			var herr caddyhttp.HandlerError
+			require.ErrorAs(t, err, &herr)
+			require.Equal(t, tt.wantStatusCode, herr.StatusCode)
+			require.Equal(t, tt.wantRetryAfter, w.Header().Get("Retry-After"))
+		})
+	}
+}
+
+func TestIsUpgrade(t *testing.T) {
+	tests := []struct {
+		name       string
+		connection string
+		upgrade    string
+		want       bool
+	}{
+		{"websocket", "Upgrade", "websocket", true},
+		{"multiple-tokens", "keep-alive, upgrade", "websocket", true},
+		{"no-upgrade-header", "Upgrade", "", false},
+		{"no-connection-upgrade", "keep-alive", "websocket", false},
+		{"none", "", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", http.NoBody)
+			if tt.connection != "" {
+				r.Header.Set("Connection", tt.connection)
+			}
+			if tt.upgrade != "" {
+				r.Header.Set("Upgrade", tt.upgrade)
+			}
+			require.Equal(t, tt.want, IsUpgrade(r))
+		})
+	}
+}
+
+func TestIsStreamingBody(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		length      int64
+		body        io.Reader
+		want        bool
+	}{
+		{"grpc", "application/grpc", 10, strings.NewReader("0123456789"), true},
+		{"grpc-web", "application/grpc-web+proto", 10, strings.NewReader("0123456789"), true},
+		{"unknown-length", "application/octet-stream", -1, strings.NewReader("0123456789"), true},
+		{"unknown-length-no-body", "", -1, http.NoBody, false},
+		{"json", "application/json", 2, strings.NewReader("{}"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/", tt.body)
+			r.Header.Set("Content-Type", tt.contentType)
+			r.ContentLength = tt.length
+			require.Equal(t, tt.want, IsStreamingBody(r))
+		})
+	}
+}
+
+func TestAddServerTiming(t *testing.T) {
+	w := httptest.NewRecorder()
+	AddServerTiming(w, "crowdsec", 1234*time.Microsecond)
+	AddServerTiming(w, "appsec", 12*time.Millisecond)
+
+	require.Equal(t, []string{"crowdsec;dur=1.234", "appsec;dur=12.000"}, w.Header().Values("Server-Timing"))
+}
@@ -0,0 +1,130 @@
+// Copyright 2024 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package logging allows the level of zap loggers to be changed at
+// runtime, independent of the level configured for their core.
+package logging
+
+import (
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// Level is a log level that can be changed at runtime. By default, the
+// level of the wrapped loggers isn't changed.
+type Level struct {
+	mu       sync.RWMutex
+	level    *zapcore.Level
+	revertAt time.Time
+	timer    *time.Timer
+}
+
+// Set overrides the level of the wrapped loggers. If revertAfter
+// is positive, the override is removed after that duration.
+func (l *Level) Set(level zapcore.Level, revertAfter time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.stopTimer()
+	l.level = &level
+
+	if revertAfter > 0 {
+		var timer *time.Timer
+		timer = time.AfterFunc(revertAfter, func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+
+			if l.timer == timer { // not replaced in the meantime
+				l.stopTimer()
+				l.level = nil
+			}
+		})
+		l.revertAt = time.Now().Add(revertAfter)
+		l.timer = timer
+	}
+}
+
+// Reset removes the override, reverting to the level of the
+// wrapped loggers.
+func (l *Level) Reset() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.stopTimer()
+	l.level = nil
+}
+
+func (l *Level) stopTimer() {
+	if l.timer != nil {
+		l.timer.Stop()
+		l.timer = nil
+	}
+	l.revertAt = time.Time{}
+}
+
+// Override returns the level that overrides the level of the wrapped
+// loggers, if any, and the time at which the override is removed.
+func (l *Level) Override() (level zapcore.Level, revertAt time.Time, ok bool) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	if l.level == nil {
+		return level, revertAt, false
+	}
+
+	return *l.level, l.revertAt, true
+}
+
+// Wrap returns a logger using the level l, if it's overridden.
+func (l *Level) Wrap(logger *zap.Logger) *zap.Logger {
+	return logger.WithOptions(zap.WrapCore(func(c zapcore.Core) zapcore.Core {
+		return &core{Core: c, level: l}
+	}))
+}
+
+// core overrides the level of the core it wraps. If the level is
+// overridden, entries are written to the wrapped core directly,
+// bypassing its level check.
+type core struct {
+	zapcore.Core
+	level *Level
+}
+
+func (c *core) Enabled(lvl zapcore.Level) bool {
+	if level, _, ok := c.level.Override(); ok {
+		return level.Enabled(lvl)
+	}
+
+	return c.Core.Enabled(lvl)
+}
+
+func (c *core) With(fields []zapcore.Field) zapcore.Core {
+	return &core{Core: c.Core.With(fields), level: c.level}
+}
+
+func (c *core) Check(e zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	level, _, ok := c.level.Override()
+	if !ok {
+		return c.Core.Check(e, ce)
+	}
+
+	if level.Enabled(e.Level) {
+		return ce.AddCore(e, c)
+	}
+
+	return ce
+}
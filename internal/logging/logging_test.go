@@ -0,0 +1,58 @@
+package logging
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestLevel(t *testing.T) {
+	c, logs := observer.New(zapcore.InfoLevel)
+
+	l := &Level{}
+	logger := l.Wrap(zap.New(c)).With(zap.String("module", "test"))
+
+	logger.Debug("not logged")
+	logger.Info("logged")
+	assert.Equal(t, 1, logs.Len())
+
+	l.Set(zapcore.DebugLevel, 0)
+	level, revertAt, ok := l.Override()
+	assert.True(t, ok)
+	assert.Equal(t, zapcore.DebugLevel, level)
+	assert.True(t, revertAt.IsZero())
+
+	logger.Debug("logged")
+	assert.Equal(t, 2, logs.Len())
+	assert.Equal(t, "test", logs.All()[1].ContextMap()["module"])
+
+	l.Set(zapcore.WarnLevel, 0)
+	logger.Info("not logged")
+	assert.Equal(t, 2, logs.Len())
+
+	l.Reset()
+	_, _, ok = l.Override()
+	assert.False(t, ok)
+
+	logger.Debug("not logged")
+	logger.Info("logged")
+	assert.Equal(t, 3, logs.Len())
+}
+
+func TestLevel_revert(t *testing.T) {
+	l := &Level{}
+	l.Set(zapcore.DebugLevel, 10*time.Millisecond)
+
+	_, revertAt, ok := l.Override()
+	assert.True(t, ok)
+	assert.False(t, revertAt.IsZero())
+
+	assert.Eventually(t, func() bool {
+		_, _, ok := l.Override()
+		return !ok
+	}, time.Second, 5*time.Millisecond)
+}
@@ -0,0 +1,61 @@
+package ttlcache
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCache(t *testing.T) {
+	c := New[string, int](time.Minute, 2)
+	assert.Equal(t, time.Minute, c.TTL())
+	assert.Equal(t, 2, c.Size())
+
+	c.Set("a", 1)
+	c.Set("b", 2)
+	v, ok := c.Get("a")
+	assert.True(t, ok)
+	assert.Equal(t, 1, v)
+
+	// replacing a value doesn't evict another one
+	c.Set("b", 3)
+	assert.Equal(t, 2, c.Len())
+	v, ok = c.Get("b")
+	assert.True(t, ok)
+	assert.Equal(t, 3, v)
+
+	// an arbitrary value is evicted when the cache is full
+	c.Set("c", 4)
+	assert.Equal(t, 2, c.Len())
+	v, ok = c.Get("c")
+	assert.True(t, ok)
+	assert.Equal(t, 4, v)
+
+	c.Delete("c")
+	_, ok = c.Get("c")
+	assert.False(t, ok)
+
+	c.Clear()
+	assert.Equal(t, 0, c.Len())
+}
+
+func TestCache_expiry(t *testing.T) {
+	c := New[string, int](time.Minute, 2)
+	c.Set("a", 1)
+	c.Set("b", 2)
+
+	// expired values are evicted before others
+	c.entries["a"] = entry[int]{value: 1, expiresAt: time.Now().Add(-time.Second)}
+	c.Set("c", 3)
+	assert.Equal(t, 2, c.Len())
+	assert.NotContains(t, c.entries, "a")
+	_, ok := c.Get("b")
+	assert.True(t, ok)
+
+	// expired values are removed when they're looked up
+	c.entries["b"] = entry[int]{value: 2, expiresAt: time.Now().Add(-time.Second)}
+	_, ok = c.Get("b")
+	assert.False(t, ok)
+	assert.NotContains(t, c.entries, "b")
+}
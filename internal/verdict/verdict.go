@@ -0,0 +1,95 @@
+// Copyright 2024 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package verdict implements signed headers stating that a CrowdSec
+// bouncer allowed a client IP, so that a Caddy instance behind another
+// one doesn't have to check the client IP again. A header has the form
+// <ip>;<timestamp>;<signature>, with timestamp the Unix time of the check
+// and signature the hex encoded HMAC-SHA256 of <ip>;<timestamp>, keyed
+// with a shared secret.
+package verdict
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrMalformed = errors.New("malformed verdict header")
+	ErrSignature = errors.New("invalid verdict header signature")
+	ErrExpired   = errors.New("verdict header expired")
+	ErrIP        = errors.New("verdict header is for another IP")
+)
+
+// New returns a new header value stating that ip was allowed at now.
+func New(secret []byte, ip netip.Addr, now time.Time) string {
+	msg := ip.String() + ";" + strconv.FormatInt(now.Unix(), 10)
+	return msg + ";" + sign(secret, msg)
+}
+
+// Verify verifies the header value was signed using secret, that it's
+// for ip, and that it's not older than maxAge at time now. Values with a
+// timestamp more than maxAge after now are rejected too, as they can't
+// have been created by an instance with a synchronized clock.
+func Verify(secret []byte, value string, ip netip.Addr, now time.Time, maxAge time.Duration) error {
+	i := strings.LastIndexByte(value, ';')
+	if i < 0 {
+		return ErrMalformed
+	}
+	msg, sig := value[:i], value[i+1:]
+
+	addr, ts, ok := strings.Cut(msg, ";")
+	if !ok || addr == "" || ts == "" || sig == "" {
+		return ErrMalformed
+	}
+
+	actual, err := hex.DecodeString(sig)
+	if err != nil {
+		return ErrMalformed
+	}
+	expected, _ := hex.DecodeString(sign(secret, msg))
+	if !hmac.Equal(expected, actual) {
+		return ErrSignature
+	}
+
+	unix, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return ErrMalformed
+	}
+	if age := now.Sub(time.Unix(unix, 0)); age > maxAge || age < -maxAge {
+		return ErrExpired
+	}
+
+	signed, err := netip.ParseAddr(addr)
+	if err != nil {
+		return ErrMalformed
+	}
+	if signed != ip {
+		return ErrIP
+	}
+
+	return nil
+}
+
+func sign(secret []byte, msg string) string {
+	mac := hmac.New(sha256.New, secret)
+	_, _ = mac.Write([]byte(msg))
+	return hex.EncodeToString(mac.Sum(nil))
+}
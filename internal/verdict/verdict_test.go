@@ -0,0 +1,43 @@
+package verdict
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVerify(t *testing.T) {
+	secret := []byte("secret")
+	ip := netip.MustParseAddr("192.0.2.1")
+	ipv6 := netip.MustParseAddr("2001:db8::1")
+	now := time.Unix(1700000000, 0)
+	valid := New(secret, ip, now.Add(-10*time.Second))
+
+	tests := []struct {
+		name    string
+		secret  []byte
+		value   string
+		ip      netip.Addr
+		wantErr error
+	}{
+		{"ok", secret, valid, ip, nil},
+		{"ok/ipv6", secret, New(secret, ipv6, now), ipv6, nil},
+		{"ok/clock-skew", secret, New(secret, ip, now.Add(10*time.Second)), ip, nil},
+		{"fail/wrong-secret", []byte("other"), valid, ip, ErrSignature},
+		{"fail/expired", secret, New(secret, ip, now.Add(-time.Minute)), ip, ErrExpired},
+		{"fail/future", secret, New(secret, ip, now.Add(time.Minute)), ip, ErrExpired},
+		{"fail/other-ip", secret, valid, netip.MustParseAddr("192.0.2.2"), ErrIP},
+		{"fail/empty", secret, "", ip, ErrMalformed},
+		{"fail/no-signature", secret, "192.0.2.1;1700000000;", ip, ErrMalformed},
+		{"fail/invalid-hex", secret, "192.0.2.1;1700000000;zz", ip, ErrMalformed},
+		{"fail/tampered-ip", secret, "192.0.2.2" + valid[9:], netip.MustParseAddr("192.0.2.2"), ErrSignature},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := Verify(tt.secret, tt.value, tt.ip, now, 30*time.Second)
+			assert.ErrorIs(t, err, tt.wantErr)
+		})
+	}
+}
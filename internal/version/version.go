@@ -9,17 +9,63 @@ const (
 	fallback   = "v0.8.0"
 )
 
+// Current returns the version of the module, as recorded in the build
+// information of the binary. The module is the main module when it's
+// built from a checkout of this repository, and a dependency when it's
+// built into Caddy, i.e. using xcaddy. The fallback is returned if the
+// version isn't recorded, i.e. in tests and development builds.
 func Current() string {
 	info, ok := debug.ReadBuildInfo()
 	if !ok {
 		return fallback
 	}
 
+	return current(info)
+}
+
+func current(info *debug.BuildInfo) string {
+	if info.Main.Path == modulePath && isRelease(info.Main.Version) {
+		return info.Main.Version
+	}
+
 	for _, d := range info.Deps {
-		if d.Path == modulePath {
+		if d.Path != modulePath {
+			continue
+		}
+		if d.Replace != nil && isRelease(d.Replace.Version) {
+			return d.Replace.Version
+		}
+		if isRelease(d.Version) {
 			return d.Version
 		}
 	}
 
 	return fallback
 }
+
+// isRelease returns whether v is a version recorded by the Go toolchain,
+// as opposed to a local or development build.
+func isRelease(v string) bool {
+	return v != "" && v != "(devel)"
+}
+
+// Dependency returns the version of the module with path that the
+// binary was built with. It returns an empty string if the version
+// can't be determined.
+func Dependency(path string) string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return ""
+	}
+
+	for _, d := range info.Deps {
+		if d.Path == path {
+			if d.Replace != nil {
+				return d.Replace.Version
+			}
+			return d.Version
+		}
+	}
+
+	return ""
+}
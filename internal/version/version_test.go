@@ -1,6 +1,7 @@
 package version
 
 import (
+	"runtime/debug"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -11,3 +12,61 @@ func TestCurrent(t *testing.T) {
 
 	assert.Equal(t, "v0.8.0", v) // fallback
 }
+
+func TestDependency(t *testing.T) {
+	assert.NotEmpty(t, Dependency("github.com/stretchr/testify"))
+	assert.Empty(t, Dependency("example.com/unknown"))
+}
+
+func Test_current(t *testing.T) {
+	tests := []struct {
+		name string
+		info *debug.BuildInfo
+		want string
+	}{
+		{
+			name: "main",
+			info: &debug.BuildInfo{Main: debug.Module{Path: modulePath, Version: "v0.9.1"}},
+			want: "v0.9.1",
+		},
+		{
+			name: "main-devel",
+			info: &debug.BuildInfo{Main: debug.Module{Path: modulePath, Version: "(devel)"}},
+			want: fallback,
+		},
+		{
+			name: "dependency",
+			info: &debug.BuildInfo{
+				Main: debug.Module{Path: "caddy", Version: "(devel)"},
+				Deps: []*debug.Module{{Path: modulePath, Version: "v0.9.1"}},
+			},
+			want: "v0.9.1",
+		},
+		{
+			name: "replaced",
+			info: &debug.BuildInfo{
+				Main: debug.Module{Path: "caddy", Version: "(devel)"},
+				Deps: []*debug.Module{{Path: modulePath, Version: "v0.9.1", Replace: &debug.Module{Path: "example.com/fork", Version: "v0.9.2"}}},
+			},
+			want: "v0.9.2",
+		},
+		{
+			name: "replaced-local",
+			info: &debug.BuildInfo{
+				Main: debug.Module{Path: "caddy", Version: "(devel)"},
+				Deps: []*debug.Module{{Path: modulePath, Version: "v0.9.1", Replace: &debug.Module{Path: "../caddy-crowdsec-bouncer"}}},
+			},
+			want: "v0.9.1",
+		},
+		{
+			name: "missing",
+			info: &debug.BuildInfo{Main: debug.Module{Path: "caddy", Version: "(devel)"}},
+			want: fallback,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, current(tt.info))
+		})
+	}
+}
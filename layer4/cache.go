@@ -0,0 +1,73 @@
+// Copyright 2024 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package layer4
+
+import (
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/hslatman/caddy-crowdsec-bouncer/internal/ttlcache"
+)
+
+const defaultCacheSize = 10000
+
+// verdictCache caches allow/deny verdicts per client IP for a short
+// amount of time, so that UDP packets and TCP reconnects from the same
+// client don't require a lookup every time. Verdicts are invalidated
+// when the decisions known to the CrowdSec app change.
+type verdictCache struct {
+	mu         sync.Mutex
+	generation uint64
+	verdicts   *ttlcache.Cache[netip.Addr, bool]
+}
+
+func newVerdictCache(ttl time.Duration, size int) *verdictCache {
+	if size <= 0 {
+		size = defaultCacheSize
+	}
+
+	return &verdictCache{
+		verdicts: ttlcache.New[netip.Addr, bool](ttl, size),
+	}
+}
+
+func (c *verdictCache) get(ip netip.Addr, generation uint64) (allowed, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.invalidate(generation)
+
+	return c.verdicts.Get(ip)
+}
+
+func (c *verdictCache) set(ip netip.Addr, allowed bool, generation uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.invalidate(generation)
+	c.verdicts.Set(ip, allowed)
+}
+
+// invalidate clears the cached verdicts if they were determined for
+// another generation of decisions than generation. It must be called
+// with c.mu held, so that verdicts for an older generation can't be
+// stored after the cache was invalidated.
+func (c *verdictCache) invalidate(generation uint64) {
+	if c.generation != generation {
+		c.verdicts.Clear()
+		c.generation = generation
+	}
+}
@@ -0,0 +1,65 @@
+package layer4
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_verdictCache(t *testing.T) {
+	c := newVerdictCache(time.Minute, 2)
+	a := netip.MustParseAddr("192.0.2.1")
+	b := netip.MustParseAddr("192.0.2.2")
+
+	_, ok := c.get(a, 1)
+	assert.False(t, ok)
+
+	c.set(a, true, 1)
+	c.set(b, false, 1)
+	allowed, ok := c.get(a, 1)
+	assert.True(t, ok)
+	assert.True(t, allowed)
+	allowed, ok = c.get(b, 1)
+	assert.True(t, ok)
+	assert.False(t, allowed)
+
+	// new decisions invalidate all cached verdicts
+	_, ok = c.get(a, 2)
+	assert.False(t, ok)
+	_, ok = c.get(b, 2)
+	assert.False(t, ok)
+	assert.Equal(t, 0, c.verdicts.Len())
+
+	// verdicts looked up for an older generation don't survive
+	c.set(a, true, 2)
+	c.set(b, true, 1)
+	_, ok = c.get(a, 2)
+	assert.False(t, ok)
+}
+
+func Test_verdictCache_eviction(t *testing.T) {
+	c := newVerdictCache(time.Minute, 2)
+	c.set(netip.MustParseAddr("192.0.2.1"), true, 1)
+	c.set(netip.MustParseAddr("192.0.2.2"), true, 1)
+	c.set(netip.MustParseAddr("192.0.2.3"), false, 1)
+	assert.Equal(t, 2, c.verdicts.Len())
+
+	allowed, ok := c.get(netip.MustParseAddr("192.0.2.3"), 1)
+	assert.True(t, ok)
+	assert.False(t, allowed)
+
+	assert.Equal(t, defaultCacheSize, newVerdictCache(time.Minute, 0).verdicts.Size())
+}
+
+func Test_verdictCache_expiry(t *testing.T) {
+	c := newVerdictCache(time.Millisecond, 2)
+	ip := netip.MustParseAddr("192.0.2.1")
+	c.set(ip, true, 1)
+
+	assert.Eventually(t, func() bool {
+		_, ok := c.get(ip, 1)
+		return !ok
+	}, time.Second, 5*time.Millisecond)
+}
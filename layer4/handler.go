@@ -0,0 +1,255 @@
+// Copyright 2024 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package layer4
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	l4 "github.com/mholt/caddy-l4/layer4"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+
+	"github.com/hslatman/caddy-crowdsec-bouncer/crowdsec"
+)
+
+func init() {
+	caddy.RegisterModule(Handler{})
+}
+
+var handlerActions = []string{"close", "drop"}
+
+// Handler checks the IP of the client connecting against CrowdSec
+// decisions. Connections from IPs that are not allowed are closed;
+// other connections are passed on to the next handler.
+type Handler struct {
+	// Action determines how connections from IPs that are not allowed are
+	// terminated. With "close" the connection is closed. With "drop" TCP
+	// connections are reset, without the connection being closed
+	// gracefully. Defaults to "close".
+	Action string `json:"action,omitempty"`
+	// BanBanner is written to connections from IPs that are not allowed
+	// before they're closed, i.e. a protocol-appropriate rejection line
+	// like "554 denied\r\n" for SMTP. Placeholders are replaced. Can't
+	// be combined with the "drop" action.
+	BanBanner string `json:"ban_banner,omitempty"`
+
+	logger   *zap.Logger
+	crowdsec *crowdsec.CrowdSec
+	// banner is the ban banner to write if it has no placeholders, so
+	// that it's not converted for every connection that's not allowed.
+	banner []byte
+	// bannerPlaceholders is true if the ban banner has placeholders,
+	// which are replaced for every connection.
+	bannerPlaceholders bool
+}
+
+// CaddyModule returns the Caddy module information.
+func (Handler) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "layer4.handlers.crowdsec",
+		New: func() caddy.Module { return new(Handler) },
+	}
+}
+
+// Provision sets up the CrowdSec layer4 handler.
+func (h *Handler) Provision(ctx caddy.Context) error {
+	crowdsecAppIface, err := ctx.App("crowdsec")
+	if err != nil {
+		return fmt.Errorf("getting crowdsec app: %v", err)
+	}
+	h.crowdsec = crowdsecAppIface.(*crowdsec.CrowdSec)
+
+	h.logger = h.crowdsec.Logger(ctx.Logger(h))
+
+	h.Action = caddy.NewReplacer().ReplaceKnown(h.Action, "")
+	if h.Action == "" {
+		h.Action = "close"
+	}
+
+	h.prepareBanner()
+
+	return nil
+}
+
+// prepareBanner prepares writing the ban banner. Placeholders can only
+// be replaced when a connection is handled, so the banner is converted
+// ahead of time only if it doesn't have any.
+func (h *Handler) prepareBanner() {
+	h.bannerPlaceholders = strings.Contains(h.BanBanner, "{") && strings.Contains(h.BanBanner, "}")
+	h.banner = nil
+	if !h.bannerPlaceholders {
+		h.banner = []byte(h.BanBanner)
+	}
+}
+
+// Validate ensures the handler's configuration is valid.
+func (h *Handler) Validate() error {
+	if !slices.Contains(handlerActions, h.Action) {
+		return fmt.Errorf("invalid action %q; must be one of %v", h.Action, handlerActions)
+	}
+	if h.BanBanner != "" && h.Action == "drop" {
+		return errors.New("ban banner can't be used with the drop action")
+	}
+
+	return nil
+}
+
+// Handle checks the client IP, and terminates the connection if
+// it's not allowed. Otherwise the next handler is called.
+func (h *Handler) Handle(cx *l4.Connection, next l4.Handler) error {
+	clientIP, err := getClientIP(cx)
+	if err != nil {
+		return err
+	}
+
+	isAllowed, decision, err := h.crowdsec.IsAllowed(clientIP)
+	if err != nil {
+		return err
+	}
+
+	h.crowdsec.RecordProcessed(clientIP)
+
+	if isAllowed {
+		return next.Handle(cx)
+	}
+
+	typ, origin, scenario := "ban", "", ""
+	if decision != nil && decision.Type != nil {
+		typ = *decision.Type
+	}
+	if decision != nil && decision.Origin != nil {
+		origin = *decision.Origin
+	}
+	if decision != nil && decision.Scenario != nil {
+		scenario = *decision.Scenario
+	}
+	h.crowdsec.RecordRemediation(typ, origin, clientIP)
+	h.crowdsec.LogBlocked(crowdsec.BlockedRequest{
+		IP:       clientIP,
+		Type:     typ,
+		Origin:   origin,
+		Scenario: scenario,
+		Module:   string(h.CaddyModule().ID),
+	})
+
+	if ce := h.logger.Check(zapcore.DebugLevel, "connection not allowed"); ce != nil {
+		ce.Write(zap.String("ip", clientIP.String()), zap.String("action", h.Action))
+	}
+
+	if h.BanBanner != "" {
+		h.writeBanner(cx)
+	}
+
+	if h.Action == "drop" {
+		if tc, ok := cx.Conn.(*net.TCPConn); ok {
+			_ = tc.SetLinger(0) // results in a reset when closing
+		}
+	}
+
+	return cx.Close()
+}
+
+// bannerWriteTimeout limits the time spent writing the ban banner, so
+// that slow clients can't keep connections open.
+const bannerWriteTimeout = 5 * time.Second
+
+// writeBanner writes the ban banner to the connection. Failures are
+// logged, as the connection is closed afterwards anyway.
+func (h *Handler) writeBanner(cx *l4.Connection) {
+	_ = cx.Conn.SetWriteDeadline(time.Now().Add(bannerWriteTimeout))
+	if _, err := cx.Write(h.bannerFor(cx)); err != nil {
+		h.logger.Debug("failed writing ban banner", zap.Error(err))
+	}
+}
+
+// bannerFor returns the ban banner for cx, with its placeholders
+// replaced, if it has any.
+func (h *Handler) bannerFor(cx *l4.Connection) []byte {
+	if !h.bannerPlaceholders {
+		return h.banner
+	}
+
+	banner := h.BanBanner
+	if repl, ok := cx.Context.Value(l4.ReplacerCtxKey).(*caddy.Replacer); ok {
+		banner = repl.ReplaceKnown(banner, "")
+	}
+
+	return []byte(banner)
+}
+
+func (h *Handler) Cleanup() error {
+	h.logger.Sync() // nolint
+
+	return nil
+}
+
+// UnmarshalCaddyfile implements [caddyfile.Unmarshaler]. Syntax:
+//
+//	crowdsec {
+//		action close|drop
+//		ban_banner <banner>
+//	}
+//
+// The escape sequences \r, \n, \t and \\ in the banner are
+// replaced with the characters they represent.
+func (h *Handler) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+		for nesting := d.Nesting(); d.NextBlock(nesting); {
+			switch d.Val() {
+			case "action":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				h.Action = d.Val()
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+			case "ban_banner":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				h.BanBanner = bannerEscapes.Replace(d.Val())
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+			default:
+				return d.Errf("invalid configuration token %q provided", d.Val())
+			}
+		}
+	}
+
+	return nil
+}
+
+var bannerEscapes = strings.NewReplacer(`\r`, "\r", `\n`, "\n", `\t`, "\t", `\\`, `\`)
+
+// Interface guards
+var (
+	_ l4.NextHandler        = (*Handler)(nil)
+	_ caddy.Provisioner     = (*Handler)(nil)
+	_ caddy.Validator       = (*Handler)(nil)
+	_ caddy.CleanerUpper    = (*Handler)(nil)
+	_ caddyfile.Unmarshaler = (*Handler)(nil)
+)
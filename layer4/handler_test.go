@@ -0,0 +1,219 @@
+package layer4
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	l4 "github.com/mholt/caddy-l4/layer4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+
+	"github.com/hslatman/caddy-crowdsec-bouncer/crowdsectest"
+)
+
+// newTCPConnection returns the server side of a TCP connection over the
+// loopback interface, and the client side it's connected to.
+func newTCPConnection(t *testing.T) (*l4.Connection, net.Conn) {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+
+	client, err := net.Dial("tcp", ln.Addr().String())
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = client.Close() })
+
+	server, err := ln.Accept()
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = server.Close() })
+
+	return l4.WrapConnection(server, &bytes.Buffer{}, zaptest.NewLogger(t)), client
+}
+
+func TestHandler_Handle(t *testing.T) {
+	lapi := crowdsectest.NewServer(t)
+	lapi.AddDecisions(crowdsectest.NewDecision("Ip", "127.0.0.1", "ban"))
+	cs := newCrowdSec(t, lapi)
+
+	t.Run("allowed", func(t *testing.T) {
+		h := &Handler{Action: "close", logger: zaptest.NewLogger(t), crowdsec: cs}
+
+		cx, _ := newConnection(t, tcpAddr("203.0.113.1"))
+		called := false
+		next := l4.HandlerFunc(func(*l4.Connection) error {
+			called = true
+			return nil
+		})
+		require.NoError(t, h.Handle(cx, next))
+		assert.True(t, called)
+	})
+
+	tests := []struct {
+		name      string
+		action    string
+		banner    string
+		want      string
+		wantReset bool
+	}{
+		{name: "close", action: "close"},
+		{name: "close-banner", action: "close", banner: "554 {l4.conn.remote_addr} denied\r\n", want: "554 127.0.0.1"},
+		{name: "drop", action: "drop", wantReset: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &Handler{Action: tt.action, BanBanner: tt.banner, logger: zaptest.NewLogger(t), crowdsec: cs}
+			h.prepareBanner()
+
+			cx, client := newTCPConnection(t)
+			next := l4.HandlerFunc(func(*l4.Connection) error {
+				t.Error("next handler called for connection that's not allowed")
+				return nil
+			})
+			require.NoError(t, h.Handle(cx, next))
+
+			require.NoError(t, client.SetReadDeadline(time.Now().Add(5*time.Second)))
+			got, err := io.ReadAll(client)
+			if tt.wantReset {
+				assert.True(t, errors.Is(err, syscall.ECONNRESET), "expected connection reset; got %v", err)
+				return
+			}
+
+			require.NoError(t, err)
+			if tt.want == "" {
+				assert.Empty(t, got)
+				return
+			}
+			assert.Contains(t, string(got), tt.want)
+			assert.Contains(t, string(got), "denied\r\n")
+		})
+	}
+}
+
+func TestHandler_writeBanner(t *testing.T) {
+	h := &Handler{BanBanner: "554 denied\r\n", logger: zaptest.NewLogger(t)}
+	h.prepareBanner()
+
+	cx, client := newConnection(t, tcpAddr("192.0.2.1"))
+	got := make(chan string, 1)
+	go func() {
+		b := make([]byte, 64)
+		n, _ := client.Read(b)
+		got <- string(b[:n])
+	}()
+
+	h.writeBanner(cx)
+	assert.Equal(t, "554 denied\r\n", <-got)
+
+	// failing writes are logged, as the connection is closed anyway
+	require.NoError(t, client.Close())
+	h.writeBanner(cx)
+}
+
+func TestHandler_bannerFor(t *testing.T) {
+	cx, _ := newConnection(t, tcpAddr("192.0.2.1"))
+
+	tests := []struct {
+		name         string
+		banner       string
+		placeholders bool
+		want         string
+	}{
+		{name: "static", banner: "554 denied\r\n", want: "554 denied\r\n"},
+		{name: "braces", banner: "denied {", want: "denied {"},
+		{name: "placeholder", banner: "denied {l4.conn.remote_addr}\r\n", placeholders: true, want: "denied 192.0.2.1:12345\r\n"},
+		{name: "unknown-placeholder", banner: "denied {unknown}", placeholders: true, want: "denied {unknown}"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &Handler{BanBanner: tt.banner}
+			h.prepareBanner()
+			assert.Equal(t, tt.placeholders, h.bannerPlaceholders)
+			assert.Equal(t, tt.want, string(h.bannerFor(cx)))
+
+			if !tt.placeholders {
+				// a static banner is converted once
+				allocs := testing.AllocsPerRun(100, func() { _ = h.bannerFor(cx) })
+				assert.Zero(t, allocs)
+			}
+		})
+	}
+}
+
+func TestHandler_Validate(t *testing.T) {
+	assert.NoError(t, (&Handler{Action: "close"}).Validate())
+	assert.NoError(t, (&Handler{Action: "close", BanBanner: "denied"}).Validate())
+	assert.NoError(t, (&Handler{Action: "drop"}).Validate())
+	assert.EqualError(t, (&Handler{Action: "reject"}).Validate(), `invalid action "reject"; must be one of [close drop]`)
+	assert.EqualError(t, (&Handler{Action: "drop", BanBanner: "denied"}).Validate(), "ban banner can't be used with the drop action")
+}
+
+func TestHandler_UnmarshalCaddyfile(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    Handler
+		wantErr bool
+	}{
+		{name: "ok", input: `crowdsec`, want: Handler{}},
+		{name: "ok/action", input: `crowdsec {
+			action drop
+		}`, want: Handler{Action: "drop"}},
+		{name: "ok/banner-escapes", input: `crowdsec {
+			ban_banner "554 denied\r\n\tby \\crowdsec\\"
+		}`, want: Handler{BanBanner: "554 denied\r\n\tby \\crowdsec\\"}},
+		{name: "ok/banner-without-escapes", input: `crowdsec {
+			ban_banner "SSH-2.0-denied"
+		}`, want: Handler{BanBanner: "SSH-2.0-denied"}},
+		{name: "fail/argument", input: `crowdsec drop`, wantErr: true},
+		{name: "fail/action-without-value", input: `crowdsec {
+			action
+		}`, wantErr: true},
+		{name: "fail/action-arguments", input: `crowdsec {
+			action close drop
+		}`, wantErr: true},
+		{name: "fail/banner-arguments", input: `crowdsec {
+			ban_banner 554 denied
+		}`, wantErr: true},
+		{name: "fail/unknown-token", input: `crowdsec {
+			timeout 5s
+		}`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var h Handler
+			err := h.UnmarshalCaddyfile(caddyfile.NewTestDispenser(tt.input))
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, h)
+		})
+	}
+}
+
+func Test_bannerEscapes(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{in: `554 denied\r\n`, want: "554 denied\r\n"},
+		{in: `a\tb`, want: "a\tb"},
+		{in: `a\\nb`, want: `a\nb`},
+		{in: `a\xb`, want: `a\xb`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			assert.Equal(t, tt.want, bannerEscapes.Replace(tt.in))
+		})
+	}
+}
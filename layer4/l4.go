@@ -15,16 +15,22 @@
 package layer4
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net"
 	"net/netip"
+	"strconv"
+	"time"
 
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
 	l4 "github.com/mholt/caddy-l4/layer4"
 	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
 
 	"github.com/hslatman/caddy-crowdsec-bouncer/crowdsec"
+	"github.com/hslatman/caddy-crowdsec-bouncer/internal/duration"
 )
 
 func init() {
@@ -33,8 +39,40 @@ func init() {
 
 // Matcher matches IPs to CrowdSec decisions to (dis)allow access
 type Matcher struct {
-	logger   *zap.Logger
-	crowdsec *crowdsec.CrowdSec
+	// FailOpen makes the matcher match connections when the decision
+	// for the client IP can't be determined, i.e. because the CrowdSec
+	// Local API can't be reached in live mode. By default such
+	// connections don't match.
+	FailOpen bool `json:"fail_open,omitempty"`
+	// Timeout is the maximum duration to wait for a decision when the
+	// app is in live mode, which requires a round trip to the CrowdSec
+	// Local API for every lookup. When it's exceeded, the decision is
+	// considered to be undetermined, and FailOpen applies. Disabled by
+	// default.
+	Timeout caddy.Duration `json:"timeout,omitempty"`
+	// CacheTTL is the duration the verdict for a client IP is cached
+	// for, so that UDP packets and TCP reconnects from the same client
+	// don't require a lookup every time. Cached verdicts are invalidated
+	// when new decisions arrive. Disabled by default.
+	CacheTTL caddy.Duration `json:"cache_ttl,omitempty"`
+	// CacheSize is the maximum number of cached verdicts. Defaults
+	// to 10000.
+	CacheSize int `json:"cache_size,omitempty"`
+	// Banned inverts the matcher, making it match connections from IPs
+	// that are not allowed instead, so that these can be routed to a
+	// honeypot or a handler responding with a canned banner. With
+	// FailOpen, connections for which the decision can't be determined
+	// are considered to be allowed, and thus don't match.
+	Banned bool `json:"banned,omitempty"`
+	// Allowlist is a list of IPs and CIDRs that are always allowed,
+	// regardless of CrowdSec decisions, such as load balancer health
+	// checks and mail relays.
+	Allowlist []string `json:"allowlist,omitempty"`
+
+	logger    *zap.Logger
+	crowdsec  *crowdsec.CrowdSec
+	cache     *verdictCache
+	allowlist []netip.Prefix
 }
 
 // CaddyModule returns the Caddy module information.
@@ -53,37 +91,114 @@ func (m *Matcher) Provision(ctx caddy.Context) error {
 	}
 	m.crowdsec = crowdsecAppIface.(*crowdsec.CrowdSec)
 
-	m.logger = ctx.Logger(m)
+	m.logger = m.crowdsec.Logger(ctx.Logger(m))
+
+	repl := caddy.NewReplacer()
+	for _, v := range m.Allowlist {
+		prefix, err := parsePrefix(repl.ReplaceKnown(v, ""))
+		if err != nil {
+			return fmt.Errorf("invalid allowlist entry: %w", err)
+		}
+		m.allowlist = append(m.allowlist, prefix)
+	}
+
+	if m.CacheTTL > 0 {
+		m.cache = newVerdictCache(time.Duration(m.CacheTTL), m.CacheSize)
+	}
 
 	return nil
 }
 
 // Validate ensures the app's configuration is valid.
 func (m *Matcher) Validate() error {
+	if err := duration.Check("timeout", m.Timeout); err != nil {
+		return err
+	}
+	if err := duration.Check("cache_ttl", m.CacheTTL); err != nil {
+		return err
+	}
+	if m.CacheSize < 0 {
+		return errors.New("cache size must not be negative")
+	}
+
 	return nil
 }
 
 // Match returns true if the connection is from an IP that is
 // not denied according to CrowdSec decisions stored in the
-// CrowdSec app module.
+// CrowdSec app module. If Banned is set, the result is inverted.
 func (m Matcher) Match(cx *l4.Connection) (bool, error) {
 	// TODO: needs to be tested with TCP as well as UDP.
-	clientIP, err := m.getClientIP(cx)
+	clientIP, err := getClientIP(cx)
 	if err != nil {
 		return false, err
 	}
 
-	isAllowed, _, err := m.crowdsec.IsAllowed(clientIP)
+	isAllowed, err := m.isAllowed(clientIP)
 	if err != nil {
+		if m.FailOpen {
+			m.logger.Warn("failed checking connection; allowing", zap.String("ip", clientIP.String()), zap.Error(err))
+			return !m.Banned, nil
+		}
 		return false, err
 	}
 
 	if !isAllowed {
-		m.logger.Debug(fmt.Sprintf("connection from %s not allowed", clientIP.String()))
-		return false, nil
+		if ce := m.logger.Check(zapcore.DebugLevel, "connection not allowed"); ce != nil {
+			ce.Write(zap.String("ip", clientIP.String()))
+		}
 	}
 
-	return true, nil
+	return isAllowed != m.Banned, nil
+}
+
+// isAllowed checks if the client IP is allowed, using the cached
+// verdict if there's one available.
+func (m Matcher) isAllowed(ip netip.Addr) (bool, error) {
+	for _, prefix := range m.allowlist {
+		if prefix.Contains(ip) {
+			return true, nil
+		}
+	}
+
+	if m.cache == nil {
+		return m.lookup(ip)
+	}
+
+	generation := m.crowdsec.Generation()
+	if isAllowed, ok := m.cache.get(ip, generation); ok {
+		return isAllowed, nil
+	}
+
+	isAllowed, err := m.lookup(ip)
+	if err != nil {
+		return false, err
+	}
+
+	m.cache.set(ip, isAllowed, generation)
+
+	return isAllowed, nil
+}
+
+var errLookupTimeout = errors.New("timeout looking up decision")
+
+// lookup checks if the client IP is allowed according to the CrowdSec
+// app. In live mode, the lookup is canceled after Timeout.
+func (m Matcher) lookup(ip netip.Addr) (bool, error) {
+	if m.Timeout <= 0 || m.crowdsec.IsStreaming() {
+		isAllowed, _, err := m.crowdsec.IsAllowed(ip)
+		return isAllowed, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(m.Timeout))
+	defer cancel()
+
+	isAllowed, _, err := m.crowdsec.IsAllowedContext(ctx, ip)
+	if errors.Is(err, context.DeadlineExceeded) {
+		return false, errLookupTimeout
+	}
+
+	return isAllowed, err
 }
 
 func (m *Matcher) Cleanup() error {
@@ -92,25 +207,118 @@ func (m *Matcher) Cleanup() error {
 	return nil
 }
 
-// getClientIP determines the IP of the client connecting
-// Implementation taken from github.com/mholt/caddy-l4/layer4/matchers.go
-func (m Matcher) getClientIP(cx *l4.Connection) (netip.Addr, error) {
-	remote := cx.Conn.RemoteAddr().String()
-	ipStr, _, err := net.SplitHostPort(remote)
-	if err != nil {
-		ipStr = remote
+// parsePrefix parses an IP or CIDR into a prefix. IPs are turned
+// into a prefix with all bits set.
+func parsePrefix(v string) (netip.Prefix, error) {
+	if ip, err := netip.ParseAddr(v); err == nil {
+		return netip.PrefixFrom(ip, ip.BitLen()), nil
 	}
 
-	ip, err := netip.ParseAddr(ipStr)
+	prefix, err := netip.ParsePrefix(v)
 	if err != nil {
-		return netip.Addr{}, fmt.Errorf("invalid client IP address: %s", ipStr)
+		return netip.Prefix{}, fmt.Errorf("%q is not a valid IP or CIDR", v)
 	}
 
-	return ip, nil
+	return prefix.Masked(), nil
 }
 
-// UnmarshalCaddyfile implements [caddyfile.Unmarshaler].
-func (m Matcher) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+// getClientIP determines the IP of the client connecting. Addresses of
+// TCP and UDP (i.e. QUIC) connections are used directly; other addresses
+// are parsed from their string form. IPv4-mapped IPv6 addresses, which
+// are common for UDP listeners on dual-stack sockets, are unmapped, so
+// that they match decisions for the IPv4 address.
+// Implementation based on github.com/mholt/caddy-l4/layer4/matchers.go
+func getClientIP(cx *l4.Connection) (netip.Addr, error) {
+	var ip netip.Addr
+	switch addr := cx.Conn.RemoteAddr().(type) {
+	case *net.TCPAddr:
+		ip = addr.AddrPort().Addr()
+	case *net.UDPAddr:
+		ip = addr.AddrPort().Addr()
+	}
+
+	if !ip.IsValid() {
+		remote := cx.Conn.RemoteAddr().String()
+		ipStr, _, err := net.SplitHostPort(remote)
+		if err != nil {
+			ipStr = remote
+		}
+
+		ip, err = netip.ParseAddr(ipStr)
+		if err != nil {
+			return netip.Addr{}, fmt.Errorf("invalid client IP address: %s", ipStr)
+		}
+	}
+
+	return ip.Unmap().WithZone(""), nil
+}
+
+// UnmarshalCaddyfile implements [caddyfile.Unmarshaler]. Syntax:
+//
+//	crowdsec {
+//		banned
+//		allowlist <ip|cidr...>
+//		fail_open
+//		timeout <duration>
+//		cache_ttl <duration>
+//		cache_size <size>
+//	}
+func (m *Matcher) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+		for nesting := d.Nesting(); d.NextBlock(nesting); {
+			switch d.Val() {
+			case "banned":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				m.Banned = true
+			case "allowlist":
+				values := d.RemainingArgs()
+				if len(values) == 0 {
+					return d.ArgErr()
+				}
+				m.Allowlist = append(m.Allowlist, values...)
+			case "fail_open":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				m.FailOpen = true
+			case "timeout":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				timeout, err := duration.ParseCaddyfile(d, "timeout")
+				if err != nil {
+					return err
+				}
+				m.Timeout = timeout
+			case "cache_ttl":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				ttl, err := duration.ParseCaddyfile(d, "cache_ttl")
+				if err != nil {
+					return err
+				}
+				m.CacheTTL = ttl
+			case "cache_size":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				size, err := strconv.Atoi(d.Val())
+				if err != nil {
+					return d.Errf("invalid cache size %q: %v", d.Val(), err)
+				}
+				m.CacheSize = size
+			default:
+				return d.Errf("invalid configuration token %q provided", d.Val())
+			}
+		}
+	}
+
 	return nil
 }
 
@@ -119,5 +327,5 @@ var (
 	_ l4.ConnMatcher        = (*Matcher)(nil)
 	_ caddy.Provisioner     = (*Matcher)(nil)
 	_ caddy.Validator       = (*Matcher)(nil)
-	_ caddyfile.Unmarshaler = (Matcher)(Matcher{})
+	_ caddyfile.Unmarshaler = (*Matcher)(nil)
 )
@@ -0,0 +1,326 @@
+package layer4
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	l4 "github.com/mholt/caddy-l4/layer4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+
+	"github.com/hslatman/caddy-crowdsec-bouncer/crowdsec"
+	"github.com/hslatman/caddy-crowdsec-bouncer/crowdsectest"
+	"github.com/hslatman/caddy-crowdsec-bouncer/internal/testutils"
+)
+
+// newCrowdSec returns a started CrowdSec app in live mode, which looks
+// up decisions in lapi.
+func newCrowdSec(t *testing.T, lapi *crowdsectest.Server) *crowdsec.CrowdSec {
+	t.Helper()
+
+	config := fmt.Sprintf(`{
+		"api_url": %q,
+		"api_key": %q,
+		"enable_streaming": false
+	}`, lapi.URL(), lapi.APIKey())
+
+	cs := testutils.NewCrowdSecModule(t, context.Background(), config)
+	require.NoError(t, cs.Start())
+	t.Cleanup(func() {
+		require.NoError(t, cs.Stop())
+		require.NoError(t, cs.Cleanup())
+	})
+
+	return cs
+}
+
+// remoteConn is a connection with a fixed remote address.
+type remoteConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c *remoteConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// newConnection returns the server side of an in-memory connection from
+// remote, and the client side it's connected to.
+func newConnection(t *testing.T, remote net.Addr) (*l4.Connection, net.Conn) {
+	t.Helper()
+
+	client, server := net.Pipe()
+	t.Cleanup(func() {
+		_ = client.Close()
+		_ = server.Close()
+	})
+
+	return l4.WrapConnection(&remoteConn{Conn: server, remote: remote}, &bytes.Buffer{}, zaptest.NewLogger(t)), client
+}
+
+func tcpAddr(ip string) net.Addr {
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(netip.MustParseAddr(ip), 12345))
+}
+
+func TestMatcher_Match(t *testing.T) {
+	lapi := crowdsectest.NewServer(t)
+	lapi.AddDecisions(
+		crowdsectest.NewDecision("Ip", "192.0.2.1", "ban"),
+		crowdsectest.NewDecision("Range", "198.51.100.0/24", "ban"),
+	)
+	cs := newCrowdSec(t, lapi)
+
+	tests := []struct {
+		name      string
+		banned    bool
+		allowlist []netip.Prefix
+		remote    string
+		want      bool
+	}{
+		{name: "allowed", remote: "203.0.113.1", want: true},
+		{name: "denied", remote: "192.0.2.1", want: false},
+		{name: "denied-range", remote: "198.51.100.7", want: false},
+		{name: "denied-mapped", remote: "::ffff:192.0.2.1", want: false},
+		{name: "allowlisted", remote: "192.0.2.1", allowlist: []netip.Prefix{netip.MustParsePrefix("192.0.2.0/24")}, want: true},
+		{name: "banned/allowed", banned: true, remote: "203.0.113.1", want: false},
+		{name: "banned/denied", banned: true, remote: "192.0.2.1", want: true},
+		{name: "banned/allowlisted", banned: true, remote: "192.0.2.1", allowlist: []netip.Prefix{netip.MustParsePrefix("192.0.2.1/32")}, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := Matcher{
+				Banned:    tt.banned,
+				logger:    zaptest.NewLogger(t),
+				crowdsec:  cs,
+				allowlist: tt.allowlist,
+			}
+
+			cx, _ := newConnection(t, tcpAddr(tt.remote))
+			got, err := m.Match(cx)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestMatcher_Match_cache(t *testing.T) {
+	lapi := crowdsectest.NewServer(t)
+	m := Matcher{
+		logger:   zaptest.NewLogger(t),
+		crowdsec: newCrowdSec(t, lapi),
+		cache:    newVerdictCache(time.Minute, 10),
+	}
+
+	cx, _ := newConnection(t, tcpAddr("192.0.2.1"))
+	got, err := m.Match(cx)
+	require.NoError(t, err)
+	assert.True(t, got)
+
+	// the cached verdict is used until it expires or new decisions
+	// are processed
+	lapi.AddDecisions(crowdsectest.NewDecision("Ip", "192.0.2.1", "ban"))
+	got, err = m.Match(cx)
+	require.NoError(t, err)
+	assert.True(t, got)
+
+	m.cache = newVerdictCache(time.Minute, 10)
+	got, err = m.Match(cx)
+	require.NoError(t, err)
+	assert.False(t, got)
+}
+
+func TestMatcher_Match_cacheEnforcement(t *testing.T) {
+	lapi := crowdsectest.NewServer(t)
+	lapi.AddDecisions(crowdsectest.NewDecision("Ip", "192.0.2.1", "ban"))
+	cs := newCrowdSec(t, lapi)
+	m := Matcher{
+		logger:   zaptest.NewLogger(t),
+		crowdsec: cs,
+		cache:    newVerdictCache(time.Minute, 10),
+	}
+
+	// the connection is allowed while simulating
+	require.NoError(t, cs.SetEnforcement("simulate"))
+	cx, _ := newConnection(t, tcpAddr("192.0.2.1"))
+	got, err := m.Match(cx)
+	require.NoError(t, err)
+	assert.True(t, got)
+
+	// the verdict cached while simulating isn't used when enforcing
+	require.NoError(t, cs.SetEnforcement("enforce"))
+	got, err = m.Match(cx)
+	require.NoError(t, err)
+	assert.False(t, got)
+}
+
+func TestMatcher_Match_timeout(t *testing.T) {
+	lapi := crowdsectest.NewServer(t)
+	lapi.AddDecisions(crowdsectest.NewDecision("Ip", "192.0.2.1", "ban"))
+	cs := newCrowdSec(t, lapi)
+
+	tests := []struct {
+		name     string
+		failOpen bool
+		banned   bool
+		slow     bool
+		remote   string
+		want     bool
+		wantErr  error
+	}{
+		{name: "allowed", remote: "203.0.113.1", want: true},
+		{name: "denied", remote: "192.0.2.1", want: false},
+		{name: "banned/denied", banned: true, remote: "192.0.2.1", want: true},
+		{name: "fail-open/denied", failOpen: true, remote: "192.0.2.1", want: false},
+		{name: "timeout", slow: true, remote: "192.0.2.1", wantErr: errLookupTimeout},
+		{name: "timeout/banned", banned: true, slow: true, remote: "192.0.2.1", wantErr: errLookupTimeout},
+		{name: "timeout/fail-open", failOpen: true, slow: true, remote: "192.0.2.1", want: true},
+		{name: "timeout/fail-open-banned", failOpen: true, banned: true, slow: true, remote: "192.0.2.1", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			delay := time.Duration(0)
+			if tt.slow {
+				delay = time.Minute
+			}
+			lapi.DelayDecisions(delay)
+			canceled := lapi.CanceledLookups()
+
+			m := Matcher{
+				FailOpen: tt.failOpen,
+				Banned:   tt.banned,
+				Timeout:  caddy.Duration(100 * time.Millisecond),
+				logger:   zaptest.NewLogger(t),
+				crowdsec: cs,
+			}
+
+			cx, _ := newConnection(t, tcpAddr(tt.remote))
+			got, err := m.Match(cx)
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+			} else {
+				require.NoError(t, err)
+			}
+			assert.Equal(t, tt.want, got)
+
+			if tt.slow {
+				// the lookup is canceled instead of being left running
+				assert.Eventually(t, func() bool {
+					return lapi.CanceledLookups() == canceled+1
+				}, 5*time.Second, 10*time.Millisecond)
+			}
+		})
+	}
+}
+
+func Test_getClientIP(t *testing.T) {
+	tests := []struct {
+		name    string
+		remote  net.Addr
+		want    netip.Addr
+		wantErr bool
+	}{
+		{name: "tcp", remote: tcpAddr("192.0.2.1"), want: netip.MustParseAddr("192.0.2.1")},
+		{name: "tcp-ipv6", remote: tcpAddr("2001:db8::1"), want: netip.MustParseAddr("2001:db8::1")},
+		{name: "tcp-mapped", remote: tcpAddr("::ffff:192.0.2.1"), want: netip.MustParseAddr("192.0.2.1")},
+		{name: "udp-mapped", remote: net.UDPAddrFromAddrPort(netip.MustParseAddrPort("[::ffff:192.0.2.1]:443")), want: netip.MustParseAddr("192.0.2.1")},
+		{name: "udp-zone", remote: &net.UDPAddr{IP: net.ParseIP("fe80::1"), Port: 443, Zone: "eth0"}, want: netip.MustParseAddr("fe80::1")},
+		{name: "other", remote: &net.IPAddr{IP: net.ParseIP("::ffff:192.0.2.1")}, want: netip.MustParseAddr("192.0.2.1")},
+		{name: "fail/pipe", remote: &net.UnixAddr{Name: "pipe", Net: "unix"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cx, _ := newConnection(t, tt.remote)
+			got, err := getClientIP(cx)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestMatcher_Validate(t *testing.T) {
+	assert.NoError(t, (&Matcher{}).Validate())
+	assert.NoError(t, (&Matcher{Timeout: caddy.Duration(time.Second), CacheTTL: caddy.Duration(time.Second), CacheSize: 10}).Validate())
+	assert.EqualError(t, (&Matcher{Timeout: caddy.Duration(-time.Second)}).Validate(), "invalid timeout -1s: must not be negative")
+	assert.EqualError(t, (&Matcher{CacheTTL: caddy.Duration(-time.Second)}).Validate(), "invalid cache_ttl -1s: must not be negative")
+	assert.EqualError(t, (&Matcher{CacheSize: -1}).Validate(), "cache size must not be negative")
+}
+
+func TestMatcher_UnmarshalCaddyfile(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    Matcher
+		wantErr bool
+	}{
+		{name: "ok", input: `crowdsec`, want: Matcher{}},
+		{name: "ok/all", input: `crowdsec {
+			banned
+			allowlist 192.0.2.1 198.51.100.0/24
+			allowlist 2001:db8::/32
+			fail_open
+			timeout 500ms
+			cache_ttl 10s
+			cache_size 100
+		}`, want: Matcher{
+			Banned:    true,
+			Allowlist: []string{"192.0.2.1", "198.51.100.0/24", "2001:db8::/32"},
+			FailOpen:  true,
+			Timeout:   caddy.Duration(500 * time.Millisecond),
+			CacheTTL:  caddy.Duration(10 * time.Second),
+			CacheSize: 100,
+		}},
+		{name: "fail/argument", input: `crowdsec banned`, wantErr: true},
+		{name: "fail/banned-argument", input: `crowdsec {
+			banned yes
+		}`, wantErr: true},
+		{name: "fail/allowlist-without-values", input: `crowdsec {
+			allowlist
+		}`, wantErr: true},
+		{name: "fail/fail-open-argument", input: `crowdsec {
+			fail_open yes
+		}`, wantErr: true},
+		{name: "ok/timeout-seconds", input: `crowdsec {
+			timeout 5
+		}`, want: Matcher{
+			Timeout: caddy.Duration(5 * time.Second),
+		}},
+		{name: "fail/timeout", input: `crowdsec {
+			timeout 5x
+		}`, wantErr: true},
+		{name: "fail/cache-ttl", input: `crowdsec {
+			cache_ttl forever
+		}`, wantErr: true},
+		{name: "fail/cache-size", input: `crowdsec {
+			cache_size many
+		}`, wantErr: true},
+		{name: "fail/unknown-token", input: `crowdsec {
+			action drop
+		}`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var m Matcher
+			err := m.UnmarshalCaddyfile(caddyfile.NewTestDispenser(tt.input))
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, m)
+		})
+	}
+}